@@ -3,9 +3,11 @@ module GoChat
 go 1.15
 
 require (
+	github.com/golang/protobuf v1.4.2
 	github.com/gorilla/websocket v1.4.2
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/tinode/chat v0.16.10
 	github.com/tinode/snowflake v1.0.0
 	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
-	google.golang.org/grpc v1.35.0 // indirect
+	google.golang.org/grpc v1.35.0
 )
@@ -0,0 +1,81 @@
+// Package anon provides authentication without credentials. Most useful for customer support.
+// Anonymous authentication is used only at the account creation time, later the user logs in with a token.
+package anon
+
+import (
+	"GoChat/server/auth"
+	"GoChat/server/store"
+	"GoChat/server/store/types"
+	"encoding/json"
+	"time"
+)
+
+// SchemeName is the name of the scheme. Anonymous users are identified by the authentication
+// record of this scheme. The record is removed when the user adds a real authentication scheme.
+const SchemeName = "anon"
+
+// authenticator is the singleton instance of the anonymous authorizer.
+type authenticator struct{}
+
+// Init is a noop, always returns success.
+func (authenticator) Init(_ json.RawMessage, _ string) error {
+	return nil
+}
+
+// AddRecord checks authLevel and assigns default LevelAnon. The record has no secret, it only marks
+// the user as anonymous.
+func (authenticator) AddRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	if rec.AuthLevel == auth.LevelNone {
+		rec.AuthLevel = auth.LevelAnon
+	}
+	if err := store.Users.AddAuthRecord(rec.Uid, rec.AuthLevel, SchemeName, rec.Uid.UserId(),
+		[]byte{}, time.Time{}); err != nil {
+		return nil, err
+	}
+	rec.State = types.StateOK
+	return rec, nil
+}
+
+// UpdateRecord is a noop. Just report success.
+func (authenticator) UpdateRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	return rec, nil
+}
+
+// Authenticate is not supported. This authenticator is used only at account creation time.
+func (authenticator) Authenticate(secret []byte, remoteAddr string) (*auth.Rec, []byte, error) {
+	return nil, nil, types.ErrUnsupported
+}
+
+// AsTag is not supported, will produce an empty string.
+func (authenticator) AsTag(token string) string {
+	return ""
+}
+
+// IsUnique for a noop. Anonymous login does not use secret, any secret is fine.
+func (authenticator) IsUnique(secret []byte, remoteAddr string) (bool, error) {
+	return true, nil
+}
+
+// GenSecret always fails.
+func (authenticator) GenSecret(rec *auth.Rec) ([]byte, time.Time, error) {
+	return nil, time.Time{}, types.ErrUnsupported
+}
+
+// DelRecords deletes the record which marks the user as anonymous.
+func (authenticator) DelRecords(uid types.Uid) error {
+	return store.Users.DelAuthRecords(uid, SchemeName)
+}
+
+// RestrictedTags returns tag namespaces restricted by this authenticator (none for anonymous).
+func (authenticator) RestrictedTags() ([]string, error) {
+	return nil, nil
+}
+
+// GetResetParams is not supported: anonymous users have no secret to reset.
+func (authenticator) GetResetParams(uid types.Uid) (map[string]interface{}, error) {
+	return nil, types.ErrUnsupported
+}
+
+func init() {
+	store.RegisterAuthScheme(SchemeName, &authenticator{})
+}
@@ -0,0 +1,57 @@
+package anon
+
+import (
+	"GoChat/server/auth"
+	"GoChat/server/store"
+	"GoChat/server/store/storetest"
+	"GoChat/server/store/types"
+	"testing"
+	"time"
+
+	_ "GoChat/server/db/memory"
+)
+
+func TestAnonAuth(t *testing.T) {
+	storetest.Open(t, "memory", nil)
+	defer store.Close()
+
+	// Clients create anonymous accounts with scheme "anon".
+	if store.GetLogicalAuthHandler("anon") == nil {
+		t.Fatal("anon scheme is not registered")
+	}
+
+	a := &authenticator{}
+	user, err := store.Users.Create(&types.User{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid := user.Uid()
+
+	rec, err := a.AddRecord(&auth.Rec{Uid: uid}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.AuthLevel != auth.LevelAnon {
+		t.Error("anonymous user must get LevelAnon, got", rec.AuthLevel)
+	}
+
+	if _, _, err = a.Authenticate(nil, ""); err != types.ErrUnsupported {
+		t.Error("anonymous login must not be supported, got", err)
+	}
+
+	uids, err := store.Users.GetInactive(SchemeName, time.Now().Add(time.Hour), 0)
+	if err != nil || len(uids) != 1 || uids[0] != uid {
+		t.Error("anonymous user must be reported as inactive", uids, err)
+	}
+	if uids, _ = store.Users.GetInactive(SchemeName, time.Now().Add(-time.Hour), 0); len(uids) != 0 {
+		t.Error("recently created user must not be inactive", uids)
+	}
+
+	// Upgrade to a full account removes the anonymous marker.
+	if err = a.DelRecords(uid); err != nil {
+		t.Fatal(err)
+	}
+	if uids, _ = store.Users.GetInactive(SchemeName, time.Now().Add(time.Hour), 0); len(uids) != 0 {
+		t.Error("marker record must be deleted", uids)
+	}
+}
@@ -0,0 +1,132 @@
+package basic
+
+import (
+	"GoChat/server/auth"
+	"GoChat/server/store"
+	"GoChat/server/store/storetest"
+	"GoChat/server/store/types"
+	"encoding/json"
+	"testing"
+
+	_ "GoChat/server/db/memory"
+)
+
+func newUser(t *testing.T) types.Uid {
+	user, err := store.Users.Create(&types.User{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user.Uid()
+}
+
+func TestBasicAuth(t *testing.T) {
+	storetest.Open(t, "memory", nil)
+	defer store.Close()
+
+	a := &authenticator{}
+	if err := a.Init(json.RawMessage(`{"add_to_tags": true, "min_password_length": 6}`), "basic"); err != nil {
+		t.Fatal(err)
+	}
+
+	uid := newUser(t)
+
+	// Policy violations.
+	for _, secret := range []string{"alice:short", "a:password", "1alice:password", "al ice:password"} {
+		if _, err := a.AddRecord(&auth.Rec{Uid: uid}, []byte(secret), ""); err != types.ErrPolicy {
+			t.Error("expected policy error for", secret, "got", err)
+		}
+	}
+	if _, err := a.AddRecord(&auth.Rec{Uid: uid}, []byte("alice"), ""); err != types.ErrMalformed {
+		t.Error("secret without a password must be rejected, got", err)
+	}
+
+	rec, err := a.AddRecord(&auth.Rec{Uid: uid}, []byte("Alice:password"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.AuthLevel != auth.LevelAuth || len(rec.Tags) != 1 || rec.Tags[0] != "basic:alice" {
+		t.Error("unexpected auth record", rec.AuthLevel, rec.Tags)
+	}
+
+	if ok, err := a.IsUnique([]byte("alice:whatever"), ""); ok || err != types.ErrDuplicate {
+		t.Error("login must not be unique", ok, err)
+	}
+
+	rec, _, err = a.Authenticate([]byte("alice:password"), "")
+	if err != nil || rec.Uid != uid || rec.AuthLevel != auth.LevelAuth {
+		t.Fatal("authentication failed", rec, err)
+	}
+	if _, _, err = a.Authenticate([]byte("alice:wrong-password"), ""); err != types.ErrFailed {
+		t.Error("wrong password must fail, got", err)
+	}
+	if _, _, err = a.Authenticate([]byte("bob:password"), ""); err != types.ErrFailed {
+		t.Error("unknown login must fail, got", err)
+	}
+
+	// Change both the login and the password.
+	rec, err = a.UpdateRecord(&auth.Rec{Uid: uid, Tags: []string{"basic:alice", "travel"}},
+		[]byte("alice2:new-password"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Tags) != 2 || rec.Tags[0] != "travel" || rec.Tags[1] != "basic:alice2" {
+		t.Error("login tag is not replaced", rec.Tags)
+	}
+	if _, _, err = a.Authenticate([]byte("alice:password"), ""); err != types.ErrFailed {
+		t.Error("old login must not work, got", err)
+	}
+	if _, _, err = a.Authenticate([]byte("alice2:new-password"), ""); err != nil {
+		t.Error("new login failed", err)
+	}
+
+	if tag := a.AsTag("alice2"); tag != "basic:alice2" {
+		t.Error("unexpected tag", tag)
+	}
+	if tag := a.AsTag("x"); tag != "" {
+		t.Error("invalid login must not be converted to a tag", tag)
+	}
+
+	params, err := a.GetResetParams(uid)
+	if err != nil || params["login"] != "alice2" {
+		t.Error("unexpected reset params", params, err)
+	}
+}
+
+func TestBasicAuthKeepsLevel(t *testing.T) {
+	storetest.Open(t, "memory", nil)
+	defer store.Close()
+
+	a := &authenticator{}
+	if err := a.Init(json.RawMessage(`{"min_password_length": 6}`), "basic"); err != nil {
+		t.Fatal(err)
+	}
+
+	uid := newUser(t)
+	if _, err := a.AddRecord(&auth.Rec{Uid: uid, AuthLevel: auth.LevelRoot}, []byte("admin:password"), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing the password must not demote the root user.
+	rec, err := a.UpdateRecord(&auth.Rec{Uid: uid}, []byte(":new-password"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.AuthLevel != auth.LevelRoot {
+		t.Error("auth level changed on password update", rec.AuthLevel)
+	}
+	// Login is not used as a tag unless add_to_tags is set.
+	if len(rec.Tags) != 0 {
+		t.Error("login tag added with add_to_tags off", rec.Tags)
+	}
+	if rec, _, err = a.Authenticate([]byte("admin:new-password"), ""); err != nil || rec.AuthLevel != auth.LevelRoot {
+		t.Error("root level not preserved", rec, err)
+	}
+
+	// Explicitly requested level is applied.
+	if _, err = a.UpdateRecord(&auth.Rec{Uid: uid, AuthLevel: auth.LevelAuth}, []byte(":password2"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _, err = a.Authenticate([]byte("admin:password2"), ""); err != nil || rec.AuthLevel != auth.LevelAuth {
+		t.Error("requested level not applied", rec, err)
+	}
+}
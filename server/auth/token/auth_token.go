@@ -0,0 +1,245 @@
+// Package token implements authentication by HMAC-signed security token.
+package token
+
+import (
+	"GoChat/server/auth"
+	"GoChat/server/store"
+	"GoChat/server/store/types"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// authenticator is a singleton instance of the authenticator.
+type authenticator struct {
+	name         string
+	hmacSalt     []byte
+	lifetime     time.Duration
+	serialNumber int
+}
+
+// tokenLayout defines positioning of various bytes in token.
+// [8:UID][4:expires][2:authLevel][2:serial-number][2:user-serial][2:feature-bits][32:signature] = 52 bytes
+type tokenLayout struct {
+	// User ID.
+	Uid uint64
+	// Token expiration time.
+	Expires uint32
+	// User's authentication level.
+	AuthLevel uint16
+	// Serial number - to invalidate all tokens if needed.
+	SerialNumber uint16
+	// Per-user serial number - to invalidate all tokens of one user.
+	UserSerial uint16
+	// Bitmap with feature bits.
+	Features uint16
+}
+
+// Init initializes the authenticator: parses the config and sets salt, serial number and lifetime.
+//
+//	{"key": "base64-encoded 32+ bytes", "serial_num": 1, "expire_in": 1209600}
+func (ta *authenticator) Init(jsonconf json.RawMessage, name string) error {
+	if ta.name != "" {
+		return errors.New("auth_token: already initialized as " + ta.name + "; " + name)
+	}
+
+	type configType struct {
+		// Key for signing tokens
+		Key []byte `json:"key"`
+		// Datatabase or other serial number, to invalidate all issued tokens at once.
+		SerialNum int `json:"serial_num"`
+		// Token expiration time
+		ExpireIn int `json:"expire_in"`
+	}
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("auth_token: failed to parse config: " + err.Error() + "(" + string(jsonconf) + ")")
+	}
+
+	if len(config.Key) < sha256.Size {
+		return errors.New("auth_token: the key is missing or too short, set `key` to a random base64-encoded 32-byte key")
+	}
+	if config.ExpireIn <= 0 {
+		return errors.New("auth_token: invalid expiration value")
+	}
+
+	ta.name = name
+	ta.hmacSalt = config.Key
+	ta.lifetime = time.Duration(config.ExpireIn) * time.Second
+	ta.serialNumber = config.SerialNum
+
+	return nil
+}
+
+// userSerial 返回用户当前的token序列号，保存在用户的token认证记录中，没有记录时为0
+func (ta *authenticator) userSerial(uid types.Uid) (uint16, bool, error) {
+	unique, _, secret, _, err := store.Users.GetAuthRecord(uid, ta.name)
+	if err != nil {
+		return 0, false, err
+	}
+	if unique == "" || len(secret) < 2 {
+		return 0, unique != "", nil
+	}
+	return binary.LittleEndian.Uint16(secret), true, nil
+}
+
+// AddRecord is not supprted, will produce an error.
+func (authenticator) AddRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	return nil, types.ErrUnsupported
+}
+
+// UpdateRecord revokes all tokens issued to the user so far by incrementing the user's serial number.
+// The secret is ignored.
+func (ta *authenticator) UpdateRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	if ta.name == "" {
+		return nil, types.ErrUnsupported
+	}
+
+	serial, found, err := ta.userSerial(rec.Uid)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 2)
+	binary.LittleEndian.PutUint16(buf, serial+1)
+	if found {
+		err = store.Users.UpdateAuthRecord(rec.Uid, auth.LevelNone, ta.name, rec.Uid.UserId(), buf, time.Time{})
+	} else {
+		err = store.Users.AddAuthRecord(rec.Uid, auth.LevelNone, ta.name, rec.Uid.UserId(), buf, time.Time{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Authenticate checks validity of provided token.
+func (ta *authenticator) Authenticate(token []byte, remoteAddr string) (*auth.Rec, []byte, error) {
+	if ta.name == "" {
+		return nil, nil, types.ErrUnsupported
+	}
+
+	var tl tokenLayout
+	dataSize := binary.Size(&tl)
+	if len(token) < dataSize+sha256.Size {
+		// Token is too short
+		return nil, nil, types.ErrMalformed
+	}
+
+	buf := bytes.NewBuffer(token)
+	err := binary.Read(buf, binary.LittleEndian, &tl)
+	if err != nil {
+		return nil, nil, types.ErrMalformed
+	}
+
+	// Check signature.
+	hasher := hmac.New(sha256.New, ta.hmacSalt)
+	hasher.Write(token[:dataSize])
+	if !hmac.Equal(token[dataSize:dataSize+sha256.Size], hasher.Sum(nil)) {
+		return nil, nil, types.ErrFailed
+	}
+
+	// Check authentication level for validity.
+	if auth.Level(tl.AuthLevel) > auth.LevelRoot {
+		return nil, nil, types.ErrMalformed
+	}
+
+	// Check serial number.
+	if int(tl.SerialNumber) != ta.serialNumber {
+		return nil, nil, types.ErrFailed
+	}
+
+	// Check token expiration time.
+	expires := time.Unix(int64(tl.Expires), 0).UTC()
+	if expires.Before(time.Now().Add(1 * time.Second)) {
+		return nil, nil, types.ErrExpired
+	}
+
+	// 用户撤销了之前发放的所有token
+	uid := types.Uid(tl.Uid)
+	serial, _, err := ta.userSerial(uid)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tl.UserSerial != serial {
+		return nil, nil, types.ErrFailed
+	}
+
+	return &auth.Rec{
+		Uid:       uid,
+		AuthLevel: auth.Level(tl.AuthLevel),
+		Lifetime:  auth.Duration(time.Until(expires)),
+		Features:  auth.Feature(tl.Features),
+		State:     types.StateUndefined}, nil, nil
+}
+
+// GenSecret generates a new token.
+// Tokens cannot be issued until the authenticator is configured with a signing key.
+func (ta *authenticator) GenSecret(rec *auth.Rec) ([]byte, time.Time, error) {
+	if ta.name == "" {
+		return nil, time.Time{}, types.ErrUnsupported
+	}
+
+	if rec.Lifetime == 0 {
+		rec.Lifetime = auth.Duration(ta.lifetime)
+	} else if rec.Lifetime < 0 {
+		return nil, time.Time{}, types.ErrExpired
+	}
+
+	serial, _, err := ta.userSerial(rec.Uid)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	expires := time.Now().Add(time.Duration(rec.Lifetime)).UTC().Round(time.Millisecond)
+
+	tl := tokenLayout{
+		Uid:          uint64(rec.Uid),
+		Expires:      uint32(expires.Unix()),
+		AuthLevel:    uint16(rec.AuthLevel),
+		SerialNumber: uint16(ta.serialNumber),
+		UserSerial:   serial,
+		Features:     uint16(rec.Features),
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, &tl)
+	hasher := hmac.New(sha256.New, ta.hmacSalt)
+	hasher.Write(buf.Bytes())
+	binary.Write(buf, binary.LittleEndian, hasher.Sum(nil))
+
+	return buf.Bytes(), expires, nil
+}
+
+// AsTag is not supported, will produce an empty string.
+func (authenticator) AsTag(token string) string {
+	return ""
+}
+
+// IsUnique is not supported, will produce an error.
+func (authenticator) IsUnique(token []byte, remoteAddr string) (bool, error) {
+	return false, types.ErrUnsupported
+}
+
+// DelRecords deletes the user's token serial number.
+func (ta *authenticator) DelRecords(uid types.Uid) error {
+	return store.Users.DelAuthRecords(uid, ta.name)
+}
+
+// RestrictedTags returns tag namespaces restricted by this authenticator (none for token).
+func (authenticator) RestrictedTags() ([]string, error) {
+	return nil, nil
+}
+
+// GetResetParams returns authenticator parameters passed to password reset handler
+// (none for token).
+func (authenticator) GetResetParams(uid types.Uid) (map[string]interface{}, error) {
+	return nil, nil
+}
+
+func init() {
+	store.RegisterAuthScheme("token", &authenticator{})
+}
@@ -0,0 +1,85 @@
+package token
+
+import (
+	"GoChat/server/auth"
+	"GoChat/server/store"
+	"GoChat/server/store/storetest"
+	"GoChat/server/store/types"
+	"encoding/json"
+	"testing"
+	"time"
+
+	_ "GoChat/server/db/memory"
+)
+
+func TestTokenAuth(t *testing.T) {
+	storetest.Open(t, "memory", nil)
+	defer store.Close()
+
+	ta := &authenticator{}
+	if _, _, err := ta.GenSecret(&auth.Rec{Uid: 1}); err != types.ErrUnsupported {
+		t.Error("unconfigured authenticator must not issue tokens, got", err)
+	}
+	if err := ta.Init(json.RawMessage(`{"key": "MVAFsMFOa3cclEgmVEgJBb1UYW5TpU5y8BLKl5ldigE=",
+		"serial_num": 1, "expire_in": 3600}`), "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := store.Users.Create(&types.User{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid := user.Uid()
+
+	token, expires, err := ta.GenSecret(&auth.Rec{Uid: uid, AuthLevel: auth.LevelAuth, Features: auth.FeatureValidated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(expires) < 59*time.Minute {
+		t.Error("default lifetime is not applied", expires)
+	}
+
+	rec, _, err := ta.Authenticate(token, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Uid != uid || rec.AuthLevel != auth.LevelAuth || rec.Features != auth.FeatureValidated {
+		t.Error("unexpected auth record", rec)
+	}
+
+	// Tampered token.
+	bad := append([]byte(nil), token...)
+	bad[0] ^= 1
+	if _, _, err = ta.Authenticate(bad, ""); err != types.ErrFailed {
+		t.Error("tampered token must fail, got", err)
+	}
+	if _, _, err = ta.Authenticate(token[:20], ""); err != types.ErrMalformed {
+		t.Error("short token must be malformed, got", err)
+	}
+
+	// Stale token.
+	stale, _, err := ta.GenSecret(&auth.Rec{Uid: uid, AuthLevel: auth.LevelAuth,
+		Lifetime: auth.Duration(time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = ta.Authenticate(stale, ""); err != types.ErrExpired {
+		t.Error("stale token must be expired, got", err)
+	}
+
+	// Revoke all tokens twice: the first call creates the serial, the second increments it.
+	for i := 0; i < 2; i++ {
+		if _, err = ta.UpdateRecord(&auth.Rec{Uid: uid}, nil, ""); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = ta.Authenticate(token, ""); err != types.ErrFailed {
+			t.Error("revoked token must fail, got", err)
+		}
+		if token, _, err = ta.GenSecret(&auth.Rec{Uid: uid, AuthLevel: auth.LevelAuth}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = ta.Authenticate(token, ""); err != nil {
+			t.Error("token issued after revocation must work", err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// 消息的编解码：JSON或者Protobuf，每个session单独协商
+
+package main
+
+import (
+	"encoding/json"
+	"sync/atomic"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/tinode/chat/pbx"
+	"github.com/tinode/chat/server/logs"
+)
+
+// codec 负责服务器消息的序列化和客户端消息的反序列化
+type codec interface {
+	// Name of the codec. Used in {hi} and as the websocket subprotocol name.
+	name() string
+	// Binary codecs are sent as binary websocket frames, text codecs as text frames.
+	binary() bool
+	// Serialize a server message.
+	marshal(msg *ServerComMessage) ([]byte, error)
+	// Deserialize a client message.
+	unmarshal(data []byte, msg *ClientComMessage) error
+}
+
+// codecs 列出所有可用的编解码器。第一个是默认的编解码器，
+// session中保存的是编解码器在这个列表中的位置
+var codecs = []codec{
+	jsonCodec{},
+	protoCodec{},
+}
+
+// codecByName 返回指定名称的编解码器在codecs中的位置，没有找到返回-1
+func codecByName(name string) int {
+	for i, c := range codecs {
+		if c.name() == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// codecNames 返回所有编解码器的名称，用于协商websocket子协议
+func codecNames() []string {
+	names := make([]string, len(codecs))
+	for i, c := range codecs {
+		names[i] = c.name()
+	}
+	return names
+}
+
+// jsonCodec 默认的编解码器
+type jsonCodec struct{}
+
+func (jsonCodec) name() string {
+	return "json"
+}
+
+func (jsonCodec) binary() bool {
+	return false
+}
+
+func (jsonCodec) marshal(msg *ServerComMessage) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) unmarshal(data []byte, msg *ClientComMessage) error {
+	return json.Unmarshal(data, msg)
+}
+
+// protoCodec 使用gRPC的消息结构(pbx)进行二进制编码
+type protoCodec struct{}
+
+func (protoCodec) name() string {
+	return "proto"
+}
+
+func (protoCodec) binary() bool {
+	return true
+}
+
+func (protoCodec) marshal(msg *ServerComMessage) ([]byte, error) {
+	return proto.Marshal(pbServSerialize(msg))
+}
+
+func (protoCodec) unmarshal(data []byte, msg *ClientComMessage) error {
+	var pkt pbx.ClientMsg
+	if err := proto.Unmarshal(data, &pkt); err != nil {
+		return err
+	}
+	*msg = *pbCliDeserialize(&pkt)
+	// on_behalf_of and auth_level are accepted only from trusted gRPC nodes, not from clients.
+	msg.AsUser = ""
+	msg.AuthLvl = 0
+	return nil
+}
+
+// serializedCache 是广播消息序列化后的结果：topic为接收消息的session使用的每种编解码器
+// 只序列化一次，所有session共享同一个结果。创建后不能修改，session只能读取。
+type serializedCache struct {
+	// Serialized message ([]byte) indexed by codec position in codecs, nil if no recipient uses
+	// the codec. Stored as interface{} so sessions share the value without converting it again.
+	data []interface{}
+	// Message converted to pbx for gRPC sessions, nil if there are no gRPC recipients.
+	pb *pbx.ServerMsg
+}
+
+// newSerializedCache 按照接收者的编解码器序列化消息。
+// used是接收者使用的编解码器的位掩码，grpc表示接收者中有gRPC session。
+func newSerializedCache(msg *ServerComMessage, used uint64, grpc bool) *serializedCache {
+	cache := &serializedCache{}
+	if used != 0 {
+		cache.data = make([]interface{}, len(codecs))
+		for idx, c := range codecs {
+			if used&(1<<uint(idx)) != 0 {
+				cache.data[idx] = marshalWith(c, msg)
+			}
+		}
+	}
+	if grpc {
+		cache.pb = pbServSerialize(msg)
+	}
+	return cache
+}
+
+// marshal 使用指定的编解码器序列化消息，返回[]byte。广播的消息直接使用topic序列化的结果。
+func (msg *ServerComMessage) marshal(idx int) interface{} {
+	if cache := msg.serialized; cache != nil && idx < len(cache.data) && cache.data[idx] != nil {
+		return cache.data[idx]
+	}
+	return marshalWith(codecs[idx], msg)
+}
+
+// pbMessage 将消息转换为gRPC的消息结构。广播的消息直接使用topic转换的结果。
+func (msg *ServerComMessage) pbMessage() *pbx.ServerMsg {
+	if cache := msg.serialized; cache != nil && cache.pb != nil {
+		return cache.pb
+	}
+	return pbServSerialize(msg)
+}
+
+func marshalWith(c codec, msg *ServerComMessage) []byte {
+	out, err := c.marshal(msg)
+	if err != nil {
+		logs.Warn.Println("codec: failed to serialize", c.name(), msg.describe(), err)
+	}
+	return out
+}
+
+// getCodec 返回session使用的编解码器在codecs中的位置
+func (s *Session) getCodec() int {
+	return int(atomic.LoadInt32(&s.codec))
+}
+
+// setCodec 设置session使用的编解码器
+func (s *Session) setCodec(idx int) {
+	atomic.StoreInt32(&s.codec, int32(idx))
+}
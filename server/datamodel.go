@@ -68,6 +68,12 @@ type MsgClientHi struct {
 	Platform string `json:"platf,omitempty"`
 	//session的状态，后台还是前台
 	Background bool `json:"bkg,omitempty"`
+	//断线重连时要恢复的session ID
+	Sid string `json:"sid,omitempty"`
+	//恢复session的密钥，在session的{hi}回复中得到
+	Resume string `json:"resume,omitempty"`
+	//消息的编解码器: json, proto
+	Codec string `json:"codec,omitempty"`
 }
 
 //MsgClientAcc 是客户端发起创建用户，或者更新用户状态的消息结构
@@ -79,7 +85,7 @@ type MsgClientAcc struct {
 	// 用户的状态: normal, suspended
 	State string `json:"status,omitempty"`
 	//当不是当前用户在进行更新操作时，需要认证权限:"","auth","anon",默认是"""
-	AuthLevel string
+	AuthLevel string `json:"authlevel,omitempty"`
 	//当进行修改密码等操作时，需要token鉴权
 	Token []byte `json:"token,omitempty"`
 	//用户可以使用的认证方案
@@ -186,6 +192,32 @@ const (
 	constMsgMetaDel
 	constMsgMetaCred
 )
+
+// 将get请求中的what字段解析为位标志
+func parseMsgClientMeta(params string) int {
+	var bits int
+	parts := strings.SplitN(params, " ", 8)
+	for _, p := range parts {
+		switch p {
+		case "desc":
+			bits |= constMsgMetaDesc
+		case "sub":
+			bits |= constMsgMetaSub
+		case "data":
+			bits |= constMsgMetaData
+		case "tags":
+			bits |= constMsgMetaTags
+		case "del":
+			bits |= constMsgMetaDel
+		case "cred":
+			bits |= constMsgMetaCred
+		default:
+			// ignore unknown
+		}
+	}
+	return bits
+}
+
 const (
 	constMsgDelTopic = iota + 1
 	constMsgDelMsg
@@ -194,10 +226,29 @@ const (
 	constMsgDelCred
 )
 
+// 将del请求中的what字段解析为对应的常量
+func parseMsgClientDel(params string) int {
+	switch params {
+	case "", "msg":
+		return constMsgDelMsg
+	case "topic":
+		return constMsgDelTopic
+	case "sub":
+		return constMsgDelSub
+	case "user":
+		return constMsgDelUser
+	case "cred":
+		return constMsgDelCred
+	default:
+		// ignore
+	}
+	return 0
+}
+
 // MsgSetDesc 是用户描述信息
 type MsgSetDesc struct {
 	DefaultAcs *MsgDefaultAcsMode `json:"defacs,omitempty"`
-	Public     interface{}        `json:"public:omitempty"`
+	Public     interface{}        `json:"public,omitempty"`
 	Private    interface{}        `json:"private,omitempty"`
 }
 
@@ -277,6 +328,16 @@ func (src *MsgLastSeenInfo) describe() string {
 	return "'" + src.UserAgent + "' @ " + src.When.String()
 }
 
+// MsgCredServer 是账户的验证方式，比如email或者手机号
+type MsgCredServer struct {
+	//验证的方式,比如"email","tel"
+	Method string `json:"meth,omitempty"`
+	//验证的值,比如"user@example.com"
+	Value string `json:"val,omitempty"`
+	//是否已经验证
+	Done bool `json:"done,omitempty"`
+}
+
 // MsgAccessMode 用来得到user具有的权限
 type MsgAccessMode struct {
 	Want  string `json:"want,omitempty"`
@@ -310,6 +371,12 @@ type MsgTopicDesc struct {
 	// If the group topic is online.
 	Online bool `json:"online,omitempty"`
 
+	// The group topic is also accessible as a channel.
+	IsChan bool `json:"chan,omitempty"`
+	// Number of group members and channel readers, reported to topic sharers only.
+	Members int `json:"members,omitempty"`
+	Readers int `json:"readers,omitempty"`
+
 	DefaultAcs *MsgDefaultAcsMode `json:"defacs,omitempty"`
 	// Actual access mode
 	Acs *MsgAccessMode `json:"acs,omitempty"`
@@ -330,6 +397,9 @@ func (src *MsgTopicDesc) describe() string {
 		s = " state=" + src.State
 	}
 	s += " online=" + strconv.FormatBool(src.Online)
+	if src.IsChan {
+		s += " chan=true"
+	}
 	if src.Acs != nil {
 		s += " acs={" + src.Acs.describe() + "}"
 	}
@@ -691,6 +761,8 @@ type ServerComMessage struct {
 	// Could be either empty.
 	SkipSid string `json:"-"`
 	uid     types.Uid
+	// Serialized message shared by all recipients of a broadcast message. Immutable.
+	serialized *serializedCache
 }
 
 func (src *ServerComMessage) copy() *ServerComMessage {
@@ -1302,6 +1374,14 @@ func ErrServiceUnavailableExplicitTs(id, topic string, serverTs, incomingReqTs t
 		Timestamp: serverTs}, Id: id, Timestamp: incomingReqTs}
 }
 
+// ErrSlowConsumer the client does not read messages fast enough and is being disconnected (408).
+func ErrSlowConsumer(ts time.Time) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Code:      http.StatusRequestTimeout, // 408
+		Text:      "too slow",
+		Timestamp: ts}}
+}
+
 // ErrLocked operation rejected because the topic is being deleted (503).
 func ErrLocked(id, topic string, ts time.Time) *ServerComMessage {
 	return ErrLockedExplicitTs(id, topic, ts, ts)
@@ -0,0 +1,1772 @@
+// Package memory is a database adapter which keeps all data in process memory.
+// It has no external dependencies and is intended for tests and single-node development:
+// all data is lost when the server exits.
+package memory
+
+import (
+	"GoChat/server/auth"
+	"GoChat/server/store"
+	t "GoChat/server/store/types"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// adapter holds in-memory tables.
+type adapter struct {
+	// Single lock for all tables: operations which touch several tables must be atomic.
+	lock sync.RWMutex
+	open bool
+
+	// Maximum number of records to return
+	maxResults int
+	// Maximum number of message records to return
+	maxMessageResults int
+
+	users map[t.Uid]*t.User
+	// Authentication records indexed by unique "scheme:unique" string.
+	auth map[string]*authRecord
+	// Credentials indexed by synthetic key "method:value" (validated) or "uid:method:value" (unvalidated).
+	creds  map[string]*credRecord
+	topics map[string]*t.Topic
+	// Subscriptions indexed by "topic:uid".
+	subs map[string]*t.Subscription
+	// Messages indexed by topic name, sorted by SeqId.
+	messages map[string][]*t.Message
+	// Log of deleted ranges indexed by topic name.
+	dellog map[string][]dellogRecord
+	// Devices indexed by device ID: a device belongs to one user only.
+	devices map[string]*deviceRecord
+	files   map[t.Uid]*t.FileDef
+	// IDs of files attached to a message, indexed by message ID.
+	fileLinks map[t.Uid][]t.Uid
+}
+
+type authRecord struct {
+	uid     t.Uid
+	scheme  string
+	authLvl auth.Level
+	secret  []byte
+	expires time.Time
+}
+
+type credRecord struct {
+	t.Credential
+	deletedAt *time.Time
+}
+
+type dellogRecord struct {
+	delId      int
+	deletedFor string
+	low        int
+	hi         int
+}
+
+type deviceRecord struct {
+	uid t.Uid
+	def t.DeviceDef
+}
+
+const (
+	adpVersion = 111
+
+	adapterName = "memory"
+
+	defaultMaxResults = 1024
+	// This is capped by the Session's send queue limit (128).
+	defaultMaxMessageResults = 100
+)
+
+// Open initializes in-memory tables. The config is not used.
+func (a *adapter) Open(jsonconfig json.RawMessage) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.open {
+		return errors.New("memory adapter is already connected")
+	}
+
+	if a.maxResults <= 0 {
+		a.maxResults = defaultMaxResults
+	}
+
+	if a.maxMessageResults <= 0 {
+		a.maxMessageResults = defaultMaxMessageResults
+	}
+
+	a.reset()
+	a.open = true
+
+	return nil
+}
+
+// reset drops all data.
+func (a *adapter) reset() {
+	a.users = make(map[t.Uid]*t.User)
+	a.auth = make(map[string]*authRecord)
+	a.creds = make(map[string]*credRecord)
+	a.topics = make(map[string]*t.Topic)
+	a.subs = make(map[string]*t.Subscription)
+	a.messages = make(map[string][]*t.Message)
+	a.dellog = make(map[string][]dellogRecord)
+	a.devices = make(map[string]*deviceRecord)
+	a.files = make(map[t.Uid]*t.FileDef)
+	a.fileLinks = make(map[t.Uid][]t.Uid)
+}
+
+// Close drops all data.
+func (a *adapter) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.open = false
+	a.reset()
+	return nil
+}
+
+// IsOpen returns true if the adapter is ready for use.
+func (a *adapter) IsOpen() bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return a.open
+}
+
+// GetDbVersion returns current database version. In-memory database is always current.
+func (a *adapter) GetDbVersion() (int, error) {
+	if !a.IsOpen() {
+		return -1, errors.New("Database not initialized")
+	}
+	return adpVersion, nil
+}
+
+// CheckDbVersion checks whether the actual DB version matches the expected version of this adapter.
+func (a *adapter) CheckDbVersion() error {
+	_, err := a.GetDbVersion()
+	return err
+}
+
+// Version returns adapter version.
+func (*adapter) Version() int {
+	return adpVersion
+}
+
+// GetName returns string that adapter uses to register itself with store.
+func (a *adapter) GetName() string {
+	return adapterName
+}
+
+// SetMaxResults configures how many results can be returned in a single DB call.
+func (a *adapter) SetMaxResults(val int) error {
+	if val <= 0 {
+		a.maxResults = defaultMaxResults
+	} else {
+		a.maxResults = val
+	}
+
+	return nil
+}
+
+// CreateDb initializes the storage. If reset is true all existing data is dropped.
+func (a *adapter) CreateDb(reset bool) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if !a.open {
+		return errors.New("memory adapter is not open")
+	}
+	if reset {
+		a.reset()
+	}
+	return nil
+}
+
+// UpgradeDb is a noop: in-memory database is always current.
+func (a *adapter) UpgradeDb() error {
+	return nil
+}
+
+// User management
+
+// UserCreate creates user record.
+func (a *adapter) UserCreate(user *t.User) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	uid := user.Uid()
+	if _, ok := a.users[uid]; ok {
+		return t.ErrDuplicate
+	}
+	a.users[uid] = copyUser(user)
+	return nil
+}
+
+// AuthAddRecord adds user's authentication record.
+func (a *adapter) AuthAddRecord(uid t.Uid, scheme, unique string, authLvl auth.Level,
+	secret []byte, expires time.Time) error {
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, ok := a.auth[unique]; ok {
+		return t.ErrDuplicate
+	}
+	// Only one record per user per scheme.
+	if _, rec := a.authByScheme(uid, scheme); rec != nil {
+		return t.ErrDuplicate
+	}
+	a.auth[unique] = &authRecord{uid: uid, scheme: scheme, authLvl: authLvl,
+		secret: append([]byte(nil), secret...), expires: expires}
+	return nil
+}
+
+// authByScheme finds user's authentication record for the given scheme.
+func (a *adapter) authByScheme(uid t.Uid, scheme string) (string, *authRecord) {
+	for unique, rec := range a.auth {
+		if rec.uid == uid && rec.scheme == scheme {
+			return unique, rec
+		}
+	}
+	return "", nil
+}
+
+// AuthDelScheme deletes an existing authentication scheme for the user.
+func (a *adapter) AuthDelScheme(user t.Uid, scheme string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if unique, rec := a.authByScheme(user, scheme); rec != nil {
+		delete(a.auth, unique)
+	}
+	return nil
+}
+
+func (a *adapter) authDelAll(user t.Uid) int {
+	count := 0
+	for unique, rec := range a.auth {
+		if rec.uid == user {
+			delete(a.auth, unique)
+			count++
+		}
+	}
+	return count
+}
+
+// AuthUpdRecord updates user's authentication secret.
+func (a *adapter) AuthUpdRecord(uid t.Uid, scheme, unique string, authLvl auth.Level,
+	secret []byte, expires time.Time) error {
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	oldUnique, rec := a.authByScheme(uid, scheme)
+	if rec == nil {
+		return nil
+	}
+	if oldUnique != unique {
+		if _, ok := a.auth[unique]; ok {
+			return t.ErrDuplicate
+		}
+		delete(a.auth, oldUnique)
+		a.auth[unique] = rec
+	}
+	rec.authLvl = authLvl
+	rec.secret = append([]byte(nil), secret...)
+	rec.expires = expires
+	return nil
+}
+
+// AuthGetRecord retrieves user's authentication record.
+func (a *adapter) AuthGetRecord(uid t.Uid, scheme string) (string, auth.Level, []byte, time.Time, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	unique, rec := a.authByScheme(uid, scheme)
+	if rec == nil {
+		return "", 0, nil, time.Time{}, nil
+	}
+	return unique, rec.authLvl, append([]byte(nil), rec.secret...), rec.expires, nil
+}
+
+// AuthGetInactive returns IDs of users with the given auth scheme who were not seen since lastSeenBefore.
+func (a *adapter) AuthGetInactive(scheme string, lastSeenBefore time.Time, limit int) ([]t.Uid, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	type inactive struct {
+		uid  t.Uid
+		seen time.Time
+	}
+	var found []inactive
+	for _, rec := range a.auth {
+		if rec.scheme != scheme {
+			continue
+		}
+		user := a.users[rec.uid]
+		if user == nil || user.State == t.StateDeleted {
+			continue
+		}
+		seen := user.CreatedAt
+		if user.LastSeen != nil {
+			seen = *user.LastSeen
+		}
+		if seen.Before(lastSeenBefore) {
+			found = append(found, inactive{uid: rec.uid, seen: seen})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].seen.Before(found[j].seen) })
+	if limit > 0 && len(found) > limit {
+		found = found[:limit]
+	}
+
+	var uids []t.Uid
+	for _, f := range found {
+		uids = append(uids, f.uid)
+	}
+	return uids, nil
+}
+
+// AuthGetUniqueRecord retrieves user's authentication record by unique value.
+func (a *adapter) AuthGetUniqueRecord(unique string) (t.Uid, auth.Level, []byte, time.Time, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	rec := a.auth[unique]
+	if rec == nil {
+		return t.ZeroUid, 0, nil, time.Time{}, nil
+	}
+	return rec.uid, rec.authLvl, append([]byte(nil), rec.secret...), rec.expires, nil
+}
+
+// UserGet fetches a single user by user id. If user is not found it returns (nil, nil)
+func (a *adapter) UserGet(uid t.Uid) (*t.User, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if user := a.users[uid]; user != nil && user.State != t.StateDeleted {
+		return copyUser(user), nil
+	}
+	return nil, nil
+}
+
+// UserGetAll returns user records for a given list of user IDs. Deleted users are skipped.
+func (a *adapter) UserGetAll(ids ...t.Uid) ([]t.User, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	users := []t.User{}
+	for _, uid := range ids {
+		if user := a.users[uid]; user != nil && user.State != t.StateDeleted {
+			users = append(users, *copyUser(user))
+		}
+	}
+	return users, nil
+}
+
+// UserDelete deletes specified user: wipes completely (hard-delete) or marks as deleted.
+func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	user := uid.String()
+	if hard {
+		// Delete user's devices.
+		a.deviceDelete(uid, "")
+
+		// Delete user's subscriptions in all topics.
+		a.subsDelForUser(uid, true)
+
+		// Delete records of messages soft-deleted for the user.
+		for topic, log := range a.dellog {
+			a.dellog[topic] = filterDellog(log, func(rec *dellogRecord) bool {
+				return rec.deletedFor != user
+			})
+		}
+
+		// Can't delete user's messages in all topics because we cannot notify topics of such deletion.
+		// Just leave the messages there marked as sent by "not found" user.
+
+		// Delete topics where the user is the owner together with their messages and subscriptions.
+		for name, topic := range a.topics {
+			if topic.Owner == user {
+				a.topicDelete(name, true)
+			}
+		}
+
+		// Delete user's authentication records and credentials.
+		a.authDelAll(uid)
+		a.credDel(uid, "", "")
+
+		delete(a.users, uid)
+	} else {
+		now := t.TimeNow()
+		// Disable all user's subscriptions. That includes p2p subscriptions. No need to delete them.
+		a.subsDelForUser(uid, false)
+
+		for name, topic := range a.topics {
+			if topic.Owner == user {
+				// Disable group topics where the user is the owner and all subscriptions to them.
+				a.subsDelForTopic(name, false, now)
+				topic.UpdatedAt = now
+				topic.State = t.StateDeleted
+				topic.StateAt = &now
+			} else if t.GetTopicCat(name) == t.TopicCatP2P && a.subs[subsKey(name, uid)] != nil {
+				// Disable p2p topics with the user and the other user's subscription.
+				a.subsDelForTopic(name, false, now)
+				topic.UpdatedAt = now
+				topic.State = t.StateDeleted
+				topic.StateAt = &now
+			}
+		}
+
+		// Disable user.
+		if usr := a.users[uid]; usr != nil {
+			usr.UpdatedAt = now
+			usr.State = t.StateDeleted
+			usr.StateAt = &now
+		}
+	}
+
+	return nil
+}
+
+// topicStateForUser is called by UserUpdate when the update contains state change.
+func (a *adapter) topicStateForUser(uid t.Uid, now time.Time, update interface{}) error {
+	state, ok := update.(t.ObjState)
+	if !ok {
+		return t.ErrMalformed
+	}
+
+	if now.IsZero() {
+		now = t.TimeNow()
+	}
+
+	user := uid.String()
+	for name, topic := range a.topics {
+		if topic.State == t.StateDeleted {
+			continue
+		}
+		// Change state of all topics where the user is the owner and of p2p topics with the user.
+		if topic.Owner == user ||
+			(t.GetTopicCat(name) == t.TopicCatP2P && a.subs[subsKey(name, uid)] != nil) {
+			topic.State = state
+			stateAt := now
+			topic.StateAt = &stateAt
+		}
+	}
+
+	// Subscriptions don't need to be updated:
+	// subscriptions of a disabled user are not disabled and still can be manipulated.
+
+	return nil
+}
+
+// UserUpdate updates user object.
+func (a *adapter) UserUpdate(uid t.Uid, update map[string]interface{}) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	user := a.users[uid]
+	if user == nil {
+		return nil
+	}
+
+	// Validate the update before changing anything.
+	updated := *user
+	if err := updateByMap(&updated, update); err != nil {
+		return err
+	}
+
+	if state, ok := update["State"]; ok {
+		now, _ := update["StateAt"].(time.Time)
+		if err := a.topicStateForUser(uid, now, state); err != nil {
+			return err
+		}
+	}
+
+	*user = updated
+	return nil
+}
+
+// UserUpdateTags adds, removes, or resets user's tags
+func (a *adapter) UserUpdateTags(uid t.Uid, add, remove, reset []string) ([]string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	user := a.users[uid]
+	if user == nil {
+		return nil, t.ErrNotFound
+	}
+
+	user.Tags = updateTags(user.Tags, add, remove, reset)
+	return append([]string(nil), user.Tags...), nil
+}
+
+// UserGetByCred returns user ID for the given validated credential.
+func (a *adapter) UserGetByCred(method, value string) (t.Uid, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if cred := a.creds[method+":"+value]; cred != nil {
+		return t.ParseUid(cred.User), nil
+	}
+	return t.ZeroUid, nil
+}
+
+// UserUnreadCount returns the total number of unread messages in all topics with
+// the R permission.
+func (a *adapter) UserUnreadCount(uid t.Uid) (int, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	count := 0
+	user := uid.String()
+	for _, sub := range a.subs {
+		if sub.User != user || sub.DeletedAt != nil || !sub.ModeWant.IsReader() || !sub.ModeGiven.IsReader() {
+			continue
+		}
+		if topic := a.topics[sub.Topic]; topic != nil && topic.State != t.StateDeleted {
+			count += topic.SeqId - sub.ReadSeqId
+		}
+	}
+	return count, nil
+}
+
+// Credential management
+
+// CredUpsert adds or updates a validation record. Returns true if inserted, false if updated.
+// 1. if credential is validated:
+// 1.1 Hard-delete unconfirmed equivalent record, if exists.
+// 1.2 Insert new. Report error if duplicate.
+// 2. if credential is not validated:
+// 2.1 Check if validated equivalent exist. If so, report an error.
+// 2.2 Soft-delete all unvalidated records of the same method.
+// 2.3 Undelete existing credential. Return if successful.
+// 2.4 Insert new credential record.
+func (a *adapter) CredUpsert(cred *t.Credential) (bool, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// Enforce uniqueness: if credential is confirmed, "method:value" must be unique.
+	// if credential is not yet confirmed, "userid:method:value" is unique.
+	synth := cred.Method + ":" + cred.Value
+
+	if !cred.Done {
+		// Check if this credential is already validated.
+		if _, ok := a.creds[synth]; ok {
+			return false, t.ErrDuplicate
+		}
+		// We are going to insert new record.
+		synth = cred.User + ":" + synth
+
+		// Adding new unvalidated credential. Deactivate all unvalidated records of this user and method.
+		now := t.TimeNow()
+		for _, rec := range a.creds {
+			if rec.User == cred.User && rec.Method == cred.Method && !rec.Done {
+				deletedAt := now
+				rec.deletedAt = &deletedAt
+			}
+		}
+		// Assume that the record exists and try to update it: undelete, update timestamp and response value.
+		if rec := a.creds[synth]; rec != nil {
+			rec.UpdatedAt = cred.UpdatedAt
+			rec.deletedAt = nil
+			rec.Resp = cred.Resp
+			rec.Done = false
+			return false, nil
+		}
+	} else {
+		// Hard-deleting unconformed record if it exists.
+		delete(a.creds, cred.User+":"+synth)
+	}
+
+	// Add new record.
+	if _, ok := a.creds[synth]; ok {
+		return true, t.ErrDuplicate
+	}
+	a.creds[synth] = &credRecord{Credential: *cred}
+	return true, nil
+}
+
+// credDel deletes given validation method or all methods of the given user.
+// 1. If user is being deleted, hard-delete all records (method == "")
+// 2. If one value is being deleted:
+// 2.1 Delete it if it's valiated or if there were no attempts at validation
+// (otherwise it could be used to circumvent the limit on validation attempts).
+// 2.2 In that case mark it as soft-deleted.
+func (a *adapter) credDel(uid t.Uid, method, value string) error {
+	user := uid.String()
+	count := 0
+	for synth, rec := range a.creds {
+		if rec.User != user || (method != "" && rec.Method != method) || (value != "" && rec.Value != value) {
+			continue
+		}
+		count++
+		if method == "" || rec.Done || rec.Retries == 0 {
+			// Case 1 and 2.1
+			delete(a.creds, synth)
+		} else if rec.deletedAt == nil {
+			// Case 2.2
+			now := t.TimeNow()
+			rec.deletedAt = &now
+		}
+	}
+
+	if count == 0 {
+		return t.ErrNotFound
+	}
+	return nil
+}
+
+// CredDel deletes either credentials of the given user. If method is blank all
+// credentials are removed. If value is blank all credentials of the given the
+// method are removed.
+func (a *adapter) CredDel(uid t.Uid, method, value string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.credDel(uid, method, value)
+}
+
+// CredConfirm marks given credential method as confirmed.
+func (a *adapter) CredConfirm(uid t.Uid, method string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	user := uid.String()
+	for synth, rec := range a.creds {
+		if rec.User != user || rec.Method != method || rec.deletedAt != nil || rec.Done {
+			continue
+		}
+		confirmed := rec.Method + ":" + rec.Value
+		if _, ok := a.creds[confirmed]; ok {
+			return t.ErrDuplicate
+		}
+		rec.UpdatedAt = t.TimeNow()
+		rec.Done = true
+		delete(a.creds, synth)
+		a.creds[confirmed] = rec
+		return nil
+	}
+	return t.ErrNotFound
+}
+
+// CredFail increments failure count of the given validation method.
+func (a *adapter) CredFail(uid t.Uid, method string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	user := uid.String()
+	for _, rec := range a.creds {
+		if rec.User == user && rec.Method == method && !rec.Done {
+			rec.UpdatedAt = t.TimeNow()
+			rec.Retries++
+		}
+	}
+	return nil
+}
+
+// CredGetActive returns currently active unvalidated credential of the given user and method.
+func (a *adapter) CredGetActive(uid t.Uid, method string) (*t.Credential, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	user := uid.String()
+	for _, rec := range a.creds {
+		if rec.User == user && rec.Method == method && rec.deletedAt == nil && !rec.Done {
+			cred := rec.Credential
+			return &cred, nil
+		}
+	}
+	return nil, nil
+}
+
+// CredGetAll returns credential records for the given user and method, all or validated only.
+func (a *adapter) CredGetAll(uid t.Uid, method string, validatedOnly bool) ([]t.Credential, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var credentials []t.Credential
+	user := uid.String()
+	for _, rec := range a.creds {
+		if rec.User != user || rec.deletedAt != nil ||
+			(method != "" && rec.Method != method) || (validatedOnly && !rec.Done) {
+			continue
+		}
+		credentials = append(credentials, rec.Credential)
+	}
+	sort.Slice(credentials, func(i, j int) bool {
+		return credentials[i].CreatedAt.Before(credentials[j].CreatedAt)
+	})
+	return credentials, nil
+}
+
+// Topic management
+
+// TopicCreate saves topic object to database.
+func (a *adapter) TopicCreate(topic *t.Topic) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, ok := a.topics[topic.Id]; ok {
+		return t.ErrDuplicate
+	}
+	a.topics[topic.Id] = copyTopic(topic)
+	return nil
+}
+
+// If undelete = true - update subscription on duplicate key, otherwise ignore the duplicate.
+func (a *adapter) createSubscription(sub *t.Subscription, undelete bool) {
+	key := subsKey(sub.Topic, t.ParseUid(sub.User))
+	if old := a.subs[key]; old != nil {
+		old.CreatedAt = sub.CreatedAt
+		old.UpdatedAt = sub.UpdatedAt
+		old.DeletedAt = nil
+		old.ModeGiven = sub.ModeGiven
+		if !undelete {
+			old.ModeWant = sub.ModeWant
+			old.Private = sub.Private
+		}
+	} else {
+		a.subs[key] = copySub(sub)
+	}
+
+	if (sub.ModeGiven & sub.ModeWant).IsOwner() {
+		if topic := a.topics[sub.Topic]; topic != nil {
+			topic.Owner = sub.User
+		}
+	}
+}
+
+// TopicCreateP2P given two users creates a p2p topic
+func (a *adapter) TopicCreateP2P(initiator, invited *t.Subscription) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, ok := a.topics[initiator.Topic]; ok {
+		return t.ErrDuplicate
+	}
+
+	a.createSubscription(initiator, false)
+	a.createSubscription(invited, true)
+
+	topic := &t.Topic{ObjHeader: t.ObjHeader{Id: initiator.Topic}}
+	topic.ObjHeader.MergeTimes(&initiator.ObjHeader)
+	topic.TouchedAt = initiator.GetTouchedAt()
+	a.topics[topic.Id] = topic
+
+	return nil
+}
+
+// TopicGet loads a single topic by name, if it exists. If the topic does not exist the call returns (nil, nil)
+func (a *adapter) TopicGet(topic string) (*t.Topic, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if tt := a.topics[topic]; tt != nil {
+		return copyTopic(tt), nil
+	}
+	return nil, nil
+}
+
+// TopicsForUser loads user's contact list: p2p and grp topics, except for 'me' & 'fnd' subscriptions.
+// Reads and denormalizes Public value.
+func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	limit := a.maxResults
+	var topicFilter string
+	if opts != nil {
+		// Ignore IfModifiedSince - we must return all entries
+		// Those unmodified will be stripped of Public & Private.
+		topicFilter = opts.Topic
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	var subs []t.Subscription
+	for _, s := range a.sortedSubs(func(s *t.Subscription) bool {
+		return s.User == uid.String() && (keepDeleted || s.DeletedAt == nil) &&
+			(topicFilter == "" || s.Topic == topicFilter)
+	}) {
+		if len(subs) >= limit {
+			break
+		}
+
+		tcat := t.GetTopicCat(s.Topic)
+		// 'me' or 'fnd' subscription, skip
+		if tcat == t.TopicCatMe || tcat == t.TopicCatFnd {
+			continue
+		}
+
+		tname := s.Topic
+		if tcat == t.TopicCatGrp {
+			// Channel readers are subscribed to 'chnXXX', the topic itself is 'grpXXX'.
+			tname = t.ChnToGrp(tname)
+		}
+		top := a.topics[tname]
+		if top == nil || (!keepDeleted && top.State == t.StateDeleted) {
+			continue
+		}
+
+		sub := *copySub(s)
+		sub.ObjHeader.MergeTimes(&top.ObjHeader)
+		sub.SetState(top.State)
+		sub.SetTouchedAt(top.TouchedAt)
+		sub.SetSeqId(top.SeqId)
+
+		if tcat == t.TopicCatGrp {
+			sub.SetPublic(top.Public)
+		} else {
+			// p2p subscription, find the other user to get user.Public
+			uid1, uid2, _ := t.ParseP2P(s.Topic)
+			if uid1 == uid {
+				uid1 = uid2
+			}
+			usr := a.users[uid1]
+			if usr == nil || (!keepDeleted && usr.State == t.StateDeleted) {
+				continue
+			}
+			sub.ObjHeader.MergeTimes(&usr.ObjHeader)
+			sub.SetState(usr.State)
+			sub.SetPublic(usr.Public)
+			sub.SetWith(uid1.UserId())
+			sub.SetDefaultAccess(usr.Access.Auth, usr.Access.Anon)
+			sub.SetLastSeenAndUA(usr.LastSeen, usr.UserAgent)
+		}
+		subs = append(subs, sub)
+	}
+
+	return subs, nil
+}
+
+// UsersForTopic loads users subscribed to the given topic.
+// The difference between UsersForTopic vs SubsForTopic is that the former loads user.public,
+// the latter does not.
+func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	tcat := t.GetTopicCat(topic)
+
+	limit := a.maxResults
+	var oneUser t.Uid
+	if opts != nil {
+		// Ignore IfModifiedSince - we must return all entries
+		// Those unmodified will be stripped of Public & Private.
+		oneUser = opts.User
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	var subs []t.Subscription
+	for _, s := range a.sortedSubs(func(s *t.Subscription) bool {
+		if s.Topic != topic {
+			return false
+		}
+		// For p2p topics we must load all subscriptions including deleted.
+		// Otherwise it will be impossible to swipe Public values.
+		if tcat == t.TopicCatP2P {
+			return true
+		}
+		return (keepDeleted || s.DeletedAt == nil) && (oneUser.IsZero() || s.User == oneUser.String())
+	}) {
+		if len(subs) >= limit {
+			break
+		}
+
+		usr := a.users[t.ParseUid(s.User)]
+		if usr == nil || (!keepDeleted && usr.State == t.StateDeleted) {
+			continue
+		}
+
+		sub := *copySub(s)
+		sub.SetPublic(usr.Public)
+		subs = append(subs, sub)
+	}
+
+	if tcat == t.TopicCatP2P && len(subs) > 0 {
+		// Swap public values of P2P topics as expected.
+		if len(subs) == 1 {
+			// The other user is deleted, nothing we can do.
+			subs[0].SetPublic(nil)
+		} else {
+			pub := subs[0].GetPublic()
+			subs[0].SetPublic(subs[1].GetPublic())
+			subs[1].SetPublic(pub)
+		}
+
+		// Remove deleted and unneeded subscriptions
+		if !keepDeleted || !oneUser.IsZero() {
+			var xsubs []t.Subscription
+			for i := range subs {
+				if (subs[i].DeletedAt != nil && !keepDeleted) || (!oneUser.IsZero() && subs[i].User != oneUser.String()) {
+					continue
+				}
+				xsubs = append(xsubs, subs[i])
+			}
+			subs = xsubs
+		}
+	}
+
+	return subs, nil
+}
+
+// OwnTopics loads a slice of topic names where the user is the owner.
+func (a *adapter) OwnTopics(uid t.Uid) ([]string, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var names []string
+	for name, topic := range a.topics {
+		if topic.Owner == uid.String() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// TopicShare creates topic subscriptions.
+func (a *adapter) TopicShare(shares []*t.Subscription) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, sub := range shares {
+		a.createSubscription(sub, true)
+	}
+	return nil
+}
+
+// topicDelete deletes topic, subscriptions and messages or marks them as deleted.
+func (a *adapter) topicDelete(topic string, hard bool) {
+	// Subscriptions of channel readers, if any.
+	chn := t.GrpToChn(topic)
+	if hard {
+		a.subsDelForTopic(topic, true, time.Time{})
+		if chn != "" {
+			a.subsDelForTopic(chn, true, time.Time{})
+		}
+		a.messageDeleteList(topic, nil)
+		delete(a.topics, topic)
+	} else {
+		now := t.TimeNow()
+		for _, sub := range a.subs {
+			if sub.Topic == topic || sub.Topic == chn {
+				deletedAt := now
+				sub.UpdatedAt = now
+				sub.DeletedAt = &deletedAt
+			}
+		}
+		if tt := a.topics[topic]; tt != nil {
+			tt.UpdatedAt = now
+			tt.State = t.StateDeleted
+			tt.StateAt = &now
+		}
+	}
+}
+
+// TopicDelete deletes specified topic.
+func (a *adapter) TopicDelete(topic string, hard bool) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.topicDelete(topic, hard)
+	return nil
+}
+
+// TopicUpdateOnMessage updates topic's SeqId and TouchedAt.
+func (a *adapter) TopicUpdateOnMessage(topic string, msg *t.Message) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if tt := a.topics[topic]; tt != nil {
+		tt.SeqId = msg.SeqId
+		tt.TouchedAt = msg.CreatedAt
+	}
+	return nil
+}
+
+// TopicUpdate updates topic record.
+func (a *adapter) TopicUpdate(topic string, update map[string]interface{}) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if tt := a.topics[topic]; tt != nil {
+		return updateByMap(tt, update)
+	}
+	return nil
+}
+
+// TopicOwnerChange updates topic's owner.
+func (a *adapter) TopicOwnerChange(topic string, newOwner t.Uid) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if tt := a.topics[topic]; tt != nil {
+		tt.Owner = newOwner.String()
+	}
+	return nil
+}
+
+// Topic subscriptions
+
+// SubscriptionGet reads a subscription of a user to a topic.
+func (a *adapter) SubscriptionGet(topic string, user t.Uid) (*t.Subscription, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if sub := a.subs[subsKey(topic, user)]; sub != nil && sub.DeletedAt == nil {
+		return copySub(sub), nil
+	}
+	return nil, nil
+}
+
+// SubsForUser loads a list of user's subscriptions to topics. Does NOT load Public value.
+func (a *adapter) SubsForUser(forUser t.Uid, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	limit := a.maxResults // maxResults here, not maxSubscribers
+	var topicFilter string
+	if opts != nil {
+		// Ignore IfModifiedSince - we must return all entries
+		// Those unmodified will be stripped of Public & Private.
+		topicFilter = opts.Topic
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	var subs []t.Subscription
+	for _, s := range a.sortedSubs(func(s *t.Subscription) bool {
+		return s.User == forUser.String() && (keepDeleted || s.DeletedAt == nil) &&
+			(topicFilter == "" || s.Topic == topicFilter)
+	}) {
+		if len(subs) >= limit {
+			break
+		}
+		subs = append(subs, *copySub(s))
+	}
+	return subs, nil
+}
+
+// SubsForTopic fetches all subsciptions for a topic. Does NOT load Public value.
+func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	limit := a.maxResults
+	var oneUser t.Uid
+	if opts != nil {
+		// Ignore IfModifiedSince - we must return all entries
+		// Those unmodified will be stripped of Public & Private.
+		oneUser = opts.User
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	var subs []t.Subscription
+	for _, s := range a.sortedSubs(func(s *t.Subscription) bool {
+		return s.Topic == topic && (keepDeleted || s.DeletedAt == nil) &&
+			(oneUser.IsZero() || s.User == oneUser.String())
+	}) {
+		if len(subs) >= limit {
+			break
+		}
+		subs = append(subs, *copySub(s))
+	}
+	return subs, nil
+}
+
+// SubsUpdate updates one or multiple subscriptions to a topic.
+func (a *adapter) SubsUpdate(topic string, user t.Uid, update map[string]interface{}) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, sub := range a.subs {
+		if sub.Topic != topic || (!user.IsZero() && sub.User != user.String()) {
+			continue
+		}
+		if err := updateByMap(sub, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SubsDelete marks subscription as deleted.
+func (a *adapter) SubsDelete(topic string, user t.Uid) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	sub := a.subs[subsKey(topic, user)]
+	if sub == nil || sub.DeletedAt != nil {
+		return t.ErrNotFound
+	}
+	now := t.TimeNow()
+	sub.UpdatedAt = now
+	sub.DeletedAt = &now
+	return nil
+}
+
+func (a *adapter) subsDelForTopic(topic string, hard bool, now time.Time) {
+	for key, sub := range a.subs {
+		if sub.Topic != topic {
+			continue
+		}
+		if hard {
+			delete(a.subs, key)
+		} else if sub.DeletedAt == nil {
+			deletedAt := now
+			sub.UpdatedAt = now
+			sub.DeletedAt = &deletedAt
+		}
+	}
+}
+
+func (a *adapter) subsDelForUser(user t.Uid, hard bool) {
+	now := t.TimeNow()
+	for key, sub := range a.subs {
+		if sub.User != user.String() {
+			continue
+		}
+		if hard {
+			delete(a.subs, key)
+		} else if sub.DeletedAt == nil {
+			deletedAt := now
+			sub.UpdatedAt = now
+			sub.DeletedAt = &deletedAt
+		}
+	}
+}
+
+// Search
+
+// findMatch counts tags matching the query. Returns -1 if any of the required disjunctions is not matched.
+func findMatch(tags []string, req [][]string, index map[string]struct{}) (int, []string) {
+	have := make(map[string]struct{}, len(tags))
+	foundTags := make([]string, 0, 1)
+	for _, tag := range tags {
+		have[tag] = struct{}{}
+		if _, ok := index[tag]; ok {
+			foundTags = append(foundTags, tag)
+		}
+	}
+
+	for _, reqDisjunction := range req {
+		if len(reqDisjunction) == 0 {
+			continue
+		}
+		found := false
+		for _, tag := range reqDisjunction {
+			if _, ok := have[tag]; ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return -1, nil
+		}
+	}
+	return len(foundTags), foundTags
+}
+
+type matchedSub struct {
+	sub     t.Subscription
+	matches int
+}
+
+// sortMatches orders search results by number of matched tags from high to low.
+func sortMatches(found []matchedSub, limit int) []t.Subscription {
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].matches > found[j].matches
+	})
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	var subs []t.Subscription
+	for i := range found {
+		subs = append(subs, found[i].sub)
+	}
+	return subs
+}
+
+func searchIndex(req [][]string, opt []string) map[string]struct{} {
+	index := make(map[string]struct{})
+	for _, tag := range append(t.FlattenDoubleSlice(req), opt...) {
+		index[tag] = struct{}{}
+	}
+	return index
+}
+
+// FindUsers returns a list of users who match given tags, such as "email:jdoe@example.com" or "tel:+18003287448".
+func (a *adapter) FindUsers(uid t.Uid, req [][]string, opt []string) ([]t.Subscription, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	index := searchIndex(req, opt)
+
+	var ids []t.Uid
+	for id := range a.users {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var found []matchedSub
+	for _, id := range ids {
+		usr := a.users[id]
+		if id == uid || usr.State != t.StateOK {
+			// Skip the callee
+			continue
+		}
+		matches, foundTags := findMatch(usr.Tags, req, index)
+		if matches <= 0 {
+			continue
+		}
+
+		var sub t.Subscription
+		sub.CreatedAt = usr.CreatedAt
+		sub.UpdatedAt = usr.UpdatedAt
+		sub.User = id.String()
+		sub.SetPublic(usr.Public)
+		sub.SetDefaultAccess(usr.Access.Auth, usr.Access.Anon)
+		sub.Private = foundTags
+		found = append(found, matchedSub{sub: sub, matches: matches})
+	}
+
+	return sortMatches(found, a.maxResults), nil
+}
+
+// FindTopics returns a list of topics with matching tags.
+func (a *adapter) FindTopics(req [][]string, opt []string) ([]t.Subscription, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	index := searchIndex(req, opt)
+
+	var names []string
+	for name := range a.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var found []matchedSub
+	for _, name := range names {
+		top := a.topics[name]
+		if top.State != t.StateOK {
+			continue
+		}
+		matches, foundTags := findMatch(top.Tags, req, index)
+		if matches <= 0 {
+			continue
+		}
+
+		var sub t.Subscription
+		sub.CreatedAt = top.CreatedAt
+		sub.UpdatedAt = top.UpdatedAt
+		sub.Topic = name
+		sub.SetPublic(top.Public)
+		sub.SetDefaultAccess(top.Access.Auth, top.Access.Anon)
+		sub.Private = foundTags
+		found = append(found, matchedSub{sub: sub, matches: matches})
+	}
+
+	return sortMatches(found, a.maxResults), nil
+}
+
+// Messages
+
+// MessageSave saves message to database.
+func (a *adapter) MessageSave(msg *t.Message) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	msgs := a.messages[msg.Topic]
+	// Keep messages sorted by SeqId.
+	i := sort.Search(len(msgs), func(i int) bool { return msgs[i].SeqId >= msg.SeqId })
+	if i < len(msgs) && msgs[i].SeqId == msg.SeqId {
+		return t.ErrDuplicate
+	}
+	msgs = append(msgs, nil)
+	copy(msgs[i+1:], msgs[i:])
+	msgs[i] = copyMessage(msg)
+	a.messages[msg.Topic] = msgs
+	return nil
+}
+
+// MessageGetAll returns messages matching the query, newest first.
+func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.Message, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var limit = a.maxMessageResults
+	var lower = 0
+	var upper = 1<<31 - 1
+
+	if opts != nil {
+		if opts.Since > 0 {
+			lower = opts.Since
+		}
+		if opts.Before > 0 {
+			// Before is exclusive.
+			upper = opts.Before - 1
+		}
+
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	// Ranges of messages soft-deleted for the user.
+	var softDeleted []dellogRecord
+	if !forUser.IsZero() {
+		softDeleted = filterDellog(a.dellog[topic], func(rec *dellogRecord) bool {
+			return rec.deletedFor == forUser.String()
+		})
+	}
+
+	msgs := make([]t.Message, 0, limit)
+	all := a.messages[topic]
+	for i := len(all) - 1; i >= 0 && len(msgs) < limit; i-- {
+		msg := all[i]
+		if msg.SeqId > upper {
+			continue
+		}
+		if msg.SeqId < lower {
+			break
+		}
+		if msg.DelId != 0 || inDellog(softDeleted, msg.SeqId) {
+			continue
+		}
+		msgs = append(msgs, *copyMessage(msg))
+	}
+	return msgs, nil
+}
+
+// MessageGetDeleted returns ranges of deleted messages.
+func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.DelMessage, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var limit = a.maxResults
+	var lower = 0
+	var upper = 1<<31 - 1
+
+	if opts != nil {
+		if opts.Since > 0 {
+			lower = opts.Since
+		}
+		if opts.Before > 1 {
+			// Before is exclusive.
+			upper = opts.Before - 1
+		}
+
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	// Fetch log of deletions
+	log := filterDellog(a.dellog[topic], func(rec *dellogRecord) bool {
+		return rec.delId >= lower && rec.delId <= upper &&
+			(rec.deletedFor == "" || rec.deletedFor == forUser.String())
+	})
+	sort.SliceStable(log, func(i, j int) bool { return log[i].delId < log[j].delId })
+	if len(log) > limit {
+		log = log[:limit]
+	}
+
+	var dmsgs []t.DelMessage
+	var dmsg t.DelMessage
+	for _, rec := range log {
+		if rec.delId != dmsg.DelId {
+			if dmsg.DelId > 0 {
+				dmsgs = append(dmsgs, dmsg)
+			}
+			dmsg.DelId = rec.delId
+			dmsg.Topic = topic
+			dmsg.DeletedFor = rec.deletedFor
+			dmsg.SeqIdRanges = nil
+		}
+		hi := rec.hi
+		if hi <= rec.low+1 {
+			hi = 0
+		}
+		dmsg.SeqIdRanges = append(dmsg.SeqIdRanges, t.Range{Low: rec.low, Hi: hi})
+	}
+	if dmsg.DelId > 0 {
+		dmsgs = append(dmsgs, dmsg)
+	}
+
+	return dmsgs, nil
+}
+
+func (a *adapter) messageDeleteList(topic string, toDel *t.DelMessage) {
+	if toDel == nil {
+		// Whole topic is being deleted, thus also deleting all messages and their attachment links.
+		for _, msg := range a.messages[topic] {
+			delete(a.fileLinks, msg.Uid())
+		}
+		delete(a.messages, topic)
+		delete(a.dellog, topic)
+		return
+	}
+
+	// Only some messages are being deleted. Start with making log entries.
+	log := a.dellog[topic]
+	for _, rng := range toDel.SeqIdRanges {
+		if rng.Hi == 0 {
+			// Dellog must contain valid Low and *Hi*.
+			rng.Hi = rng.Low + 1
+		}
+		log = append(log, dellogRecord{delId: toDel.DelId, deletedFor: toDel.DeletedFor, low: rng.Low, hi: rng.Hi})
+	}
+	a.dellog[topic] = log
+
+	if toDel.DeletedFor == "" {
+		// Hard-deleting messages: clear content and drop attachment links.
+		now := t.TimeNow()
+		ranges := log[len(log)-len(toDel.SeqIdRanges):]
+		for _, msg := range a.messages[topic] {
+			if msg.DeletedAt != nil || !inDellog(ranges, msg.SeqId) {
+				continue
+			}
+			deletedAt := now
+			msg.DeletedAt = &deletedAt
+			msg.DelId = toDel.DelId
+			msg.Head = nil
+			msg.Content = nil
+			delete(a.fileLinks, msg.Uid())
+		}
+	}
+}
+
+// MessageDeleteList deletes messages in the given topic with seqIds from the list
+func (a *adapter) MessageDeleteList(topic string, toDel *t.DelMessage) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.messageDeleteList(topic, toDel)
+	return nil
+}
+
+// MessageAttachments connects given message to a list of file record IDs.
+func (a *adapter) MessageAttachments(msgId t.Uid, fids []string) error {
+	var ids []t.Uid
+	for _, fid := range fids {
+		id := t.ParseUid(fid)
+		if id.IsZero() {
+			return t.ErrMalformed
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return t.ErrMalformed
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, id := range ids {
+		if a.files[id] == nil {
+			return t.ErrNotFound
+		}
+	}
+
+	now := t.TimeNow()
+	for _, id := range ids {
+		a.files[id].UpdatedAt = now
+	}
+	a.fileLinks[msgId] = append(a.fileLinks[msgId], ids...)
+	return nil
+}
+
+// Devices (for push notifications)
+
+// DeviceUpsert creates or updates a device record.
+func (a *adapter) DeviceUpsert(uid t.Uid, def *t.DeviceDef) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// Ensure uniqueness of the device ID: the device is re-assigned to the new user.
+	a.devices[def.DeviceId] = &deviceRecord{uid: uid, def: *def}
+	return nil
+}
+
+// DeviceGetAll returns all devices for a given set of users.
+func (a *adapter) DeviceGetAll(uids ...t.Uid) (map[t.Uid][]t.DeviceDef, int, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	want := make(map[t.Uid]bool, len(uids))
+	for _, uid := range uids {
+		want[uid] = true
+	}
+
+	result := make(map[t.Uid][]t.DeviceDef)
+	count := 0
+	for _, dev := range a.devices {
+		if want[dev.uid] {
+			result[dev.uid] = append(result[dev.uid], dev.def)
+			count++
+		}
+	}
+	return result, count, nil
+}
+
+func (a *adapter) deviceDelete(uid t.Uid, deviceID string) error {
+	count := 0
+	for id, dev := range a.devices {
+		if dev.uid == uid && (deviceID == "" || deviceID == id) {
+			delete(a.devices, id)
+			count++
+		}
+	}
+	if count == 0 {
+		return t.ErrNotFound
+	}
+	return nil
+}
+
+// DeviceDelete deletes a device record. If deviceID is empty, all user's devices are deleted.
+func (a *adapter) DeviceDelete(uid t.Uid, deviceID string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.deviceDelete(uid, deviceID)
+}
+
+// File upload records. The files are stored outside of the database.
+
+// FileStartUpload initializes a file upload
+func (a *adapter) FileStartUpload(fd *t.FileDef) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	id := fd.Uid()
+	if _, ok := a.files[id]; ok {
+		return t.ErrDuplicate
+	}
+	rec := *fd
+	a.files[id] = &rec
+	return nil
+}
+
+// FileFinishUpload marks file upload as completed, successfully or otherwise
+func (a *adapter) FileFinishUpload(fid string, status int, size int64) (*t.FileDef, error) {
+	id := t.ParseUid(fid)
+	if id.IsZero() {
+		return nil, t.ErrMalformed
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	fd := a.files[id]
+	if fd == nil {
+		return nil, t.ErrNotFound
+	}
+	fd.UpdatedAt = t.TimeNow()
+	fd.Status = status
+	fd.Size = size
+
+	result := *fd
+	return &result, nil
+}
+
+// FileGet fetches a record of a specific file
+func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
+	id := t.ParseUid(fid)
+	if id.IsZero() {
+		return nil, t.ErrMalformed
+	}
+
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if fd := a.files[id]; fd != nil {
+		result := *fd
+		return &result, nil
+	}
+	return nil, nil
+}
+
+// FileDeleteUnused deletes file upload records which are not attached to any message.
+func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	used := make(map[t.Uid]bool)
+	for _, ids := range a.fileLinks {
+		for _, id := range ids {
+			used[id] = true
+		}
+	}
+
+	var unused []*t.FileDef
+	for id, fd := range a.files {
+		if !used[id] && (olderThan.IsZero() || fd.UpdatedAt.Before(olderThan)) {
+			unused = append(unused, fd)
+		}
+	}
+	// Delete the oldest records first.
+	sort.Slice(unused, func(i, j int) bool { return unused[i].UpdatedAt.Before(unused[j].UpdatedAt) })
+	if limit > 0 && len(unused) > limit {
+		unused = unused[:limit]
+	}
+
+	var locations []string
+	for _, fd := range unused {
+		locations = append(locations, fd.Location)
+		delete(a.files, fd.Uid())
+	}
+	return locations, nil
+}
+
+// Helper functions
+
+func subsKey(topic string, user t.Uid) string {
+	return topic + ":" + user.String()
+}
+
+// sortedSubs returns subscriptions matching the filter ordered by topic name then by user.
+func (a *adapter) sortedSubs(filter func(*t.Subscription) bool) []*t.Subscription {
+	var subs []*t.Subscription
+	for _, sub := range a.subs {
+		if filter(sub) {
+			subs = append(subs, sub)
+		}
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		if subs[i].Topic != subs[j].Topic {
+			return subs[i].Topic < subs[j].Topic
+		}
+		return subs[i].User < subs[j].User
+	})
+	return subs
+}
+
+func filterDellog(log []dellogRecord, keep func(*dellogRecord) bool) []dellogRecord {
+	var result []dellogRecord
+	for i := range log {
+		if keep(&log[i]) {
+			result = append(result, log[i])
+		}
+	}
+	return result
+}
+
+// inDellog checks if seqId falls into any of the deleted ranges.
+func inDellog(log []dellogRecord, seqId int) bool {
+	for i := range log {
+		if seqId >= log[i].low && seqId < log[i].hi {
+			return true
+		}
+	}
+	return false
+}
+
+// updateTags adds, removes, or resets tags. Duplicates are ignored.
+func updateTags(tags, add, remove, reset []string) t.StringSlice {
+	if reset != nil {
+		tags = nil
+		add = reset
+		remove = nil
+	}
+
+	drop := make(map[string]bool, len(remove))
+	for _, tag := range remove {
+		drop[tag] = true
+	}
+	seen := make(map[string]bool, len(tags)+len(add))
+	var result t.StringSlice
+	for _, tag := range append(append([]string(nil), tags...), add...) {
+		if seen[tag] || drop[tag] {
+			continue
+		}
+		seen[tag] = true
+		result = append(result, tag)
+	}
+	return result
+}
+
+// updateByMap assigns update values to the fields of the struct pointed to by obj.
+// Map keys are field names. Nil value resets the field.
+func updateByMap(obj interface{}, update map[string]interface{}) error {
+	val := reflect.ValueOf(obj).Elem()
+	for name, arg := range update {
+		field := val.FieldByName(name)
+		if !field.IsValid() || !field.CanSet() {
+			return errors.New("memory adapter: unknown field '" + name + "'")
+		}
+		if arg == nil {
+			field.Set(reflect.Zero(field.Type()))
+			continue
+		}
+
+		src := reflect.ValueOf(arg)
+		if src.Kind() == reflect.Ptr && field.Kind() != reflect.Ptr && field.Kind() != reflect.Interface {
+			if src.IsNil() {
+				field.Set(reflect.Zero(field.Type()))
+				continue
+			}
+			src = src.Elem()
+		}
+		switch {
+		case src.Type().AssignableTo(field.Type()):
+			field.Set(src)
+		case field.Kind() == reflect.Ptr && src.Type().AssignableTo(field.Type().Elem()):
+			// Such as time.Time assigned to *time.Time.
+			ptr := reflect.New(field.Type().Elem())
+			ptr.Elem().Set(src)
+			field.Set(ptr)
+		case src.Type().ConvertibleTo(field.Type()):
+			field.Set(src.Convert(field.Type()))
+		default:
+			return errors.New("memory adapter: invalid value for field '" + name + "'")
+		}
+	}
+	return nil
+}
+
+func copyUser(user *t.User) *t.User {
+	usr := *user
+	usr.Tags = append(t.StringSlice(nil), user.Tags...)
+	usr.Devices = nil
+	usr.DeviceArray = nil
+	return &usr
+}
+
+func copyTopic(topic *t.Topic) *t.Topic {
+	top := *topic
+	top.Tags = append(t.StringSlice(nil), topic.Tags...)
+	return &top
+}
+
+func copySub(sub *t.Subscription) *t.Subscription {
+	s := *sub
+	return &s
+}
+
+func copyMessage(msg *t.Message) *t.Message {
+	m := *msg
+	if msg.Head != nil {
+		m.Head = make(t.MessageHeaders, len(msg.Head))
+		for k, v := range msg.Head {
+			m.Head[k] = v
+		}
+	}
+	return &m
+}
+
+func init() {
+	store.RegisterAdapter(&adapter{})
+}
@@ -0,0 +1,10 @@
+package memory
+
+import (
+	"GoChat/server/store/storetest"
+	"testing"
+)
+
+func TestAdapter(t *testing.T) {
+	storetest.Run(t, adapterName, nil)
+}
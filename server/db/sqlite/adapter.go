@@ -0,0 +1,2585 @@
+// +build sqlite
+
+// Package sqlite is a database adapter for SQLite. The whole database is kept in a single file.
+package sqlite
+
+import (
+	"GoChat/server/auth"
+	"GoChat/server/store"
+	t "GoChat/server/store/types"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// adapter holds SQLite connection data.
+type adapter struct {
+	db     *sql.DB
+	dbFile string
+	// Maximum number of records to return
+	maxResults int
+	// Maximum number of message records to return
+	maxMessageResults int
+	version           int
+}
+
+const (
+	defaultDatabase = "gochat.db"
+
+	adpVersion = 111
+
+	adapterName = "sqlite"
+
+	defaultMaxResults = 1024
+	// This is capped by the Session's send queue limit (128).
+	defaultMaxMessageResults = 100
+)
+
+type configType struct {
+	// Path to the database file.
+	Database string `json:"database,omitempty"`
+}
+
+// Open initializes database session
+func (a *adapter) Open(jsonconfig json.RawMessage) error {
+	if a.db != nil {
+		return errors.New("sqlite adapter is already connected")
+	}
+
+	var err error
+	var config configType
+	if len(jsonconfig) > 0 {
+		if err = json.Unmarshal(jsonconfig, &config); err != nil {
+			return errors.New("sqlite adapter failed to parse config: " + err.Error())
+		}
+	}
+
+	a.dbFile = config.Database
+	if a.dbFile == "" {
+		a.dbFile = defaultDatabase
+	}
+
+	if a.maxResults <= 0 {
+		a.maxResults = defaultMaxResults
+	}
+
+	if a.maxMessageResults <= 0 {
+		a.maxMessageResults = defaultMaxMessageResults
+	}
+
+	// The file is created if it does not exist. Transactions take the write lock immediately
+	// to avoid deadlocks when a read transaction is upgraded to a write transaction.
+	a.db, err = sql.Open("sqlite3", "file:"+a.dbFile+
+		"?_foreign_keys=1&_busy_timeout=5000&_txlock=immediate&_journal_mode=WAL")
+	if err != nil {
+		return err
+	}
+	// SQLite permits only one writer at a time anyway.
+	a.db.SetMaxOpenConns(1)
+
+	return a.db.Ping()
+}
+
+// Close closes the underlying database connection
+func (a *adapter) Close() error {
+	var err error
+	if a.db != nil {
+		err = a.db.Close()
+		a.db = nil
+		a.version = -1
+	}
+	return err
+}
+
+// IsOpen returns true if connection to database has been established. It does not check if
+// connection is actually live.
+func (a *adapter) IsOpen() bool {
+	return a.db != nil
+}
+
+// GetDbVersion returns current database version.
+func (a *adapter) GetDbVersion() (int, error) {
+	if a.version > 0 {
+		return a.version, nil
+	}
+
+	var vers int
+	err := a.db.QueryRow("SELECT `value` FROM kvmeta WHERE `key`='version'").Scan(&vers)
+	if err != nil {
+		if isMissingTable(err) || err == sql.ErrNoRows {
+			err = errors.New("Database not initialized")
+		}
+		return -1, err
+	}
+
+	a.version = vers
+
+	return vers, nil
+}
+
+// CheckDbVersion checks whether the actual DB version matches the expected version of this adapter.
+func (a *adapter) CheckDbVersion() error {
+	version, err := a.GetDbVersion()
+	if err != nil {
+		return err
+	}
+
+	if version != adpVersion {
+		return errors.New("Invalid database version " + strconv.Itoa(version) +
+			". Expected " + strconv.Itoa(adpVersion))
+	}
+
+	return nil
+}
+
+// Version returns adapter version.
+func (adapter) Version() int {
+	return adpVersion
+}
+
+// GetName returns string that adapter uses to register itself with store.
+func (a *adapter) GetName() string {
+	return adapterName
+}
+
+// SetMaxResults configures how many results can be returned in a single DB call.
+func (a *adapter) SetMaxResults(val int) error {
+	if val <= 0 {
+		a.maxResults = defaultMaxResults
+	} else {
+		a.maxResults = val
+	}
+
+	return nil
+}
+
+// Tables in the order of creation. Dropped in reverse order.
+var schema = []struct {
+	name  string
+	query string
+}{
+	{"users", `CREATE TABLE users(
+			id        INTEGER NOT NULL PRIMARY KEY,
+			createdat DATETIME NOT NULL,
+			updatedat DATETIME NOT NULL,
+			state     INTEGER NOT NULL DEFAULT 0,
+			stateat   DATETIME,
+			access    BLOB,
+			lastseen  DATETIME,
+			useragent TEXT DEFAULT '',
+			public    BLOB,
+			tags      BLOB
+		);
+		CREATE INDEX users_state_stateat ON users(state, stateat);`},
+	// Indexed user tags.
+	{"usertags", `CREATE TABLE usertags(
+			id     INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			userid INTEGER NOT NULL REFERENCES users(id),
+			tag    TEXT NOT NULL
+		);
+		CREATE INDEX usertags_tag ON usertags(tag);
+		CREATE UNIQUE INDEX usertags_userid_tag ON usertags(userid, tag);`},
+	// Indexed devices. Normalized into a separate table.
+	{"devices", `CREATE TABLE devices(
+			id       INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			userid   INTEGER NOT NULL REFERENCES users(id),
+			hash     TEXT NOT NULL,
+			deviceid TEXT NOT NULL,
+			platform TEXT,
+			lastseen DATETIME NOT NULL,
+			lang     TEXT
+		);
+		CREATE UNIQUE INDEX devices_hash ON devices(hash);`},
+	// Authentication records for the basic authentication scheme.
+	{"auth", `CREATE TABLE auth(
+			id      INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			uname   TEXT NOT NULL,
+			userid  INTEGER NOT NULL REFERENCES users(id),
+			scheme  TEXT NOT NULL,
+			authlvl INTEGER NOT NULL,
+			secret  BLOB NOT NULL,
+			expires DATETIME
+		);
+		CREATE UNIQUE INDEX auth_userid_scheme ON auth(userid, scheme);
+		CREATE UNIQUE INDEX auth_uname ON auth(uname);`},
+	// Topics
+	{"topics", `CREATE TABLE topics(
+			id        INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			createdat DATETIME NOT NULL,
+			updatedat DATETIME NOT NULL,
+			state     INTEGER NOT NULL DEFAULT 0,
+			stateat   DATETIME,
+			touchedat DATETIME,
+			name      TEXT NOT NULL,
+			usebt     INTEGER DEFAULT 0,
+			owner     INTEGER NOT NULL DEFAULT 0,
+			access    BLOB,
+			seqid     INTEGER NOT NULL DEFAULT 0,
+			delid     INTEGER DEFAULT 0,
+			public    BLOB,
+			tags      BLOB
+		);
+		CREATE UNIQUE INDEX topics_name ON topics(name);
+		CREATE INDEX topics_owner ON topics(owner);
+		CREATE INDEX topics_state_stateat ON topics(state, stateat);`},
+	// Indexed topic tags.
+	{"topictags", `CREATE TABLE topictags(
+			id    INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			topic TEXT NOT NULL REFERENCES topics(name),
+			tag   TEXT NOT NULL
+		);
+		CREATE INDEX topictags_tag ON topictags(tag);
+		CREATE UNIQUE INDEX topictags_topic_tag ON topictags(topic, tag);`},
+	// Subscriptions
+	{"subscriptions", `CREATE TABLE subscriptions(
+			id        INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			createdat DATETIME NOT NULL,
+			updatedat DATETIME NOT NULL,
+			deletedat DATETIME,
+			userid    INTEGER NOT NULL REFERENCES users(id),
+			topic     TEXT NOT NULL,
+			delid     INTEGER DEFAULT 0,
+			recvseqid INTEGER DEFAULT 0,
+			readseqid INTEGER DEFAULT 0,
+			modewant  TEXT,
+			modegiven TEXT,
+			private   BLOB
+		);
+		CREATE UNIQUE INDEX subscriptions_topic_userid ON subscriptions(topic, userid);
+		CREATE INDEX subscriptions_userid ON subscriptions(userid);
+		CREATE INDEX subscriptions_deletedat ON subscriptions(deletedat);`},
+	// Messages
+	{"messages", "CREATE TABLE messages(" +
+		`id        INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			createdat DATETIME NOT NULL,
+			updatedat DATETIME NOT NULL,
+			deletedat DATETIME,
+			delid     INTEGER DEFAULT 0,
+			seqid     INTEGER NOT NULL,
+			topic     TEXT NOT NULL REFERENCES topics(name),` +
+		"`from`    INTEGER NOT NULL," +
+		`head      BLOB,
+			content   BLOB
+		);
+		CREATE UNIQUE INDEX messages_topic_seqid ON messages(topic, seqid);`},
+	// Deletion log
+	{"dellog", `CREATE TABLE dellog(
+			id         INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			topic      TEXT NOT NULL REFERENCES topics(name),
+			deletedfor INTEGER NOT NULL DEFAULT 0,
+			delid      INTEGER NOT NULL,
+			low        INTEGER NOT NULL,
+			hi         INTEGER NOT NULL
+		);
+		CREATE INDEX dellog_topic_delid_deletedfor ON dellog(topic, delid, deletedfor);
+		CREATE INDEX dellog_topic_deletedfor_low_hi ON dellog(topic, deletedfor, low, hi);
+		CREATE INDEX dellog_deletedfor ON dellog(deletedfor);`},
+	// User credentials
+	{"credentials", `CREATE TABLE credentials(
+			id        INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			createdat DATETIME NOT NULL,
+			updatedat DATETIME NOT NULL,
+			deletedat DATETIME,
+			method    TEXT NOT NULL,
+			value     TEXT NOT NULL,
+			synthetic TEXT NOT NULL,
+			userid    INTEGER NOT NULL REFERENCES users(id),
+			resp      TEXT,
+			done      INTEGER NOT NULL DEFAULT 0,
+			retries   INTEGER NOT NULL DEFAULT 0
+		);
+		CREATE UNIQUE INDEX credentials_uniqueness ON credentials(synthetic);`},
+	// Records of uploaded files.
+	// Don't add FOREIGN KEY on userid. It's not needed and it will break user deletion.
+	{"fileuploads", `CREATE TABLE fileuploads(
+			id        INTEGER NOT NULL PRIMARY KEY,
+			createdat DATETIME NOT NULL,
+			updatedat DATETIME NOT NULL,
+			userid    INTEGER NOT NULL,
+			status    INTEGER NOT NULL,
+			mimetype  TEXT NOT NULL,
+			size      INTEGER NOT NULL,
+			location  TEXT NOT NULL
+		);`},
+	// Links between uploaded files and the messages they are attached to.
+	{"filemsglinks", `CREATE TABLE filemsglinks(
+			id        INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			createdat DATETIME NOT NULL,
+			fileid    INTEGER NOT NULL REFERENCES fileuploads(id) ON DELETE CASCADE,
+			msgid     INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE
+		);
+		CREATE INDEX filemsglinks_fileid ON filemsglinks(fileid);
+		CREATE INDEX filemsglinks_msgid ON filemsglinks(msgid);`},
+	{"kvmeta", "CREATE TABLE kvmeta(`key` TEXT NOT NULL PRIMARY KEY, `value` TEXT);"},
+}
+
+// CreateDb initializes the storage. If reset is true the existing tables are dropped first,
+// otherwise an error is returned if the database already exists.
+func (a *adapter) CreateDb(reset bool) error {
+	if !reset {
+		if _, err := a.GetDbVersion(); err == nil {
+			return errors.New("Database already exists")
+		}
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	a.version = -1
+	for i := len(schema) - 1; i >= 0; i-- {
+		if _, err = tx.Exec("DROP TABLE IF EXISTS " + schema[i].name); err != nil {
+			return err
+		}
+	}
+
+	for _, table := range schema {
+		if _, err = tx.Exec(table.query); err != nil {
+			return err
+		}
+	}
+
+	if _, err = tx.Exec("INSERT INTO kvmeta(`key`, `value`) VALUES('version', ?)", adpVersion); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpgradeDb upgrades the database, if necessary. This is the first version of the
+// SQLite schema, nothing to upgrade yet.
+func (a *adapter) UpgradeDb() error {
+	if _, err := a.GetDbVersion(); err != nil {
+		return err
+	}
+
+	if a.version != adpVersion {
+		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
+			". DB is still at " + strconv.Itoa(a.version))
+	}
+	return nil
+}
+
+func addTags(tx *sql.Tx, table, keyName string, keyVal interface{}, tags []string, ignoreDups bool) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	insert, err := tx.Prepare("INSERT INTO " + table + "(" + keyName + ",tag) VALUES(?,?)")
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	for _, tag := range tags {
+		_, err = insert.Exec(keyVal, tag)
+
+		if err != nil {
+			if isDupe(err) {
+				if ignoreDups {
+					continue
+				}
+				return t.ErrDuplicate
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func removeTags(tx *sql.Tx, table, keyName string, keyVal interface{}, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	args := []interface{}{keyVal}
+	for _, tag := range tags {
+		args = append(args, tag)
+	}
+
+	_, err := tx.Exec("DELETE FROM "+table+" WHERE "+keyName+"=? AND tag IN ("+placeholders(len(tags))+")",
+		args...)
+
+	return err
+}
+
+// UserCreate creates a new user.
+func (a *adapter) UserCreate(user *t.User) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	decoded_uid := store.DecodeUid(user.Uid())
+	if _, err = tx.Exec("INSERT INTO users(id,createdat,updatedat,state,access,public,tags) VALUES(?,?,?,?,?,?,?)",
+		decoded_uid,
+		user.CreatedAt, user.UpdatedAt,
+		user.State, user.Access,
+		toJSON(user.Public), user.Tags); err != nil {
+		if isDupe(err) {
+			err = t.ErrDuplicate
+		}
+		return err
+	}
+
+	// Save user's tags to a separate table to make user findable.
+	if err = addTags(tx, "usertags", "userid", decoded_uid, user.Tags, false); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AuthAddRecord adds user's authentication record.
+func (a *adapter) AuthAddRecord(uid t.Uid, scheme, unique string, authLvl auth.Level,
+	secret []byte, expires time.Time) error {
+
+	_, err := a.db.Exec("INSERT INTO auth(uname,userid,scheme,authLvl,secret,expires) VALUES(?,?,?,?,?,?)",
+		unique, store.DecodeUid(uid), scheme, authLvl, secret, nullTime(expires))
+	if err != nil {
+		if isDupe(err) {
+			return t.ErrDuplicate
+		}
+		return err
+	}
+	return nil
+}
+
+// AuthDelScheme deletes an existing authentication scheme for the user.
+func (a *adapter) AuthDelScheme(user t.Uid, scheme string) error {
+	_, err := a.db.Exec("DELETE FROM auth WHERE userid=? AND scheme=?", store.DecodeUid(user), scheme)
+	return err
+}
+
+// AuthUpdRecord updates user's authentication secret.
+func (a *adapter) AuthUpdRecord(uid t.Uid, scheme, unique string, authLvl auth.Level,
+	secret []byte, expires time.Time) error {
+
+	_, err := a.db.Exec("UPDATE auth SET uname=?,authLvl=?,secret=?,expires=? WHERE userid=? AND scheme=?",
+		unique, authLvl, secret, nullTime(expires), store.DecodeUid(uid), scheme)
+	if isDupe(err) {
+		return t.ErrDuplicate
+	}
+
+	return err
+}
+
+// AuthGetRecord retrieves user's authentication record.
+func (a *adapter) AuthGetRecord(uid t.Uid, scheme string) (string, auth.Level, []byte, time.Time, error) {
+	var expires time.Time
+
+	var unique string
+	var authLvl auth.Level
+	var secret []byte
+	var exp *time.Time
+	if err := a.db.QueryRow("SELECT uname,secret,expires,authlvl FROM auth WHERE userid=? AND scheme=?",
+		store.DecodeUid(uid), scheme).Scan(&unique, &secret, &exp, &authLvl); err != nil {
+		if err == sql.ErrNoRows {
+			// Nothing found - clear the error
+			err = nil
+		}
+		return "", 0, nil, expires, err
+	}
+
+	if exp != nil {
+		expires = *exp
+	}
+
+	return unique, authLvl, secret, expires, nil
+}
+
+// AuthGetUniqueRecord retrieves user's authentication record by unique value.
+func (a *adapter) AuthGetUniqueRecord(unique string) (t.Uid, auth.Level, []byte, time.Time, error) {
+	var expires time.Time
+
+	var userId int64
+	var authLvl auth.Level
+	var secret []byte
+	var exp *time.Time
+	if err := a.db.QueryRow("SELECT userid,secret,expires,authlvl FROM auth WHERE uname=?",
+		unique).Scan(&userId, &secret, &exp, &authLvl); err != nil {
+		if err == sql.ErrNoRows {
+			// Nothing found - clear the error
+			err = nil
+		}
+		return t.ZeroUid, 0, nil, expires, err
+	}
+
+	if exp != nil {
+		expires = *exp
+	}
+
+	return store.EncodeUid(userId), authLvl, secret, expires, nil
+}
+
+// AuthGetInactive returns IDs of users with the given auth scheme who were not seen since lastSeenBefore.
+func (a *adapter) AuthGetInactive(scheme string, lastSeenBefore time.Time, limit int) ([]t.Uid, error) {
+	query := "SELECT u.id FROM auth AS a JOIN users AS u ON u.id=a.userid " +
+		"WHERE a.scheme=? AND u.state!=? AND IFNULL(u.lastseen,u.createdat)<? " +
+		"ORDER BY IFNULL(u.lastseen,u.createdat)"
+	// Timestamps are stored as UTC strings.
+	args := []interface{}{scheme, t.StateDeleted, lastSeenBefore.UTC()}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uids []t.Uid
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		uids = append(uids, store.EncodeUid(id))
+	}
+	return uids, rows.Err()
+}
+
+const userCols = "id,createdat,updatedat,state,stateat,access,lastseen,useragent,public,tags"
+
+func scanUser(row scanner) (*t.User, error) {
+	var user t.User
+	var id int64
+	var access, public, tags []byte
+	if err := row.Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.State, &user.StateAt, &access,
+		&user.LastSeen, &user.UserAgent, &public, &tags); err != nil {
+		return nil, err
+	}
+	user.SetUid(store.EncodeUid(id))
+	fromJSONTo(access, &user.Access)
+	user.Public = fromJSON(public)
+	fromJSONTo(tags, &user.Tags)
+	return &user, nil
+}
+
+// UserGet fetches a single user by user id. If user is not found it returns (nil, nil)
+func (a *adapter) UserGet(uid t.Uid) (*t.User, error) {
+	user, err := scanUser(a.db.QueryRow("SELECT "+userCols+" FROM users WHERE id=? AND state!=?",
+		store.DecodeUid(uid), t.StateDeleted))
+	if err == sql.ErrNoRows {
+		// Clear the error if user does not exist or marked as soft-deleted.
+		return nil, nil
+	}
+	return user, err
+}
+
+// UserGetAll returns user records for a given list of user IDs. Deleted users are skipped.
+func (a *adapter) UserGetAll(ids ...t.Uid) ([]t.User, error) {
+	users := []t.User{}
+	if len(ids) == 0 {
+		return users, nil
+	}
+
+	args := make([]interface{}, 0, len(ids)+1)
+	for _, id := range ids {
+		args = append(args, store.DecodeUid(id))
+	}
+	args = append(args, t.StateDeleted)
+
+	rows, err := a.db.Query("SELECT "+userCols+" FROM users WHERE id IN ("+placeholders(len(ids))+") AND state!=?",
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user *t.User
+		if user, err = scanUser(rows); err != nil {
+			return nil, err
+		}
+		users = append(users, *user)
+	}
+
+	return users, rows.Err()
+}
+
+// UserDelete deletes specified user: wipes completely (hard-delete) or marks as deleted.
+func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	decoded_uid := store.DecodeUid(uid)
+
+	if hard {
+		// Delete user's devices
+		// t.ErrNotFound = user has no devices.
+		if err = deviceDelete(tx, uid, ""); err != nil && err != t.ErrNotFound {
+			return err
+		}
+
+		// Delete user's subscriptions in all topics.
+		if err = subsDelForUser(tx, uid, true); err != nil {
+			return err
+		}
+
+		// Delete records of messages soft-deleted for the user.
+		if _, err = tx.Exec("DELETE FROM dellog WHERE deletedfor=?", decoded_uid); err != nil {
+			return err
+		}
+
+		// Can't delete user's messages in all topics because we cannot notify topics of such deletion.
+		// Just leave the messages there marked as sent by "not found" user.
+
+		// Delete topics where the user is the owner.
+		ownTopics := "SELECT name FROM topics WHERE owner=?"
+
+		// First delete all messages in those topics.
+		if _, err = tx.Exec("DELETE FROM dellog WHERE topic IN ("+ownTopics+")", decoded_uid); err != nil {
+			return err
+		}
+		// filemsglinks will be deleted because of ON DELETE CASCADE
+		if _, err = tx.Exec("DELETE FROM messages WHERE topic IN ("+ownTopics+")", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete all subscriptions.
+		if _, err = tx.Exec("DELETE FROM subscriptions WHERE topic IN ("+ownTopics+")", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete topic tags
+		if _, err = tx.Exec("DELETE FROM topictags WHERE topic IN ("+ownTopics+")", decoded_uid); err != nil {
+			return err
+		}
+
+		// And finally delete the topics.
+		if _, err = tx.Exec("DELETE FROM topics WHERE owner=?", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete user's authentication records.
+		if _, err = tx.Exec("DELETE FROM auth WHERE userid=?", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete all credentials.
+		if err = credDel(tx, uid, "", ""); err != nil && err != t.ErrNotFound {
+			return err
+		}
+
+		if _, err = tx.Exec("DELETE FROM usertags WHERE userid=?", decoded_uid); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec("DELETE FROM users WHERE id=?", decoded_uid); err != nil {
+			return err
+		}
+	} else {
+		now := t.TimeNow()
+		// Disable all user's subscriptions. That includes p2p subscriptions. No need to delete them.
+		if err = subsDelForUser(tx, uid, false); err != nil {
+			return err
+		}
+
+		// Disable all subscriptions to topics where the user is the owner.
+		if _, err = tx.Exec("UPDATE subscriptions SET updatedat=?,deletedat=? "+
+			"WHERE topic IN (SELECT name FROM topics WHERE owner=?)",
+			now, now, decoded_uid); err != nil {
+			return err
+		}
+		// Disable group topics where the user is the owner.
+		if _, err = tx.Exec("UPDATE topics SET updatedat=?,state=?,stateat=? WHERE owner=?",
+			now, t.StateDeleted, now, decoded_uid); err != nil {
+			return err
+		}
+		// Disable p2p topics with the user (p2p topic's owner is 0).
+		if _, err = tx.Exec("UPDATE topics SET updatedat=?,state=?,stateat=? "+
+			"WHERE owner=0 AND name IN (SELECT topic FROM subscriptions WHERE userid=?)",
+			now, t.StateDeleted, now, decoded_uid); err != nil {
+			return err
+		}
+
+		// Disable the other user's subscription to a disabled p2p topic.
+		if _, err = tx.Exec("UPDATE subscriptions SET updatedat=?,deletedat=? "+
+			"WHERE deletedat IS NULL AND topic IN (SELECT s.topic FROM subscriptions AS s "+
+			"JOIN topics ON topics.name=s.topic WHERE topics.owner=0 AND s.userid=?)",
+			now, now, decoded_uid); err != nil {
+			return err
+		}
+
+		// Disable user.
+		if _, err = tx.Exec("UPDATE users SET updatedat=?,state=?,stateat=? WHERE id=?",
+			now, t.StateDeleted, now, decoded_uid); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// topicStateForUser is called by UserUpdate when the update contains state change.
+func (a *adapter) topicStateForUser(tx *sql.Tx, decoded_uid int64, now time.Time, update interface{}) error {
+	var err error
+
+	state, ok := update.(t.ObjState)
+	if !ok {
+		return t.ErrMalformed
+	}
+
+	if now.IsZero() {
+		now = t.TimeNow()
+	}
+
+	// Change state of all topics where the user is the owner.
+	if _, err = tx.Exec("UPDATE topics SET state=?,stateat=? WHERE owner=? AND state!=?",
+		state, now, decoded_uid, t.StateDeleted); err != nil {
+		return err
+	}
+
+	// Change state of p2p topics with the user (p2p topic's owner is 0)
+	if _, err = tx.Exec("UPDATE topics SET state=?,stateat=? "+
+		"WHERE owner=0 AND name IN (SELECT topic FROM subscriptions WHERE userid=?) AND state!=?",
+		state, now, decoded_uid, t.StateDeleted); err != nil {
+		return err
+	}
+
+	// Subscriptions don't need to be updated:
+	// subscriptions of a disabled user are not disabled and still can be manipulated.
+
+	return nil
+}
+
+// UserUpdate updates user object.
+func (a *adapter) UserUpdate(uid t.Uid, update map[string]interface{}) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	cols, args := updateByMap(update)
+	decoded_uid := store.DecodeUid(uid)
+	args = append(args, decoded_uid)
+	_, err = tx.Exec("UPDATE users SET "+strings.Join(cols, ",")+" WHERE id=?", args...)
+	if err != nil {
+		return err
+	}
+
+	if state, ok := update["State"]; ok {
+		now, _ := update["StateAt"].(time.Time)
+		err = a.topicStateForUser(tx, decoded_uid, now, state)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Tags are also stored in a separate table
+	if tags := extractTags(update); tags != nil {
+		// First delete all user tags
+		_, err = tx.Exec("DELETE FROM usertags WHERE userid=?", decoded_uid)
+		if err != nil {
+			return err
+		}
+		// Now insert new tags
+		err = addTags(tx, "usertags", "userid", decoded_uid, tags, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UserUpdateTags adds or resets user's tags
+func (a *adapter) UserUpdateTags(uid t.Uid, add, remove, reset []string) ([]string, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	decoded_uid := store.DecodeUid(uid)
+
+	if reset != nil {
+		// Delete all tags first if resetting.
+		_, err = tx.Exec("DELETE FROM usertags WHERE userid=?", decoded_uid)
+		if err != nil {
+			return nil, err
+		}
+		add = reset
+		remove = nil
+	}
+
+	// Now insert new tags. Ignore duplicates if resetting.
+	err = addTags(tx, "usertags", "userid", decoded_uid, add, reset == nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Delete tags.
+	err = removeTags(tx, "usertags", "userid", decoded_uid, remove)
+	if err != nil {
+		return nil, err
+	}
+
+	var allTags []string
+	rows, err := tx.Query("SELECT tag FROM usertags WHERE userid=? ORDER BY id", decoded_uid)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var tag string
+		if err = rows.Scan(&tag); err != nil {
+			break
+		}
+		allTags = append(allTags, tag)
+	}
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("UPDATE users SET tags=? WHERE id=?", t.StringSlice(allTags), decoded_uid)
+	if err != nil {
+		return nil, err
+	}
+
+	return allTags, tx.Commit()
+}
+
+// UserGetByCred returns user ID for the given validated credential.
+func (a *adapter) UserGetByCred(method, value string) (t.Uid, error) {
+	var decoded_uid int64
+	err := a.db.QueryRow("SELECT userid FROM credentials WHERE synthetic=?", method+":"+value).Scan(&decoded_uid)
+	if err == nil {
+		return store.EncodeUid(decoded_uid), nil
+	}
+
+	if err == sql.ErrNoRows {
+		// Clear the error if user does not exist
+		return t.ZeroUid, nil
+	}
+	return t.ZeroUid, err
+}
+
+// UserUnreadCount returns the total number of unread messages in all topics with
+// the R permission.
+func (a *adapter) UserUnreadCount(uid t.Uid) (int, error) {
+	var count int
+	err := a.db.QueryRow("SELECT IFNULL(SUM(t.seqid)-SUM(s.readseqid),0) FROM topics AS t, subscriptions AS s "+
+		"WHERE s.userid=? AND t.name=s.topic AND s.deletedat IS NULL AND t.state!=? AND "+
+		"INSTR(s.modewant, 'R')>0 AND INSTR(s.modegiven, 'R')>0", store.DecodeUid(uid), t.StateDeleted).Scan(&count)
+	if err == nil {
+		return count, nil
+	}
+
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return -1, err
+}
+
+// *****************************
+
+func (a *adapter) topicCreate(tx *sql.Tx, topic *t.Topic) error {
+	_, err := tx.Exec("INSERT INTO topics(createdat,updatedat,touchedat,state,name,usebt,owner,access,public,tags) "+
+		"VALUES(?,?,?,?,?,?,?,?,?,?)",
+		topic.CreatedAt, topic.UpdatedAt, topic.TouchedAt, topic.State, topic.Id, topic.UseBt,
+		store.DecodeUid(t.ParseUid(topic.Owner)), topic.Access, toJSON(topic.Public), topic.Tags)
+	if err != nil {
+		if isDupe(err) {
+			err = t.ErrDuplicate
+		}
+		return err
+	}
+
+	// Save topic's tags to a separate table to make topic findable.
+	return addTags(tx, "topictags", "topic", topic.Id, topic.Tags, false)
+}
+
+// TopicCreate saves topic object to database.
+func (a *adapter) TopicCreate(topic *t.Topic) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = a.topicCreate(tx, topic)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// If undelete = true - update subscription on duplicate key, otherwise ignore the duplicate.
+func createSubscription(tx *sql.Tx, sub *t.Subscription, undelete bool) error {
+
+	isOwner := (sub.ModeGiven & sub.ModeWant).IsOwner()
+
+	jpriv := toJSON(sub.Private)
+	decoded_uid := store.DecodeUid(t.ParseUid(sub.User))
+	_, err := tx.Exec(
+		"INSERT INTO subscriptions(createdat,updatedat,deletedat,userid,topic,modeWant,modeGiven,private) "+
+			"VALUES(?,?,NULL,?,?,?,?,?)",
+		sub.CreatedAt, sub.UpdatedAt, decoded_uid, sub.Topic, sub.ModeWant.String(), sub.ModeGiven.String(), jpriv)
+
+	if err != nil && isDupe(err) {
+		if undelete {
+			_, err = tx.Exec("UPDATE subscriptions SET createdat=?,updatedat=?,deletedat=NULL,modeGiven=? "+
+				"WHERE topic=? AND userid=?",
+				sub.CreatedAt, sub.UpdatedAt, sub.ModeGiven.String(), sub.Topic, decoded_uid)
+
+		} else {
+			_, err = tx.Exec(
+				"UPDATE subscriptions SET createdat=?,updatedat=?,deletedat=NULL,modeWant=?,modeGiven=?,private=? "+
+					"WHERE topic=? AND userid=?",
+				sub.CreatedAt, sub.UpdatedAt, sub.ModeWant.String(), sub.ModeGiven.String(),
+				jpriv, sub.Topic, decoded_uid)
+		}
+	}
+	if err == nil && isOwner {
+		_, err = tx.Exec("UPDATE topics SET owner=? WHERE name=?", decoded_uid, sub.Topic)
+	}
+	return err
+}
+
+// TopicCreateP2P given two users creates a p2p topic
+func (a *adapter) TopicCreateP2P(initiator, invited *t.Subscription) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = createSubscription(tx, initiator, false)
+	if err != nil {
+		return err
+	}
+
+	err = createSubscription(tx, invited, true)
+	if err != nil {
+		return err
+	}
+
+	topic := &t.Topic{ObjHeader: t.ObjHeader{Id: initiator.Topic}}
+	topic.ObjHeader.MergeTimes(&initiator.ObjHeader)
+	topic.TouchedAt = initiator.GetTouchedAt()
+	err = a.topicCreate(tx, topic)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const topicCols = "createdat,updatedat,state,stateat,touchedat,name,usebt,owner,access,seqid,delid,public,tags"
+
+func scanTopic(row scanner) (*t.Topic, error) {
+	var tt t.Topic
+	var touchedAt *time.Time
+	var owner int64
+	var access, public, tags []byte
+	if err := row.Scan(&tt.CreatedAt, &tt.UpdatedAt, &tt.State, &tt.StateAt, &touchedAt, &tt.Id, &tt.UseBt,
+		&owner, &access, &tt.SeqId, &tt.DelId, &public, &tags); err != nil {
+		return nil, err
+	}
+	if touchedAt != nil {
+		tt.TouchedAt = *touchedAt
+	}
+	tt.Owner = store.EncodeUid(owner).String()
+	fromJSONTo(access, &tt.Access)
+	tt.Public = fromJSON(public)
+	fromJSONTo(tags, &tt.Tags)
+	return &tt, nil
+}
+
+// TopicGet loads a single topic by name, if it exists. If the topic does not exist the call returns (nil, nil)
+func (a *adapter) TopicGet(topic string) (*t.Topic, error) {
+	tt, err := scanTopic(a.db.QueryRow("SELECT "+topicCols+" FROM topics WHERE name=?", topic))
+	if err == sql.ErrNoRows {
+		// Nothing found - clear the error
+		return nil, nil
+	}
+	return tt, err
+}
+
+const subsCols = "createdat,updatedat,deletedat,userid,topic,delid,recvseqid,readseqid,modewant,modegiven,private"
+
+func scanSub(row scanner, extra ...interface{}) (*t.Subscription, error) {
+	var sub t.Subscription
+	var userId int64
+	var modeWant, modeGiven, private []byte
+	dest := append([]interface{}{&sub.CreatedAt, &sub.UpdatedAt, &sub.DeletedAt, &userId, &sub.Topic,
+		&sub.DelId, &sub.RecvSeqId, &sub.ReadSeqId, &modeWant, &modeGiven, &private}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	sub.User = store.EncodeUid(userId).String()
+	sub.ModeWant.UnmarshalText(modeWant)
+	sub.ModeGiven.UnmarshalText(modeGiven)
+	sub.Private = fromJSON(private)
+	return &sub, nil
+}
+
+// querySubs runs a query which selects subsCols and collects the results.
+func (a *adapter) querySubs(query string, args ...interface{}) ([]t.Subscription, error) {
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []t.Subscription
+	for rows.Next() {
+		sub, err := scanSub(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, *sub)
+	}
+	return subs, rows.Err()
+}
+
+// TopicsForUser loads user's contact list: p2p and grp topics, except for 'me' & 'fnd' subscriptions.
+// Reads and denormalizes Public value.
+func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	// Fetch user's subscriptions
+	q := "SELECT " + subsCols + " FROM subscriptions WHERE userid=?"
+	args := []interface{}{store.DecodeUid(uid)}
+	if !keepDeleted {
+		// Filter out deleted rows.
+		q += " AND deletedat IS NULL"
+	}
+
+	limit := a.maxResults
+	if opts != nil {
+		// Ignore IfModifiedSince - we must return all entries
+		// Those unmodified will be stripped of Public & Private.
+
+		if opts.Topic != "" {
+			q += " AND topic=?"
+			args = append(args, opts.Topic)
+		}
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	q += " ORDER BY topic LIMIT ?"
+	args = append(args, limit)
+
+	all, err := a.querySubs(q, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch subscriptions. Two queries are needed: users table (me & p2p) and topics table (p2p and grp).
+	// Prepare a list of Separate subscriptions to users vs topics
+	join := make(map[string]t.Subscription) // Keeping these to make a join with table for .private and .access
+	topq := make([]interface{}, 0, 16)
+	usrq := make([]interface{}, 0, 16)
+	for _, sub := range all {
+		tname := sub.Topic
+		tcat := t.GetTopicCat(tname)
+
+		// 'me' or 'fnd' subscription, skip
+		if tcat == t.TopicCatMe || tcat == t.TopicCatFnd {
+			continue
+
+			// p2p subscription, find the other user to get user.Public
+		} else if tcat == t.TopicCatP2P {
+			uid1, uid2, _ := t.ParseP2P(tname)
+			if uid1 == uid {
+				usrq = append(usrq, store.DecodeUid(uid2))
+			} else {
+				usrq = append(usrq, store.DecodeUid(uid1))
+			}
+		} else if tcat == t.TopicCatGrp {
+			// Channel readers are subscribed to 'chnXXX', the topic itself is 'grpXXX'.
+			tname = t.ChnToGrp(tname)
+		}
+		topq = append(topq, tname)
+		join[tname] = sub
+	}
+
+	var subs []t.Subscription
+	if len(topq) > 0 || len(usrq) > 0 {
+		subs = make([]t.Subscription, 0, len(join))
+	}
+
+	if len(topq) > 0 {
+		// Fetch grp & p2p topics
+		q = "SELECT " + topicCols + " FROM topics WHERE name IN (" + placeholders(len(topq)) + ")"
+		// Optionally skip deleted topics.
+		if !keepDeleted {
+			q += " AND state!=?"
+			topq = append(topq, t.StateDeleted)
+		}
+		q += " ORDER BY name"
+		rows, err := a.db.Query(q, topq...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var top *t.Topic
+			if top, err = scanTopic(rows); err != nil {
+				break
+			}
+
+			sub := join[top.Id]
+			sub.ObjHeader.MergeTimes(&top.ObjHeader)
+			sub.SetState(top.State)
+			sub.SetTouchedAt(top.TouchedAt)
+			sub.SetSeqId(top.SeqId)
+			if t.GetTopicCat(sub.Topic) == t.TopicCatGrp {
+				// all done with a grp topic
+				sub.SetPublic(top.Public)
+				subs = append(subs, sub)
+			} else {
+				// put back the updated value of a p2p subsription, will process further below
+				join[top.Id] = sub
+			}
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Fetch p2p users and join to p2p tables
+	if len(usrq) > 0 {
+		q = "SELECT " + userCols + " FROM users WHERE id IN (" + placeholders(len(usrq)) + ")"
+		// Optionally skip deleted users.
+		if !keepDeleted {
+			q += " AND state!=?"
+			usrq = append(usrq, t.StateDeleted)
+		}
+		rows, err := a.db.Query(q, usrq...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var usr *t.User
+			if usr, err = scanUser(rows); err != nil {
+				break
+			}
+
+			uid2 := usr.Uid()
+			if sub, ok := join[uid.P2PName(uid2)]; ok {
+				if sub.GetTouchedAt().IsZero() {
+					// The p2p topic itself is missing or deleted.
+					continue
+				}
+				sub.ObjHeader.MergeTimes(&usr.ObjHeader)
+				sub.SetState(usr.State)
+				sub.SetPublic(usr.Public)
+				sub.SetWith(uid2.UserId())
+				sub.SetDefaultAccess(usr.Access.Auth, usr.Access.Anon)
+				sub.SetLastSeenAndUA(usr.LastSeen, usr.UserAgent)
+				subs = append(subs, sub)
+			}
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+	}
+
+	return subs, err
+}
+
+// UsersForTopic loads users subscribed to the given topic.
+// The difference between UsersForTopic vs SubsForTopic is that the former loads user.public,
+// the latter does not.
+func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	tcat := t.GetTopicCat(topic)
+
+	// Fetch all subscribed users. The number of users is not large
+	q := `SELECT s.createdat,s.updatedat,s.deletedat,s.userid,s.topic,s.delid,s.recvseqid,
+		s.readseqid,s.modewant,s.modegiven,s.private,u.public
+		FROM subscriptions AS s JOIN users AS u ON s.userid=u.id
+		WHERE s.topic=?`
+	args := []interface{}{topic}
+	if !keepDeleted {
+		// Filter out rows with users deleted
+		q += " AND u.state!=?"
+		args = append(args, t.StateDeleted)
+
+		// For p2p topics we must load all subscriptions including deleted.
+		// Otherwise it will be impossible to swipe Public values.
+		if tcat != t.TopicCatP2P {
+			// Filter out deleted subscriptions.
+			q += " AND s.deletedat IS NULL"
+		}
+	}
+
+	limit := a.maxResults
+	var oneUser t.Uid
+	if opts != nil {
+		// Ignore IfModifiedSince - we must return all entries
+		// Those unmodified will be stripped of Public & Private.
+
+		if !opts.User.IsZero() {
+			// For p2p topics we have to fetch both users otherwise public cannot be swapped.
+			if tcat != t.TopicCatP2P {
+				q += " AND s.userid=?"
+				args = append(args, store.DecodeUid(opts.User))
+			}
+			oneUser = opts.User
+		}
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+	q += " ORDER BY s.userid LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := a.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch subscriptions
+	var subs []t.Subscription
+	for rows.Next() {
+		var public []byte
+		var sub *t.Subscription
+		if sub, err = scanSub(rows, &public); err != nil {
+			break
+		}
+		sub.SetPublic(fromJSON(public))
+		subs = append(subs, *sub)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	if err == nil && tcat == t.TopicCatP2P && len(subs) > 0 {
+		// Swap public values of P2P topics as expected.
+		if len(subs) == 1 {
+			// The other user is deleted, nothing we can do.
+			subs[0].SetPublic(nil)
+		} else {
+			pub := subs[0].GetPublic()
+			subs[0].SetPublic(subs[1].GetPublic())
+			subs[1].SetPublic(pub)
+		}
+
+		// Remove deleted and unneeded subscriptions
+		if !keepDeleted || !oneUser.IsZero() {
+			var xsubs []t.Subscription
+			for i := range subs {
+				if (subs[i].DeletedAt != nil && !keepDeleted) || (!oneUser.IsZero() && subs[i].User != oneUser.String()) {
+					continue
+				}
+				xsubs = append(xsubs, subs[i])
+			}
+			subs = xsubs
+		}
+	}
+
+	return subs, err
+}
+
+// OwnTopics loads a slice of topic names where the user is the owner.
+func (a *adapter) OwnTopics(uid t.Uid) ([]string, error) {
+	rows, err := a.db.Query("SELECT name FROM topics WHERE owner=? ORDER BY name", store.DecodeUid(uid))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	var name string
+	for rows.Next() {
+		if err = rows.Scan(&name); err != nil {
+			break
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+
+	return names, err
+}
+
+// TopicShare creates topic subscriptions.
+func (a *adapter) TopicShare(shares []*t.Subscription) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	for _, sub := range shares {
+		err = createSubscription(tx, sub, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// TopicDelete deletes specified topic.
+func (a *adapter) TopicDelete(topic string, hard bool) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if hard {
+		// Subscriptions of channel readers are deleted too.
+		if _, err = tx.Exec("DELETE FROM subscriptions WHERE topic=? OR topic=?", topic, t.GrpToChn(topic)); err != nil {
+			return err
+		}
+
+		if err = messageDeleteList(tx, topic, nil); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec("DELETE FROM topictags WHERE topic=?", topic); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec("DELETE FROM topics WHERE name=?", topic); err != nil {
+			return err
+		}
+	} else {
+		now := t.TimeNow()
+		if _, err = tx.Exec("UPDATE subscriptions SET updatedat=?,deletedat=? WHERE topic=? OR topic=?",
+			now, now, topic, t.GrpToChn(topic)); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec("UPDATE topics SET updatedat=?,state=?,stateat=? WHERE name=?",
+			now, t.StateDeleted, now, topic); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// TopicUpdateOnMessage updates topic's SeqId and TouchedAt.
+func (a *adapter) TopicUpdateOnMessage(topic string, msg *t.Message) error {
+	_, err := a.db.Exec("UPDATE topics SET seqid=?,touchedat=? WHERE name=?", msg.SeqId, msg.CreatedAt, topic)
+
+	return err
+}
+
+// TopicUpdate updates topic record.
+func (a *adapter) TopicUpdate(topic string, update map[string]interface{}) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	cols, args := updateByMap(update)
+	args = append(args, topic)
+	_, err = tx.Exec("UPDATE topics SET "+strings.Join(cols, ",")+" WHERE name=?", args...)
+	if err != nil {
+		return err
+	}
+
+	// Tags are also stored in a separate table
+	if tags := extractTags(update); tags != nil {
+		// First delete all user tags
+		_, err = tx.Exec("DELETE FROM topictags WHERE topic=?", topic)
+		if err != nil {
+			return err
+		}
+		// Now insert new tags
+		err = addTags(tx, "topictags", "topic", topic, tags, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// TopicOwnerChange updates topic's owner.
+func (a *adapter) TopicOwnerChange(topic string, newOwner t.Uid) error {
+	_, err := a.db.Exec("UPDATE topics SET owner=? WHERE name=?", store.DecodeUid(newOwner), topic)
+	return err
+}
+
+// SubscriptionGet reads a subscription of a user to a topic.
+func (a *adapter) SubscriptionGet(topic string, user t.Uid) (*t.Subscription, error) {
+	sub, err := scanSub(a.db.QueryRow("SELECT "+subsCols+" FROM subscriptions WHERE topic=? AND userid=?",
+		topic, store.DecodeUid(user)))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// Nothing found - clear the error
+			err = nil
+		}
+		return nil, err
+	}
+
+	if sub.DeletedAt != nil {
+		return nil, nil
+	}
+
+	return sub, nil
+}
+
+// SubsForUser loads a list of user's subscriptions to topics. Does NOT load Public value.
+func (a *adapter) SubsForUser(forUser t.Uid, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	q := "SELECT " + subsCols + " FROM subscriptions WHERE userid=?"
+	args := []interface{}{store.DecodeUid(forUser)}
+	if !keepDeleted {
+		// Filter out deleted rows.
+		q += " AND deletedat IS NULL"
+	}
+
+	limit := a.maxResults // maxResults here, not maxSubscribers
+	if opts != nil {
+		// Ignore IfModifiedSince - we must return all entries
+		// Those unmodified will be stripped of Public & Private.
+
+		if opts.Topic != "" {
+			q += " AND topic=?"
+			args = append(args, opts.Topic)
+		}
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+	q += " ORDER BY topic LIMIT ?"
+	args = append(args, limit)
+
+	return a.querySubs(q, args...)
+}
+
+// SubsForTopic fetches all subsciptions for a topic. Does NOT load Public value.
+// The difference between UsersForTopic vs SubsForTopic is that the former loads user.public,
+// the latter does not.
+func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	q := "SELECT " + subsCols + " FROM subscriptions WHERE topic=?"
+	args := []interface{}{topic}
+	if !keepDeleted {
+		// Filter out deleted rows.
+		q += " AND deletedat IS NULL"
+	}
+	limit := a.maxResults
+	if opts != nil {
+		// Ignore IfModifiedSince - we must return all entries
+		// Those unmodified will be stripped of Public & Private.
+
+		if !opts.User.IsZero() {
+			q += " AND userid=?"
+			args = append(args, store.DecodeUid(opts.User))
+		}
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	q += " ORDER BY userid LIMIT ?"
+	args = append(args, limit)
+
+	return a.querySubs(q, args...)
+}
+
+// SubsUpdate updates one or multiple subscriptions to a topic.
+func (a *adapter) SubsUpdate(topic string, user t.Uid, update map[string]interface{}) error {
+	cols, args := updateByMap(update)
+	q := "UPDATE subscriptions SET " + strings.Join(cols, ",") + " WHERE topic=?"
+	args = append(args, topic)
+	if !user.IsZero() {
+		// Update just one topic subscription
+		q += " AND userid=?"
+		args = append(args, store.DecodeUid(user))
+	}
+
+	_, err := a.db.Exec(q, args...)
+	return err
+}
+
+// SubsDelete marks subscription as deleted.
+func (a *adapter) SubsDelete(topic string, user t.Uid) error {
+	now := t.TimeNow()
+	res, err := a.db.Exec(
+		"UPDATE subscriptions SET updatedat=?,deletedat=? WHERE topic=? AND userid=? AND deletedat IS NULL",
+		now, now, topic, store.DecodeUid(user))
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err == nil && affected == 0 {
+		err = t.ErrNotFound
+	}
+	return err
+}
+
+// subsDelForUser marks user's subscriptions as deleted
+func subsDelForUser(tx *sql.Tx, user t.Uid, hard bool) error {
+	var err error
+	if hard {
+		_, err = tx.Exec("DELETE FROM subscriptions WHERE userid=?", store.DecodeUid(user))
+	} else {
+		now := t.TimeNow()
+		_, err = tx.Exec("UPDATE subscriptions SET updatedat=?,deletedat=? WHERE userid=? AND deletedat IS NULL",
+			now, now, store.DecodeUid(user))
+	}
+	return err
+}
+
+// findQuery builds a query which finds records by tags. Records are sorted by the number of
+// matched tags from high to low.
+func findQuery(query, tagCol string, req [][]string, opt []string) (string, []interface{}, map[string]struct{}) {
+	index := make(map[string]struct{})
+	args := []interface{}{t.StateOK}
+	allReq := t.FlattenDoubleSlice(req)
+	for _, tag := range append(allReq, opt...) {
+		args = append(args, tag)
+		index[tag] = struct{}{}
+	}
+
+	query += " IN (" + placeholders(len(allReq)+len(opt)) + ") " + "GROUP BY 1 "
+	if len(allReq) > 0 {
+		query += "HAVING"
+		first := true
+		for _, reqDisjunction := range req {
+			if len(reqDisjunction) > 0 {
+				if !first {
+					query += " AND"
+				} else {
+					first = false
+				}
+				// At least one of the tags must be present.
+				query += " COUNT(" + tagCol + " IN (" + placeholders(len(reqDisjunction)) + ") OR NULL)>=1 "
+				for _, tag := range reqDisjunction {
+					args = append(args, tag)
+				}
+			}
+		}
+	}
+	query += "ORDER BY matches DESC LIMIT ?"
+
+	return query, args, index
+}
+
+// FindUsers returns a list of users who match given tags, such as "email:jdoe@example.com" or "tel:+18003287448".
+// Searching the 'users.Tags' for the given tags using respective index.
+func (a *adapter) FindUsers(uid t.Uid, req [][]string, opt []string) ([]t.Subscription, error) {
+	if len(t.FlattenDoubleSlice(req))+len(opt) == 0 {
+		return nil, nil
+	}
+
+	query, args, index := findQuery("SELECT u.id,u.createdat,u.updatedat,u.access,u.public,u.tags,COUNT(*) AS matches "+
+		"FROM users AS u LEFT JOIN usertags AS t ON t.userid=u.id "+
+		"WHERE u.state=? AND t.tag", "t.tag", req, opt)
+
+	// Get users matched by tags, sort by number of matches from high to low.
+	rows, err := a.db.Query(query, append(args, a.maxResults)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var userId int64
+	var public, access, userTags []byte
+	var ignored int
+	var subs []t.Subscription
+	thisUser := store.DecodeUid(uid)
+	for rows.Next() {
+		var sub t.Subscription
+		if err = rows.Scan(&userId, &sub.CreatedAt, &sub.UpdatedAt, &access, &public, &userTags, &ignored); err != nil {
+			subs = nil
+			break
+		}
+
+		if userId == thisUser {
+			// Skip the callee
+			continue
+		}
+		sub.User = store.EncodeUid(userId).String()
+		sub.SetPublic(fromJSON(public))
+		var acc t.DefaultAccess
+		fromJSONTo(access, &acc)
+		sub.SetDefaultAccess(acc.Auth, acc.Anon)
+		sub.Private = foundTags(userTags, index)
+		subs = append(subs, sub)
+	}
+	rows.Close()
+
+	return subs, err
+}
+
+// FindTopics returns a list of topics with matching tags.
+// Searching the 'topics.Tags' for the given tags using respective index.
+func (a *adapter) FindTopics(req [][]string, opt []string) ([]t.Subscription, error) {
+	if len(t.FlattenDoubleSlice(req))+len(opt) == 0 {
+		return nil, nil
+	}
+
+	query, args, index := findQuery("SELECT t.name AS topic,t.createdat,t.updatedat,t.access,t.public,t.tags,"+
+		"COUNT(*) AS matches FROM topics AS t LEFT JOIN topictags AS tt ON t.name=tt.topic "+
+		"WHERE t.state=? AND tt.tag", "tt.tag", req, opt)
+
+	rows, err := a.db.Query(query, append(args, a.maxResults)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var public, access, topicTags []byte
+	var ignored int
+	var subs []t.Subscription
+	for rows.Next() {
+		var sub t.Subscription
+		if err = rows.Scan(&sub.Topic, &sub.CreatedAt, &sub.UpdatedAt, &access, &public, &topicTags,
+			&ignored); err != nil {
+			subs = nil
+			break
+		}
+
+		sub.SetPublic(fromJSON(public))
+		var acc t.DefaultAccess
+		fromJSONTo(access, &acc)
+		sub.SetDefaultAccess(acc.Auth, acc.Anon)
+		sub.Private = foundTags(topicTags, index)
+		subs = append(subs, sub)
+	}
+	rows.Close()
+
+	if err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
+
+// foundTags returns the tags which were used in the search query.
+func foundTags(tags []byte, index map[string]struct{}) []string {
+	var all []string
+	fromJSONTo(tags, &all)
+	found := make([]string, 0, 1)
+	for _, tag := range all {
+		if _, ok := index[tag]; ok {
+			found = append(found, tag)
+		}
+	}
+	return found
+}
+
+// Messages
+
+// MessageSave saves message to database.
+func (a *adapter) MessageSave(msg *t.Message) error {
+	// store assignes message ID, but we don't use it. Message IDs are not used anywhere.
+	// Using a sequential ID provided by the database.
+	res, err := a.db.Exec(
+		"INSERT INTO messages(createdAt,updatedAt,seqid,topic,`from`,head,content) VALUES(?,?,?,?,?,?,?)",
+		msg.CreatedAt, msg.UpdatedAt, msg.SeqId, msg.Topic,
+		store.DecodeUid(t.ParseUid(msg.From)), toJSON(msg.Head), toJSON(msg.Content))
+	if err == nil {
+		id, _ := res.LastInsertId()
+		// Replacing ID given by store by ID given by the DB.
+		msg.SetUid(t.Uid(id))
+	} else if isDupe(err) {
+		err = t.ErrDuplicate
+	}
+	return err
+}
+
+// MessageGetAll returns messages matching the query, newest first.
+func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.Message, error) {
+	var limit = a.maxMessageResults
+	var lower = 0
+	var upper = 1<<31 - 1
+
+	if opts != nil {
+		if opts.Since > 0 {
+			lower = opts.Since
+		}
+		if opts.Before > 0 {
+			// BETWEEN is inclusive-inclusive, Tinode API requires inclusive-exclusive, thus -1
+			upper = opts.Before - 1
+		}
+
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	unum := store.DecodeUid(forUser)
+	rows, err := a.db.Query(
+		"SELECT m.id,m.createdat,m.updatedat,m.deletedat,m.delid,m.seqid,m.topic,m.`from`,m.head,m.content"+
+			" FROM messages AS m LEFT JOIN dellog AS d"+
+			" ON d.topic=m.topic AND m.seqid BETWEEN d.low AND d.hi-1 AND d.deletedfor=?"+
+			" WHERE m.delid=0 AND m.topic=? AND m.seqid BETWEEN ? AND ? AND d.deletedfor IS NULL"+
+			" ORDER BY m.seqid DESC LIMIT ?",
+		unum, topic, lower, upper, limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]t.Message, 0, limit)
+	for rows.Next() {
+		var msg t.Message
+		var id, from int64
+		var head, content []byte
+		if err = rows.Scan(&id, &msg.CreatedAt, &msg.UpdatedAt, &msg.DeletedAt, &msg.DelId, &msg.SeqId,
+			&msg.Topic, &from, &head, &content); err != nil {
+			break
+		}
+		msg.SetUid(t.Uid(id))
+		msg.From = store.EncodeUid(from).String()
+		fromJSONTo(head, &msg.Head)
+		msg.Content = fromJSON(content)
+		msgs = append(msgs, msg)
+	}
+	rows.Close()
+	return msgs, err
+}
+
+// MessageGetDeleted returns ranges of deleted messages.
+func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.DelMessage, error) {
+	var limit = a.maxResults
+	var lower = 0
+	var upper = 1<<31 - 1
+
+	if opts != nil {
+		if opts.Since > 0 {
+			lower = opts.Since
+		}
+		if opts.Before > 1 {
+			// DelRange is inclusive-exclusive, while BETWEEN is inclusive-inclisive.
+			upper = opts.Before - 1
+		}
+
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	// Fetch log of deletions
+	rows, err := a.db.Query("SELECT topic,deletedfor,delid,low,hi FROM dellog WHERE topic=? AND delid BETWEEN ? AND ?"+
+		" AND (deletedFor=0 OR deletedFor=?)"+
+		" ORDER BY delid,id LIMIT ?", topic, lower, upper, store.DecodeUid(forUser), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dellog struct {
+		Topic      string
+		Deletedfor int64
+		Delid      int
+		Low        int
+		Hi         int
+	}
+
+	var dmsgs []t.DelMessage
+	var dmsg t.DelMessage
+	for rows.Next() {
+		if err = rows.Scan(&dellog.Topic, &dellog.Deletedfor, &dellog.Delid, &dellog.Low, &dellog.Hi); err != nil {
+			dmsgs = nil
+			break
+		}
+
+		if dellog.Delid != dmsg.DelId {
+			if dmsg.DelId > 0 {
+				dmsgs = append(dmsgs, dmsg)
+			}
+			dmsg.DelId = dellog.Delid
+			dmsg.Topic = dellog.Topic
+			if dellog.Deletedfor > 0 {
+				dmsg.DeletedFor = store.EncodeUid(dellog.Deletedfor).String()
+			} else {
+				dmsg.DeletedFor = ""
+			}
+			dmsg.SeqIdRanges = nil
+		}
+		if dellog.Hi <= dellog.Low+1 {
+			dellog.Hi = 0
+		}
+		dmsg.SeqIdRanges = append(dmsg.SeqIdRanges, t.Range{Low: dellog.Low, Hi: dellog.Hi})
+	}
+
+	if err == nil {
+		if dmsg.DelId > 0 {
+			dmsgs = append(dmsgs, dmsg)
+		}
+	}
+
+	return dmsgs, err
+}
+
+func messageDeleteList(tx *sql.Tx, topic string, toDel *t.DelMessage) error {
+	var err error
+	if toDel == nil {
+		// Whole topic is being deleted, thus also deleting all messages.
+		_, err = tx.Exec("DELETE FROM dellog WHERE topic=?", topic)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM messages WHERE topic=?", topic)
+		}
+		// filemsglinks will be deleted because of ON DELETE CASCADE
+
+	} else {
+		// Only some messages are being deleted
+		// Start with making log entries
+		forUser := store.DecodeUid(t.ParseUid(toDel.DeletedFor))
+		var insert *sql.Stmt
+		if insert, err = tx.Prepare(
+			"INSERT INTO dellog(topic,deletedfor,delid,low,hi) VALUES(?,?,?,?,?)"); err != nil {
+			return err
+		}
+		defer insert.Close()
+
+		// Counter of deleted messages
+		seqCount := 0
+		for _, rng := range toDel.SeqIdRanges {
+			if rng.Hi == 0 {
+				// Dellog must contain valid Low and *Hi*.
+				rng.Hi = rng.Low + 1
+			}
+			seqCount += rng.Hi - rng.Low
+			if _, err = insert.Exec(topic, forUser, toDel.DelId, rng.Low, rng.Hi); err != nil {
+				break
+			}
+		}
+
+		if err == nil && toDel.DeletedFor == "" {
+			// Hard-deleting messages requires updates to the messages table
+			where := "topic=? AND "
+			args := []interface{}{topic}
+			if len(toDel.SeqIdRanges) > 1 || toDel.SeqIdRanges[0].Hi == 0 {
+				for _, r := range toDel.SeqIdRanges {
+					if r.Hi == 0 {
+						args = append(args, r.Low)
+					} else {
+						for i := r.Low; i < r.Hi; i++ {
+							args = append(args, i)
+						}
+					}
+				}
+
+				where += "seqid IN (" + placeholders(seqCount) + ")"
+			} else {
+				// Optimizing for a special case of single range low..hi.
+				where += "seqid BETWEEN ? AND ?"
+				// BETWEEN is inclusive-inclusive thus decrement Hi by 1.
+				args = append(args, toDel.SeqIdRanges[0].Low, toDel.SeqIdRanges[0].Hi-1)
+			}
+			where += " AND deletedat IS NULL"
+
+			_, err = tx.Exec("DELETE FROM filemsglinks WHERE msgid IN (SELECT id FROM messages WHERE "+
+				where+")", args...)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec("UPDATE messages SET deletedat=?,delid=?,head=NULL,content=NULL WHERE "+
+				where,
+				append([]interface{}{t.TimeNow(), toDel.DelId}, args...)...)
+		}
+	}
+
+	return err
+}
+
+// MessageDeleteList deletes messages in the given topic with seqIds from the list
+func (a *adapter) MessageDeleteList(topic string, toDel *t.DelMessage) (err error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err = messageDeleteList(tx, topic, toDel); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MessageAttachments connects given message to a list of file record IDs.
+func (a *adapter) MessageAttachments(msgId t.Uid, fids []string) error {
+	var args []interface{}
+	for _, fid := range fids {
+		id := t.ParseUid(fid)
+		if id.IsZero() {
+			return t.ErrMalformed
+		}
+		args = append(args, store.DecodeUid(id))
+	}
+	if len(args) == 0 {
+		return t.ErrMalformed
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	now := t.TimeNow()
+	for _, fid := range args {
+		if _, err = tx.Exec("INSERT INTO filemsglinks(createdat,fileid,msgid) VALUES(?,?,?)",
+			now, fid, int64(msgId)); err != nil {
+			if isForeignKey(err) {
+				err = t.ErrNotFound
+			}
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE fileuploads SET updatedat=? WHERE id IN ("+placeholders(len(args))+")",
+		append([]interface{}{now}, args...)...)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func deviceHasher(deviceID string) string {
+	// Generate custom key as [64-bit hash of device id] to ensure predictable
+	// length of the key
+	hasher := fnv.New64()
+	hasher.Write([]byte(deviceID))
+	return strconv.FormatUint(uint64(hasher.Sum64()), 16)
+}
+
+// DeviceUpsert creates or updates a device record.
+func (a *adapter) DeviceUpsert(uid t.Uid, def *t.DeviceDef) error {
+	hash := deviceHasher(def.DeviceId)
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Ensure uniqueness of the device ID: delete all records of the device ID
+	_, err = tx.Exec("DELETE FROM devices WHERE hash=?", hash)
+	if err != nil {
+		return err
+	}
+
+	// Actually add/update DeviceId for the new user
+	_, err = tx.Exec("INSERT INTO devices(userid,hash,deviceId,platform,lastseen,lang) VALUES(?,?,?,?,?,?)",
+		store.DecodeUid(uid), hash, def.DeviceId, def.Platform, def.LastSeen, def.Lang)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeviceGetAll returns all devices for a given set of users.
+func (a *adapter) DeviceGetAll(uids ...t.Uid) (map[t.Uid][]t.DeviceDef, int, error) {
+	result := make(map[t.Uid][]t.DeviceDef)
+	if len(uids) == 0 {
+		return result, 0, nil
+	}
+
+	var unums []interface{}
+	for _, uid := range uids {
+		unums = append(unums, store.DecodeUid(uid))
+	}
+
+	rows, err := a.db.Query("SELECT userid,deviceid,platform,lastseen,lang FROM devices WHERE userid IN ("+
+		placeholders(len(unums))+") ORDER BY id", unums...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	count := 0
+	for rows.Next() {
+		var userId int64
+		var dev t.DeviceDef
+		var platform, lang sql.NullString
+		if err = rows.Scan(&userId, &dev.DeviceId, &platform, &dev.LastSeen, &lang); err != nil {
+			break
+		}
+		dev.Platform = platform.String
+		dev.Lang = lang.String
+		uid := store.EncodeUid(userId)
+		result[uid] = append(result[uid], dev)
+		count++
+	}
+	rows.Close()
+
+	return result, count, err
+}
+
+func deviceDelete(tx *sql.Tx, uid t.Uid, deviceID string) error {
+	var err error
+	var res sql.Result
+	if deviceID == "" {
+		res, err = tx.Exec("DELETE FROM devices WHERE userid=?", store.DecodeUid(uid))
+	} else {
+		res, err = tx.Exec("DELETE FROM devices WHERE userid=? AND hash=?", store.DecodeUid(uid), deviceHasher(deviceID))
+	}
+
+	if err == nil {
+		if count, _ := res.RowsAffected(); count == 0 {
+			err = t.ErrNotFound
+		}
+	}
+
+	return err
+}
+
+// DeviceDelete deletes a device record. If deviceID is empty, all user's devices are deleted.
+func (a *adapter) DeviceDelete(uid t.Uid, deviceID string) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = deviceDelete(tx, uid, deviceID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Credential management
+
+// CredUpsert adds or updates a validation record. Returns true if inserted, false if updated.
+// 1. if credential is validated:
+// 1.1 Hard-delete unconfirmed equivalent record, if exists.
+// 1.2 Insert new. Report error if duplicate.
+// 2. if credential is not validated:
+// 2.1 Check if validated equivalent exist. If so, report an error.
+// 2.2 Soft-delete all unvalidated records of the same method.
+// 2.3 Undelete existing credential. Return if successful.
+// 2.4 Insert new credential record.
+func (a *adapter) CredUpsert(cred *t.Credential) (bool, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	now := t.TimeNow()
+	userId := store.DecodeUid(t.ParseUid(cred.User))
+
+	// Enforce uniqueness: if credential is confirmed, "method:value" must be unique.
+	// if credential is not yet confirmed, "userid:method:value" is unique.
+	synth := cred.Method + ":" + cred.Value
+
+	if !cred.Done {
+		// Check if this credential is already validated.
+		var done bool
+		err = tx.QueryRow("SELECT done FROM credentials WHERE synthetic=?", synth).Scan(&done)
+		if err == nil {
+			err = t.ErrDuplicate
+			return false, err
+		}
+		if err != sql.ErrNoRows {
+			return false, err
+		}
+		// We are going to insert new record.
+		synth = cred.User + ":" + synth
+
+		// Adding new unvalidated credential. Deactivate all unvalidated records of this user and method.
+		_, err = tx.Exec("UPDATE credentials SET deletedat=? WHERE userid=? AND method=? AND done=0",
+			now, userId, cred.Method)
+		if err != nil {
+			return false, err
+		}
+		// Assume that the record exists and try to update it: undelete, update timestamp and response value.
+		var res sql.Result
+		res, err = tx.Exec("UPDATE credentials SET updatedat=?,deletedat=NULL,resp=?,done=0 WHERE synthetic=?",
+			cred.UpdatedAt, cred.Resp, synth)
+		if err != nil {
+			return false, err
+		}
+		// If record was updated, then all is fine.
+		if numrows, _ := res.RowsAffected(); numrows > 0 {
+			return false, tx.Commit()
+		}
+	} else {
+		// Hard-deleting unconformed record if it exists.
+		_, err = tx.Exec("DELETE FROM credentials WHERE synthetic=?", cred.User+":"+synth)
+		if err != nil {
+			return false, err
+		}
+	}
+	// Add new record.
+	_, err = tx.Exec("INSERT INTO credentials(createdat,updatedat,method,value,synthetic,userid,resp,done) "+
+		"VALUES(?,?,?,?,?,?,?,?)",
+		cred.CreatedAt, cred.UpdatedAt, cred.Method, cred.Value, synth, userId, cred.Resp, cred.Done)
+	if err != nil {
+		if isDupe(err) {
+			err = t.ErrDuplicate
+		}
+		return true, err
+	}
+	return true, tx.Commit()
+}
+
+// credDel deletes given validation method or all methods of the given user.
+// 1. If user is being deleted, hard-delete all records (method == "")
+// 2. If one value is being deleted:
+// 2.1 Delete it if it's valiated or if there were no attempts at validation
+// (otherwise it could be used to circumvent the limit on validation attempts).
+// 2.2 In that case mark it as soft-deleted.
+func credDel(tx *sql.Tx, uid t.Uid, method, value string) error {
+	constraints := " WHERE userid=?"
+	args := []interface{}{store.DecodeUid(uid)}
+
+	if method != "" {
+		constraints += " AND method=?"
+		args = append(args, method)
+
+		if value != "" {
+			constraints += " AND value=?"
+			args = append(args, value)
+		}
+	}
+
+	var err error
+	var res sql.Result
+	if method == "" {
+		// Case 1
+		res, err = tx.Exec("DELETE FROM credentials"+constraints, args...)
+		if err == nil {
+			if count, _ := res.RowsAffected(); count == 0 {
+				err = t.ErrNotFound
+			}
+		}
+		return err
+	}
+
+	// Case 2.1
+	res, err = tx.Exec("DELETE FROM credentials"+constraints+" AND (done=1 OR retries=0)", args...)
+	if err != nil {
+		return err
+	}
+	if count, _ := res.RowsAffected(); count > 0 {
+		return nil
+	}
+
+	// Case 2.2
+	args = append([]interface{}{t.TimeNow()}, args...)
+	res, err = tx.Exec("UPDATE credentials SET deletedat=?"+constraints, args...)
+	if err == nil {
+		if count, _ := res.RowsAffected(); count == 0 {
+			err = t.ErrNotFound
+		}
+	}
+
+	return err
+}
+
+// CredDel deletes either credentials of the given user. If method is blank all
+// credentials are removed. If value is blank all credentials of the given the
+// method are removed.
+func (a *adapter) CredDel(uid t.Uid, method, value string) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = credDel(tx, uid, method, value)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CredConfirm marks given credential method as confirmed.
+func (a *adapter) CredConfirm(uid t.Uid, method string) error {
+	res, err := a.db.Exec(
+		"UPDATE credentials SET updatedat=?,done=1,synthetic=method||':'||value "+
+			"WHERE userid=? AND method=? AND deletedat IS NULL AND done=0",
+		t.TimeNow(), store.DecodeUid(uid), method)
+	if err != nil {
+		if isDupe(err) {
+			return t.ErrDuplicate
+		}
+		return err
+	}
+	if numrows, _ := res.RowsAffected(); numrows < 1 {
+		return t.ErrNotFound
+	}
+	return nil
+}
+
+// CredFail increments failure count of the given validation method.
+func (a *adapter) CredFail(uid t.Uid, method string) error {
+	_, err := a.db.Exec("UPDATE credentials SET updatedat=?,retries=retries+1 WHERE userid=? AND method=? AND done=0",
+		t.TimeNow(), store.DecodeUid(uid), method)
+	return err
+}
+
+const credCols = "createdat,updatedat,method,value,resp,done,retries"
+
+func scanCred(row scanner, uid t.Uid) (*t.Credential, error) {
+	var cred t.Credential
+	var resp sql.NullString
+	if err := row.Scan(&cred.CreatedAt, &cred.UpdatedAt, &cred.Method, &cred.Value, &resp,
+		&cred.Done, &cred.Retries); err != nil {
+		return nil, err
+	}
+	cred.Resp = resp.String
+	cred.User = uid.String()
+	return &cred, nil
+}
+
+// CredGetActive returns currently active unvalidated credential of the given user and method.
+func (a *adapter) CredGetActive(uid t.Uid, method string) (*t.Credential, error) {
+	cred, err := scanCred(a.db.QueryRow("SELECT "+credCols+
+		" FROM credentials WHERE userid=? AND deletedat IS NULL AND method=? AND done=0",
+		store.DecodeUid(uid), method), uid)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return cred, err
+}
+
+// CredGetAll returns credential records for the given user and method, all or validated only.
+func (a *adapter) CredGetAll(uid t.Uid, method string, validatedOnly bool) ([]t.Credential, error) {
+	query := "SELECT " + credCols + " FROM credentials WHERE userid=? AND deletedat IS NULL"
+	args := []interface{}{store.DecodeUid(uid)}
+	if method != "" {
+		query += " AND method=?"
+		args = append(args, method)
+	}
+	if validatedOnly {
+		query += " AND done=1"
+	}
+	query += " ORDER BY id"
+
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credentials []t.Credential
+	for rows.Next() {
+		cred, err := scanCred(rows, uid)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, *cred)
+	}
+
+	return credentials, rows.Err()
+}
+
+// FileUploads
+
+// FileStartUpload initializes a file upload
+func (a *adapter) FileStartUpload(fd *t.FileDef) error {
+	_, err := a.db.Exec("INSERT INTO fileuploads(id,createdat,updatedat,userid,status,mimetype,size,location)"+
+		" VALUES(?,?,?,?,?,?,?,?)",
+		store.DecodeUid(fd.Uid()), fd.CreatedAt, fd.UpdatedAt,
+		store.DecodeUid(t.ParseUid(fd.User)), fd.Status, fd.MimeType, fd.Size, fd.Location)
+	if isDupe(err) {
+		return t.ErrDuplicate
+	}
+	return err
+}
+
+// FileFinishUpload marks file upload as completed, successfully or otherwise
+func (a *adapter) FileFinishUpload(fid string, status int, size int64) (*t.FileDef, error) {
+	id := t.ParseUid(fid)
+	if id.IsZero() {
+		return nil, t.ErrMalformed
+	}
+
+	fd, err := a.FileGet(fid)
+	if err != nil {
+		return nil, err
+	}
+	if fd == nil {
+		return nil, t.ErrNotFound
+	}
+
+	fd.UpdatedAt = t.TimeNow()
+	_, err = a.db.Exec("UPDATE fileuploads SET updatedat=?,status=?,size=? WHERE id=?",
+		fd.UpdatedAt, status, size, store.DecodeUid(id))
+	if err == nil {
+		fd.Status = status
+		fd.Size = size
+	} else {
+		fd = nil
+	}
+	return fd, err
+}
+
+// FileGet fetches a record of a specific file
+func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
+	id := t.ParseUid(fid)
+	if id.IsZero() {
+		return nil, t.ErrMalformed
+	}
+
+	var fd t.FileDef
+	var userId int64
+	err := a.db.QueryRow("SELECT createdat,updatedat,userid,status,mimetype,size,location "+
+		"FROM fileuploads WHERE id=?", store.DecodeUid(id)).Scan(&fd.CreatedAt, &fd.UpdatedAt, &userId,
+		&fd.Status, &fd.MimeType, &fd.Size, &fd.Location)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fd.SetUid(id)
+	fd.User = store.EncodeUid(userId).String()
+
+	return &fd, nil
+}
+
+// FileDeleteUnused deletes file upload records.
+func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	query := "SELECT fu.id,fu.location FROM fileuploads AS fu LEFT JOIN filemsglinks AS fml ON fml.fileid=fu.id WHERE fml.id IS NULL "
+	var args []interface{}
+	if !olderThan.IsZero() {
+		query += "AND fu.updatedat<? "
+		// Timestamps are stored as UTC strings.
+		args = append(args, olderThan.UTC())
+	}
+	query += "ORDER BY fu.updatedat "
+	if limit > 0 {
+		query += "LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var locations []string
+	var ids []interface{}
+	for rows.Next() {
+		var id int64
+		var loc string
+		if err = rows.Scan(&id, &loc); err != nil {
+			break
+		}
+		locations = append(locations, loc)
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ids) > 0 {
+		_, err = tx.Exec("DELETE FROM fileuploads WHERE id IN ("+placeholders(len(ids))+")", ids...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return locations, tx.Commit()
+}
+
+// Helper functions
+
+// scanner is implemented by *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// placeholders returns a comma-separated list of n query placeholders.
+func placeholders(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return "?" + strings.Repeat(",?", n-1)
+}
+
+// Check if SQLite error is a violation of a UNIQUE or PRIMARY KEY constraint.
+func isDupe(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	myerr, ok := err.(sqlite3.Error)
+	return ok && (myerr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+		myerr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+}
+
+// Check if SQLite error is a violation of a FOREIGN KEY constraint.
+func isForeignKey(err error) bool {
+	myerr, ok := err.(sqlite3.Error)
+	return ok && myerr.ExtendedCode == sqlite3.ErrConstraintForeignKey
+}
+
+func isMissingTable(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "no such table")
+}
+
+// nullTime converts zero time to NULL.
+func nullTime(tm time.Time) interface{} {
+	if tm.IsZero() {
+		return nil
+	}
+	return tm
+}
+
+// Convert to JSON before storing to the DB.
+func toJSON(src interface{}) []byte {
+	if src == nil {
+		return nil
+	}
+
+	jval, _ := json.Marshal(src)
+	return jval
+}
+
+// Deserialize JSON data from DB.
+func fromJSON(src []byte) interface{} {
+	if len(src) == 0 {
+		return nil
+	}
+	var out interface{}
+	json.Unmarshal(src, &out)
+	return out
+}
+
+// Deserialize JSON data from DB into the given object. NULL leaves the object unchanged.
+func fromJSONTo(src []byte, dst interface{}) {
+	if len(src) > 0 {
+		json.Unmarshal(src, dst)
+	}
+}
+
+// Convert update to a list of columns and arguments.
+func updateByMap(update map[string]interface{}) (cols []string, args []interface{}) {
+	for col, arg := range update {
+		col = strings.ToLower(col)
+		if col == "public" || col == "private" {
+			arg = toJSON(arg)
+		} else if mode, ok := arg.(t.AccessMode); ok {
+			// Access modes are stored as strings.
+			arg = mode.String()
+		}
+		cols = append(cols, col+"=?")
+		args = append(args, arg)
+	}
+	return
+}
+
+// If Tags field is updated, get the tags so tags table cab be updated too.
+func extractTags(update map[string]interface{}) []string {
+	var tags []string
+
+	val := update["Tags"]
+	if val != nil {
+		tags, _ = val.(t.StringSlice)
+	}
+
+	return []string(tags)
+}
+
+func init() {
+	store.RegisterAdapter(&adapter{})
+}
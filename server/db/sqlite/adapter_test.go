@@ -0,0 +1,23 @@
+// +build sqlite
+
+package sqlite
+
+import (
+	"GoChat/server/store/storetest"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAdapter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gochat-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config, _ := json.Marshal(&configType{Database: filepath.Join(dir, "test.db")})
+	storetest.Run(t, adapterName, config)
+}
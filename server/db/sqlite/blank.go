@@ -0,0 +1,7 @@
+// +build !sqlite
+
+// This file is needed for conditional compilation. It's used when
+// the build tag 'sqlite' is not defined. Otherwise the adapter.go
+// is compiled.
+
+package sqlite
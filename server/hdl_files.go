@@ -0,0 +1,189 @@
+// 大文件的上传和下载：首先验证请求，然后交给媒体处理器处理
+
+package main
+
+import (
+	"GoChat/server/store"
+	"GoChat/server/store/types"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+func largeFileServe(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+	mh := store.GetMediaHandler()
+
+	writeHttpResponse := func(msg *ServerComMessage, err error) {
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+		if err != nil {
+			logs.Warn.Println("media serve", err)
+		}
+	}
+
+	// Check authorization: either auth information or SID must be present
+	uid, challenge, err := authHttpRequest(req)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+	if challenge != nil {
+		writeHttpResponse(InfoChallenge("", now, challenge), nil)
+		return
+	}
+	if uid.IsZero() {
+		// Not authenticated
+		writeHttpResponse(ErrAuthRequired("", "", now, now), nil)
+		return
+	}
+
+	// Check if media handler requests redirection to another service.
+	if redirTo, err := mh.Redirect(req.Method, req.URL.String()); redirTo != "" {
+		wrt.Header().Set("Location", redirTo)
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		wrt.WriteHeader(http.StatusTemporaryRedirect)
+		enc.Encode(InfoFound("", "", now))
+		logs.Info.Println("media serve redirected", redirTo)
+		return
+	} else if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+
+	fd, rsc, err := mh.Download(req.URL.String())
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+
+	defer rsc.Close()
+
+	wrt.Header().Set("Content-Type", fd.MimeType)
+	wrt.Header().Set("Content-Disposition", "attachment")
+	http.ServeContent(wrt, req, "", fd.UpdatedAt, rsc)
+
+	logs.Info.Println("media served OK")
+}
+
+// largeFileReceive 通过HTTP(S)接收客户端上传的文件，交给配置的媒体处理器
+func largeFileReceive(wrt http.ResponseWriter, req *http.Request) {
+	logs.Info.Println("Upload request", req.RequestURI)
+
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+	mh := store.GetMediaHandler()
+
+	writeHttpResponse := func(msg *ServerComMessage, err error) {
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+
+		logs.Info.Println("media upload:", msg.Ctrl.Code, msg.Ctrl.Text, "/", err)
+	}
+
+	// Check if this is a POST or a PUT request.
+	if req.Method != http.MethodPost && req.Method != http.MethodPut {
+		writeHttpResponse(ErrOperationNotAllowed("", "", now), errors.New("method '"+req.Method+"' not allowed"))
+		return
+	}
+
+	if globals.maxFileUploadSize > 0 {
+		// Enforce maximum upload size.
+		req.Body = http.MaxBytesReader(wrt, req.Body, globals.maxFileUploadSize)
+	}
+
+	msgID := req.FormValue("id")
+	// Check authorization: either auth information or SID must be present
+	uid, challenge, err := authHttpRequest(req)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, msgID, "", now, nil), err)
+		return
+	}
+	if challenge != nil {
+		writeHttpResponse(InfoChallenge(msgID, now, challenge), nil)
+		return
+	}
+	if uid.IsZero() {
+		// Not authenticated
+		writeHttpResponse(ErrAuthRequired(msgID, "", now, now), nil)
+		return
+	}
+
+	// Check if uploads are handled elsewhere.
+	if redirTo, err := mh.Redirect(req.Method, req.URL.String()); redirTo != "" {
+		wrt.Header().Set("Location", redirTo)
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(http.StatusTemporaryRedirect)
+		enc.Encode(InfoFound("", "", now))
+
+		logs.Info.Println("media upload redirected", redirTo)
+		return
+	} else if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+
+	file, _, err := req.FormFile("file")
+	if err != nil {
+		if strings.Contains(err.Error(), "request body too large") {
+			writeHttpResponse(ErrTooLarge(msgID, "", now), err)
+		} else {
+			writeHttpResponse(ErrMalformed(msgID, "", now), err)
+		}
+		return
+	}
+	fdef := types.FileDef{}
+	fdef.Id = store.GetUidString()
+	fdef.InitTimes()
+	fdef.User = uid.String()
+
+	buff := make([]byte, 512)
+	if _, err = file.Read(buff); err != nil {
+		writeHttpResponse(ErrUnknown(msgID, "", now), err)
+		return
+	}
+
+	fdef.MimeType = http.DetectContentType(buff)
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		writeHttpResponse(ErrUnknown(msgID, "", now), err)
+		return
+	}
+
+	url, err := mh.Upload(&fdef, file)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, msgID, "", now, nil), err)
+		return
+	}
+
+	writeHttpResponse(NoErrParams(msgID, "", now, map[string]string{"url": url}), nil)
+}
+
+// largeFileRunGarbageCollection 定期删除没有被引用的文件
+func largeFileRunGarbageCollection(period time.Duration, block int) chan<- bool {
+	// Unbuffered stop channel. Whoever stops it must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		gcTimer := time.Tick(period)
+		for {
+			select {
+			case <-gcTimer:
+				if err := store.Files.DeleteUnused(time.Now().Add(-time.Hour), block); err != nil {
+					logs.Warn.Println("media gc:", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
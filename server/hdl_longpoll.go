@@ -0,0 +1,211 @@
+// 长轮询的处理，用于无法使用websocket的客户端
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+func (sess *Session) sendMessageLp(wrt http.ResponseWriter, msg interface{}) bool {
+	if len(sess.send) > sendQueueLimit {
+		logs.Err.Println("longPoll: outbound queue limit exceeded", sess.sid)
+		return false
+	}
+
+	if err := lpWrite(wrt, msg); err != nil {
+		logs.Err.Println("longPoll: writeOnce failed", sess.sid, err)
+		return false
+	}
+
+	return true
+}
+
+//阻塞直到send中有消息或者超时，然后将一条消息写入response
+func (sess *Session) writeOnce(wrt http.ResponseWriter, req *http.Request) {
+
+	for {
+		select {
+		case msg, ok := <-sess.send:
+			if !ok {
+				return
+			}
+			switch v := msg.(type) {
+			case *ServerComMessage: // single unserialized message
+				_, w := sess.serialize(v)
+				if !sess.sendMessageLp(wrt, w) {
+					return
+				}
+			default: // serialized message
+				if !sess.sendMessageLp(wrt, v) {
+					return
+				}
+			}
+			sess.flushDeferred()
+			return
+
+		case msg := <-sess.stop:
+			// Request to close the session. Make it unavailable.
+			globals.sessionStore.Delete(sess)
+			// Don't care if lpWrite fails.
+			if msg != nil {
+				lpWrite(wrt, msg)
+			}
+			return
+
+		case topic := <-sess.detach:
+			// Request to detach the session from a topic.
+			sess.delSub(topic)
+			// No 'return' statement here: continue waiting
+
+		case <-sess.bkgTimer.C:
+			if atomic.CompareAndSwapInt32(&sess.background, 1, 0) {
+				sess.onBackgroundTimer()
+			}
+
+		case <-time.After(pingPeriod):
+			// just write an empty packet on timeout
+			if _, err := wrt.Write([]byte{}); err != nil {
+				logs.Err.Println("longPoll: writeOnce: timout", sess.sid, err)
+			}
+			return
+
+		case <-req.Context().Done():
+			// HTTP request cancelled or connection lost.
+			return
+		}
+	}
+}
+
+func lpWrite(wrt http.ResponseWriter, msg interface{}) error {
+	// This will panic if msg is not []byte. This is intentional.
+	_, err := wrt.Write(msg.([]byte))
+	return err
+}
+
+//读取客户端POST的消息并进行处理
+func (sess *Session) readOnce(wrt http.ResponseWriter, req *http.Request) (int, error) {
+	if req.ContentLength > globals.maxMessageSize {
+		return http.StatusExpectationFailed, errors.New("request too large")
+	}
+
+	req.Body = http.MaxBytesReader(wrt, req.Body, globals.maxMessageSize)
+	raw, err := ioutil.ReadAll(req.Body)
+	if err == nil {
+		// Locking-unlocking is needed because the client may issue multiple requests in parallel.
+		// Should not affect performance
+		sess.lock.Lock()
+		sess.dispatchRaw(raw)
+		sess.lock.Unlock()
+		return 0, nil
+	}
+
+	return 0, err
+}
+
+// serveLongPoll handles long poll connections when WebSocket is not available
+// Connection could be without sid or with sid:
+//  - if sid is empty, create session, respond with the new sid and close
+//  - if sid is not empty and there is an initialized session:
+//   - GET performs long poll: blocks until a message is available or timeout
+//   - POST delivers the payload for processing and closes
+//  - if sid is not empty but there is no session, report an error
+func serveLongPoll(wrt http.ResponseWriter, req *http.Request) {
+	now := time.Now().UTC().Round(time.Millisecond)
+
+	// Use the lowest common denominator - this is a legacy handler after all (otherwise would use application/json)
+	wrt.Header().Set("Content-Type", "text/plain")
+	if globals.tlsStrictMaxAge != "" {
+		wrt.Header().Set("Strict-Transport-Security", "max-age"+globals.tlsStrictMaxAge)
+	}
+
+	enc := json.NewEncoder(wrt)
+
+	// Currently any domain is allowed to get data from the chat server
+	wrt.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Ensure the response is not cached
+	if req.ProtoAtLeast(1, 1) {
+		wrt.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate") // HTTP 1.1
+	} else {
+		wrt.Header().Set("Pragma", "no-cache") // HTTP 1.0
+	}
+	wrt.Header().Set("Expires", "0") // Proxies
+
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		wrt.WriteHeader(http.StatusMethodNotAllowed)
+		enc.Encode(ErrOperationNotAllowed("", "", now))
+		logs.Err.Println("longPoll: Invalid HTTP method", req.Method)
+		return
+	}
+
+	// Get session id
+	sid := req.FormValue("sid")
+	var sess *Session
+	if sid == "" {
+		// New session
+		var count int
+		sess, count = globals.sessionStore.NewSession(wrt, "")
+		sess.remoteAddr = getRemoteAddr(req)
+		logs.Info.Println("longPoll: session started", sess.sid, sess.remoteAddr, count)
+
+		wrt.WriteHeader(http.StatusCreated)
+		pkt := NoErrCreated(req.FormValue("id"), "", now)
+		pkt.Ctrl.Params = map[string]string{
+			"sid": sess.sid,
+		}
+		enc.Encode(pkt)
+
+		return
+	}
+
+	// Existing session
+	sess = globals.sessionStore.Get(sid)
+	if sess == nil || sess.proto != LPOLL {
+		logs.Warn.Println("longPoll: invalid or expired session id", sid)
+		wrt.WriteHeader(http.StatusForbidden)
+		enc.Encode(ErrSessionNotFound(now))
+		return
+	}
+
+	addr := getRemoteAddr(req)
+	if sess.remoteAddr != addr {
+		sess.remoteAddr = addr
+		logs.Warn.Println("longPoll: remote address changed", sid, addr)
+	}
+
+	if req.Method == http.MethodPost {
+		// Read payload and send it for processing.
+		if code, err := sess.readOnce(wrt, req); err != nil {
+			logs.Warn.Println("longPoll: readOnce failed", sess.sid, err)
+			// Failed to read request, report an error, if possible
+			if code != 0 {
+				wrt.WriteHeader(code)
+			} else {
+				wrt.WriteHeader(http.StatusBadRequest)
+			}
+			enc.Encode(ErrMalformed(req.FormValue("id"), "", now))
+		}
+		return
+	}
+
+	sess.writeOnce(wrt, req)
+}
+
+// Obtain IP address of the client.
+func getRemoteAddr(req *http.Request) string {
+	var addr string
+	if globals.useXForwardedFor {
+		addr = req.Header.Get("X-Forwarded-For")
+	}
+	if addr != "" {
+		return addr
+	}
+	return req.RemoteAddr
+}
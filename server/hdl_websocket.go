@@ -0,0 +1,223 @@
+// websocket连接的处理
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tinode/chat/server/logs"
+)
+
+const (
+	// Time allowed to write a message to the peer.
+	writeWait = 10 * time.Second
+
+	// Time allowed to read the next pong message from the peer.
+	pongWait = idleSessionTimeout
+
+	// Send pings to peer with this period. Must be less than pongWait.
+	pingPeriod = (pongWait * 9) / 10
+)
+
+func (sess *Session) closeWS() {
+	if sess.proto == WEBSOCK {
+		sess.ws.Close()
+	}
+}
+
+//从websocket中读取客户端发送的消息
+func (sess *Session) readLoop() {
+	defer func() {
+		sess.closeWS()
+		sess.connLost()
+	}()
+
+	sess.ws.SetReadLimit(globals.maxMessageSize)
+	sess.ws.SetReadDeadline(time.Now().Add(pongWait))
+	sess.ws.SetPongHandler(func(string) error {
+		sess.ws.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		// Read a ClientComMessage
+		_, raw, err := sess.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure,
+				websocket.CloseNormalClosure) {
+				logs.Err.Println("ws: readLoop", sess.sid, err)
+			}
+			return
+		}
+		sess.dispatchRaw(raw)
+		if sess.resumed != nil {
+			// The connection now belongs to the resumed session.
+			sess = sess.resumed
+		}
+	}
+}
+
+func (sess *Session) sendMessage(msg interface{}) bool {
+	if len(sess.send) > sendQueueLimit {
+		logs.Err.Println("ws: outbound queue limit exceeded", sess.sid)
+		return false
+	}
+
+	if err := wsWrite(sess.ws, sess.wsFrameType(), msg); err != nil {
+		if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure,
+			websocket.CloseNormalClosure) {
+			logs.Err.Println("ws: writeLoop", sess.sid, err)
+		}
+		return false
+	}
+	return true
+}
+
+//将send中的消息写入websocket，同时定时发送ping包
+func (sess *Session) writeLoop() {
+	ticker := time.NewTicker(pingPeriod)
+	// The session was resumed by another connection, this connection must not be closed.
+	var handedOver bool
+
+	defer func() {
+		ticker.Stop()
+		if !handedOver {
+			// Break readLoop.
+			sess.closeWS()
+		}
+	}()
+
+	for {
+		select {
+		case msg, ok := <-sess.send:
+			if !ok {
+				// Channel closed.
+				return
+			}
+			switch v := msg.(type) {
+			case *ServerComMessage: // single unserialized message
+				_, w := sess.serialize(v)
+				if !sess.sendMessage(w) {
+					handedOver = sess.writeFailed()
+					return
+				}
+			default: // serialized message
+				if !sess.sendMessage(v) {
+					handedOver = sess.writeFailed()
+					return
+				}
+			}
+			sess.flushDeferred()
+
+		case msg := <-sess.stop:
+			if next, ok := msg.(*Session); ok {
+				// A suspended session was resumed on this connection.
+				sess = next
+				continue
+			}
+			// Shutdown requested, don't care if the message is delivered.
+			// The session is stopped by the server and must not be suspended when the read loop
+			// finds the connection closed.
+			atomic.StoreInt32(&sess.terminating, 1)
+			if msg != nil {
+				wsWrite(sess.ws, sess.wsFrameType(), msg)
+			}
+			return
+
+		case topic := <-sess.detach:
+			sess.delSub(topic)
+
+		case <-sess.suspend:
+			// Connection lost.
+			handedOver = sess.waitResume()
+			return
+
+		case <-sess.bkgTimer.C:
+			if atomic.CompareAndSwapInt32(&sess.background, 1, 0) {
+				sess.onBackgroundTimer()
+			}
+
+		case <-ticker.C:
+			if err := wsWrite(sess.ws, websocket.PingMessage, nil); err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure,
+					websocket.CloseNormalClosure) {
+					logs.Err.Println("ws: writeLoop ping", sess.sid, err)
+				}
+				handedOver = sess.writeFailed()
+				return
+			}
+		}
+	}
+}
+
+// wsFrameType 返回websocket发送消息时使用的帧类型：二进制编解码器使用二进制帧
+func (sess *Session) wsFrameType() int {
+	if codecs[sess.getCodec()].binary() {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// Writes a message with the given message type (mt) and payload.
+func wsWrite(ws *websocket.Conn, mt int, msg interface{}) error {
+	var bits []byte
+	if msg != nil {
+		bits = msg.([]byte)
+	} else {
+		bits = []byte{}
+	}
+	ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return ws.WriteMessage(mt, bits)
+}
+
+// Handles websocket requests from peers
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// Allow connections from any Origin
+	CheckOrigin: func(r *http.Request) bool { return true },
+	// 客户端可以通过子协议选择编解码器，没有选择时使用JSON
+	Subprotocols: codecNames(),
+}
+
+func serveWebSocket(wrt http.ResponseWriter, req *http.Request) {
+	now := time.Now().UTC().Round(time.Millisecond)
+
+	if req.Method != http.MethodGet {
+		wrt.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(wrt).Encode(ErrOperationNotAllowed("", "", now))
+		logs.Err.Println("ws: Invalid HTTP method", req.Method)
+		return
+	}
+
+	ws, err := upgrader.Upgrade(wrt, req, nil)
+	if _, ok := err.(websocket.HandshakeError); ok {
+		logs.Err.Println("ws: Not a websocket handshake")
+		return
+	} else if err != nil {
+		logs.Err.Println("ws: failed to Upgrade ", err)
+		return
+	}
+
+	sess, count := globals.sessionStore.NewSession(ws, "")
+	if proto := ws.Subprotocol(); proto != "" {
+		sess.setCodec(codecByName(proto))
+	}
+	if globals.useXForwardedFor {
+		sess.remoteAddr = req.Header.Get("X-Forwarded-For")
+	}
+	if sess.remoteAddr == "" {
+		sess.remoteAddr = req.RemoteAddr
+	}
+
+	logs.Info.Println("ws: session started", sess.sid, sess.remoteAddr, count)
+
+	// Do work in goroutines to return from serveWebSocket() to release file pointers.
+	// Otherwise "too many open files" will happen.
+	go sess.writeLoop()
+	go sess.readLoop()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"GoChat/server/store"
+	"GoChat/server/store/storetest"
+	"GoChat/server/store/types"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tinode/chat/server/logs"
+)
+
+// testSessionStore 测试使用的session存储。NewSessionStore发布expvar变量，只能调用一次。
+var testSessionStore *SessionStore
+
+// initSessionTest 初始化日志和session存储，测试结束后恢复原来的设置
+func initSessionTest(t *testing.T) {
+	info, warn, err := logs.Info, logs.Warn, logs.Err
+	sessionStore := globals.sessionStore
+	t.Cleanup(func() {
+		logs.Info, logs.Warn, logs.Err = info, warn, err
+		globals.sessionStore = sessionStore
+	})
+
+	logs.Init(os.Stderr, "stdFlags")
+	if testSessionStore == nil {
+		testSessionStore = NewSessionStore(time.Minute)
+	}
+	globals.sessionStore = testSessionStore
+}
+
+// TestEvictResumableSession 被服务器终止的session即使支持恢复也不能挂起，必须被清理
+func TestEvictResumableSession(t *testing.T) {
+	initSessionTest(t)
+	storetest.Open(t, "memory", nil)
+	defer store.Close()
+
+	uid := types.Uid(12345)
+	leave := make(chan *sessionLeave, 1)
+	sessions := make(chan *Session, 1)
+
+	// Authenticated session of a client which supports resumption, attached to one topic.
+	// The session is set up before its loops are started.
+	srv := httptest.NewServer(http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+		ws, err := upgrader.Upgrade(wrt, req, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		sess, _ := globals.sessionStore.NewSession(ws, "")
+		sess.uid = uid
+		sess.features = featureResume
+		sess.resumeKey = newResumeKey()
+		sess.addSub("grpTest", &Subscription{done: leave})
+		sessions <- sess
+
+		go sess.writeLoop()
+		go sess.readLoop()
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sess := <-sessions
+	if !sess.resumable() {
+		t.Fatal("session must be resumable")
+	}
+
+	globals.sessionStore.EvictUser(uid, "")
+
+	// The client receives the frame and the connection is closed.
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err = conn.ReadMessage(); err != nil {
+		t.Fatal("evicted message not received", err)
+	}
+
+	select {
+	case msg := <-leave:
+		if msg.sess != sess {
+			t.Error("wrong session left the topic")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("evicted session is not detached from its topics")
+	}
+	if atomic.LoadInt32(&sess.suspended) != 0 {
+		t.Error("evicted session must not be suspended")
+	}
+}
+
+// TestResumeSessionKey 只知道sid不能恢复别人的session
+func TestResumeSessionKey(t *testing.T) {
+	initSessionTest(t)
+
+	old, _ := globals.sessionStore.NewSession(&websocket.Conn{}, "suspended")
+	defer globals.sessionStore.Delete(old)
+	old.features = featureResume
+	old.resumeKey = newResumeKey()
+	atomic.StoreInt32(&old.suspended, 1)
+
+	for _, key := range []string{"", "wrong", old.resumeKey[1:]} {
+		s := &Session{proto: WEBSOCK, sid: "intruder", features: featureResume,
+			send: make(chan interface{}, 8), stop: make(chan interface{}, 1)}
+		s.resumeSession(&ClientComMessage{Id: "1", Hi: &MsgClientHi{Sid: old.sid, Resume: key}})
+
+		if atomic.LoadInt32(&old.suspended) != 1 || s.resumed != nil {
+			t.Fatal("session resumed with key", key)
+		}
+		if msg := (<-s.send).(*ServerComMessage); msg.Ctrl == nil || msg.Ctrl.Code != http.StatusForbidden {
+			t.Error("expected session not found, got", msg.Ctrl)
+		}
+	}
+}
@@ -1 +1,247 @@
+// Web服务器的启动和关闭
+
 package main
+
+import (
+	"GoChat/server/store"
+	"GoChat/server/store/types"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+func listenAndServe(addr string, mux *http.ServeMux, tlfConf *tls.Config, stop <-chan bool) error {
+	globals.shuttingDown = false
+
+	httpdone := make(chan bool)
+
+	server := &http.Server{
+		Handler: mux,
+	}
+
+	server.TLSConfig = tlfConf
+
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			// If port is not specified, use default https port (443),
+			// otherwise it will default to 80
+			if addr == "" {
+				addr = ":https"
+			}
+
+			if globals.tlsRedirectHTTP != "" {
+				// Serving redirects from a unix socket or to a unix socket makes no sense.
+				if isUnixAddr(globals.tlsRedirectHTTP) || isUnixAddr(addr) {
+					err = errors.New("HTTP to HTTPS redirect: unix sockets not supported")
+				} else {
+					logs.Info.Printf("Redirecting connections from HTTP at [%s] to HTTPS at [%s]",
+						globals.tlsRedirectHTTP, addr)
+
+					// This is a second HTTP server listenning on a different port.
+					go http.ListenAndServe(globals.tlsRedirectHTTP, tlsRedirect(addr))
+				}
+			}
+
+			if err == nil {
+				logs.Info.Printf("Listening for client HTTPS connections on [%s]", addr)
+				var lis net.Listener
+				lis, err = netListener(addr)
+				if err == nil {
+					err = server.ServeTLS(lis, "", "")
+				}
+			}
+		} else {
+			if addr == "" {
+				addr = ":http"
+			}
+			logs.Info.Printf("Listening for client HTTP connections on [%s]", addr)
+			var lis net.Listener
+			lis, err = netListener(addr)
+			if err == nil {
+				err = server.Serve(lis)
+			}
+		}
+
+		if err != nil {
+			if globals.shuttingDown {
+				logs.Info.Println("HTTP server: stopped")
+			} else {
+				logs.Err.Println("HTTP server: failed", err)
+			}
+		}
+		httpdone <- true
+	}()
+
+	// Wait for either a termination signal or an error
+Loop:
+	for {
+		select {
+		case <-stop:
+			// Flip the flag that we are terminating and close the Accept-ing socket, so no new connections are possible.
+			globals.shuttingDown = true
+			// Give server 2 seconds to shut down.
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			if err := server.Shutdown(ctx); err != nil {
+				// failure/timeout shutting down the server gracefully
+				logs.Err.Println("HTTP server failed to terminate gracefully", err)
+			}
+
+			// While the server shuts down, termianate all sessions.
+			globals.sessionStore.Shutdown()
+
+			// Wait for http server to stop Accept()-ing connections.
+			<-httpdone
+			cancel()
+
+			// Shutdown gRPC server, if one is configured.
+			if globals.grpcServer != nil {
+				// GracefulStop does not terminate ServerStream. Must use Stop().
+				globals.grpcServer.Stop()
+			}
+
+			// Shutdown the hub. The hub will shutdown topics.
+			hubdone := make(chan bool)
+			globals.hub.shutdown <- hubdone
+
+			// Wait for the hub to finish.
+			<-hubdone
+
+			break Loop
+
+		case <-httpdone:
+			break Loop
+		}
+	}
+	return nil
+}
+
+func signalHandler() <-chan bool {
+	stop := make(chan bool)
+
+	signchan := make(chan os.Signal, 1)
+	signal.Notify(signchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	go func() {
+		// Wait for a signal. Don't care which signal it is
+		sig := <-signchan
+		logs.Info.Printf("Signal received: '%s', shutting down", sig)
+		stop <- true
+	}()
+
+	return stop
+}
+
+// Custom 404 response.
+func serve404(wrt http.ResponseWriter, req *http.Request) {
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+	wrt.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(wrt).Encode(
+		&ServerComMessage{Ctrl: &MsgServerCtrl{
+			Timestamp: time.Now().UTC().Round(time.Millisecond),
+			Code:      http.StatusNotFound,
+			Text:      "not found"}})
+}
+
+// Redirect HTTP requests to HTTPS
+func tlsRedirect(toPort string) http.HandlerFunc {
+	if toPort == ":443" || toPort == ":https" {
+		toPort = ""
+	} else if toPort != "" && toPort[:1] == ":" {
+		// Strip leading colon. JoinHostPort will add it back.
+		toPort = toPort[1:]
+	}
+
+	return func(wrt http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			// If SplitHostPort has failed assume it's because :port part is missing.
+			host = req.Host
+		}
+
+		target, _ := url.ParseRequestURI(req.RequestURI)
+		target.Scheme = "https"
+
+		// Ensure valid redirect target.
+		if toPort != "" {
+			// Replace the port number.
+			target.Host = net.JoinHostPort(host, toPort)
+		} else {
+			target.Host = host
+		}
+
+		if target.Path == "" {
+			target.Path = "/"
+		}
+
+		http.Redirect(wrt, req, target.String(), http.StatusTemporaryRedirect)
+	}
+}
+
+// 从HTTP请求中提取认证信息，返回认证方式和密钥
+func getHttpAuth(req *http.Request) (method, secret string) {
+	// Check canonical Authorization header.
+	if parts := strings.Split(req.Header.Get("Authorization"), " "); len(parts) == 2 {
+		method, secret = parts[0], parts[1]
+		return
+	}
+
+	// Check URL query parameters.
+	if method = req.URL.Query().Get("auth"); method != "" {
+		secret = req.URL.Query().Get("secret")
+		// Convert base64 URL-encoding to standard encoding.
+		secret = strings.NewReplacer("-", "+", "_", "/").Replace(secret)
+		return
+	}
+
+	// Check form values.
+	if method = req.FormValue("auth"); method != "" {
+		return method, req.FormValue("secret")
+	}
+
+	return
+}
+
+// 对非websocket的HTTP请求进行认证：使用请求中的认证信息，或者已经认证过的session ID
+func authHttpRequest(req *http.Request) (types.Uid, []byte, error) {
+	var uid types.Uid
+	if authMethod, secret := getHttpAuth(req); authMethod != "" {
+		decodedSecret := make([]byte, base64.StdEncoding.DecodedLen(len(secret)))
+		n, err := base64.StdEncoding.Decode(decodedSecret, []byte(secret))
+		if err != nil {
+			return uid, nil, types.ErrMalformed
+		}
+
+		if authhdl := store.GetLogicalAuthHandler(authMethod); authhdl != nil {
+			rec, challenge, err := authhdl.Authenticate(decodedSecret[:n], getRemoteAddr(req))
+			if err != nil {
+				return uid, nil, err
+			}
+			if challenge != nil {
+				return uid, challenge, nil
+			}
+			uid = rec.Uid
+		} else {
+			logs.Info.Println("fileUpload: auth data is present but handler is not found", authMethod)
+		}
+	} else {
+		// Find the session, make sure it's appropriately authenticated.
+		sess := globals.sessionStore.Get(req.FormValue("sid"))
+		if sess != nil {
+			uid = sess.uid
+		}
+	}
+	return uid, nil, nil
+}
@@ -1 +1,433 @@
 package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"GoChat/server/auth"
+	"GoChat/server/store"
+	"github.com/tinode/chat/server/logs"
+	"google.golang.org/grpc"
+
+	// Authenticators
+	_ "GoChat/server/auth/anon"
+	_ "GoChat/server/auth/basic"
+	_ "GoChat/server/auth/token"
+
+	// Database backends
+	_ "GoChat/server/db/memory"
+	_ "GoChat/server/db/sqlite"
+)
+
+const (
+	// currentVersion is the current API/protocol version
+	currentVersion = "0.16"
+	// minSupportedVersion is the minimum supported API version
+	minSupportedVersion = "0.15"
+
+	// idleSessionTimeout defines duration of being idle before terminating a session.
+	idleSessionTimeout = time.Second * 55
+	// idleMasterTopicTimeout defines now long to keep topic alive after the last session detached.
+	idleMasterTopicTimeout = time.Second * 4
+
+	// defaultMaxMessageSize is the default maximum message size
+	defaultMaxMessageSize = 1 << 19 // 512K
+
+	// defaultMaxSubscriberCount is the default maximum number of group topic subscribers.
+	defaultMaxSubscriberCount = 256
+
+	// defaultMaxDeleteCount is the maximum allowed number of messages to delete in one call.
+	defaultMaxDeleteCount = 1024
+
+	// uaTimerDelay is the delay before publishing user agent change on 'me'.
+	uaTimerDelay = time.Second * 5
+
+	// defaultMaxTagCount is the default maximum number of indexable tags
+	defaultMaxTagCount = 16
+
+	// minTagLength is the shortest acceptable length of a tag in runes. Shorter tags are discarded.
+	minTagLength = 2
+	// maxTagLength is the maximum length of a tag in runes. Longer tags are trimmed.
+	maxTagLength = 96
+
+	// Base URL path for serving the streaming API.
+	defaultApiPath = "/"
+
+	// 没有配置集群，使用固定的worker ID生成唯一ID
+	defaultWorkerId = 1
+)
+
+// credValidator 保存验证器的额外配置
+type credValidator struct {
+	// AuthLevel(s) which require this validator.
+	requiredAuthLvl []auth.Level
+	addToTags       bool
+}
+
+var globals struct {
+	// Topics cache and processing.
+	hub *Hub
+	// Indicator that shutdown is in progress
+	shuttingDown bool
+	// Sessions cache.
+	sessionStore *SessionStore
+	// gRPC server.
+	grpcServer *grpc.Server
+
+	// Credential validators.
+	validators map[string]credValidator
+	// Validators required for each auth level.
+	authValidators map[auth.Level][]string
+	// Tag namespaces which cannot be changed directly by the client, e.g. 'email' or 'tel'.
+	immutableTagNS map[string]bool
+
+	// Use X-Forwarded-For HTTP header as the client IP address.
+	useXForwardedFor bool
+
+	// Maximum allowed size of an incoming packet.
+	maxMessageSize int64
+	// Maximum number of group topic subscribers.
+	maxSubscriberCount int
+	// Maximum number of indexable tags.
+	maxTagCount int
+	// Maximum allowed upload size.
+	maxFileUploadSize int64
+
+	// Add Strict-Transport-Security to headers, the value signifies age.
+	// Empty string "" turns it off
+	tlsStrictMaxAge string
+	// Listen for connections on this address:port and redirect them to HTTPS port.
+	tlsRedirectHTTP string
+}
+
+type validatorConfig struct {
+	// TRUE or FALSE to set
+	AddToTags bool `json:"add_to_tags"`
+	//  Authentication level which triggers this validator: "auth", "anon"... or ""
+	Required []string `json:"required"`
+	// Validator params passed to validator unchanged.
+	Config json.RawMessage `json:"config"`
+}
+
+type mediaConfig struct {
+	// The name of the handler to use for file uploads.
+	UseHandler string `json:"use_handler"`
+	// Maximum allowed size of an uploaded file
+	MaxFileUploadSize int64 `json:"max_size"`
+	// Garbage collection timeout
+	GcPeriod int `json:"gc_period"`
+	// Number of entries to delete in one pass
+	GcBlockSize int `json:"gc_block_size"`
+	// Individual handler config params to pass to handlers unchanged.
+	Handlers map[string]json.RawMessage `json:"handlers"`
+}
+
+// anonGcConfig 删除不活跃的匿名用户
+type anonGcConfig struct {
+	// Anonymous users not seen for this many seconds are deleted.
+	MaxInactive int `json:"max_inactive"`
+	// Garbage collection period in seconds.
+	GcPeriod int `json:"gc_period"`
+	// Number of users to delete in one pass
+	GcBlockSize int `json:"gc_block_size"`
+}
+
+// 配置文件的内容
+type configType struct {
+	// HTTP(S) address:port to listen on for websocket and long polling clients. Either a
+	// numeric or a canonical name, e.g. ":80" or ":https". Could include a host name, e.g.
+	// "localhost:80". Unix sockets are specified as "unix:/run/gochat.sock".
+	// Could be blank: if TLS is not configured, will use ":80", otherwise ":443".
+	// Can be overridden from the command line, see option --listen.
+	Listen string `json:"listen"`
+	// Base URL path where the streaming and large file API calls are served, default is '/'.
+	// Can be overridden from the command line, see option --api_path.
+	ApiPath string `json:"api_path"`
+	// Address:port to listen for gRPC clients. If blank gRPC support will not be initialized.
+	// Could be overridden from the command line with --grpc_listen.
+	GrpcListen string `json:"grpc_listen"`
+	// Enable handling of gRPC keepalives.
+	GrpcKeepalive bool `json:"grpc_keepalive_enabled"`
+	// Maximum message size allowed from client. Intended to prevent malicious client from sending
+	// very large files inband (does not affect out of band uploads).
+	MaxMessageSize int `json:"max_message_size"`
+	// Maximum number of group topic subscribers.
+	MaxSubscriberCount int `json:"max_subscriber_count"`
+	// Maximum number of indexable tags
+	MaxTagCount int `json:"max_tag_count"`
+	// URL path for exposing runtime stats. Disabled if the path is blank.
+	ExpvarPath string `json:"expvar"`
+	// Take IP address of the client from HTTP header 'X-Forwarded-For'.
+	// Useful when the server is behind a proxy. If missing, fallback to default RemoteAddr.
+	UseXForwardedFor bool `json:"use_x_forwarded_for"`
+
+	// Configs for subsystems
+	Store      json.RawMessage              `json:"store_config"`
+	TLS        json.RawMessage              `json:"tls"`
+	Auth       map[string]json.RawMessage   `json:"auth_config"`
+	Validator  map[string]*validatorConfig  `json:"acc_validation"`
+	Media      *mediaConfig                 `json:"media"`
+	SendQueues map[string]*sendPolicyConfig `json:"send_queue"`
+	AnonGc     *anonGcConfig                `json:"anon_gc"`
+}
+
+func main() {
+	executable, _ := os.Executable()
+
+	var logFlags = flag.String("log_flags", "stdFlags", "Comma-separated list of log flags (as defined in https://golang.org/pkg/log/#pkg-constants without the L prefix)")
+	var configfile = flag.String("config", "gochat.conf", "Path to config file.")
+	var listenOn = flag.String("listen", "", "Override address and port to listen on for HTTP(S) clients.")
+	var apiPath = flag.String("api_path", "", "Override the base URL path where API is served.")
+	var listenGrpc = flag.String("grpc_listen", "", "Override address and port to listen on for gRPC clients.")
+	var tlsEnabled = flag.Bool("tls_enabled", false, "Override config value for enabling TLS.")
+	var expvarPath = flag.String("expvar", "", "Override the URL path where runtime stats are exposed. Use '-' to disable.")
+	var initDb = flag.Bool("init_db", false, "Create the database if it does not exist yet.")
+	flag.Parse()
+
+	logs.Init(os.Stderr, *logFlags)
+
+	// All relative paths are resolved against the executable path, not against current working directory.
+	// Absolute paths are left unchanged.
+	rootpath, _ := filepath.Split(executable)
+
+	logs.Info.Printf("Server v%s:%s; pid %d; %d process(es)",
+		currentVersion, executable, os.Getpid(), runtime.GOMAXPROCS(runtime.NumCPU()))
+
+	*configfile = toAbsolutePath(rootpath, *configfile)
+	logs.Info.Printf("Using config from '%s'", *configfile)
+
+	var config configType
+	if file, err := os.Open(*configfile); err != nil {
+		logs.Err.Fatal("Failed to read config file: ", err)
+	} else {
+		if err = json.NewDecoder(file).Decode(&config); err != nil {
+			logs.Err.Fatal("Failed to parse config file: ", err)
+		}
+		file.Close()
+	}
+
+	if *listenOn != "" {
+		config.Listen = *listenOn
+	}
+
+	// Set up HTTP server. Must use non-default mux because of expvar.
+	mux := http.NewServeMux()
+
+	// Exposing values for statistics and monitoring.
+	evpath := *expvarPath
+	if evpath == "" {
+		evpath = config.ExpvarPath
+	}
+	if evpath != "" && evpath != "-" {
+		mux.Handle(evpath, expvar.Handler())
+		logs.Info.Printf("Stats: variables exposed at '%s'", evpath)
+	}
+
+	err := store.Open(defaultWorkerId, config.Store)
+	if err != nil && *initDb && strings.Contains(err.Error(), "Database not initialized") {
+		// 嵌入式数据库（如SQLite）首次启动时创建数据库
+		logs.Info.Println("Database not found. Creating.")
+		err = store.InitDb(nil, false)
+	}
+	if err != nil {
+		logs.Err.Fatal("Failed to connect to DB: ", err)
+	}
+	logs.Info.Println("DB adapter", store.GetAdapterName())
+	defer func() {
+		store.Close()
+		logs.Info.Println("Closed database connection(s)")
+		logs.Info.Println("All done, good bye")
+	}()
+
+	err = store.InitAuthLogicalNames(config.Auth["logical_names"])
+	if err != nil {
+		logs.Err.Fatal(err)
+	}
+
+	globals.immutableTagNS = make(map[string]bool)
+
+	// 初始化所有配置了的认证方式
+	authNames := store.GetAuthNames()
+	for _, name := range authNames {
+		if authhdl := store.GetLogicalAuthHandler(name); authhdl == nil {
+			logs.Err.Fatalln("Unknown authenticator", name)
+		} else {
+			if jsconf := config.Auth[name]; jsconf != nil {
+				if err := authhdl.Init(jsconf, name); err != nil {
+					logs.Err.Fatalln("Failed to init auth scheme", name+":", err)
+				}
+			}
+			// 认证方案生成的标签，比如"basic:alice"，客户端不能直接修改
+			tags, err := authhdl.RestrictedTags()
+			if err != nil {
+				logs.Err.Fatalln("Failed get restricted tag namespaces", name+":", err)
+			}
+			for _, tag := range tags {
+				globals.immutableTagNS[tag] = true
+			}
+		}
+	}
+
+	// Process validators.
+	for name, vconf := range config.Validator {
+		if vconf.AddToTags && strings.Contains(name, ":") {
+			logs.Err.Fatalln("acc_validation names should not contain character ':'", name)
+		}
+
+		if len(vconf.Required) == 0 {
+			// Skip disabled validator.
+			continue
+		}
+
+		var reqLevels []auth.Level
+		for _, req := range vconf.Required {
+			lvl := auth.ParseAuthLevel(req)
+			if lvl == auth.LevelNone {
+				if req != "" {
+					logs.Err.Fatalf("Invalid required AuthLevel '%s' in validator '%s'", req, name)
+				}
+				// Skip empty string
+				continue
+			}
+			reqLevels = append(reqLevels, lvl)
+			if globals.authValidators == nil {
+				globals.authValidators = make(map[auth.Level][]string)
+			}
+			globals.authValidators[lvl] = append(globals.authValidators[lvl], name)
+		}
+
+		if len(reqLevels) == 0 {
+			// Ignore validator with empty levels.
+			continue
+		}
+
+		if val := store.GetValidator(name); val == nil {
+			logs.Err.Fatal("Config provided for an unknown validator '" + name + "'")
+		} else if err = val.Init(string(vconf.Config)); err != nil {
+			logs.Err.Fatal("Failed to init validator '"+name+"': ", err)
+		}
+		if globals.validators == nil {
+			globals.validators = make(map[string]credValidator)
+		}
+		globals.validators[name] = credValidator{
+			requiredAuthLvl: reqLevels,
+			addToTags:       vconf.AddToTags}
+		if vconf.AddToTags {
+			globals.immutableTagNS[name] = true
+		}
+	}
+
+	// Maximum message size
+	globals.maxMessageSize = int64(config.MaxMessageSize)
+	if globals.maxMessageSize <= 0 {
+		globals.maxMessageSize = defaultMaxMessageSize
+	}
+	// Maximum number of group topic subscribers
+	globals.maxSubscriberCount = config.MaxSubscriberCount
+	if globals.maxSubscriberCount <= 1 {
+		globals.maxSubscriberCount = defaultMaxSubscriberCount
+	}
+	// Maximum number of indexable tags per user or topics
+	globals.maxTagCount = config.MaxTagCount
+	if globals.maxTagCount <= 0 {
+		globals.maxTagCount = defaultMaxTagCount
+	}
+
+	globals.useXForwardedFor = config.UseXForwardedFor
+
+	if err = sendPoliciesInit(config.SendQueues); err != nil {
+		logs.Err.Fatal(err)
+	}
+
+	if config.Media != nil {
+		if config.Media.UseHandler == "" {
+			config.Media = nil
+		} else {
+			globals.maxFileUploadSize = config.Media.MaxFileUploadSize
+			var conf string
+			if params := config.Media.Handlers[config.Media.UseHandler]; params != nil {
+				conf = string(params)
+			}
+			if err = store.UseMediaHandler(config.Media.UseHandler, conf); err != nil {
+				logs.Err.Fatalf("Failed to init media handler '%s': %s", config.Media.UseHandler, err)
+			}
+			if config.Media.GcPeriod > 0 && config.Media.GcBlockSize > 0 {
+				stopFilesGc := largeFileRunGarbageCollection(time.Second*time.Duration(config.Media.GcPeriod),
+					config.Media.GcBlockSize)
+				defer func() {
+					stopFilesGc <- true
+					logs.Info.Println("Stopped files garbage collector")
+				}()
+			}
+		}
+	}
+
+	// Keep inactive LP sessions for 15 seconds
+	globals.sessionStore = NewSessionStore(idleSessionTimeout + 15*time.Second)
+	// The hub (the main message router)
+	globals.hub = newHub()
+
+	if gc := config.AnonGc; gc != nil && gc.MaxInactive > 0 && gc.GcPeriod > 0 && gc.GcBlockSize > 0 {
+		stopAnonGc := anonUsersRunGarbageCollection(time.Second*time.Duration(gc.GcPeriod),
+			time.Second*time.Duration(gc.MaxInactive), gc.GcBlockSize)
+		defer func() {
+			stopAnonGc <- true
+			logs.Info.Println("Stopped anonymous users garbage collector")
+		}()
+	}
+
+	tlsConfig, err := parseTLSConfig(*tlsEnabled, config.TLS)
+	if err != nil {
+		logs.Err.Fatalln(err)
+	}
+
+	// Set up gRPC server, if one is configured
+	if *listenGrpc == "" {
+		*listenGrpc = config.GrpcListen
+	}
+	if globals.grpcServer, err = serveGrpc(*listenGrpc, config.GrpcKeepalive, tlsConfig); err != nil {
+		logs.Err.Fatal(err)
+	}
+
+	// Configure root path for serving API calls.
+	if *apiPath != "" {
+		config.ApiPath = *apiPath
+	}
+	if config.ApiPath == "" {
+		config.ApiPath = defaultApiPath
+	} else {
+		if !strings.HasPrefix(config.ApiPath, "/") {
+			config.ApiPath = "/" + config.ApiPath
+		}
+		if !strings.HasSuffix(config.ApiPath, "/") {
+			config.ApiPath += "/"
+		}
+	}
+	logs.Info.Printf("API served from root URL path '%s'", config.ApiPath)
+
+	// Handle websocket clients.
+	mux.HandleFunc(config.ApiPath+"v0/channels", serveWebSocket)
+	// Handle long polling clients.
+	mux.HandleFunc(config.ApiPath+"v0/channels/lp", serveLongPoll)
+	if config.Media != nil {
+		// Handle uploads of large files.
+		mux.HandleFunc(config.ApiPath+"v0/file/u/", largeFileReceive)
+		// Serve large files.
+		mux.HandleFunc(config.ApiPath+"v0/file/s/", largeFileServe)
+		logs.Info.Println("Large media handling enabled", config.Media.UseHandler)
+	}
+
+	// Serve json-formatted 404 for all other URLs
+	mux.HandleFunc("/", serve404)
+
+	if err = listenAndServe(config.Listen, mux, tlsConfig, signalHandler()); err != nil {
+		logs.Err.Fatal(err)
+	}
+}
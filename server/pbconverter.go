@@ -0,0 +1,570 @@
+// pbx的protobuf结构与ClientComMessage/ServerComMessage之间的相互转换
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/tinode/chat/pbx"
+	"github.com/tinode/chat/server/logs"
+)
+
+func pbServCtrlSerialize(ctrl *MsgServerCtrl) *pbx.ServerMsg_Ctrl {
+	var params map[string][]byte
+	if ctrl.Params != nil {
+		if in, ok := ctrl.Params.(map[string]interface{}); ok {
+			params = interfaceMapToByteMap(in)
+		}
+	}
+
+	return &pbx.ServerMsg_Ctrl{Ctrl: &pbx.ServerCtrl{
+		Id:     ctrl.Id,
+		Topic:  ctrl.Topic,
+		Code:   int32(ctrl.Code),
+		Text:   ctrl.Text,
+		Params: params}}
+}
+
+func pbServDataSerialize(data *MsgServerData) *pbx.ServerMsg_Data {
+	return &pbx.ServerMsg_Data{Data: &pbx.ServerData{
+		Topic:      data.Topic,
+		FromUserId: data.From,
+		Timestamp:  timeToInt64(&data.Timestamp),
+		DeletedAt:  timeToInt64(data.DeletedAt),
+		SeqId:      int32(data.SeqId),
+		Head:       interfaceMapToByteMap(data.Head),
+		Content:    interfaceToBytes(data.Content)}}
+}
+
+func pbServPresSerialize(pres *MsgServerPres) *pbx.ServerMsg_Pres {
+	var what pbx.ServerPres_What
+	switch pres.What {
+	case "on":
+		what = pbx.ServerPres_ON
+	case "off":
+		what = pbx.ServerPres_OFF
+	case "ua":
+		what = pbx.ServerPres_UA
+	case "upd":
+		what = pbx.ServerPres_UPD
+	case "gone":
+		what = pbx.ServerPres_GONE
+	case "acs":
+		what = pbx.ServerPres_ACS
+	case "term":
+		what = pbx.ServerPres_TERM
+	case "msg":
+		what = pbx.ServerPres_MSG
+	case "read":
+		what = pbx.ServerPres_READ
+	case "recv":
+		what = pbx.ServerPres_RECV
+	case "del":
+		what = pbx.ServerPres_DEL
+	case "tags":
+		what = pbx.ServerPres_TAGS
+	default:
+		logs.Warn.Println("pbx: unknown pres.what value", pres.What)
+	}
+	return &pbx.ServerMsg_Pres{Pres: &pbx.ServerPres{
+		Topic:        pres.Topic,
+		Src:          pres.Src,
+		What:         what,
+		UserAgent:    pres.UserAgent,
+		SeqId:        int32(pres.SeqId),
+		DelId:        int32(pres.DelId),
+		DelSeq:       pbDelQuerySerialize(pres.DelSeq),
+		TargetUserId: pres.AcsTarget,
+		ActorUserId:  pres.AcsActor,
+		Acs:          pbAccessModeSerialize(pres.Acs)}}
+}
+
+func pbServInfoSerialize(info *MsgServerInfo) *pbx.ServerMsg_Info {
+	return &pbx.ServerMsg_Info{Info: &pbx.ServerInfo{
+		Topic:      info.Topic,
+		FromUserId: info.From,
+		Src:        info.Src,
+		What:       pbInfoNoteWhatSerialize(info.What),
+		SeqId:      int32(info.SeqId),
+	}}
+}
+
+func pbServMetaSerialize(meta *MsgServerMeta) *pbx.ServerMsg_Meta {
+	return &pbx.ServerMsg_Meta{Meta: &pbx.ServerMeta{
+		Id:    meta.Id,
+		Topic: meta.Topic,
+		Desc:  pbTopicDescSerialize(meta.Desc),
+		Sub:   pbTopicSubSliceSerialize(meta.Sub),
+		Del:   pbDelValuesSerialize(meta.Del),
+		Tags:  meta.Tags,
+		Cred:  pbServerCredsSerialize(meta.Cred),
+	}}
+}
+
+// Convert ServerComMessage to pbx.ServerMsg
+func pbServSerialize(msg *ServerComMessage) *pbx.ServerMsg {
+	var pkt pbx.ServerMsg
+
+	switch {
+	case msg.Ctrl != nil:
+		pkt.Message = pbServCtrlSerialize(msg.Ctrl)
+	case msg.Data != nil:
+		pkt.Message = pbServDataSerialize(msg.Data)
+	case msg.Pres != nil:
+		pkt.Message = pbServPresSerialize(msg.Pres)
+	case msg.Info != nil:
+		pkt.Message = pbServInfoSerialize(msg.Info)
+	case msg.Meta != nil:
+		pkt.Message = pbServMetaSerialize(msg.Meta)
+	}
+
+	pkt.Topic = msg.RcptTo
+
+	return &pkt
+}
+
+// Convert pbx.ClientMsg to ClientComMessage
+func pbCliDeserialize(pkt *pbx.ClientMsg) *ClientComMessage {
+	var msg ClientComMessage
+	if hi := pkt.GetHi(); hi != nil {
+		msg.Hi = &MsgClientHi{
+			Id:         hi.GetId(),
+			UserAgent:  hi.GetUserAgent(),
+			Version:    hi.GetVer(),
+			DeviceID:   hi.GetDeviceId(),
+			Platform:   hi.GetPlatform(),
+			Lang:       hi.GetLang(),
+			Background: hi.GetBackground(),
+		}
+	} else if acc := pkt.GetAcc(); acc != nil {
+		msg.Acc = &MsgClientAcc{
+			Id:     acc.GetId(),
+			User:   acc.GetUserId(),
+			State:  acc.GetState(),
+			Token:  acc.GetToken(),
+			Scheme: acc.GetScheme(),
+			Secret: acc.GetSecret(),
+			Login:  acc.GetLogin(),
+			Tags:   acc.GetTags(),
+			Desc:   pbSetDescDeserialize(acc.GetDesc()),
+			Cred:   pbClientCredsDeserialize(acc.GetCred()),
+		}
+	} else if login := pkt.GetLogin(); login != nil {
+		msg.Login = &MsgClientLogin{
+			Id:     login.GetId(),
+			Scheme: login.GetScheme(),
+			Secret: login.GetSecret(),
+			Cred:   pbClientCredsDeserialize(login.GetCred()),
+		}
+	} else if sub := pkt.GetSub(); sub != nil {
+		msg.Sub = &MsgClientSub{
+			Id:    sub.GetId(),
+			Topic: sub.GetTopic(),
+			Get:   pbGetQueryDeserialize(sub.GetGetQuery()),
+			Set:   pbSetQueryDeserialize(sub.GetSetQuery()),
+		}
+	} else if leave := pkt.GetLeave(); leave != nil {
+		msg.Leave = &MsgClientLeave{
+			Id:    leave.GetId(),
+			Topic: leave.GetTopic(),
+			Unsub: leave.GetUnsub(),
+		}
+	} else if pub := pkt.GetPub(); pub != nil {
+		msg.Pub = &MsgClientPub{
+			Id:      pub.GetId(),
+			Topic:   pub.GetTopic(),
+			NoEcho:  pub.GetNoEcho(),
+			Head:    byteMapToInterfaceMap(pub.GetHead()),
+			Content: bytesToInterface(pub.GetContent()),
+		}
+	} else if get := pkt.GetGet(); get != nil {
+		msg.Get = &MsgClientGet{
+			Id:          get.GetId(),
+			Topic:       get.GetTopic(),
+			MsgGetQuery: *pbGetQueryDeserialize(get.GetQuery()),
+		}
+	} else if set := pkt.GetSet(); set != nil {
+		msg.Set = &MsgClientSet{
+			Id:    set.GetId(),
+			Topic: set.GetTopic(),
+		}
+		if query := pbSetQueryDeserialize(set.GetQuery()); query != nil {
+			msg.Set.MsgSetQuery = *query
+		}
+	} else if del := pkt.GetDel(); del != nil {
+		msg.Del = &MsgClientDel{
+			Id:     del.GetId(),
+			Topic:  del.GetTopic(),
+			DelSeq: pbDelQueryDeserialize(del.GetDelSeq()),
+			User:   del.GetUserId(),
+			Cred:   pbClientCredDeserialize(del.GetCred()),
+			Hard:   del.GetHard(),
+		}
+		switch del.GetWhat() {
+		case pbx.ClientDel_MSG:
+			msg.Del.What = "msg"
+		case pbx.ClientDel_TOPIC:
+			msg.Del.What = "topic"
+		case pbx.ClientDel_SUB:
+			msg.Del.What = "sub"
+		case pbx.ClientDel_USER:
+			msg.Del.What = "user"
+		case pbx.ClientDel_CRED:
+			msg.Del.What = "cred"
+		}
+	} else if note := pkt.GetNote(); note != nil {
+		msg.Note = &MsgClientNote{
+			Topic: note.GetTopic(),
+			SeqId: int(note.GetSeqId()),
+		}
+		switch note.GetWhat() {
+		case pbx.InfoNote_READ:
+			msg.Note.What = "read"
+		case pbx.InfoNote_RECV:
+			msg.Note.What = "recv"
+		case pbx.InfoNote_KP:
+			msg.Note.What = "kp"
+		}
+	}
+
+	msg.AsUser = pkt.GetOnBehalfOf()
+	msg.AuthLvl = int(pkt.GetAuthLevel())
+
+	return &msg
+}
+
+func interfaceMapToByteMap(in map[string]interface{}) map[string][]byte {
+	out := make(map[string][]byte, len(in))
+	for key, val := range in {
+		if val != nil {
+			out[key], _ = json.Marshal(val)
+		}
+	}
+	return out
+}
+
+func byteMapToInterfaceMap(in map[string][]byte) map[string]interface{} {
+	out := make(map[string]interface{}, len(in))
+	for key, raw := range in {
+		if val := bytesToInterface(raw); val != nil {
+			out[key] = val
+		}
+	}
+	return out
+}
+
+func interfaceToBytes(in interface{}) []byte {
+	if in != nil {
+		out, _ := json.Marshal(in)
+		return out
+	}
+	return nil
+}
+
+func bytesToInterface(in []byte) interface{} {
+	var out interface{}
+	if len(in) > 0 {
+		err := json.Unmarshal(in, &out)
+		if err != nil {
+			logs.Warn.Println("pbx: failed to parse bytes", string(in), err)
+		}
+	}
+	return out
+}
+
+func timeToInt64(ts *time.Time) int64 {
+	if ts != nil && !ts.IsZero() {
+		return ts.UnixNano() / int64(time.Millisecond)
+	}
+	return 0
+}
+
+func int64ToTime(ts int64) *time.Time {
+	if ts > 0 {
+		res := time.Unix(ts/1000, (ts%1000)*int64(time.Millisecond)).UTC()
+		return &res
+	}
+	return nil
+}
+
+func pbGetQueryDeserialize(in *pbx.GetQuery) *MsgGetQuery {
+	msg := MsgGetQuery{}
+
+	if in != nil {
+		msg.What = in.GetWhat()
+
+		if desc := in.GetDesc(); desc != nil {
+			msg.Desc = &MsgGetOpts{
+				IfModifiedSince: int64ToTime(desc.GetIfModifiedSince()),
+				Limit:           int(desc.GetLimit()),
+			}
+		}
+		if sub := in.GetSub(); sub != nil {
+			msg.Sub = &MsgGetOpts{
+				IfModifiedSince: int64ToTime(sub.GetIfModifiedSince()),
+				User:            sub.GetUser(),
+				Topic:           sub.GetTopic(),
+				Limit:           int(sub.GetLimit()),
+			}
+		}
+		if data := in.GetData(); data != nil {
+			msg.Data = &MsgGetOpts{
+				BeforeId: int(data.GetBeforeId()),
+				SinceId:  int(data.GetSinceId()),
+				Limit:    int(data.GetLimit()),
+			}
+		}
+	}
+
+	return &msg
+}
+
+func pbSetDescDeserialize(in *pbx.SetDesc) *MsgSetDesc {
+	if in == nil {
+		return nil
+	}
+
+	defacs := pbDefaultAcsDeserialize(in.GetDefaultAcs())
+	public := in.GetPublic()
+	private := in.GetPrivate()
+
+	if defacs != nil || public != nil || private != nil {
+		return &MsgSetDesc{
+			DefaultAcs: defacs,
+			Public:     bytesToInterface(public),
+			Private:    bytesToInterface(private),
+		}
+	}
+
+	return nil
+}
+
+func pbSetQueryDeserialize(in *pbx.SetQuery) *MsgSetQuery {
+	if in == nil {
+		return nil
+	}
+
+	var msg MsgSetQuery
+	var found bool
+
+	if desc := in.GetDesc(); desc != nil {
+		msg.Desc = pbSetDescDeserialize(desc)
+		found = msg.Desc != nil
+	}
+
+	if sub := in.GetSub(); sub != nil {
+		user := sub.GetUserId()
+		mode := sub.GetMode()
+
+		if user != "" || mode != "" {
+			msg.Sub = &MsgSetSub{
+				User: user,
+				Mode: mode,
+			}
+			found = true
+		}
+	}
+
+	if tags := in.GetTags(); tags != nil {
+		msg.Tags = tags
+		found = true
+	}
+
+	if cred := pbClientCredDeserialize(in.GetCred()); cred != nil {
+		msg.Cred = cred
+		found = true
+	}
+
+	if !found {
+		return nil
+	}
+	return &msg
+}
+
+func pbInfoNoteWhatSerialize(what string) pbx.InfoNote {
+	var out pbx.InfoNote
+	switch what {
+	case "kp":
+		out = pbx.InfoNote_KP
+	case "read":
+		out = pbx.InfoNote_READ
+	case "recv":
+		out = pbx.InfoNote_RECV
+	default:
+		logs.Warn.Println("pbx: unknown info-note.what", what)
+	}
+	return out
+}
+
+func pbAccessModeSerialize(acs *MsgAccessMode) *pbx.AccessMode {
+	if acs == nil {
+		return nil
+	}
+
+	return &pbx.AccessMode{
+		Want:  acs.Want,
+		Given: acs.Given,
+	}
+}
+
+func pbDefaultAcsSerialize(defacs *MsgDefaultAcsMode) *pbx.DefaultAcsMode {
+	if defacs == nil {
+		return nil
+	}
+
+	return &pbx.DefaultAcsMode{
+		Auth: defacs.Auth,
+		Anon: defacs.Anon}
+}
+
+func pbDefaultAcsDeserialize(defacs *pbx.DefaultAcsMode) *MsgDefaultAcsMode {
+	if defacs == nil {
+		return nil
+	}
+
+	auth := defacs.GetAuth()
+	anon := defacs.GetAnon()
+
+	if auth != "" || anon != "" {
+		return &MsgDefaultAcsMode{
+			Auth: auth,
+			Anon: anon,
+		}
+	}
+	return nil
+}
+
+func pbTopicDescSerialize(desc *MsgTopicDesc) *pbx.TopicDesc {
+	if desc == nil {
+		return nil
+	}
+	return &pbx.TopicDesc{
+		CreatedAt: timeToInt64(desc.CreatedAt),
+		UpdatedAt: timeToInt64(desc.UpdatedAt),
+		TouchedAt: timeToInt64(desc.TouchedAt),
+		State:     desc.State,
+		Defacs:    pbDefaultAcsSerialize(desc.DefaultAcs),
+		Acs:       pbAccessModeSerialize(desc.Acs),
+		SeqId:     int32(desc.SeqId),
+		ReadId:    int32(desc.ReadSeqId),
+		RecvId:    int32(desc.RecvSeqId),
+		DelId:     int32(desc.DelId),
+		Public:    interfaceToBytes(desc.Public),
+		Private:   interfaceToBytes(desc.Private),
+	}
+}
+
+func pbTopicSubSliceSerialize(subs []MsgTopicSub) []*pbx.TopicSub {
+	if len(subs) == 0 {
+		return nil
+	}
+
+	out := make([]*pbx.TopicSub, len(subs))
+	for i := 0; i < len(subs); i++ {
+		out[i] = pbTopicSubSerialize(&subs[i])
+	}
+	return out
+}
+
+func pbTopicSubSerialize(sub *MsgTopicSub) *pbx.TopicSub {
+	out := &pbx.TopicSub{
+		UpdatedAt: timeToInt64(sub.UpdatedAt),
+		DeletedAt: timeToInt64(sub.DeletedAt),
+		Online:    sub.Online,
+		Acs:       pbAccessModeSerialize(&sub.Acs),
+		ReadId:    int32(sub.ReadSeqId),
+		RecvId:    int32(sub.RecvSeqId),
+		Public:    interfaceToBytes(sub.Public),
+		Private:   interfaceToBytes(sub.Private),
+		UserId:    sub.User,
+		Topic:     sub.Topic,
+		TouchedAt: timeToInt64(sub.TouchedAt),
+		SeqId:     int32(sub.SeqId),
+		DelId:     int32(sub.DelId),
+	}
+	if sub.LastSeen != nil {
+		out.LastSeenTime = timeToInt64(&sub.LastSeen.When)
+		out.LastSeenUserAgent = sub.LastSeen.UserAgent
+	}
+	return out
+}
+
+func pbDelQuerySerialize(in []MsgDelRange) []*pbx.SeqRange {
+	if in == nil {
+		return nil
+	}
+
+	out := make([]*pbx.SeqRange, len(in))
+	for i, dq := range in {
+		out[i] = &pbx.SeqRange{Low: int32(dq.LowId), Hi: int32(dq.HiId)}
+	}
+
+	return out
+}
+
+func pbDelQueryDeserialize(in []*pbx.SeqRange) []MsgDelRange {
+	if in == nil {
+		return nil
+	}
+
+	out := make([]MsgDelRange, len(in))
+	for i, sr := range in {
+		out[i].LowId = int(sr.GetLow())
+		out[i].HiId = int(sr.GetHi())
+	}
+
+	return out
+}
+
+func pbDelValuesSerialize(in *MsgDelValues) *pbx.DelValues {
+	if in == nil {
+		return nil
+	}
+
+	return &pbx.DelValues{
+		DelId:  int32(in.DelId),
+		DelSeq: pbDelQuerySerialize(in.DelSeq),
+	}
+}
+
+func pbClientCredDeserialize(in *pbx.ClientCred) *MsgCredClient {
+	if in == nil {
+		return nil
+	}
+
+	return &MsgCredClient{
+		Method:   in.GetMethod(),
+		Value:    in.GetValue(),
+		Response: in.GetResponse(),
+		Params:   byteMapToInterfaceMap(in.GetParams())}
+}
+
+func pbClientCredsDeserialize(in []*pbx.ClientCred) []MsgCredClient {
+	if in == nil {
+		return nil
+	}
+
+	out := make([]MsgCredClient, len(in))
+	for i, cr := range in {
+		out[i] = *pbClientCredDeserialize(cr)
+	}
+
+	return out
+}
+
+func pbServerCredsSerialize(in []*MsgCredServer) []*pbx.ServerCred {
+	if in == nil {
+		return nil
+	}
+
+	out := make([]*pbx.ServerCred, len(in))
+	for i, cr := range in {
+		out[i] = &pbx.ServerCred{
+			Method: cr.Method,
+			Value:  cr.Value,
+			Done:   cr.Done}
+	}
+
+	return out
+}
@@ -0,0 +1,230 @@
+// 客户端处理消息过慢时发送队列的处理策略
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+// sendPolicy 定义session的发送队列拥堵时的处理方式。
+// 队列长度达到coalesceLevel后{pres}被合并，达到dropLevel后{pres}和"正在输入"通知被丢弃，
+// 队列长度持续超过dropLevel达到overflowTimeout后断开连接。
+type sendPolicy struct {
+	// Queue depth at which presence notifications are coalesced: only the latest one is kept.
+	coalesceLevel int
+	// Queue depth at which presence notifications and typing notes are dropped.
+	dropLevel int
+	// Session is disconnected if the queue depth stays above dropLevel for this long.
+	overflowTimeout time.Duration
+}
+
+// maxDeferredPres is the maximum number of coalesced {pres} messages per session.
+const maxDeferredPres = 64
+
+// sendPolicies 按照session的类型定义的发送策略，没有定义策略的session不做任何处理。
+var sendPolicies = map[SessionProto]*sendPolicy{
+	WEBSOCK: {
+		coalesceLevel:   sendQueueLimit / 2,
+		dropLevel:       sendQueueLimit * 3 / 4,
+		overflowTimeout: time.Second * 5,
+	},
+	GRPC: {
+		coalesceLevel:   sendQueueLimit / 2,
+		dropLevel:       sendQueueLimit * 3 / 4,
+		overflowTimeout: time.Second * 5,
+	},
+	// Long polling delivers one message per request, give it more time.
+	LPOLL: {
+		coalesceLevel:   sendQueueLimit / 2,
+		dropLevel:       sendQueueLimit * 3 / 4,
+		overflowTimeout: idleSessionTimeout,
+	},
+}
+
+// sendPolicyConfig 是配置文件中的发送策略，没有设置的值使用默认值
+type sendPolicyConfig struct {
+	CoalesceLevel int `json:"coalesce_level"`
+	DropLevel     int `json:"drop_level"`
+	// Overflow timeout in seconds.
+	OverflowTimeout int `json:"overflow_timeout"`
+}
+
+// sendPoliciesInit 使用配置文件覆盖默认的发送策略。配置按session类型设置："ws", "lp", "grpc"
+func sendPoliciesInit(config map[string]*sendPolicyConfig) error {
+	protos := map[string]SessionProto{"ws": WEBSOCK, "lp": LPOLL, "grpc": GRPC}
+	for name, conf := range config {
+		proto, ok := protos[name]
+		if !ok {
+			return errors.New("send_queue: unknown session type '" + name + "'")
+		}
+		if conf == nil {
+			continue
+		}
+
+		policy := *sendPolicies[proto]
+		if conf.CoalesceLevel > 0 {
+			policy.coalesceLevel = conf.CoalesceLevel
+		}
+		if conf.DropLevel > 0 {
+			policy.dropLevel = conf.DropLevel
+		}
+		if conf.OverflowTimeout > 0 {
+			policy.overflowTimeout = time.Duration(conf.OverflowTimeout) * time.Second
+		}
+		if policy.coalesceLevel > policy.dropLevel || policy.dropLevel > sendQueueLimit {
+			return errors.New("send_queue: levels must satisfy coalesce_level <= drop_level <= " +
+				strconv.Itoa(sendQueueLimit) + " for '" + name + "'")
+		}
+		sendPolicies[proto] = &policy
+	}
+	return nil
+}
+
+// droppable 检查消息在队列拥堵时是否可以丢弃：在线状态以及"正在输入"通知。
+// 这些消息丢失后客户端可以重新获取最新状态。
+func (msg *ServerComMessage) droppable() bool {
+	if msg.Info != nil {
+		return msg.Info.What == "kp"
+	}
+	if msg.Pres != nil {
+		switch msg.Pres.What {
+		case "on", "off", "ua", "read", "recv":
+			return true
+		}
+	}
+	return false
+}
+
+// coalesceKey 返回合并{pres}时使用的键：同一个键只保留最新的消息。
+func (msg *ServerComMessage) coalesceKey() string {
+	what := msg.Pres.What
+	if what == "off" {
+		// "on" and "off" replace each other.
+		what = "on"
+	}
+	return msg.Pres.Topic + "/" + msg.Pres.Src + "/" + what
+}
+
+// admit 按照session的发送策略决定消息是否直接进入发送队列。
+// 返回false表示消息已经被丢弃或者被合并，不需要再发送。
+// msg为nil表示已经序列化的消息，这种消息不会被丢弃，只检查队列是否拥堵。
+func (s *Session) admit(msg *ServerComMessage) bool {
+	policy := sendPolicies[s.proto]
+	if policy == nil {
+		return true
+	}
+
+	depth := len(s.send)
+	s.checkOverflow(policy, depth)
+
+	if msg == nil || !msg.droppable() {
+		return true
+	}
+	if depth >= policy.dropLevel {
+		atomic.AddInt64(&s.dropped, 1)
+		return false
+	}
+	if msg.Info != nil {
+		// Typing notifications are not coalesced.
+		return true
+	}
+	// Once some {pres} are deferred all subsequent ones are deferred too, otherwise
+	// an older deferred {pres} could overwrite the newer one on the client.
+	if depth >= policy.coalesceLevel || atomic.LoadInt32(&s.deferredCount) > 0 {
+		s.deferPres(msg)
+		return false
+	}
+	return true
+}
+
+// checkOverflow 记录发送队列拥堵的开始时间，拥堵持续时间过长时断开连接。
+func (s *Session) checkOverflow(policy *sendPolicy, depth int) {
+	if depth < policy.dropLevel {
+		atomic.StoreInt64(&s.overflowSince, 0)
+		return
+	}
+
+	now := time.Now().UnixNano()
+	since := atomic.LoadInt64(&s.overflowSince)
+	if since == 0 {
+		atomic.CompareAndSwapInt64(&s.overflowSince, 0, now)
+		return
+	}
+
+	if time.Duration(now-since) > policy.overflowTimeout &&
+		atomic.CompareAndSwapInt32(&s.slowConsumer, 0, 1) {
+		logs.Warn.Println("s.queueOut: client is too slow, disconnecting", s.sid, depth)
+		_, data := s.serialize(ErrSlowConsumer(time.Now().UTC().Round(time.Millisecond)))
+		// Never block here, the caller is likely a topic's run() goroutine.
+		select {
+		case s.stop <- data:
+		default:
+		}
+	}
+}
+
+// deferPres 将{pres}保存起来，队列不再拥堵后由写循环发送
+func (s *Session) deferPres(msg *ServerComMessage) {
+	key := msg.coalesceKey()
+
+	s.presLock.Lock()
+	defer s.presLock.Unlock()
+
+	if s.deferredPres == nil {
+		s.deferredPres = make(map[string]*ServerComMessage)
+	}
+	if _, ok := s.deferredPres[key]; !ok && len(s.deferredPres) >= maxDeferredPres {
+		atomic.AddInt64(&s.dropped, 1)
+		return
+	}
+	s.deferredPres[key] = msg
+	atomic.StoreInt32(&s.deferredCount, int32(len(s.deferredPres)))
+}
+
+// flushDeferred 由写循环在发送消息后调用，队列不再拥堵时将合并后的{pres}放入发送队列
+func (s *Session) flushDeferred() {
+	if atomic.LoadInt32(&s.deferredCount) == 0 {
+		return
+	}
+	policy := sendPolicies[s.proto]
+	if policy == nil || len(s.send) >= policy.coalesceLevel {
+		return
+	}
+
+	s.presLock.Lock()
+	defer s.presLock.Unlock()
+
+	for key, msg := range s.deferredPres {
+		select {
+		case s.send <- msg:
+			delete(s.deferredPres, key)
+		default:
+			// The queue is full again, try later.
+			atomic.StoreInt32(&s.deferredCount, int32(len(s.deferredPres)))
+			return
+		}
+	}
+	atomic.StoreInt32(&s.deferredCount, 0)
+}
+
+// purgeDeferred 丢弃所有合并的{pres}
+func (s *Session) purgeDeferred() {
+	s.presLock.Lock()
+	s.deferredPres = nil
+	atomic.StoreInt32(&s.deferredCount, 0)
+	s.presLock.Unlock()
+}
+
+// queueStats 返回session的发送队列状态：队列长度、合并的{pres}数量以及丢弃的消息数量
+func (s *Session) queueStats() map[string]int64 {
+	return map[string]int64{
+		"depth":    int64(len(s.send)),
+		"deferred": int64(atomic.LoadInt32(&s.deferredCount)),
+		"dropped":  atomic.LoadInt64(&s.dropped),
+	}
+}
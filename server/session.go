@@ -1,22 +1,66 @@
 package main
 
 import (
+	"GoChat/server/auth"
+	"GoChat/server/store"
 	"GoChat/server/store/types"
 	"container/list"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/tinode/chat/pbx"
-	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/logs"
 )
 
 const sendTimeout = time.Millisecond * 7
 const sendQueueLimit = 128
 const deferredNotificationsTimeout = time.Second * 5
 
+// 网络连接断开后，session等待客户端恢复的时间
+const suspendedSessionTimeout = time.Second * 30
+
 var minSupportedVersionValue = parseVersion(minSupportedVersion)
 
+// protoFeature 是协议中可以按客户端版本开启的功能，位标志
+type protoFeature int
+
+const (
+	// 在{hi}的{ctrl}回复中返回服务器参数
+	featureServerParams protoFeature = 1 << iota
+	// {hi}中的background标记：后台session延迟发送在线通知
+	featureBackground
+	// 网络连接断开后，通过{hi}中的sid恢复session
+	featureResume
+)
+
+// protoCapabilities 按协议版本列出新增的功能。
+// 客户端支持所有不高于其版本的条目中的功能。新功能只能追加到表的末尾。
+var protoCapabilities = []struct {
+	ver      int
+	features protoFeature
+}{
+	{parseVersion("0.15"), featureServerParams | featureBackground},
+	{parseVersion("0.16"), featureResume},
+}
+
+// capabilitiesFor 返回指定协议版本支持的所有功能
+func capabilitiesFor(ver int) protoFeature {
+	var features protoFeature
+	for _, c := range protoCapabilities {
+		if versionCompare(ver, c.ver) >= 0 {
+			features |= c.features
+		}
+	}
+	return features
+}
+
 //用户传输消息的通信协议
 type SessionProto int
 
@@ -65,6 +109,10 @@ type Session struct {
 
 	// Protocol version of the client: ((major & 0xff) << 8) | (minor & 0xff).
 	ver int
+	// Protocol features supported by the client, derived from ver.
+	features protoFeature
+	// Wire codec of the session, index in codecs. Read/written atomically.
+	codec int32
 
 	// Device ID of the client
 	deviceID string
@@ -89,7 +137,10 @@ type Session struct {
 	lastAction int64
 
 	// Background session: subscription presence notifications and online status are delayed.
-	background bool
+	// Read/written atomically: the session sets it, topics read it.
+	// 0 = false
+	// 1 = true
+	background int32
 	// Timer which triggers after some seconds to mark background session as foreground.
 	bkgTimer *time.Timer
 
@@ -118,6 +169,39 @@ type Session struct {
 	// Content is topic name to detach from.
 	detach chan string
 
+	// Indicates that the network connection was lost and the session is waiting to be resumed.
+	// Read/written atomically.
+	// 0 = false
+	// 1 = true
+	suspended int32
+	// Signals the write loop that the connection was lost and the session should wait
+	// to be resumed. Buffered = 1.
+	suspend chan struct{}
+	// Hands the suspended session over to a new connection. Unbuffered.
+	resume chan struct{}
+	// Suspended session which took over the network connection of this session.
+	// Accessed only by the read loop.
+	resumed *Session
+	// Secret the client must present in {hi} to resume this session. Only the client which
+	// received it in reply to {hi} knows it. Set once in {hi}, empty if the session cannot be resumed.
+	resumeKey string
+
+	// Send queue policy state, see sendqueue.go.
+	// Time in nanoseconds when the send queue started to overflow, 0 if not overflowing.
+	// Read/written atomically.
+	overflowSince int64
+	// Set to 1 when the session is being disconnected for not reading messages fast enough.
+	// Read/written atomically.
+	slowConsumer int32
+	// Number of messages dropped because the client could not keep up. Read/written atomically.
+	dropped int64
+	// Coalesced {pres} messages waiting for the send queue to drain, indexed by coalescing key.
+	deferredPres map[string]*ServerComMessage
+	// Number of messages in deferredPres. Read/written atomically.
+	deferredCount int32
+	// Mutex for deferredPres access.
+	presLock sync.Mutex
+
 	// Map of topic subscriptions, indexed by topic name.
 	// Don't access directly. Use getters/setters.
 	subs map[string]*Subscription
@@ -144,3 +228,1173 @@ type Subscription struct {
 	//当session更新时，向topic发送ping包
 	supd chan<- *sessionUpdate
 }
+
+func (s *Session) addSub(topic string, sub *Subscription) {
+	s.subsLock.Lock()
+	s.subs[topic] = sub
+	s.subsLock.Unlock()
+}
+
+func (s *Session) getSub(topic string) *Subscription {
+	s.subsLock.RLock()
+	defer s.subsLock.RUnlock()
+
+	return s.subs[topic]
+}
+
+func (s *Session) delSub(topic string) {
+	s.subsLock.Lock()
+	delete(s.subs, topic)
+	s.subsLock.Unlock()
+}
+
+func (s *Session) countSub() int {
+	s.subsLock.RLock()
+	defer s.subsLock.RUnlock()
+
+	return len(s.subs)
+}
+
+// 通知所有订阅的topic该session即将关闭
+func (s *Session) unsubAll() {
+	s.subsLock.RLock()
+	defer s.subsLock.RUnlock()
+
+	for _, sub := range s.subs {
+		// sub.done is the same as topic.unreg
+		// Leave message is not set because the whole session is being dropped.
+		sub.done <- &sessionLeave{sess: s}
+	}
+}
+
+// queueOut attempts to send a ServerComMessage to a session write loop;
+// it fails, if the send buffer is full.
+func (s *Session) queueOut(msg *ServerComMessage) bool {
+	if s == nil {
+		return true
+	}
+	if atomic.LoadInt32(&s.terminating) > 0 {
+		return true
+	}
+	if !s.admit(msg) {
+		// Dropped or coalesced by the send queue policy.
+		return true
+	}
+
+	select {
+	case s.send <- msg:
+	default:
+		// Never block here since it may also block the topic's run() goroutine.
+		logs.Err.Println("s.queueOut: session's send queue full", s.sid)
+		return false
+	}
+	return true
+}
+
+// queueOutBytes attempts to send a ServerComMessage already serialized to []byte.
+// If the send buffer is full, it fails.
+func (s *Session) queueOutBytes(data []byte) bool {
+	if s == nil || atomic.LoadInt32(&s.terminating) > 0 {
+		return true
+	}
+	// Serialized messages are never dropped, but still count towards the queue overflow.
+	s.admit(nil)
+
+	select {
+	case s.send <- data:
+	default:
+		logs.Err.Println("s.queueOutBytes: session's send queue full", s.sid)
+		return false
+	}
+	return true
+}
+
+// supports 检查客户端的协议版本是否支持指定的功能
+func (s *Session) supports(f protoFeature) bool {
+	return s.features&f == f
+}
+
+// detachSession 由topic调用，通知session已经从topic中分离
+func (s *Session) detachSession(fromTopic string) {
+	if atomic.LoadInt32(&s.terminating) == 0 {
+		s.detach <- fromTopic
+	}
+}
+
+func (s *Session) stopSession(data interface{}) {
+	s.stop <- data
+}
+
+func (s *Session) purgeChannels() {
+	for len(s.send) > 0 {
+		<-s.send
+	}
+	for len(s.stop) > 0 {
+		<-s.stop
+	}
+	for len(s.detach) > 0 {
+		<-s.detach
+	}
+	s.purgeDeferred()
+}
+
+// cleanUp is called when the session is terminated to perform resource cleanup.
+func (s *Session) cleanUp(expired bool) {
+	atomic.StoreInt32(&s.terminating, 1)
+	s.purgeChannels()
+	s.inflightReqs.Wait()
+	if !expired {
+		s.sessionStoreLock.Lock()
+		globals.sessionStore.Delete(s)
+		s.sessionStoreLock.Unlock()
+	}
+
+	atomic.StoreInt32(&s.background, 0)
+	s.bkgTimer.Stop()
+	s.unsubAll()
+	// Stop the write loop.
+	s.stopSession(nil)
+}
+
+// Message received, convert bytes to ClientComMessage and dispatch
+func (s *Session) dispatchRaw(raw []byte) {
+	now := types.TimeNow()
+	var msg ClientComMessage
+
+	if atomic.LoadInt32(&s.terminating) > 0 {
+		logs.Warn.Println("s.dispatch: message received on a terminating session", s.sid)
+		s.queueOut(ErrLocked("", "", now))
+		return
+	}
+
+	if len(raw) == 1 && raw[0] == 0x31 {
+		// 0x31 == '1'. This is a network probe message. Respond with a '0':
+		s.queueOutBytes([]byte{0x30})
+		return
+	}
+
+	toLog := raw
+	truncated := ""
+	if len(raw) > 512 {
+		toLog = raw[:512]
+		truncated = "<...>"
+	}
+	c := codecs[s.getCodec()]
+	if c.binary() {
+		logs.Info.Printf("in: %s %d bytes sid='%s' uid='%s'", c.name(), len(raw), s.sid, s.uid)
+	} else {
+		logs.Info.Printf("in: '%s%s' sid='%s' uid='%s'", toLog, truncated, s.sid, s.uid)
+	}
+
+	if err := c.unmarshal(raw, &msg); err != nil {
+		// Malformed message
+		logs.Warn.Println("s.dispatch", err, s.sid)
+		s.queueOut(ErrMalformed("", "", now))
+		return
+	}
+
+	s.dispatch(&msg)
+}
+
+//处理客户端发送的消息
+//协议要求的顺序：首先是{hi}，然后是{login}或{acc}，最后才是针对topic的操作
+func (s *Session) dispatch(msg *ClientComMessage) {
+	now := types.TimeNow()
+	atomic.StoreInt64(&s.lastAction, now.UnixNano())
+	msg.Timestamp = now
+
+	if msg.AsUser == "" {
+		msg.AsUser = s.uid.UserId()
+		msg.AuthLvl = int(s.authLvl)
+	} else if s.authLvl != auth.LevelRoot {
+		// 只有root用户可以代表其他用户发送消息
+		s.queueOut(ErrPermissionDenied("", "", msg.Timestamp))
+		logs.Warn.Println("s.dispatch: non-root asigned msg.from", s.sid)
+		return
+	} else if fromUid := types.ParseUserId(msg.AsUser); fromUid.IsZero() {
+		s.queueOut(ErrMalformed("", "", msg.Timestamp))
+		logs.Warn.Println("s.dispatch: malformed msg.from: ", msg.AsUser, s.sid)
+		return
+	} else if auth.Level(msg.AuthLvl) == auth.LevelNone {
+		// AuthLvl is not set by caller, assign default LevelAuth.
+		msg.AuthLvl = int(auth.LevelAuth)
+	}
+
+	var handler func(*ClientComMessage)
+	var uaRefresh bool
+	// 用户主动的操作，后台session收到后立即转为前台
+	var foreground bool
+
+	// 检查是否已经收到{hi}
+	checkVers := func(m *ClientComMessage, handler func(*ClientComMessage)) func(*ClientComMessage) {
+		return func(m *ClientComMessage) {
+			if s.ver == 0 {
+				logs.Warn.Println("s.dispatch: {hi} is missing", s.sid)
+				s.queueOut(ErrCommandOutOfSequence(m.Id, m.Original, msg.Timestamp))
+				return
+			}
+			handler(m)
+		}
+	}
+
+	// 检查用户是否已经登录
+	checkUser := func(m *ClientComMessage, handler func(*ClientComMessage)) func(*ClientComMessage) {
+		return func(m *ClientComMessage) {
+			if msg.AsUser == "" {
+				logs.Warn.Println("s.dispatch: authentication required", s.sid)
+				s.queueOut(ErrAuthRequiredReply(m, m.Timestamp))
+				return
+			}
+			handler(m)
+		}
+	}
+
+	switch {
+	case msg.Pub != nil:
+		handler = checkVers(msg, checkUser(msg, s.publish))
+		msg.Id = msg.Pub.Id
+		msg.Original = msg.Pub.Topic
+		uaRefresh = true
+		foreground = true
+
+	case msg.Sub != nil:
+		handler = checkVers(msg, checkUser(msg, s.subscribe))
+		msg.Id = msg.Sub.Id
+		msg.Original = msg.Sub.Topic
+		uaRefresh = true
+
+	case msg.Leave != nil:
+		handler = checkVers(msg, checkUser(msg, s.leave))
+		msg.Id = msg.Leave.Id
+		msg.Original = msg.Leave.Topic
+
+	case msg.Hi != nil:
+		handler = s.hello
+		msg.Id = msg.Hi.Id
+
+	case msg.Login != nil:
+		handler = checkVers(msg, s.login)
+		msg.Id = msg.Login.Id
+
+	case msg.Get != nil:
+		handler = checkVers(msg, checkUser(msg, s.get))
+		msg.Id = msg.Get.Id
+		msg.Original = msg.Get.Topic
+		uaRefresh = true
+
+	case msg.Set != nil:
+		handler = checkVers(msg, checkUser(msg, s.set))
+		msg.Id = msg.Set.Id
+		msg.Original = msg.Set.Topic
+		uaRefresh = true
+
+	case msg.Del != nil:
+		handler = checkVers(msg, checkUser(msg, s.del))
+		msg.Id = msg.Del.Id
+		msg.Original = msg.Del.Topic
+
+	case msg.Acc != nil:
+		handler = checkVers(msg, s.acc)
+		msg.Id = msg.Acc.Id
+
+	case msg.Note != nil:
+		handler = s.note
+		msg.Original = msg.Note.Topic
+		uaRefresh = true
+		// "recv" is sent by push wake-ups too, only typing and reading are user actions.
+		foreground = msg.Note.What == "kp" || msg.Note.What == "read"
+
+	default:
+		// Unknown message
+		s.queueOut(ErrMalformed("", "", msg.Timestamp))
+		logs.Warn.Println("s.dispatch: unknown message", s.sid)
+		return
+	}
+
+	if foreground && atomic.LoadInt32(&s.background) == 1 && s.bkgTimer.Stop() {
+		// 计时器尚未触发，由这里完成转换
+		atomic.StoreInt32(&s.background, 0)
+		s.onBackgroundTimer()
+	}
+
+	handler(msg)
+
+	// 通知'me' topic该session当前处于活跃状态
+	if uaRefresh && msg.AsUser != "" && s.userAgent != "" {
+		if sub := s.getSub(msg.AsUser); sub != nil {
+			// The chan is buffered. If the buffer is exhaused, the session will wait for 'me' to become available
+			sub.supd <- &sessionUpdate{userAgent: s.userAgent}
+		}
+	}
+}
+
+// 请求订阅topic
+func (s *Session) subscribe(msg *ClientComMessage) {
+	if strings.HasPrefix(msg.Original, "new") || strings.HasPrefix(msg.Original, "nch") {
+		// 创建新的群组topic，"nch"创建的群组同时也是频道
+		msg.RcptTo = genTopicName()
+	} else {
+		var resp *ServerComMessage
+		msg.RcptTo, resp = s.expandTopicName(msg)
+		if resp != nil {
+			s.queueOut(resp)
+			return
+		}
+	}
+
+	// Session can subscribe to topic on behalf of a single user at a time.
+	if sub := s.getSub(msg.RcptTo); sub != nil {
+		s.queueOut(InfoAlreadySubscribed(msg.Id, msg.Original, msg.Timestamp))
+	} else {
+		s.inflightReqs.Add(1)
+		select {
+		case globals.hub.join <- &sessionJoin{
+			pkt:  msg,
+			sess: s}:
+		default:
+			// Reply with a 500 to the user.
+			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
+			s.inflightReqs.Done()
+			logs.Err.Println("s.subscribe: hub.join queue full, topic ", msg.RcptTo, s.sid)
+		}
+		// Hub will send Ctrl success/failure packets back to session
+	}
+}
+
+// 离开或取消订阅topic
+func (s *Session) leave(msg *ClientComMessage) {
+	// Expand topic name
+	var resp *ServerComMessage
+	msg.RcptTo, resp = s.expandTopicName(msg)
+	if resp != nil {
+		s.queueOut(resp)
+		return
+	}
+
+	if sub := s.getSub(msg.RcptTo); sub != nil {
+		// Session is attached to the topic.
+		if (msg.Original == "me" || msg.Original == "fnd") && msg.Leave.Unsub {
+			// User should not unsubscribe from 'me' or 'find'. Just leaving is fine.
+			s.queueOut(ErrPermissionDeniedReply(msg, msg.Timestamp))
+		} else {
+			// Unlink from topic, topic will send a reply.
+			s.delSub(msg.RcptTo)
+			s.inflightReqs.Add(1)
+			sub.done <- &sessionLeave{
+				pkt:  msg,
+				sess: s}
+		}
+	} else if !msg.Leave.Unsub {
+		// Session is not attached to the topic, wants to leave - fine, no change
+		s.queueOut(InfoNotJoined(msg.Id, msg.Original, msg.Timestamp))
+	} else {
+		// Session wants to unsubscribe from the topic it did not join
+		logs.Warn.Println("s.leave:", "must attach first", s.sid)
+		s.queueOut(ErrAttachFirst(msg, msg.Timestamp))
+	}
+}
+
+// 向topic的所有订阅者广播消息
+func (s *Session) publish(msg *ClientComMessage) {
+	var resp *ServerComMessage
+	msg.RcptTo, resp = s.expandTopicName(msg)
+	if resp != nil {
+		s.queueOut(resp)
+		return
+	}
+
+	// Add "sender" header if the message is sent on behalf of another user.
+	if msg.AsUser != s.uid.UserId() {
+		if msg.Pub.Head == nil {
+			msg.Pub.Head = make(map[string]interface{})
+		}
+		msg.Pub.Head["sender"] = s.uid.UserId()
+	} else if msg.Pub.Head != nil {
+		// Clear potentially false "sender" field.
+		delete(msg.Pub.Head, "sender")
+		if len(msg.Pub.Head) == 0 {
+			msg.Pub.Head = nil
+		}
+	}
+
+	data := &ServerComMessage{Data: &MsgServerData{
+		Topic:     msg.Original,
+		From:      msg.AsUser,
+		Timestamp: msg.Timestamp,
+		Head:      msg.Pub.Head,
+		Content:   msg.Pub.Content},
+		// Internal-only values.
+		Id:        msg.Id,
+		RcptTo:    msg.RcptTo,
+		AsUser:    msg.AsUser,
+		Timestamp: msg.Timestamp,
+		sess:      s}
+	if msg.Pub.NoEcho {
+		data.SkipSid = s.sid
+	}
+	if sub := s.getSub(msg.RcptTo); sub != nil {
+		// This is a post to a subscribed topic. The message is sent to the topic only
+		select {
+		case sub.broadcast <- data:
+		default:
+			// Reply with a 500 to the user.
+			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
+			logs.Err.Println("s.publish: sub.broadcast channel full, topic ", msg.RcptTo, s.sid)
+		}
+	} else {
+		// Publish request received without attaching to topic first.
+		s.queueOut(ErrAttachFirst(msg, msg.Timestamp))
+		logs.Warn.Println("s.publish:", "must attach first", s.sid)
+	}
+}
+
+// 处理{hi}：客户端元数据
+func (s *Session) hello(msg *ClientComMessage) {
+	var params map[string]interface{}
+	var deviceIDUpdate bool
+
+	if s.ver == 0 {
+		s.ver = parseVersion(msg.Hi.Version)
+		if s.ver == 0 {
+			logs.Warn.Println("s.hello:", "failed to parse version", s.sid)
+			s.queueOut(ErrMalformed(msg.Id, "", msg.Timestamp))
+			return
+		}
+		// 检查版本兼容性
+		if versionCompare(s.ver, minSupportedVersionValue) < 0 {
+			s.ver = 0
+			s.queueOut(ErrVersionNotSupported(msg.Id, msg.Timestamp))
+			logs.Warn.Println("s.hello:", "unsupported version", msg.Hi.Version, s.sid)
+			return
+		}
+		s.features = capabilitiesFor(s.ver)
+
+		if msg.Hi.Codec != "" {
+			// 编解码器只能在session开始时选择，gRPC自己负责序列化
+			idx := codecByName(msg.Hi.Codec)
+			if idx < 0 || s.proto == GRPC {
+				s.ver = 0
+				s.features = 0
+				s.queueOut(ErrMalformed(msg.Id, "", msg.Timestamp))
+				logs.Warn.Println("s.hello:", "unsupported codec", msg.Hi.Codec, s.sid)
+				return
+			}
+			// {hi}的回复已经使用新的编解码器
+			s.setCodec(idx)
+		}
+
+		if msg.Hi.Sid != "" {
+			// 客户端要求恢复断线前的session
+			s.resumeSession(msg)
+			return
+		}
+
+		if s.supports(featureServerParams) {
+			params = map[string]interface{}{
+				"ver":                currentVersion,
+				"maxMessageSize":     globals.maxMessageSize,
+				"maxSubscriberCount": globals.maxSubscriberCount,
+				"minTagLength":       minTagLength,
+				"maxTagLength":       maxTagLength,
+				"maxTagCount":        globals.maxTagCount,
+			}
+			if s.proto != GRPC {
+				params["codec"] = codecs[s.getCodec()].name()
+			}
+			if s.proto == WEBSOCK && s.supports(featureResume) {
+				// 客户端断线重连时用来恢复session，sid可能被其他人知道，所以同时需要密钥
+				if s.resumeKey = newResumeKey(); s.resumeKey != "" {
+					params["sid"] = s.sid
+					params["resume"] = s.resumeKey
+				}
+			}
+		}
+
+		// ua和platform只在session开始时设置，之后不再改变
+		s.userAgent = msg.Hi.UserAgent
+		s.platf = msg.Hi.Platform
+		if s.platf == "" {
+			s.platf = platformFromUA(msg.Hi.UserAgent)
+		}
+		// 后台session：延迟发送在线通知，直到计时器触发或者客户端有前台操作
+		if msg.Hi.Background && s.supports(featureBackground) {
+			atomic.StoreInt32(&s.background, 1)
+			s.bkgTimer.Reset(deferredNotificationsTimeout)
+		}
+	} else if msg.Hi.Version == "" || parseVersion(msg.Hi.Version) == s.ver {
+		// Save changed device ID+Lang or delete earlier specified device ID.
+		// Platform cannot be changed.
+		if !s.uid.IsZero() {
+			var err error
+			if msg.Hi.DeviceID == types.NullValue {
+				deviceIDUpdate = true
+				err = store.Devices.Delete(s.uid, s.deviceID)
+			} else if msg.Hi.DeviceID != "" {
+				deviceIDUpdate = true
+				err = store.Devices.Update(s.uid, s.deviceID, &types.DeviceDef{
+					DeviceId: msg.Hi.DeviceID,
+					Platform: s.platf,
+					LastSeen: msg.Timestamp,
+					Lang:     msg.Hi.Lang,
+				})
+			}
+
+			if err != nil {
+				logs.Warn.Println("s.hello:", "device ID", err, s.sid)
+				s.queueOut(ErrUnknown(msg.Id, "", msg.Timestamp))
+				return
+			}
+		}
+	} else {
+		// 同一个session中不能修改协议版本
+		s.queueOut(ErrCommandOutOfSequence(msg.Id, "", msg.Timestamp))
+		logs.Warn.Println("s.hello:", "version cannot be changed", s.sid)
+		return
+	}
+
+	if msg.Hi.DeviceID == types.NullValue {
+		msg.Hi.DeviceID = ""
+	}
+	s.deviceID = msg.Hi.DeviceID
+	s.lang = msg.Hi.Lang
+
+	var httpStatus int
+	var httpStatusText string
+	if s.proto == LPOLL || deviceIDUpdate {
+		// In case of long polling StatusCreated was reported earlier.
+		// In case of deviceID update just report success.
+		httpStatus = http.StatusOK
+		httpStatusText = "ok"
+
+	} else {
+		httpStatus = http.StatusCreated
+		httpStatusText = "created"
+	}
+
+	ctrl := &MsgServerCtrl{Id: msg.Id, Code: httpStatus, Text: httpStatusText, Timestamp: msg.Timestamp}
+	if len(params) > 0 {
+		ctrl.Params = params
+	}
+	s.queueOut(&ServerComMessage{Ctrl: ctrl})
+}
+
+// resumeSession 将当前的网络连接交给{hi}中sid指定的等待恢复的session，
+// 然后发送该session在断线期间缓存的消息。
+func (s *Session) resumeSession(msg *ClientComMessage) {
+	old := globals.sessionStore.Get(msg.Hi.Sid)
+	if old == nil || old == s || s.proto != WEBSOCK || old.proto != WEBSOCK ||
+		// resumeKey is set before the session is suspended and is immutable after that.
+		atomic.LoadInt32(&old.suspended) == 0 || old.resumeKey == "" ||
+		subtle.ConstantTimeCompare([]byte(msg.Hi.Resume), []byte(old.resumeKey)) != 1 ||
+		!s.supports(featureResume) || old.ver != s.ver || old.getCodec() != s.getCodec() ||
+		// The backlog is too long to be delivered, the session is as good as gone.
+		len(old.send) > sendQueueLimit ||
+		!atomic.CompareAndSwapInt32(&old.suspended, 1, 0) {
+
+		// The client may continue with a new session.
+		s.ver = 0
+		s.features = 0
+		resp := ErrSessionNotFound(msg.Timestamp)
+		resp.Ctrl.Id = msg.Id
+		s.queueOut(resp)
+		logs.Warn.Println("s.hello: failed to resume session", msg.Hi.Sid, s.sid)
+		return
+	}
+
+	// Wait for the write loop of the suspended session to let go of its channels.
+	old.resume <- struct{}{}
+
+	old.ws = s.ws
+	old.remoteAddr = s.remoteAddr
+
+	// The new session is no longer needed. It was never subscribed to anything.
+	globals.sessionStore.Delete(s)
+	atomic.StoreInt32(&s.terminating, 1)
+	s.resumed = old
+
+	// Messages buffered while the session was suspended are sent before the reply.
+	old.queueOut(NoErrParams(msg.Id, "", msg.Timestamp, map[string]interface{}{"sid": old.sid}))
+	// Switch the write loop of this connection to the resumed session.
+	s.stop <- old
+
+	logs.Info.Println("s.hello: session resumed", old.sid, old.remoteAddr)
+}
+
+// newResumeKey 生成恢复session所需的随机密钥，失败时返回空字符串
+func newResumeKey() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		logs.Warn.Println("s.hello: failed to generate resume key", err)
+		return ""
+	}
+	return base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(buf)
+}
+
+// 创建或更新账户
+func (s *Session) acc(msg *ClientComMessage) {
+	// 客户端提供了token时，从token中得到用户ID
+	var rec *auth.Rec
+	if msg.Acc.Token != nil {
+		if !s.uid.IsZero() {
+			s.queueOut(ErrAlreadyAuthenticated(msg.Id, "", msg.Timestamp))
+			logs.Warn.Println("s.acc: got token while already authenticated", s.sid)
+			return
+		}
+
+		tokhdl := store.GetLogicalAuthHandler("token")
+		if tokhdl == nil {
+			s.queueOut(ErrAuthUnknownScheme(msg.Id, "", msg.Timestamp))
+			logs.Warn.Println("s.acc: token authentication is not available", s.sid)
+			return
+		}
+
+		var err error
+		rec, _, err = tokhdl.Authenticate(msg.Acc.Token, s.remoteAddr)
+		if err != nil {
+			s.queueOut(decodeStoreError(err, msg.Id, "", msg.Timestamp,
+				map[string]interface{}{"what": "auth"}))
+			logs.Warn.Println("s.acc: invalid token", err, s.sid)
+			return
+		}
+	}
+
+	if strings.HasPrefix(msg.Acc.User, "new") {
+		replyCreateUser(s, msg, rec)
+	} else {
+		replyUpdateUser(s, msg, rec)
+	}
+}
+
+// onLogin 认证成功之后的处理：所有要求的凭证都已验证时将用户绑定到session，
+// 否则要求客户端验证缺少的凭证
+func (s *Session) onLogin(msgID string, timestamp time.Time, rec *auth.Rec, missing []string) *ServerComMessage {
+	var reply *ServerComMessage
+
+	features := rec.Features
+
+	params := map[string]interface{}{
+		"user":    rec.Uid.UserId(),
+		"authlvl": rec.AuthLevel.String()}
+	if len(missing) > 0 {
+		// Some credentials are not validated yet. Respond with request for validation.
+		reply = InfoValidateCredentials(msgID, timestamp)
+		params["cred"] = missing
+	} else {
+		reply = NoErr(msgID, "", timestamp)
+
+		// Check if the token is suitable for session authentication.
+		if features&auth.FeatureNoLogin == 0 {
+			if !globals.sessionStore.BindUser(s, rec.Uid) {
+				// The user is being deleted.
+				logs.Warn.Println("s.login: user is being deleted", rec.Uid.UserId(), s.sid)
+				return ErrUserNotFound(msgID, "", types.TimeNow(), timestamp)
+			}
+			s.authLvl = rec.AuthLevel
+			// Reset expiration time.
+			rec.Lifetime = 0
+		}
+		features |= auth.FeatureValidated
+
+		// Record deviceId used in this session
+		if s.deviceID != "" {
+			if err := store.Devices.Update(rec.Uid, "", &types.DeviceDef{
+				DeviceId: s.deviceID,
+				Platform: s.platf,
+				LastSeen: timestamp,
+				Lang:     s.lang,
+			}); err != nil {
+				logs.Warn.Println("failed to update device record", err)
+			}
+		}
+	}
+
+	// 客户端使用token重新登录，不需要再次发送密码
+	if tokhdl := store.GetLogicalAuthHandler("token"); tokhdl != nil {
+		rec.Features = features
+		params["token"], params["expires"], _ = tokhdl.GenSecret(rec)
+	}
+
+	reply.Ctrl.Params = params
+	return reply
+}
+
+// 身份认证
+func (s *Session) login(msg *ClientComMessage) {
+	// "reset"不是真正的认证方案：客户端请求通过凭证重置认证信息，比如忘记密码
+	if msg.Login.Scheme == "reset" {
+		if err := s.authSecretReset(msg.Login.Secret); err != nil {
+			s.queueOut(decodeStoreError(err, msg.Id, "", msg.Timestamp, nil))
+		} else {
+			s.queueOut(InfoAuthReset(msg.Id, msg.Timestamp))
+		}
+		return
+	}
+
+	if !s.uid.IsZero() {
+		s.queueOut(ErrAlreadyAuthenticated(msg.Id, "", msg.Timestamp))
+		return
+	}
+
+	handler := store.GetLogicalAuthHandler(msg.Login.Scheme)
+	if handler == nil {
+		logs.Warn.Println("s.login: unknown authentication scheme", msg.Login.Scheme, s.sid)
+		s.queueOut(ErrAuthUnknownScheme(msg.Id, "", msg.Timestamp))
+		return
+	}
+
+	rec, challenge, err := handler.Authenticate(msg.Login.Secret, s.remoteAddr)
+	if err != nil {
+		resp := decodeStoreError(err, msg.Id, "", msg.Timestamp, nil)
+		if resp.Ctrl.Code >= 500 {
+			// Log internal errors
+			logs.Warn.Println("s.login: internal", err, s.sid)
+		}
+		s.queueOut(resp)
+		return
+	}
+
+	// 认证方案没有检查用户状态时返回StateUndefined，这里检查
+	if rec.State == types.StateUndefined {
+		rec.State, err = userGetState(rec.Uid)
+	}
+	if err == nil && rec.State != types.StateOK {
+		err = types.ErrPermissionDenied
+	}
+	if err != nil {
+		logs.Warn.Println("s.login: user state check failed", rec.Uid, err, s.sid)
+		s.queueOut(decodeStoreError(err, msg.Id, "", msg.Timestamp, nil))
+		return
+	}
+
+	if challenge != nil {
+		// 多步认证：客户端需要回应服务器的challenge
+		s.queueOut(InfoChallenge(msg.Id, msg.Timestamp, challenge))
+		return
+	}
+
+	var missing []string
+	if rec.Features&auth.FeatureValidated == 0 && len(globals.authValidators[rec.AuthLevel]) > 0 {
+		var validated []string
+		// Check responses. Ignore invalid responses, just keep cred unvalidated.
+		if validated, _, err = validatedCreds(rec.Uid, rec.AuthLevel, msg.Login.Cred, false); err == nil {
+			// Get a list of credentials which have not been validated.
+			_, missing = stringSliceDelta(globals.authValidators[rec.AuthLevel], validated)
+		}
+	}
+	if err != nil {
+		logs.Warn.Println("s.login: failed to validate credentials:", err, s.sid)
+		s.queueOut(decodeStoreError(err, msg.Id, "", msg.Timestamp, nil))
+	} else {
+		s.queueOut(s.onLogin(msg.Id, msg.Timestamp, rec, missing))
+	}
+}
+
+// authSecretReset 重置认证信息，通过凭证发送重置的说明
+//  params: "auth-method-to-reset:credential-method:credential-value".
+func (s *Session) authSecretReset(params []byte) error {
+	var authScheme, credMethod, credValue string
+	if parts := strings.Split(string(params), ":"); len(parts) == 3 {
+		authScheme, credMethod, credValue = parts[0], parts[1], parts[2]
+	} else {
+		return types.ErrMalformed
+	}
+
+	// The scheme name is sent to the user, make sure it's a known scheme.
+	hdl := store.GetLogicalAuthHandler(authScheme)
+	if hdl == nil {
+		return types.ErrUnsupported
+	}
+	validator := store.GetValidator(credMethod)
+	if validator == nil {
+		return types.ErrUnsupported
+	}
+	tokhdl := store.GetLogicalAuthHandler("token")
+	if tokhdl == nil {
+		return types.ErrUnsupported
+	}
+	uid, err := store.Users.GetByCred(credMethod, credValue)
+	if err != nil {
+		return err
+	}
+	if uid.IsZero() {
+		return types.ErrNotFound
+	}
+
+	resetParams, err := hdl.GetResetParams(uid)
+	if err != nil {
+		return err
+	}
+
+	// 用户使用该token通过{acc}设置新的认证信息，不能用于登录
+	token, _, err := tokhdl.GenSecret(&auth.Rec{
+		Uid:       uid,
+		AuthLevel: auth.LevelAuth,
+		Lifetime:  auth.Duration(time.Hour * 24),
+		Features:  auth.FeatureNoLogin})
+	if err != nil {
+		return err
+	}
+
+	return validator.ResetSecret(credValue, authScheme, s.lang, token, resetParams)
+}
+
+func (s *Session) get(msg *ClientComMessage) {
+	// Expand topic name.
+	var resp *ServerComMessage
+	msg.RcptTo, resp = s.expandTopicName(msg)
+	if resp != nil {
+		s.queueOut(resp)
+		return
+	}
+
+	msg.MetaWhat = parseMsgClientMeta(msg.Get.What)
+
+	sub := s.getSub(msg.RcptTo)
+	meta := &metaReq{
+		pkt:  msg,
+		sess: s}
+
+	if meta.pkt.MetaWhat == 0 {
+		s.queueOut(ErrMalformedReply(msg, msg.Timestamp))
+		logs.Warn.Println("s.get: invalid Get message action", msg.Get.What)
+	} else if sub != nil {
+		select {
+		case sub.meta <- meta:
+		default:
+			// Reply with a 500 to the user.
+			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
+			logs.Err.Println("s.get: sub.meta channel full, topic ", msg.RcptTo, s.sid)
+		}
+	} else if meta.pkt.MetaWhat&(constMsgMetaDesc|constMsgMetaSub) != 0 {
+		// Request some minimal info from a topic not currently attached to.
+		select {
+		case globals.hub.meta <- meta:
+		default:
+			// Reply with a 500 to the user.
+			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
+			logs.Err.Println("s.get: hub.meta channel full", s.sid)
+		}
+	} else {
+		logs.Warn.Println("s.get: subscribe first to get=", msg.Get.What)
+		s.queueOut(ErrPermissionDeniedReply(msg, msg.Timestamp))
+	}
+}
+
+func (s *Session) set(msg *ClientComMessage) {
+	// Expand topic name.
+	var resp *ServerComMessage
+	msg.RcptTo, resp = s.expandTopicName(msg)
+	if resp != nil {
+		s.queueOut(resp)
+		return
+	}
+
+	meta := &metaReq{
+		pkt:  msg,
+		sess: s}
+
+	if msg.Set.Desc != nil {
+		meta.pkt.MetaWhat = constMsgMetaDesc
+	}
+	if msg.Set.Sub != nil {
+		meta.pkt.MetaWhat |= constMsgMetaSub
+	}
+	if msg.Set.Tags != nil {
+		meta.pkt.MetaWhat |= constMsgMetaTags
+	}
+
+	if meta.pkt.MetaWhat == 0 {
+		s.queueOut(ErrMalformedReply(msg, msg.Timestamp))
+		logs.Warn.Println("s.set: nil Set action")
+	} else if sub := s.getSub(msg.RcptTo); sub != nil {
+		select {
+		case sub.meta <- meta:
+		default:
+			// Reply with a 500 to the user.
+			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
+			logs.Err.Println("s.set: sub.meta channel full, topic ", msg.RcptTo, s.sid)
+		}
+	} else if meta.pkt.MetaWhat&constMsgMetaTags != 0 {
+		logs.Warn.Println("s.set: can Set tags for subscribed topics only", meta.pkt.MetaWhat)
+		s.queueOut(ErrPermissionDeniedReply(msg, msg.Timestamp))
+	} else {
+		// Desc.Private and Sub updates are possible without the subscription.
+		select {
+		case globals.hub.meta <- meta:
+		default:
+			// Reply with a 500 to the user.
+			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
+			logs.Err.Println("s.set: hub.meta channel full", s.sid)
+		}
+	}
+}
+
+func (s *Session) del(msg *ClientComMessage) {
+	msg.MetaWhat = parseMsgClientDel(msg.Del.What)
+
+	//TODO: 删除用户
+	if msg.MetaWhat == constMsgDelUser {
+		s.queueOut(ErrNotImplemented(msg.Id, "", msg.Timestamp, msg.Timestamp))
+		return
+	}
+
+	// Delete something other than user: topic, subscription, message(s)
+
+	// Expand topic name and validate request.
+	var resp *ServerComMessage
+	msg.RcptTo, resp = s.expandTopicName(msg)
+	if resp != nil {
+		s.queueOut(resp)
+		return
+	}
+
+	if msg.MetaWhat == 0 {
+		s.queueOut(ErrMalformedReply(msg, msg.Timestamp))
+		logs.Warn.Println("s.del: invalid Del action", msg.Del.What, s.sid)
+		return
+	}
+	sub := s.getSub(msg.RcptTo)
+	if sub != nil && msg.MetaWhat != constMsgDelTopic {
+		// Session is attached, deleting subscription or messages. Send to topic.
+		select {
+		case sub.meta <- &metaReq{
+			pkt:  msg,
+			sess: s}:
+		default:
+			// Reply with a 500 to the user.
+			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
+			logs.Err.Println("s.del: sub.meta channel full, topic ", msg.RcptTo, s.sid)
+		}
+	} else if msg.MetaWhat == constMsgDelTopic {
+		// Deleting topic: for sessions attached or not attached, send request to hub first.
+		// Hub will forward to topic, if appropriate.
+		select {
+		case globals.hub.unreg <- &topicUnreg{
+			rcptTo: msg.RcptTo,
+			pkt:    msg,
+			sess:   s,
+			del:    true}:
+		default:
+			// Reply with a 500 to the user.
+			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
+			logs.Err.Println("s.del: hub.unreg channel full", s.sid)
+		}
+	} else {
+		// Must join the topic to delete messages or subscriptions.
+		s.queueOut(ErrAttachFirst(msg, msg.Timestamp))
+		logs.Warn.Println("s.del: invalid Del action while unsubbed", msg.Del.What, s.sid)
+	}
+}
+
+// 向topic的活跃订阅者广播临时的{info}消息，不返回任何错误
+func (s *Session) note(msg *ClientComMessage) {
+	if s.ver == 0 || msg.AsUser == "" {
+		// Silently ignore the message: have not received {hi} or don't know who sent the message.
+		return
+	}
+
+	// Expand topic name and validate request.
+	var resp *ServerComMessage
+	msg.RcptTo, resp = s.expandTopicName(msg)
+	if resp != nil {
+		// Silently ignoring the message
+		return
+	}
+
+	switch msg.Note.What {
+	case "kp":
+		if msg.Note.SeqId != 0 {
+			return
+		}
+	case "read", "recv":
+		if msg.Note.SeqId <= 0 {
+			return
+		}
+	default:
+		return
+	}
+
+	response := &ServerComMessage{
+		Info: &MsgServerInfo{
+			Topic: msg.Original,
+			From:  msg.AsUser,
+			What:  msg.Note.What,
+			SeqId: msg.Note.SeqId},
+		RcptTo:    msg.RcptTo,
+		AsUser:    msg.AsUser,
+		Timestamp: msg.Timestamp,
+		SkipSid:   s.sid,
+		sess:      s}
+	if sub := s.getSub(msg.RcptTo); sub != nil {
+		// Pings can be sent to subscribed topics only
+		select {
+		case sub.broadcast <- response:
+		default:
+			// Reply with a 500 to the user.
+			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
+			logs.Err.Println("s.note: sub.broacast channel full, topic ", msg.RcptTo, s.sid)
+		}
+	} else if msg.Note.What == "recv" {
+		// Client received a pres notification about a new message, initiated a fetch
+		// from the server (and detached from the topic) and acknowledges receipt.
+		// Hub will forward to topic, if appropriate.
+		select {
+		case globals.hub.route <- response:
+		default:
+			// Reply with a 500 to the user.
+			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
+			logs.Err.Println("s.note: hub.route channel full", s.sid)
+		}
+	} else {
+		s.queueOut(ErrAttachFirst(msg, msg.Timestamp))
+		logs.Warn.Println("s.note: note to invalid topic - must subscribe first", msg.Note.What, s.sid)
+	}
+}
+
+// expandTopicName 将session中的topic名称扩展为全局可路由的名称
+// 返回值
+//   routeTo: 可路由的全局topic名称
+//   err: 需要返回给发送者的错误信息
+func (s *Session) expandTopicName(msg *ClientComMessage) (string, *ServerComMessage) {
+	if msg.Original == "" {
+		logs.Warn.Println("s.etn: empty topic name", s.sid)
+		return "", ErrMalformed(msg.Id, "", msg.Timestamp)
+	}
+
+	// Expanded name of the topic to route to i.e. rcptto: or s.subs[routeTo]
+	var routeTo string
+	if msg.Original == "me" {
+		routeTo = msg.AsUser
+	} else if msg.Original == "fnd" {
+		routeTo = types.ParseUserId(msg.AsUser).FndName()
+	} else if strings.HasPrefix(msg.Original, "usr") {
+		// p2p topic
+		uid1 := types.ParseUserId(msg.AsUser)
+		uid2 := types.ParseUserId(msg.Original)
+		if uid2.IsZero() {
+			// Ensure the user id is valid.
+			logs.Warn.Println("s.etn: failed to parse p2p topic name", s.sid)
+			return "", ErrMalformed(msg.Id, msg.Original, msg.Timestamp)
+		} else if uid2 == uid1 {
+			// Use 'me' to access self-topic.
+			logs.Warn.Println("s.etn: invalid p2p self-subscription", s.sid)
+			return "", ErrPermissionDeniedReply(msg, msg.Timestamp)
+		}
+		routeTo = uid1.P2PName(uid2)
+	} else if strings.HasPrefix(msg.Original, "p2p") {
+		// Clients address p2p topics by the ID of the other user.
+		uid1, uid2, err := types.ParseP2P(msg.Original)
+		if err != nil {
+			logs.Warn.Println("s.etn: failed to parse p2p topic name", s.sid)
+			return "", ErrMalformed(msg.Id, msg.Original, msg.Timestamp)
+		}
+		asUid := types.ParseUserId(msg.AsUser)
+		if asUid != uid1 && asUid != uid2 {
+			return "", ErrPermissionDeniedReply(msg, msg.Timestamp)
+		}
+		other := uid1
+		if asUid == uid1 {
+			other = uid2
+		}
+		return "", decodeStoreErrorExplicitTs(types.ErrRedirected, msg.Id, msg.Original, types.TimeNow(), msg.Timestamp,
+			map[string]interface{}{"topic": other.UserId()})
+	} else if types.IsChannel(msg.Original) {
+		// Channel is served by the group topic.
+		routeTo = types.ChnToGrp(msg.Original)
+	} else {
+		routeTo = msg.Original
+	}
+
+	return routeTo, nil
+}
+
+// resumable 检查session在网络连接断开后能否被恢复
+func (s *Session) resumable() bool {
+	return s.proto == WEBSOCK && s.supports(featureResume) && s.resumeKey != "" && !s.uid.IsZero() &&
+		atomic.LoadInt32(&s.terminating) == 0 && atomic.LoadInt32(&s.slowConsumer) == 0 &&
+		!globals.shuttingDown
+}
+
+// connLost 由读循环在网络连接断开后调用：保留可以恢复的session，否则清理session
+func (s *Session) connLost() {
+	if s.resumable() {
+		atomic.StoreInt32(&s.suspended, 1)
+		s.suspend <- struct{}{}
+		logs.Info.Println("session suspended", s.sid)
+		return
+	}
+	s.cleanUp(false)
+}
+
+// writeFailed 由写循环在写入失败后调用，等待读循环决定是保留还是清理session。
+// 返回true表示session已经被新的连接恢复。
+func (s *Session) writeFailed() bool {
+	s.closeWS()
+	select {
+	case <-s.suspend:
+		return s.waitResume()
+	case <-s.stop:
+		// Stopped by the server, the read loop must clean up.
+		atomic.StoreInt32(&s.terminating, 1)
+		return false
+	}
+}
+
+// waitResume 在网络连接断开后保留session，发送给session的消息缓存在send中，
+// 直到新的连接恢复session或者超时。返回true表示session已经被恢复。
+func (s *Session) waitResume() bool {
+	timer := time.NewTimer(suspendedSessionTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.resume:
+			return true
+
+		case topic := <-s.detach:
+			s.delSub(topic)
+
+		case msg := <-s.stop:
+			if atomic.CompareAndSwapInt32(&s.suspended, 1, 0) {
+				s.cleanUp(false)
+				return false
+			}
+			// The session is being resumed. Let the new write loop handle the request.
+			<-s.resume
+			s.stop <- msg
+			return true
+
+		case <-timer.C:
+			if atomic.CompareAndSwapInt32(&s.suspended, 1, 0) {
+				logs.Info.Println("suspended session expired", s.sid)
+				s.cleanUp(false)
+				return false
+			}
+			// Otherwise the session is being resumed right now.
+		}
+	}
+}
+
+// onBackgroundTimer 将后台session标记为前台session，并通知所有订阅的topic
+func (s *Session) onBackgroundTimer() {
+	s.subsLock.RLock()
+	defer s.subsLock.RUnlock()
+
+	update := &sessionUpdate{sess: s}
+	for _, sub := range s.subs {
+		if sub.supd != nil {
+			sub.supd <- update
+		}
+	}
+}
+
+//将消息序列化为客户端可以接受的格式
+func (s *Session) serialize(msg *ServerComMessage) (int, interface{}) {
+	if s.proto == GRPC {
+		// gRPC负责序列化，这里只需要转换为pbx的结构
+		return -1, msg.pbMessage()
+	}
+
+	out := msg.marshal(s.getCodec())
+	return len(out.([]byte)), out
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"GoChat/server/store"
+	"GoChat/server/store/types"
 	"container/list"
+	"expvar"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/tinode/chat/pbx"
 	"github.com/tinode/chat/server/logs"
 )
 
@@ -23,6 +27,9 @@ type SessionStore struct {
 
 	//用map存储所有的session
 	sessCache map[string]*Session
+
+	// 被LockOffline锁定的用户，session不能以这些用户的身份登录
+	locked map[types.Uid]bool
 }
 
 //创建一个新的session
@@ -47,6 +54,9 @@ func (ss *SessionStore) NewSession(conn interface{}, sid string) (*Session, int)
 	case http.ResponseWriter:
 		//long polling不需要进行存储，每次请求将会改变
 		s.proto = LPOLL
+	case pbx.Node_MessageLoopServer:
+		s.proto = GRPC
+		s.grpcnode = c
 	default:
 		logs.Err.Panic("session:unkonwn connection type", conn)
 	}
@@ -54,6 +64,8 @@ func (ss *SessionStore) NewSession(conn interface{}, sid string) (*Session, int)
 	s.send = make(chan interface{}, sendQueueLimit+32)
 	s.stop = make(chan interface{}, 1)
 	s.detach = make(chan string, 64) //topic的名称
+	s.suspend = make(chan struct{}, 1)
+	s.resume = make(chan struct{})
 
 	s.bkgTimer = time.NewTimer(time.Hour)
 	s.bkgTimer.Stop()
@@ -68,5 +80,155 @@ func (ss *SessionStore) NewSession(conn interface{}, sid string) (*Session, int)
 	}
 	ss.sessCache[s.sid] = &s
 
+	//清理过期的长轮询session：lru中只有长轮询session，最近使用的在最前面
+	var expired []*Session
+	expire := s.lastTouched.Add(-ss.lifeTime)
+	for elem := ss.lru.Back(); elem != nil; elem = ss.lru.Back() {
+		sess := elem.Value.(*Session)
+		if sess.lastTouched.Before(expire) {
+			ss.lru.Remove(elem)
+			delete(ss.sessCache, sess.sid)
+			expired = append(expired, sess)
+		} else {
+			break // don't need to traverse further
+		}
+	}
+
+	numSessions := len(ss.sessCache)
+
+	ss.lock.Unlock()
+
+	// Deleting long polling sessions.
+	for _, sess := range expired {
+		// This locks the session. Thus cleaning up outside of the
+		// sessionStore lock. Otherwise deadlock.
+		sess.cleanUp(true)
+	}
+
+	return &s, numSessions
+}
+
+//根据session ID得到session
+func (ss *SessionStore) Get(sid string) *Session {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	if sess := ss.sessCache[sid]; sess != nil {
+		if sess.proto == LPOLL {
+			ss.lru.MoveToFront(sess.lpTracker)
+			sess.lastTouched = time.Now()
+		}
+
+		return sess
+	}
+
+	return nil
+}
+
+//从sessionstore中删除session
+func (ss *SessionStore) Delete(s *Session) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	delete(ss.sessCache, s.sid)
+	if s.proto == LPOLL {
+		ss.lru.Remove(s.lpTracker)
+	}
+}
+
+//关闭所有的session，并通知客户端服务器即将关闭
+func (ss *SessionStore) Shutdown() {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	shutdown := NoErrShutdown(types.TimeNow())
+	for _, s := range ss.sessCache {
+		_, data := s.serialize(shutdown)
+		s.stopSession(data)
+	}
+
+	logs.Info.Println("SessionStore shut down, sessions terminated:", len(ss.sessCache))
+}
+
+// EvictUser 终止用户的所有session，skipSid指定的session除外
+func (ss *SessionStore) EvictUser(uid types.Uid, skipSid string) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	evicted := NoErrEvicted("", "", types.TimeNow())
+	evicted.AsUser = uid.UserId()
+	for _, s := range ss.sessCache {
+		if s.uid == uid && s.sid != skipSid {
+			_, data := s.serialize(evicted)
+			s.stopSession(data)
+			delete(ss.sessCache, s.sid)
+			if s.proto == LPOLL {
+				ss.lru.Remove(s.lpTracker)
+			}
+		}
+	}
+}
+
+// LockOffline 在用户没有任何session时锁定用户，锁定期间session不能以该用户的身份登录。
+// 返回false表示用户在线。锁定的用户必须用UnlockUser解锁。
+func (ss *SessionStore) LockOffline(uid types.Uid) bool {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	for _, s := range ss.sessCache {
+		if s.uid == uid {
+			return false
+		}
+	}
+	ss.locked[uid] = true
+	return true
+}
+
+// UnlockUser 解除LockOffline对用户的锁定
+func (ss *SessionStore) UnlockUser(uid types.Uid) {
+	ss.lock.Lock()
+	delete(ss.locked, uid)
 	ss.lock.Unlock()
 }
+
+// BindUser 将登录的用户绑定到session，用户被锁定时返回false
+func (ss *SessionStore) BindUser(s *Session, uid types.Uid) bool {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	if ss.locked[uid] {
+		return false
+	}
+	s.uid = uid
+	return true
+}
+
+// queueStats 返回发送队列非空的session的队列状态，以session ID为键
+func (ss *SessionStore) queueStats() interface{} {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	stats := make(map[string]map[string]int64)
+	for sid, s := range ss.sessCache {
+		if len(s.send) > 0 || atomic.LoadInt64(&s.dropped) > 0 {
+			stats[sid] = s.queueStats()
+		}
+	}
+	return stats
+}
+
+//初始化sessionstore
+func NewSessionStore(lifetime time.Duration) *SessionStore {
+	ss := &SessionStore{
+		lru:      list.New(),
+		lifeTime: lifetime,
+
+		sessCache: make(map[string]*Session),
+		locked:    make(map[types.Uid]bool),
+	}
+
+	// 通过expvar公开每个session的发送队列长度
+	expvar.Publish("SessionQueues", expvar.Func(ss.queueStats))
+
+	return ss
+}
@@ -9,15 +9,14 @@ import (
 	"strings"
 	"time"
 
-	"github.com/tinode/chat/server/auth"
-	adapter "github.com/tinode/chat/server/db"
-	"github.com/tinode/chat/server/media"
-	"github.com/tinode/chat/server/store/types"
-	"github.com/tinode/chat/server/validate"
+	"GoChat/server/auth"
+	"GoChat/server/media"
+	"GoChat/server/store/types"
+	"GoChat/server/validate"
 )
 
-var adp adapter.Adapter
-var availableAdapters = make(map[string]adapter.Adapter)
+var adp Adapter
+var availableAdapters = make(map[string]Adapter)
 var mediaHandler media.Handler
 
 // Unique ID generator
@@ -46,7 +45,9 @@ func openAdapter(workerId int, jsonconf json.RawMessage) error {
 			if ad, ok := availableAdapters[config.UseAdapter]; ok {
 				adp = ad
 			} else {
-				return errors.New("store: " + config.UseAdapter + " adapter is not available in this binary")
+				// Adapters other than memory are compiled in with a build tag named after the adapter.
+				return errors.New("store: " + config.UseAdapter + " adapter is not available in this binary, " +
+					"build the server with '-tags " + config.UseAdapter + "'")
 			}
 		} else if len(availableAdapters) == 1 {
 			// Default to the only entry in availableAdapters.
@@ -66,6 +67,9 @@ func openAdapter(workerId int, jsonconf json.RawMessage) error {
 	if workerId < 0 || workerId > 1023 {
 		return errors.New("store: invalid worker ID")
 	}
+	if len(config.UidKey) == 0 {
+		return errors.New("store: `store_config.uid_key` is not set. Please set it to a random base64-encoded 16-byte key")
+	}
 
 	if err := uGen.Init(uint(workerId), config.UidKey); err != nil {
 		return errors.New("store: failed to init snowflake: " + err.Error())
@@ -167,7 +171,7 @@ func UpgradeDb(jsonconf json.RawMessage) error {
 
 // RegisterAdapter makes a persistence adapter available.
 // If Register is called twice or if the adapter is nil, it panics.
-func RegisterAdapter(a adapter.Adapter) {
+func RegisterAdapter(a Adapter) {
 	if a == nil {
 		panic("store: Register adapter is nil")
 	}
@@ -257,9 +261,10 @@ func (UsersObjMapper) Create(user *types.User, private interface{}) (*types.User
 // authentication secret.
 func (UsersObjMapper) GetAuthRecord(user types.Uid, scheme string) (string, auth.Level, []byte, time.Time, error) {
 	unique, authLvl, secret, expires, err := adp.AuthGetRecord(user, scheme)
-	if err == nil {
-		parts := strings.Split(unique, ":")
-		unique = parts[1]
+	if err == nil && unique != "" {
+		// Strip the "scheme:" prefix. Empty unique means the record is not found.
+		parts := strings.SplitN(unique, ":", 2)
+		unique = parts[len(parts)-1]
 	}
 	return unique, authLvl, secret, expires, err
 }
@@ -289,6 +294,12 @@ func (UsersObjMapper) DelAuthRecords(uid types.Uid, scheme string) error {
 	return adp.AuthDelScheme(uid, scheme)
 }
 
+// GetInactive returns up to limit IDs of users authenticated by the given scheme who have not been seen
+// since lastSeenBefore.
+func (UsersObjMapper) GetInactive(scheme string, lastSeenBefore time.Time, limit int) ([]types.Uid, error) {
+	return adp.AuthGetInactive(scheme, lastSeenBefore, limit)
+}
+
 // Get returns a user object for the given user id
 func (UsersObjMapper) Get(uid types.Uid) (*types.User, error) {
 	return adp.UserGet(uid)
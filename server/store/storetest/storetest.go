@@ -0,0 +1,1189 @@
+// Package storetest is a conformance test suite for database adapters. Every adapter is expected to
+// pass it when called from the adapter's own tests:
+//
+//	func TestAdapter(t *testing.T) {
+//		storetest.Run(t, "memory", nil)
+//	}
+//
+// The suite works through the public API of the store package (store.Users, store.Topics, store.Subs,
+// store.Messages, store.Devices, store.Files), so the adapter must be registered with store.RegisterAdapter.
+// The store supports just one adapter per process, thus Run should be called once per test binary.
+package storetest
+
+import (
+	"GoChat/server/auth"
+	"GoChat/server/media"
+	"GoChat/server/store"
+	"GoChat/server/store/types"
+	"encoding/json"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Key for the UID generator, any 16 bytes will do.
+const uidKey = "la6YsO+bNX/+XIkOqc5Svw=="
+
+// Name of the fake media handler and the URL path it serves files from.
+const (
+	mediaName = "storetest"
+	serveUrl  = "/v0/file/s/"
+)
+
+// Open initializes the store with the adapter registered as adapterName, e.g. for tests of packages
+// built on top of the store. The config is passed to the adapter's Open as is. All existing data is
+// deleted. The caller must close the store with store.Close.
+func Open(t *testing.T, adapterName string, config json.RawMessage) {
+	if len(config) == 0 {
+		config = json.RawMessage("{}")
+	}
+	conf, _ := json.Marshal(map[string]interface{}{
+		"uid_key":     uidKey,
+		"use_adapter": adapterName,
+		"adapters":    map[string]json.RawMessage{adapterName: config},
+	})
+
+	if err := store.InitDb(conf, true); err != nil {
+		t.Fatal("failed to initialize the database:", err)
+	}
+}
+
+// Run executes the conformance suite against the adapter registered as adapterName.
+// The config is passed to the adapter's Open as is. All existing data is deleted.
+func Run(t *testing.T, adapterName string, config json.RawMessage) {
+	Open(t, adapterName, config)
+	defer store.Close()
+
+	if name := store.GetAdapterName(); name != adapterName {
+		t.Fatalf("adapter %q is in use instead of %q", name, adapterName)
+	}
+
+	if err := store.UpgradeDb(nil); err != nil {
+		t.Fatal("upgrade of a freshly created database failed:", err)
+	}
+
+	mh := useMediaHandler(t)
+
+	tests := []struct {
+		name string
+		fn   func(t *testing.T)
+	}{
+		{"Users", testUsers},
+		{"AuthRecords", testAuthRecords},
+		{"Credentials", testCredentials},
+		{"Topics", testTopics},
+		{"Channels", testChannels},
+		{"P2P", testP2P},
+		{"Subscriptions", testSubs},
+		{"Search", testSearch},
+		{"Messages", testMessages},
+		{"DeletedMessages", testDeletedMessages},
+		{"Attachments", func(t *testing.T) { testAttachments(t, mh) }},
+		{"Devices", testDevices},
+		{"Files", testFiles},
+		{"UserDelete", testUserDelete},
+	}
+	for _, test := range tests {
+		// Every group of tests starts with an empty database.
+		if err := store.InitDb(nil, true); err != nil {
+			t.Fatal("failed to reset the database:", err)
+		}
+		t.Run(test.name, test.fn)
+	}
+}
+
+// fakeMedia is a media handler which records deleted files.
+type fakeMedia struct {
+	lock    sync.Mutex
+	deleted []string
+}
+
+func (*fakeMedia) Init(jsconf string) error                    { return nil }
+func (*fakeMedia) Redirect(method, url string) (string, error) { return "", nil }
+func (*fakeMedia) Upload(fdef *types.FileDef, file io.ReadSeeker) (string, error) {
+	return serveUrl + fdef.Id, nil
+}
+func (*fakeMedia) Download(url string) (*types.FileDef, media.ReadSeekCloser, error) {
+	return nil, nil, types.ErrUnsupported
+}
+func (*fakeMedia) GetIdFromUrl(url string) types.Uid { return media.GetIdFromUrl(url, serveUrl) }
+
+func (fm *fakeMedia) Delete(locations []string) error {
+	fm.lock.Lock()
+	fm.deleted = append(fm.deleted, locations...)
+	fm.lock.Unlock()
+	return nil
+}
+
+// takeDeleted returns the list of deleted locations, sorted, and clears it.
+func (fm *fakeMedia) takeDeleted() []string {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+	out := fm.deleted
+	fm.deleted = nil
+	sort.Strings(out)
+	return out
+}
+
+var registerMedia sync.Once
+var mediaHandler = &fakeMedia{}
+
+func useMediaHandler(t *testing.T) *fakeMedia {
+	registerMedia.Do(func() {
+		store.RegisterMediaHandler(mediaName, mediaHandler)
+	})
+	if err := store.UseMediaHandler(mediaName, ""); err != nil {
+		t.Fatal(err)
+	}
+	return mediaHandler
+}
+
+// Helpers
+
+func newUser(t *testing.T, public interface{}, tags ...string) *types.User {
+	t.Helper()
+	user := &types.User{Public: public, Tags: tags}
+	user.Access.Auth = types.ModeCP2P
+	user.Access.Anon = types.ModeNone
+	if _, err := store.Users.Create(user, map[string]interface{}{"comment": "private"}); err != nil {
+		t.Fatal("Users.Create:", err)
+	}
+	if user.Uid().IsZero() {
+		t.Fatal("Users.Create: uid is not assigned")
+	}
+	return user
+}
+
+func newTopic(t *testing.T, name string, owner types.Uid, public interface{}, tags ...string) *types.Topic {
+	t.Helper()
+	topic := &types.Topic{ObjHeader: types.ObjHeader{Id: name}, Public: public, Tags: tags}
+	topic.Access.Auth = types.ModeCPublic
+	topic.Access.Anon = types.ModeNone
+	if err := store.Topics.Create(topic, owner, "owner's private"); err != nil {
+		t.Fatal("Topics.Create:", err)
+	}
+	return topic
+}
+
+func subscribe(t *testing.T, topic string, uid types.Uid, mode types.AccessMode) {
+	t.Helper()
+	if err := store.Subs.Create(&types.Subscription{
+		User:      uid.String(),
+		Topic:     topic,
+		ModeWant:  mode,
+		ModeGiven: mode}); err != nil {
+		t.Fatal("Subs.Create:", err)
+	}
+}
+
+// saveMessages saves messages with SeqIds from..to to topic. The topic assigns SeqIds, not the store.
+func saveMessages(t *testing.T, topic string, from types.Uid, low, hi int) {
+	t.Helper()
+	for seq := low; seq <= hi; seq++ {
+		if err := store.Messages.Save(&types.Message{
+			SeqId:   seq,
+			Topic:   topic,
+			From:    from.String(),
+			Content: "message " + strconv.Itoa(seq)}, true); err != nil {
+			t.Fatal("Messages.Save:", err)
+		}
+	}
+}
+
+func seqIds(msgs []types.Message) []int {
+	ids := []int{}
+	for _, m := range msgs {
+		ids = append(ids, m.SeqId)
+	}
+	return ids
+}
+
+func topicNames(subs []types.Subscription) []string {
+	names := []string{}
+	for _, s := range subs {
+		names = append(names, s.Topic)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func subUsers(subs []types.Subscription) []string {
+	users := []string{}
+	for _, s := range subs {
+		users = append(users, s.User)
+	}
+	sort.Strings(users)
+	return users
+}
+
+func sortedStrings(in ...string) []string {
+	out := append([]string{}, in...)
+	sort.Strings(out)
+	return out
+}
+
+// sameJSON compares two values by their JSON representation: adapters may return
+// maps and numbers of different types than those originally saved.
+func sameJSON(a, b interface{}) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return string(ja) == string(jb)
+}
+
+func expect(t *testing.T, what string, got, want interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: got %v, want %v", what, got, want)
+	}
+}
+
+func expectErr(t *testing.T, what string, got, want error) {
+	t.Helper()
+	if got != want {
+		t.Errorf("%s: got error %v, want %v", what, got, want)
+	}
+}
+
+func noErr(t *testing.T, what string, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+}
+
+// Tests
+
+func testUsers(t *testing.T) {
+	alice := newUser(t, map[string]interface{}{"fn": "Alice"}, "alice", "email:alice@example.com")
+	bob := newUser(t, "Bob", "bob")
+
+	if alice.Uid() == bob.Uid() {
+		t.Fatal("users have the same uid")
+	}
+
+	user, err := store.Users.Get(alice.Uid())
+	noErr(t, "Users.Get", err)
+	if user == nil {
+		t.Fatal("Users.Get: user not found")
+	}
+	expect(t, "Uid", user.Uid(), alice.Uid())
+	expect(t, "Public", sameJSON(user.Public, alice.Public), true)
+	expect(t, "Tags", []string(user.Tags), []string{"alice", "email:alice@example.com"})
+	expect(t, "Access", user.Access, alice.Access)
+	expect(t, "State", user.State, types.StateOK)
+	if user.CreatedAt.IsZero() || !user.CreatedAt.Equal(alice.CreatedAt) {
+		t.Errorf("CreatedAt: got %v, want %v", user.CreatedAt, alice.CreatedAt)
+	}
+
+	// Unknown user: no error, no user.
+	user, err = store.Users.Get(store.GetUid())
+	noErr(t, "Users.Get unknown", err)
+	if user != nil {
+		t.Error("Users.Get unknown: expected nil user")
+	}
+
+	users, err := store.Users.GetAll(alice.Uid(), bob.Uid(), store.GetUid())
+	noErr(t, "Users.GetAll", err)
+	expect(t, "Users.GetAll count", len(users), 2)
+
+	// 'me' and 'fnd' subscriptions are created together with the user.
+	subs, err := store.Users.GetSubs(alice.Uid(), nil)
+	noErr(t, "Users.GetSubs", err)
+	expect(t, "Users.GetSubs", topicNames(subs), sortedStrings(alice.Uid().UserId(), alice.Uid().FndName()))
+	me, err := store.Subs.Get(alice.Uid().UserId(), alice.Uid())
+	noErr(t, "Subs.Get me", err)
+	if me == nil {
+		t.Fatal("Subs.Get me: not found")
+	}
+	expect(t, "me.Private", sameJSON(me.Private, map[string]interface{}{"comment": "private"}), true)
+	expect(t, "me.ModeGiven", me.ModeGiven, types.ModeCSelf)
+
+	// 'me' and 'fnd' are not returned as topics.
+	subs, err = store.Users.GetTopics(alice.Uid(), nil)
+	noErr(t, "Users.GetTopics", err)
+	expect(t, "Users.GetTopics", len(subs), 0)
+
+	when := types.TimeNow()
+	noErr(t, "Users.UpdateLastSeen", store.Users.UpdateLastSeen(alice.Uid(), "TestAgent/1.0", when))
+	noErr(t, "Users.Update", store.Users.Update(alice.Uid(),
+		map[string]interface{}{"Public": map[string]interface{}{"fn": "Alice Cooper"}}))
+	user, _ = store.Users.Get(alice.Uid())
+	expect(t, "UserAgent", user.UserAgent, "TestAgent/1.0")
+	if user.LastSeen == nil || !user.LastSeen.Equal(when) {
+		t.Errorf("LastSeen: got %v, want %v", user.LastSeen, when)
+	}
+	expect(t, "updated Public", sameJSON(user.Public, map[string]interface{}{"fn": "Alice Cooper"}), true)
+	if !user.UpdatedAt.After(alice.UpdatedAt) && !user.UpdatedAt.Equal(alice.UpdatedAt) {
+		t.Error("UpdatedAt: not updated")
+	}
+
+	tags, err := store.Users.UpdateTags(bob.Uid(), []string{"builder", "bob"}, nil, nil)
+	noErr(t, "Users.UpdateTags add", err)
+	expect(t, "tags after add", sortedStrings(tags...), []string{"bob", "builder"})
+	tags, err = store.Users.UpdateTags(bob.Uid(), nil, []string{"bob"}, nil)
+	noErr(t, "Users.UpdateTags remove", err)
+	expect(t, "tags after remove", tags, []string{"builder"})
+	tags, err = store.Users.UpdateTags(bob.Uid(), nil, nil, []string{"robert", "email:bob@example.com"})
+	noErr(t, "Users.UpdateTags reset", err)
+	expect(t, "tags after reset", sortedStrings(tags...), []string{"email:bob@example.com", "robert"})
+	user, _ = store.Users.Get(bob.Uid())
+	expect(t, "User.Tags after reset", sortedStrings(user.Tags...), []string{"email:bob@example.com", "robert"})
+
+	// Suspending the user suspends topics owned by the user.
+	newTopic(t, "grpAliceOwns", alice.Uid(), "Alice's")
+	noErr(t, "Users.UpdateState", store.Users.UpdateState(alice.Uid(), types.StateSuspended))
+	user, _ = store.Users.Get(alice.Uid())
+	expect(t, "suspended user", user.State, types.StateSuspended)
+	if user.StateAt == nil {
+		t.Error("StateAt: not set")
+	}
+	topic, _ := store.Topics.Get("grpAliceOwns")
+	expect(t, "topic of suspended user", topic.State, types.StateSuspended)
+	noErr(t, "Users.UpdateState", store.Users.UpdateState(alice.Uid(), types.StateOK))
+	topic, _ = store.Topics.Get("grpAliceOwns")
+	expect(t, "topic of restored user", topic.State, types.StateOK)
+}
+
+func testAuthRecords(t *testing.T) {
+	alice := newUser(t, "Alice")
+	bob := newUser(t, "Bob")
+
+	expires := types.TimeNow().Add(time.Hour)
+	noErr(t, "Users.AddAuthRecord", store.Users.AddAuthRecord(alice.Uid(), auth.LevelAuth, "basic", "alice",
+		[]byte("secret"), expires))
+	expectErr(t, "Users.AddAuthRecord duplicate unique",
+		store.Users.AddAuthRecord(bob.Uid(), auth.LevelAuth, "basic", "alice", []byte("x"), time.Time{}),
+		types.ErrDuplicate)
+
+	unique, lvl, secret, exp, err := store.Users.GetAuthRecord(alice.Uid(), "basic")
+	noErr(t, "Users.GetAuthRecord", err)
+	expect(t, "unique", unique, "alice")
+	expect(t, "level", lvl, auth.LevelAuth)
+	expect(t, "secret", string(secret), "secret")
+	if !exp.Equal(expires) {
+		t.Errorf("expires: got %v, want %v", exp, expires)
+	}
+
+	uid, lvl, secret, _, err := store.Users.GetAuthUniqueRecord("basic", "alice")
+	noErr(t, "Users.GetAuthUniqueRecord", err)
+	expect(t, "uid", uid, alice.Uid())
+	expect(t, "level", lvl, auth.LevelAuth)
+	expect(t, "secret", string(secret), "secret")
+
+	// The record does not expire.
+	noErr(t, "Users.UpdateAuthRecord", store.Users.UpdateAuthRecord(alice.Uid(), auth.LevelRoot, "basic",
+		"alice2", []byte("secret2"), time.Time{}))
+	uid, lvl, secret, exp, err = store.Users.GetAuthUniqueRecord("basic", "alice2")
+	noErr(t, "Users.GetAuthUniqueRecord after update", err)
+	expect(t, "uid", uid, alice.Uid())
+	expect(t, "level", lvl, auth.LevelRoot)
+	expect(t, "secret", string(secret), "secret2")
+	expect(t, "expires", exp.IsZero(), true)
+	uid, _, _, _, err = store.Users.GetAuthUniqueRecord("basic", "alice")
+	noErr(t, "Users.GetAuthUniqueRecord old unique", err)
+	expect(t, "old unique", uid.IsZero(), true)
+
+	noErr(t, "Users.AddAuthRecord token", store.Users.AddAuthRecord(alice.Uid(), auth.LevelAuth, "token",
+		"alice", []byte("serial"), time.Time{}))
+	noErr(t, "Users.DelAuthRecords", store.Users.DelAuthRecords(alice.Uid(), "basic"))
+	unique, _, _, _, err = store.Users.GetAuthRecord(alice.Uid(), "basic")
+	noErr(t, "Users.GetAuthRecord deleted", err)
+	expect(t, "deleted unique", unique, "")
+	unique, _, _, _, err = store.Users.GetAuthRecord(alice.Uid(), "token")
+	noErr(t, "Users.GetAuthRecord other scheme", err)
+	expect(t, "other scheme unique", unique, "alice")
+
+	// Inactive users of a scheme: bob was never seen, carol was seen recently.
+	carol := newUser(t, "Carol")
+	for _, u := range []*types.User{bob, carol} {
+		noErr(t, "Users.AddAuthRecord anonymous", store.Users.AddAuthRecord(u.Uid(), auth.LevelAnon,
+			"anon", u.Uid().UserId(), []byte{}, time.Time{}))
+	}
+	noErr(t, "Users.UpdateLastSeen", store.Users.UpdateLastSeen(carol.Uid(), "", types.TimeNow().Add(time.Hour)))
+	inactive, err := store.Users.GetInactive("anon", types.TimeNow().Add(time.Minute), 0)
+	noErr(t, "Users.GetInactive", err)
+	expect(t, "inactive", inactive, []types.Uid{bob.Uid()})
+	inactive, err = store.Users.GetInactive("anon", types.TimeNow().Add(2*time.Hour), 1)
+	noErr(t, "Users.GetInactive limit", err)
+	expect(t, "inactive limit", inactive, []types.Uid{bob.Uid()})
+	inactive, err = store.Users.GetInactive("anon", bob.CreatedAt, 0)
+	noErr(t, "Users.GetInactive none", err)
+	expect(t, "inactive none", len(inactive), 0)
+}
+
+func testCredentials(t *testing.T) {
+	alice := newUser(t, "Alice")
+	bob := newUser(t, "Bob")
+
+	cred := &types.Credential{User: alice.Uid().String(), Method: "email", Value: "alice@example.com", Resp: "123456"}
+	inserted, err := store.Users.UpsertCred(cred)
+	noErr(t, "Users.UpsertCred", err)
+	expect(t, "inserted", inserted, true)
+
+	// Upserting the same unconfirmed credential again updates it.
+	inserted, err = store.Users.UpsertCred(&types.Credential{User: alice.Uid().String(), Method: "email",
+		Value: "alice@example.com", Resp: "654321"})
+	noErr(t, "Users.UpsertCred again", err)
+	expect(t, "inserted again", inserted, false)
+
+	active, err := store.Users.GetActiveCred(alice.Uid(), "email")
+	noErr(t, "Users.GetActiveCred", err)
+	if active == nil {
+		t.Fatal("Users.GetActiveCred: not found")
+	}
+	expect(t, "active.Value", active.Value, "alice@example.com")
+	expect(t, "active.Resp", active.Resp, "654321")
+	expect(t, "active.Done", active.Done, false)
+
+	noErr(t, "Users.FailCred", store.Users.FailCred(alice.Uid(), "email"))
+	active, _ = store.Users.GetActiveCred(alice.Uid(), "email")
+	expect(t, "retries", active.Retries, 1)
+
+	// Not validated yet.
+	uid, err := store.Users.GetByCred("email", "alice@example.com")
+	noErr(t, "Users.GetByCred unconfirmed", err)
+	expect(t, "GetByCred unconfirmed", uid.IsZero(), true)
+	creds, err := store.Users.GetAllCreds(alice.Uid(), "", true)
+	noErr(t, "Users.GetAllCreds validated", err)
+	expect(t, "validated creds", len(creds), 0)
+
+	noErr(t, "Users.ConfirmCred", store.Users.ConfirmCred(alice.Uid(), "email"))
+	expectErr(t, "Users.ConfirmCred twice", store.Users.ConfirmCred(alice.Uid(), "email"), types.ErrNotFound)
+	uid, err = store.Users.GetByCred("email", "alice@example.com")
+	noErr(t, "Users.GetByCred", err)
+	expect(t, "GetByCred", uid, alice.Uid())
+	active, err = store.Users.GetActiveCred(alice.Uid(), "email")
+	noErr(t, "Users.GetActiveCred after confirm", err)
+	if active != nil {
+		t.Error("Users.GetActiveCred: confirmed credential is still active")
+	}
+
+	// Validated credential cannot be claimed by another user.
+	_, err = store.Users.UpsertCred(&types.Credential{User: bob.Uid().String(), Method: "email",
+		Value: "alice@example.com", Resp: "000000"})
+	expectErr(t, "Users.UpsertCred taken", err, types.ErrDuplicate)
+
+	_, err = store.Users.UpsertCred(&types.Credential{User: alice.Uid().String(), Method: "tel",
+		Value: "+15551234567", Resp: "111111"})
+	noErr(t, "Users.UpsertCred tel", err)
+	creds, err = store.Users.GetAllCreds(alice.Uid(), "", false)
+	noErr(t, "Users.GetAllCreds", err)
+	expect(t, "all creds", len(creds), 2)
+	creds, err = store.Users.GetAllCreds(alice.Uid(), "email", true)
+	noErr(t, "Users.GetAllCreds email validated", err)
+	if len(creds) != 1 || creds[0].Value != "alice@example.com" || !creds[0].Done {
+		t.Errorf("validated email creds: got %+v", creds)
+	}
+
+	noErr(t, "Users.DelCred", store.Users.DelCred(alice.Uid(), "email", "alice@example.com"))
+	uid, err = store.Users.GetByCred("email", "alice@example.com")
+	noErr(t, "Users.GetByCred deleted", err)
+	expect(t, "GetByCred deleted", uid.IsZero(), true)
+	creds, _ = store.Users.GetAllCreds(alice.Uid(), "", false)
+	expect(t, "creds after delete", len(creds), 1)
+
+	noErr(t, "Users.DelCred all", store.Users.DelCred(alice.Uid(), "", ""))
+	creds, _ = store.Users.GetAllCreds(alice.Uid(), "", false)
+	expect(t, "creds after delete all", len(creds), 0)
+}
+
+func testTopics(t *testing.T) {
+	alice := newUser(t, "Alice")
+	bob := newUser(t, "Bob")
+	carol := newUser(t, "Carol")
+
+	topic := newTopic(t, "grpTopic", alice.Uid(), map[string]interface{}{"fn": "Group"}, "travel")
+	expectErr(t, "Topics.Create duplicate",
+		store.Topics.Create(&types.Topic{ObjHeader: types.ObjHeader{Id: "grpTopic"}}, bob.Uid(), nil),
+		types.ErrDuplicate)
+
+	got, err := store.Topics.Get("grpTopic")
+	noErr(t, "Topics.Get", err)
+	if got == nil {
+		t.Fatal("Topics.Get: not found")
+	}
+	expect(t, "Owner", got.Owner, alice.Uid().String())
+	expect(t, "Public", sameJSON(got.Public, topic.Public), true)
+	expect(t, "Access", got.Access, topic.Access)
+	expect(t, "Tags", []string(got.Tags), []string{"travel"})
+	expect(t, "SeqId", got.SeqId, 0)
+
+	got, err = store.Topics.Get("grpMissing")
+	noErr(t, "Topics.Get missing", err)
+	if got != nil {
+		t.Error("Topics.Get missing: expected nil")
+	}
+
+	subscribe(t, "grpTopic", bob.Uid(), types.ModeCPublic)
+	subscribe(t, "grpTopic", carol.Uid(), types.ModeCPublic)
+
+	subs, err := store.Topics.GetUsers("grpTopic", nil)
+	noErr(t, "Topics.GetUsers", err)
+	expect(t, "Topics.GetUsers", subUsers(subs),
+		sortedStrings(alice.Uid().String(), bob.Uid().String(), carol.Uid().String()))
+	for _, sub := range subs {
+		if sub.User == bob.Uid().String() {
+			expect(t, "user Public", sameJSON(sub.GetPublic(), "Bob"), true)
+		}
+	}
+
+	subs, err = store.Topics.GetUsers("grpTopic", &types.QueryOpt{User: bob.Uid()})
+	noErr(t, "Topics.GetUsers one user", err)
+	expect(t, "Topics.GetUsers one user", subUsers(subs), []string{bob.Uid().String()})
+
+	subs, err = store.Topics.GetUsers("grpTopic", &types.QueryOpt{Limit: 2})
+	noErr(t, "Topics.GetUsers limit", err)
+	expect(t, "Topics.GetUsers limit", len(subs), 2)
+
+	subs, err = store.Topics.GetSubs("grpTopic", &types.QueryOpt{Limit: 2})
+	noErr(t, "Topics.GetSubs limit", err)
+	expect(t, "Topics.GetSubs limit", len(subs), 2)
+
+	subs, err = store.Topics.GetSubs("grpTopic", &types.QueryOpt{User: carol.Uid()})
+	noErr(t, "Topics.GetSubs one user", err)
+	expect(t, "Topics.GetSubs one user", subUsers(subs), []string{carol.Uid().String()})
+
+	// Topic as seen by a subscriber.
+	subs, err = store.Users.GetTopics(bob.Uid(), nil)
+	noErr(t, "Users.GetTopics", err)
+	if len(subs) != 1 || subs[0].Topic != "grpTopic" {
+		t.Fatalf("Users.GetTopics: got %v", topicNames(subs))
+	}
+	expect(t, "topic Public", sameJSON(subs[0].GetPublic(), topic.Public), true)
+
+	newTopic(t, "grpOther", bob.Uid(), "Other")
+	subs, err = store.Users.GetTopics(bob.Uid(), &types.QueryOpt{Topic: "grpOther"})
+	noErr(t, "Users.GetTopics one topic", err)
+	expect(t, "Users.GetTopics one topic", topicNames(subs), []string{"grpOther"})
+	subs, err = store.Users.GetSubs(bob.Uid(), &types.QueryOpt{Limit: 1})
+	noErr(t, "Users.GetSubs limit", err)
+	expect(t, "Users.GetSubs limit", len(subs), 1)
+
+	noErr(t, "Topics.Update", store.Topics.Update("grpTopic", map[string]interface{}{
+		"Public": map[string]interface{}{"fn": "Renamed"},
+		"Tags":   types.StringSlice{"travel", "europe"}}))
+	got, _ = store.Topics.Get("grpTopic")
+	expect(t, "updated Public", sameJSON(got.Public, map[string]interface{}{"fn": "Renamed"}), true)
+	expect(t, "updated Tags", sortedStrings(got.Tags...), []string{"europe", "travel"})
+
+	noErr(t, "Topics.OwnerChange", store.Topics.OwnerChange("grpTopic", bob.Uid()))
+	got, _ = store.Topics.Get("grpTopic")
+	expect(t, "new owner", got.Owner, bob.Uid().String())
+	own, err := store.Users.GetOwnTopics(bob.Uid())
+	noErr(t, "Users.GetOwnTopics", err)
+	expect(t, "own topics", own, []string{"grpOther", "grpTopic"})
+	own, err = store.Users.GetOwnTopics(alice.Uid())
+	noErr(t, "Users.GetOwnTopics", err)
+	expect(t, "previous owner's topics", len(own), 0)
+
+	// Soft delete: the topic is still there but marked as deleted.
+	noErr(t, "Topics.Delete soft", store.Topics.Delete("grpOther", false))
+	got, err = store.Topics.Get("grpOther")
+	noErr(t, "Topics.Get soft-deleted", err)
+	if got == nil || got.State != types.StateDeleted {
+		t.Errorf("soft-deleted topic: got %+v", got)
+	}
+	subs, _ = store.Users.GetTopics(bob.Uid(), nil)
+	expect(t, "Users.GetTopics without deleted", topicNames(subs), []string{"grpTopic"})
+	subs, _ = store.Users.GetTopicsAny(bob.Uid(), nil)
+	expect(t, "Users.GetTopicsAny", topicNames(subs), []string{"grpOther", "grpTopic"})
+
+	// Hard delete removes the topic and subscriptions.
+	saveMessages(t, "grpTopic", alice.Uid(), 1, 3)
+	noErr(t, "Topics.Delete hard", store.Topics.Delete("grpTopic", true))
+	got, err = store.Topics.Get("grpTopic")
+	noErr(t, "Topics.Get hard-deleted", err)
+	if got != nil {
+		t.Error("hard-deleted topic is still present")
+	}
+	subs, _ = store.Topics.GetSubsAny("grpTopic", nil)
+	expect(t, "subscriptions of hard-deleted topic", len(subs), 0)
+	msgs, _ := store.Messages.GetAll("grpTopic", alice.Uid(), nil)
+	expect(t, "messages of hard-deleted topic", len(msgs), 0)
+}
+
+func testChannels(t *testing.T) {
+	alice := newUser(t, "Alice")
+	bob := newUser(t, "Bob")
+	carol := newUser(t, "Carol")
+
+	topic := &types.Topic{ObjHeader: types.ObjHeader{Id: "grpNews"}, UseBt: true, Public: "News"}
+	topic.Access.Auth = types.ModeCChnWriter
+	noErr(t, "Topics.Create channel", store.Topics.Create(topic, alice.Uid(), nil))
+	got, _ := store.Topics.Get("grpNews")
+	if got == nil || !got.UseBt {
+		t.Fatalf("channel flag is lost: %+v", got)
+	}
+
+	// Publishers are members of the group, readers are subscribed to the channel.
+	subscribe(t, "grpNews", bob.Uid(), types.ModeCChnWriter)
+	subscribe(t, "chnNews", carol.Uid(), types.ModeCChnReader)
+
+	subs, err := store.Topics.GetUsers("grpNews", nil)
+	noErr(t, "Topics.GetUsers", err)
+	expect(t, "members", subUsers(subs), sortedStrings(alice.Uid().String(), bob.Uid().String()))
+	subs, err = store.Topics.GetSubs("chnNews", nil)
+	noErr(t, "Topics.GetSubs channel", err)
+	expect(t, "readers", subUsers(subs), []string{carol.Uid().String()})
+
+	// The reader sees the channel with the group's public data.
+	subs, err = store.Users.GetTopics(carol.Uid(), nil)
+	noErr(t, "Users.GetTopics reader", err)
+	expect(t, "reader's topics", topicNames(subs), []string{"chnNews"})
+	if len(subs) == 1 {
+		expect(t, "channel Public", sameJSON(subs[0].GetPublic(), "News"), true)
+	}
+
+	noErr(t, "Topics.Delete soft", store.Topics.Delete("grpNews", false))
+	subs, _ = store.Users.GetTopics(carol.Uid(), nil)
+	expect(t, "reader's topics after soft delete", len(subs), 0)
+	subs, _ = store.Topics.GetSubsAny("chnNews", nil)
+	if len(subs) != 1 || subs[0].DeletedAt == nil {
+		t.Errorf("reader's subscription is not marked as deleted: %+v", subs)
+	}
+
+	noErr(t, "Topics.Delete hard", store.Topics.Delete("grpNews", true))
+	subs, _ = store.Topics.GetSubsAny("chnNews", nil)
+	expect(t, "readers of hard-deleted channel", len(subs), 0)
+}
+
+func testP2P(t *testing.T) {
+	alice := newUser(t, "Alice")
+	bob := newUser(t, "Bob")
+
+	name := alice.Uid().P2PName(bob.Uid())
+	noErr(t, "Topics.CreateP2P", store.Topics.CreateP2P(
+		&types.Subscription{
+			User:      alice.Uid().String(),
+			Topic:     name,
+			ModeWant:  types.ModeCP2P,
+			ModeGiven: types.ModeCP2P,
+			Private:   "alice's private"},
+		&types.Subscription{
+			User:      bob.Uid().String(),
+			Topic:     name,
+			ModeWant:  types.ModeCP2P,
+			ModeGiven: types.ModeCP2P}))
+
+	topic, err := store.Topics.Get(name)
+	noErr(t, "Topics.Get p2p", err)
+	if topic == nil {
+		t.Fatal("p2p topic not found")
+	}
+
+	// Each user sees the other user's Public.
+	subs, err := store.Users.GetTopics(alice.Uid(), nil)
+	noErr(t, "Users.GetTopics p2p", err)
+	if len(subs) != 1 {
+		t.Fatalf("Users.GetTopics p2p: got %v", topicNames(subs))
+	}
+	expect(t, "p2p topic", subs[0].Topic, name)
+	expect(t, "p2p Public", sameJSON(subs[0].GetPublic(), "Bob"), true)
+	expect(t, "p2p With", subs[0].GetWith(), bob.Uid().UserId())
+	expect(t, "p2p Private", sameJSON(subs[0].Private, "alice's private"), true)
+
+	subs, err = store.Topics.GetUsers(name, nil)
+	noErr(t, "Topics.GetUsers p2p", err)
+	if len(subs) != 2 {
+		t.Fatalf("Topics.GetUsers p2p: got %d subs", len(subs))
+	}
+	for _, sub := range subs {
+		// Public values are swapped: a user sees the other user's Public.
+		if sub.User == alice.Uid().String() {
+			expect(t, "alice sees", sameJSON(sub.GetPublic(), "Bob"), true)
+		} else {
+			expect(t, "bob sees", sameJSON(sub.GetPublic(), "Alice"), true)
+		}
+	}
+
+	subs, err = store.Topics.GetUsers(name, &types.QueryOpt{User: bob.Uid()})
+	noErr(t, "Topics.GetUsers p2p one user", err)
+	if len(subs) != 1 || subs[0].User != bob.Uid().String() {
+		t.Fatalf("Topics.GetUsers p2p one user: got %v", subUsers(subs))
+	}
+	expect(t, "bob sees", sameJSON(subs[0].GetPublic(), "Alice"), true)
+}
+
+func testSubs(t *testing.T) {
+	alice := newUser(t, "Alice")
+	bob := newUser(t, "Bob")
+	newTopic(t, "grpSubs", alice.Uid(), "Subs")
+	subscribe(t, "grpSubs", bob.Uid(), types.ModeCPublic)
+
+	sub, err := store.Subs.Get("grpSubs", bob.Uid())
+	noErr(t, "Subs.Get", err)
+	if sub == nil {
+		t.Fatal("Subs.Get: not found")
+	}
+	expect(t, "ModeWant", sub.ModeWant, types.ModeCPublic)
+	expect(t, "ModeGiven", sub.ModeGiven, types.ModeCPublic)
+	expect(t, "User", sub.User, bob.Uid().String())
+
+	owner, _ := store.Subs.Get("grpSubs", alice.Uid())
+	expect(t, "owner's ModeGiven", owner.ModeGiven, types.ModeCFull)
+	expect(t, "owner's Private", sameJSON(owner.Private, "owner's private"), true)
+
+	noErr(t, "Subs.Update", store.Subs.Update("grpSubs", bob.Uid(), map[string]interface{}{
+		"ReadSeqId": 5,
+		"RecvSeqId": 7,
+		"ModeWant":  types.ModeCReadOnly,
+		"Private":   map[string]interface{}{"note": "mine"}}, true))
+	sub, _ = store.Subs.Get("grpSubs", bob.Uid())
+	expect(t, "ReadSeqId", sub.ReadSeqId, 5)
+	expect(t, "RecvSeqId", sub.RecvSeqId, 7)
+	expect(t, "updated ModeWant", sub.ModeWant, types.ModeCReadOnly)
+	expect(t, "updated Private", sameJSON(sub.Private, map[string]interface{}{"note": "mine"}), true)
+
+	// Update all subscriptions of the topic.
+	noErr(t, "Subs.Update all", store.Subs.Update("grpSubs", types.ZeroUid,
+		map[string]interface{}{"DelId": 3}, false))
+	sub, _ = store.Subs.Get("grpSubs", bob.Uid())
+	expect(t, "DelId of bob", sub.DelId, 3)
+	owner, _ = store.Subs.Get("grpSubs", alice.Uid())
+	expect(t, "DelId of owner", owner.DelId, 3)
+
+	noErr(t, "Subs.Delete", store.Subs.Delete("grpSubs", bob.Uid()))
+	expectErr(t, "Subs.Delete twice", store.Subs.Delete("grpSubs", bob.Uid()), types.ErrNotFound)
+	sub, err = store.Subs.Get("grpSubs", bob.Uid())
+	noErr(t, "Subs.Get deleted", err)
+	if sub != nil {
+		t.Error("Subs.Get: deleted subscription returned")
+	}
+	subs, _ := store.Topics.GetSubs("grpSubs", nil)
+	expect(t, "Topics.GetSubs", subUsers(subs), []string{alice.Uid().String()})
+	subs, _ = store.Topics.GetSubsAny("grpSubs", nil)
+	expect(t, "Topics.GetSubsAny", subUsers(subs), sortedStrings(alice.Uid().String(), bob.Uid().String()))
+	for _, s := range subs {
+		if s.User == bob.Uid().String() && s.DeletedAt == nil {
+			t.Error("DeletedAt is not set")
+		}
+	}
+	subs, _ = store.Topics.GetUsersAny("grpSubs", nil)
+	expect(t, "Topics.GetUsersAny", len(subs), 2)
+
+	// Re-subscribing undeletes the subscription.
+	subscribe(t, "grpSubs", bob.Uid(), types.ModeCPublic)
+	sub, _ = store.Subs.Get("grpSubs", bob.Uid())
+	if sub == nil || sub.DeletedAt != nil {
+		t.Error("subscription is not restored")
+	}
+}
+
+func testSearch(t *testing.T) {
+	alice := newUser(t, "Alice", "alice", "email:alice@example.com", "travel")
+	bob := newUser(t, "Bob", "bob", "travel", "music")
+	newTopic(t, "grpTravel", alice.Uid(), "Travel", "travel", "europe")
+	newTopic(t, "grpMusic", alice.Uid(), "Music", "music")
+
+	// The caller is not returned.
+	found, err := store.Users.FindSubs(alice.Uid(), nil, []string{"travel"})
+	noErr(t, "Users.FindSubs", err)
+	var users, topics []string
+	for _, f := range found {
+		if f.Topic != "" {
+			topics = append(topics, f.Topic)
+		} else {
+			users = append(users, f.User)
+		}
+		expect(t, "ModeGiven", f.ModeGiven, types.ModeUnset)
+		expect(t, "matched tags", []string(anyToStrings(f.Private)), []string{"travel"})
+	}
+	expect(t, "found users", users, []string{bob.Uid().String()})
+	expect(t, "found topics", topics, []string{"grpTravel"})
+
+	// Required tags: every group must match.
+	found, err = store.Users.FindSubs(bob.Uid(), [][]string{{"alice", "carol"}, {"travel"}}, nil)
+	noErr(t, "Users.FindSubs required", err)
+	if len(found) != 1 || found[0].User != alice.Uid().String() {
+		t.Errorf("Users.FindSubs required: got %+v", found)
+	} else {
+		expect(t, "found Public", sameJSON(found[0].GetPublic(), "Alice"), true)
+	}
+
+	// More matching tags come first.
+	found, err = store.Users.FindSubs(bob.Uid(), nil, []string{"travel", "europe", "music"})
+	noErr(t, "Users.FindSubs ordering", err)
+	topics = nil
+	for _, f := range found {
+		if f.Topic != "" {
+			topics = append(topics, f.Topic)
+		}
+	}
+	expect(t, "topics ordered by matches", topics, []string{"grpTravel", "grpMusic"})
+
+	found, err = store.Users.FindSubs(alice.Uid(), nil, []string{"nothing"})
+	noErr(t, "Users.FindSubs no match", err)
+	expect(t, "no match", len(found), 0)
+
+	// Deleted topics are not found.
+	noErr(t, "Topics.Delete", store.Topics.Delete("grpTravel", false))
+	found, _ = store.Users.FindSubs(bob.Uid(), [][]string{{"europe"}}, nil)
+	expect(t, "deleted topic found", len(found), 0)
+}
+
+func anyToStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case []string:
+		return v
+	case types.StringSlice:
+		return v
+	case []interface{}:
+		var out []string
+		for _, s := range v {
+			str, _ := s.(string)
+			out = append(out, str)
+		}
+		return out
+	}
+	return nil
+}
+
+func testMessages(t *testing.T) {
+	alice := newUser(t, "Alice")
+	bob := newUser(t, "Bob")
+	newTopic(t, "grpChat", alice.Uid(), "Chat")
+	subscribe(t, "grpChat", bob.Uid(), types.ModeCPublic)
+
+	saveMessages(t, "grpChat", alice.Uid(), 1, 10)
+
+	topic, _ := store.Topics.Get("grpChat")
+	expect(t, "topic SeqId", topic.SeqId, 10)
+	if !topic.TouchedAt.After(topic.CreatedAt) && !topic.TouchedAt.Equal(topic.CreatedAt) {
+		t.Error("TouchedAt is not updated")
+	}
+
+	// Messages are marked as read by the sender.
+	sub, _ := store.Subs.Get("grpChat", alice.Uid())
+	expect(t, "sender ReadSeqId", sub.ReadSeqId, 10)
+	expect(t, "sender RecvSeqId", sub.RecvSeqId, 10)
+	sub, _ = store.Subs.Get("grpChat", bob.Uid())
+	expect(t, "reader ReadSeqId", sub.ReadSeqId, 0)
+
+	unread, err := store.Users.GetUnreadCount(bob.Uid())
+	noErr(t, "Users.GetUnreadCount", err)
+	expect(t, "unread", unread, 10)
+	unread, _ = store.Users.GetUnreadCount(alice.Uid())
+	expect(t, "unread by sender", unread, 0)
+
+	// Newest first.
+	msgs, err := store.Messages.GetAll("grpChat", bob.Uid(), nil)
+	noErr(t, "Messages.GetAll", err)
+	expect(t, "all", seqIds(msgs), []int{10, 9, 8, 7, 6, 5, 4, 3, 2, 1})
+	m := msgs[0]
+	expect(t, "From", m.From, alice.Uid().String())
+	expect(t, "Topic", m.Topic, "grpChat")
+	expect(t, "Content", sameJSON(m.Content, "message 10"), true)
+	if m.CreatedAt.IsZero() {
+		t.Error("CreatedAt is not set")
+	}
+
+	msgs, _ = store.Messages.GetAll("grpChat", bob.Uid(), &types.QueryOpt{Limit: 3})
+	expect(t, "Limit", seqIds(msgs), []int{10, 9, 8})
+	// Since is inclusive, Before is exclusive.
+	msgs, _ = store.Messages.GetAll("grpChat", bob.Uid(), &types.QueryOpt{Since: 3, Before: 7})
+	expect(t, "Since/Before", seqIds(msgs), []int{6, 5, 4, 3})
+	msgs, _ = store.Messages.GetAll("grpChat", bob.Uid(), &types.QueryOpt{Since: 8})
+	expect(t, "Since", seqIds(msgs), []int{10, 9, 8})
+	msgs, _ = store.Messages.GetAll("grpChat", bob.Uid(), &types.QueryOpt{Before: 4})
+	expect(t, "Before", seqIds(msgs), []int{3, 2, 1})
+	msgs, _ = store.Messages.GetAll("grpChat", bob.Uid(), &types.QueryOpt{Since: 2, Before: 9, Limit: 2})
+	expect(t, "Since/Before/Limit", seqIds(msgs), []int{8, 7})
+
+	msgs, err = store.Messages.GetAll("grpNone", bob.Uid(), nil)
+	noErr(t, "Messages.GetAll unknown topic", err)
+	expect(t, "unknown topic", len(msgs), 0)
+}
+
+func testDeletedMessages(t *testing.T) {
+	alice := newUser(t, "Alice")
+	bob := newUser(t, "Bob")
+	newTopic(t, "grpDel", alice.Uid(), "Del")
+	subscribe(t, "grpDel", bob.Uid(), types.ModeCPublic)
+	saveMessages(t, "grpDel", alice.Uid(), 1, 10)
+
+	// Hard delete for everyone: 2, 5, 6.
+	noErr(t, "Messages.DeleteList hard", store.Messages.DeleteList("grpDel", 1, types.ZeroUid,
+		[]types.Range{{Low: 2}, {Low: 5, Hi: 7}}))
+	// Soft delete for bob only: 3, 7.
+	noErr(t, "Messages.DeleteList soft", store.Messages.DeleteList("grpDel", 2, bob.Uid(),
+		[]types.Range{{Low: 3, Hi: 4}, {Low: 7}}))
+
+	msgs, _ := store.Messages.GetAll("grpDel", alice.Uid(), nil)
+	expect(t, "alice's messages", seqIds(msgs), []int{10, 9, 8, 7, 4, 3, 1})
+	msgs, _ = store.Messages.GetAll("grpDel", bob.Uid(), nil)
+	expect(t, "bob's messages", seqIds(msgs), []int{10, 9, 8, 4, 1})
+	msgs, _ = store.Messages.GetAll("grpDel", bob.Uid(), &types.QueryOpt{Since: 2, Before: 9})
+	expect(t, "bob's messages 2..9", seqIds(msgs), []int{8, 4})
+
+	topic, _ := store.Topics.Get("grpDel")
+	expect(t, "topic DelId", topic.DelId, 2)
+	sub, _ := store.Subs.Get("grpDel", bob.Uid())
+	expect(t, "bob's DelId", sub.DelId, 2)
+	sub, _ = store.Subs.Get("grpDel", alice.Uid())
+	expect(t, "alice's DelId", sub.DelId, 1)
+
+	// Ranges are merged: [2], [3,4) -> [2,4); [5,7), [7] -> [5,8).
+	ranges, maxID, err := store.Messages.GetDeleted("grpDel", bob.Uid(), nil)
+	noErr(t, "Messages.GetDeleted", err)
+	expect(t, "bob's deleted ranges", ranges, []types.Range{{Low: 2, Hi: 4}, {Low: 5, Hi: 8}})
+	expect(t, "bob's max DelId", maxID, 2)
+
+	ranges, maxID, err = store.Messages.GetDeleted("grpDel", alice.Uid(), nil)
+	noErr(t, "Messages.GetDeleted", err)
+	expect(t, "alice's deleted ranges", ranges, []types.Range{{Low: 2}, {Low: 5, Hi: 7}})
+	expect(t, "alice's max DelId", maxID, 1)
+
+	// Paging by DelId: Since is inclusive, Before is exclusive.
+	ranges, maxID, _ = store.Messages.GetDeleted("grpDel", bob.Uid(), &types.QueryOpt{Since: 2})
+	expect(t, "deleted since 2", ranges, []types.Range{{Low: 3}, {Low: 7}})
+	expect(t, "max DelId since 2", maxID, 2)
+	ranges, maxID, _ = store.Messages.GetDeleted("grpDel", bob.Uid(), &types.QueryOpt{Before: 2})
+	expect(t, "deleted before 2", ranges, []types.Range{{Low: 2}, {Low: 5, Hi: 7}})
+	expect(t, "max DelId before 2", maxID, 1)
+
+	ranges, maxID, err = store.Messages.GetDeleted("grpNone", bob.Uid(), nil)
+	noErr(t, "Messages.GetDeleted unknown topic", err)
+	expect(t, "unknown topic ranges", len(ranges), 0)
+	expect(t, "unknown topic max DelId", maxID, 0)
+}
+
+func testAttachments(t *testing.T, mh *fakeMedia) {
+	alice := newUser(t, "Alice")
+	newTopic(t, "grpFiles", alice.Uid(), "Files")
+	mh.takeDeleted()
+
+	upload := func(location string) *types.FileDef {
+		fd := &types.FileDef{User: alice.Uid().String(), MimeType: "image/jpeg", Location: location}
+		fd.SetUid(store.GetUid())
+		fd.InitTimes()
+		noErr(t, "Files.StartUpload", store.Files.StartUpload(fd))
+		_, err := store.Files.FinishUpload(fd.Id, true, 1024)
+		noErr(t, "Files.FinishUpload", err)
+		return fd
+	}
+
+	linked := upload("/files/linked.jpg")
+	unlinked := upload("/files/unlinked.jpg")
+
+	msg := &types.Message{
+		SeqId: 1,
+		Topic: "grpFiles",
+		From:  alice.Uid().String(),
+		Head: types.MessageHeaders{"attachments": []interface{}{
+			serveUrl + linked.Id + ".jpg",
+			"https://example.com/not-ours.jpg"}},
+		Content: "picture"}
+	noErr(t, "Messages.Save with attachment", store.Messages.Save(msg, true))
+
+	// Attachments which are not ours are ignored, the header is kept.
+	msgs, _ := store.Messages.GetAll("grpFiles", alice.Uid(), nil)
+	if len(msgs) != 1 || msgs[0].Head["attachments"] == nil {
+		t.Errorf("message with attachments: got %+v", msgs)
+	}
+
+	// A message without any recognized attachments loses the header.
+	msg = &types.Message{
+		SeqId:   2,
+		Topic:   "grpFiles",
+		From:    alice.Uid().String(),
+		Head:    types.MessageHeaders{"attachments": []interface{}{"https://example.com/other.jpg"}},
+		Content: "picture"}
+	noErr(t, "Messages.Save with foreign attachment", store.Messages.Save(msg, true))
+	if _, ok := msg.Head["attachments"]; ok {
+		t.Error("attachments header is not removed")
+	}
+
+	// Only the file not linked to any message is deleted.
+	noErr(t, "Files.DeleteUnused", store.Files.DeleteUnused(types.TimeNow().Add(time.Minute), 0))
+	expect(t, "deleted files", mh.takeDeleted(), []string{"/files/unlinked.jpg"})
+	fd, err := store.Files.Get(unlinked.Id)
+	noErr(t, "Files.Get deleted", err)
+	if fd != nil {
+		t.Error("unused file record is not deleted")
+	}
+	fd, _ = store.Files.Get(linked.Id)
+	if fd == nil {
+		t.Fatal("linked file record is deleted")
+	}
+
+	// Files updated after the cut-off time are kept.
+	recent := upload("/files/recent.jpg")
+	noErr(t, "Files.DeleteUnused old", store.Files.DeleteUnused(types.TimeNow().Add(-time.Hour), 0))
+	expect(t, "deleted old files", len(mh.takeDeleted()), 0)
+
+	// Limit is respected.
+	upload("/files/recent2.jpg")
+	noErr(t, "Files.DeleteUnused limit", store.Files.DeleteUnused(time.Time{}, 1))
+	expect(t, "deleted with limit", len(mh.takeDeleted()), 1)
+	noErr(t, "Files.DeleteUnused rest", store.Files.DeleteUnused(time.Time{}, 0))
+	expect(t, "deleted the rest", len(mh.takeDeleted()), 1)
+	fd, _ = store.Files.Get(recent.Id)
+	if fd != nil {
+		t.Error("unused file record is not deleted")
+	}
+
+	// Hard-deleting the message unlinks the file.
+	noErr(t, "Messages.DeleteList", store.Messages.DeleteList("grpFiles", 1, types.ZeroUid,
+		[]types.Range{{Low: 1}}))
+	noErr(t, "Files.DeleteUnused after message delete", store.Files.DeleteUnused(time.Time{}, 0))
+	expect(t, "deleted after message delete", mh.takeDeleted(), []string{"/files/linked.jpg"})
+}
+
+func testDevices(t *testing.T) {
+	alice := newUser(t, "Alice")
+	bob := newUser(t, "Bob")
+
+	dev := &types.DeviceDef{DeviceId: "device-1", Platform: "android", LastSeen: types.TimeNow(), Lang: "en_US"}
+	noErr(t, "Devices.Update", store.Devices.Update(alice.Uid(), "", dev))
+	noErr(t, "Devices.Update other", store.Devices.Update(bob.Uid(), "",
+		&types.DeviceDef{DeviceId: "device-2", Platform: "ios", LastSeen: types.TimeNow(), Lang: "fr"}))
+
+	devs, count, err := store.Devices.GetAll(alice.Uid(), bob.Uid())
+	noErr(t, "Devices.GetAll", err)
+	expect(t, "device count", count, 2)
+	if len(devs[alice.Uid()]) != 1 {
+		t.Fatalf("alice's devices: got %+v", devs[alice.Uid()])
+	}
+	got := devs[alice.Uid()][0]
+	expect(t, "DeviceId", got.DeviceId, "device-1")
+	expect(t, "Platform", got.Platform, "android")
+	expect(t, "Lang", got.Lang, "en_US")
+	if !got.LastSeen.Equal(dev.LastSeen) {
+		t.Errorf("LastSeen: got %v, want %v", got.LastSeen, dev.LastSeen)
+	}
+
+	// Replace the old device ID with a new one.
+	noErr(t, "Devices.Update replace", store.Devices.Update(alice.Uid(), "device-1",
+		&types.DeviceDef{DeviceId: "device-3", Platform: "web", LastSeen: types.TimeNow()}))
+	devs, count, _ = store.Devices.GetAll(alice.Uid())
+	expect(t, "device count after replace", count, 1)
+	expect(t, "replaced device", devs[alice.Uid()][0].DeviceId, "device-3")
+
+	// The same device ID moves to another user.
+	noErr(t, "Devices.Update move", store.Devices.Update(bob.Uid(), "",
+		&types.DeviceDef{DeviceId: "device-3", Platform: "web", LastSeen: types.TimeNow()}))
+	devs, count, _ = store.Devices.GetAll(alice.Uid(), bob.Uid())
+	expect(t, "device count after move", count, 2)
+	expect(t, "alice's devices after move", len(devs[alice.Uid()]), 0)
+	expect(t, "bob's devices after move", len(devs[bob.Uid()]), 2)
+
+	noErr(t, "Devices.Delete", store.Devices.Delete(bob.Uid(), "device-2"))
+	expectErr(t, "Devices.Delete missing", store.Devices.Delete(bob.Uid(), "device-2"), types.ErrNotFound)
+	_, count, _ = store.Devices.GetAll(bob.Uid())
+	expect(t, "device count after delete", count, 1)
+	noErr(t, "Devices.Delete all", store.Devices.Delete(bob.Uid(), ""))
+	_, count, _ = store.Devices.GetAll(bob.Uid())
+	expect(t, "device count after delete all", count, 0)
+}
+
+func testFiles(t *testing.T) {
+	alice := newUser(t, "Alice")
+
+	fd := &types.FileDef{User: alice.Uid().String(), MimeType: "text/plain", Location: "/files/a.txt"}
+	fd.SetUid(store.GetUid())
+	fd.InitTimes()
+	noErr(t, "Files.StartUpload", store.Files.StartUpload(fd))
+	expectErr(t, "Files.StartUpload duplicate", store.Files.StartUpload(fd), types.ErrDuplicate)
+
+	got, err := store.Files.Get(fd.Id)
+	noErr(t, "Files.Get", err)
+	if got == nil {
+		t.Fatal("Files.Get: not found")
+	}
+	expect(t, "Status", got.Status, types.UploadStarted)
+	expect(t, "User", got.User, alice.Uid().String())
+	expect(t, "MimeType", got.MimeType, "text/plain")
+	expect(t, "Location", got.Location, "/files/a.txt")
+
+	got, err = store.Files.FinishUpload(fd.Id, true, 42)
+	noErr(t, "Files.FinishUpload", err)
+	expect(t, "finished Status", got.Status, types.UploadCompleted)
+	expect(t, "finished Size", got.Size, int64(42))
+	got, _ = store.Files.Get(fd.Id)
+	expect(t, "stored Status", got.Status, types.UploadCompleted)
+	expect(t, "stored Size", got.Size, int64(42))
+
+	got, err = store.Files.FinishUpload(fd.Id, false, 0)
+	noErr(t, "Files.FinishUpload failed", err)
+	expect(t, "failed Status", got.Status, types.UploadFailed)
+
+	_, err = store.Files.FinishUpload(store.GetUidString(), true, 1)
+	expectErr(t, "Files.FinishUpload unknown", err, types.ErrNotFound)
+	got, err = store.Files.Get(store.GetUidString())
+	noErr(t, "Files.Get unknown", err)
+	if got != nil {
+		t.Error("Files.Get unknown: expected nil")
+	}
+	_, err = store.Files.Get("not-an-id")
+	expectErr(t, "Files.Get malformed", err, types.ErrMalformed)
+}
+
+func testUserDelete(t *testing.T) {
+	alice := newUser(t, "Alice", "alice")
+	bob := newUser(t, "Bob", "bob")
+	carol := newUser(t, "Carol", "carol")
+	newTopic(t, "grpAlice", alice.Uid(), "Alice's")
+	newTopic(t, "grpBob", bob.Uid(), "Bob's")
+	subscribe(t, "grpAlice", bob.Uid(), types.ModeCPublic)
+	subscribe(t, "grpBob", alice.Uid(), types.ModeCPublic)
+	p2p := alice.Uid().P2PName(bob.Uid())
+	noErr(t, "Topics.CreateP2P", store.Topics.CreateP2P(
+		&types.Subscription{User: alice.Uid().String(), Topic: p2p, ModeWant: types.ModeCP2P, ModeGiven: types.ModeCP2P},
+		&types.Subscription{User: bob.Uid().String(), Topic: p2p, ModeWant: types.ModeCP2P, ModeGiven: types.ModeCP2P}))
+
+	// Soft delete.
+	noErr(t, "Users.Delete soft", store.Users.Delete(alice.Uid(), false))
+	user, err := store.Users.Get(alice.Uid())
+	noErr(t, "Users.Get soft-deleted", err)
+	if user != nil {
+		t.Error("soft-deleted user is returned")
+	}
+	users, _ := store.Users.GetAll(alice.Uid(), bob.Uid())
+	expect(t, "Users.GetAll without deleted", len(users), 1)
+
+	topic, _ := store.Topics.Get("grpAlice")
+	expect(t, "owned topic state", topic.State, types.StateDeleted)
+	topic, _ = store.Topics.Get(p2p)
+	expect(t, "p2p topic state", topic.State, types.StateDeleted)
+	subs, _ := store.Users.GetTopics(bob.Uid(), nil)
+	expect(t, "bob's topics", topicNames(subs), []string{"grpBob"})
+	subs, _ = store.Topics.GetSubs("grpBob", nil)
+	expect(t, "grpBob subscribers", subUsers(subs), []string{bob.Uid().String()})
+
+	// Hard delete.
+	noErr(t, "Users.AddAuthRecord", store.Users.AddAuthRecord(carol.Uid(), auth.LevelAuth, "basic", "carol",
+		[]byte("secret"), time.Time{}))
+	_, err = store.Users.UpsertCred(&types.Credential{User: carol.Uid().String(), Method: "email",
+		Value: "carol@example.com", Resp: "123"})
+	noErr(t, "Users.UpsertCred", err)
+	noErr(t, "Devices.Update", store.Devices.Update(carol.Uid(), "",
+		&types.DeviceDef{DeviceId: "carol-device", Platform: "web", LastSeen: types.TimeNow()}))
+	newTopic(t, "grpCarol", carol.Uid(), "Carol's", "carol")
+	saveMessages(t, "grpCarol", carol.Uid(), 1, 2)
+	subscribe(t, "grpBob", carol.Uid(), types.ModeCPublic)
+
+	noErr(t, "Users.Delete hard", store.Users.Delete(carol.Uid(), true))
+	user, _ = store.Users.Get(carol.Uid())
+	if user != nil {
+		t.Error("hard-deleted user is returned")
+	}
+	uid, _, _, _, _ := store.Users.GetAuthUniqueRecord("basic", "carol")
+	expect(t, "auth record of deleted user", uid.IsZero(), true)
+	creds, _ := store.Users.GetAllCreds(carol.Uid(), "", false)
+	expect(t, "creds of deleted user", len(creds), 0)
+	_, count, _ := store.Devices.GetAll(carol.Uid())
+	expect(t, "devices of deleted user", count, 0)
+	topic, _ = store.Topics.Get("grpCarol")
+	if topic != nil {
+		t.Error("owned topic of hard-deleted user is not deleted")
+	}
+	subs, _ = store.Topics.GetSubsAny("grpBob", nil)
+	expect(t, "grpBob subscribers after hard delete", subUsers(subs),
+		sortedStrings(alice.Uid().String(), bob.Uid().String()))
+	found, _ := store.Users.FindSubs(bob.Uid(), nil, []string{"carol"})
+	expect(t, "deleted user found", len(found), 0)
+}
@@ -224,6 +224,11 @@ func ChnToGrp(chn string) string {
 	return ""
 }
 
+// IsChannel checks if the topic name is a channel name.
+func IsChannel(name string) bool {
+	return strings.HasPrefix(name, "chn")
+}
+
 // UidSlice is a slice of Uids sorted in ascending order.
 type UidSlice []Uid
 
@@ -1001,7 +1006,7 @@ type Topic struct {
 	// Timestamp when the last message has passed through the topic
 	TouchedAt time.Time
 
-	// Use bearer token or use ACL
+	// Group topic is also accessible as a read-only channel 'chnXXX'.
 	UseBt bool
 
 	// Topic owner. Could be zero
@@ -1150,30 +1155,33 @@ func (rs RangeSorter) Less(i, j int) bool {
 	return false
 }
 
-// Normalize ranges - remove overlaps: [1..4],[2..4],[5..7] -> [1..7].
+// Normalize ranges - remove overlaps and join adjacent ranges: [1..4),[2..4),[4..7) -> [1..7).
 // The ranges are expected to be sorted.
-// Ranges are inclusive-inclusive, i.e. [1..3] -> 1, 2, 3.
+// Ranges are inclusive-exclusive, i.e. [1..3) -> 1, 2. A range with Hi == 0 contains just Low.
 func (rs RangeSorter) Normalize() RangeSorter {
 	ll := rs.Len()
 	if ll > 1 {
 		prev := 0
 		for i := 1; i < ll; i++ {
-			if rs[prev].Low == rs[i].Low {
-				// Earlier range is guaranteed to be wider or equal to the later range,
-				// collapse two ranges into one (by doing nothing)
-				continue
+			hi := rs[prev].Hi
+			if hi == 0 {
+				hi = rs[prev].Low + 1
 			}
-			// Check for full or partial overlap
-			if rs[prev].Hi > 0 && rs[prev].Hi+1 >= rs[i].Low {
-				// Partial overlap
-				if rs[prev].Hi < rs[i].Hi {
-					rs[prev].Hi = rs[i].Hi
+			// Check for full or partial overlap or adjacency
+			if rs[i].Low <= hi {
+				next := rs[i].Hi
+				if next == 0 {
+					next = rs[i].Low + 1
 				}
 				// Otherwise the next range is fully within the previous range, consume it by doing nothing.
+				if next > hi {
+					rs[prev].Hi = next
+				}
 				continue
 			}
 			// No overlap
 			prev++
+			rs[prev] = rs[i]
 		}
 		rs = rs[:prev+1]
 	}
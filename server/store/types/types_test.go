@@ -0,0 +1,43 @@
+package types
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRangeSorterNormalize(t *testing.T) {
+	cases := []struct {
+		name string
+		in   []Range
+		want []Range
+	}{
+		// Results unchanged from the inclusive-inclusive implementation.
+		{"empty", nil, nil},
+		{"single", []Range{{Low: 3, Hi: 5}}, []Range{{Low: 3, Hi: 5}}},
+		{"duplicates", []Range{{Low: 2}, {Low: 2}}, []Range{{Low: 2}}},
+		{"overlapping", []Range{{Low: 1, Hi: 5}, {Low: 2, Hi: 4}, {Low: 3, Hi: 8}}, []Range{{Low: 1, Hi: 8}}},
+		{"adjacent", []Range{{Low: 1, Hi: 4}, {Low: 4, Hi: 7}}, []Range{{Low: 1, Hi: 7}}},
+		{"id inside range", []Range{{Low: 1, Hi: 5}, {Low: 3}}, []Range{{Low: 1, Hi: 5}}},
+
+		// Hi is exclusive: [1, 4) and [5, 7) leave 4 out, the ranges are not joined.
+		{"gap of one", []Range{{Low: 1, Hi: 4}, {Low: 5, Hi: 7}}, []Range{{Low: 1, Hi: 4}, {Low: 5, Hi: 7}}},
+		// Consecutive single IDs are joined into one range.
+		{"consecutive ids", []Range{{Low: 3}, {Low: 4}}, []Range{{Low: 3, Hi: 5}}},
+		// A disjoint range following a merged one used to be replaced by the merged-away range.
+		{"disjoint after merge", []Range{{Low: 1, Hi: 5}, {Low: 2, Hi: 3}, {Low: 7, Hi: 9}},
+			[]Range{{Low: 1, Hi: 5}, {Low: 7, Hi: 9}}},
+	}
+
+	for _, tc := range cases {
+		rs := RangeSorter(append([]Range(nil), tc.in...))
+		sort.Sort(rs)
+		got := []Range(rs.Normalize())
+		if len(got) == 0 && len(tc.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
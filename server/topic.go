@@ -1,8 +1,2839 @@
+// topic是一个独立的通信频道，比如聊天室或者一对一的会话
+
 package main
 
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"GoChat/server/auth"
+	"GoChat/server/store"
+	"GoChat/server/store/types"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+// Topic is an isolated communication channel
+type Topic struct {
+	// Еxpanded/unique name of the topic.
+	name string
+	// For single-user topics session-specific topic name, such as 'me',
+	// otherwise the same as 'name'.
+	xoriginal string
+
+	// Topic category
+	cat types.TopicCat
+
+	// Group topic which is also accessible as a read-only channel 'chnXXX'.
+	isChan bool
+	// Number of channel readers in perUser. Readers are not counted as topic members.
+	chnReaders int
+
+	// Time when the topic was first created.
+	created time.Time
+	// Time when the topic was last updated.
+	updated time.Time
+	// Time of the last outgoing message.
+	touched time.Time
+
+	// Server-side ID of the last data message
+	lastID int
+	// ID of the deletion operation. Not an ID of the message.
+	delID int
+
+	// Last published userAgent ('me' topic only)
+	userAgent string
+
+	// User ID of the topic owner/creator. Could be zero.
+	owner types.Uid
+
+	// Default access mode
+	accessAuth types.AccessMode
+	accessAnon types.AccessMode
+
+	// Topic discovery tags
+	tags []string
+
+	// Topic's public data
+	public interface{}
+
+	// Topic's per-subscriber data
+	perUser map[types.Uid]perUserData
+
+	// User's contact list (not nil for 'me' topic only).
+	// The map keys are UserIds for P2P topics and grpXXX for group topics.
+	perSubs map[string]perSubsData
+
+	// Sessions attached to this topic. The UID kept here may not match Session.uid if session is
+	// subscribed on behalf of another user.
+	sessions map[*Session]perSessionData
+	// Recipients of the message being broadcast. Reused between broadcasts to avoid allocations.
+	recipients []*Session
+	// Recipients which see the topic under another name: channel readers or the other user
+	// of a P2P topic. Reused the same way.
+	otherRecipients []*Session
+	// Topic names seen by recipients and otherRecipients.
+	recipientNames [2]string
+
+	// Requests to broadcast messages from sessions or other topics. Buffered = 256
+	broadcast chan *ServerComMessage
+	// Channel for receiving {get}/{set} requests, buffered = 64
+	meta chan *metaReq
+	// Subscribe requests from sessions, buffered = 256
+	reg chan *sessionJoin
+	// Unsubscribe requests from sessions, buffered = 256
+	unreg chan *sessionLeave
+	// Session updates: background sessions coming online, User Agent changes. Buffered = 32
+	supd chan *sessionUpdate
+	// Channel to terminate topic  -- either the topic is deleted or system is being shut down. Buffered = 1.
+	exit chan *shutDown
+
+	// Flag which tells topic lifecycle status: new, ready, paused, marked for deletion.
+	status int32
+
+	// Countdown timer for destroying the topic when there are no more attached sessions to it.
+	killTimer *time.Timer
+}
+
+// perUserData holds topic's cache of per-subscriber data
+type perUserData struct {
+	// Timestamps when the subscription was created and updated
+	created time.Time
+	updated time.Time
+
+	// Count of subscription online and announced (presence not deferred).
+	online int
+
+	// Last t.lastId reported by user through {pres} as received or read
+	recvID int
+	readID int
+	// ID of the latest Delete operation
+	delID int
+
+	private interface{}
+
+	modeWant  types.AccessMode
+	modeGiven types.AccessMode
+
+	// The user is a channel reader: subscribed as 'chnXXX', not a member of the group.
+	isChan bool
+
+	// P2P only:
+	// Public of the other user
+	public interface{}
+	// Name of the topic as seen by this user, i.e. ID of the other user.
+	topicName string
+	// The user has deleted the subscription. The other user may still use the topic.
+	deleted bool
+}
+
+// perSubsData holds user's (on 'me' topic) cache of subscription data
+type perSubsData struct {
+	// The other user's/topic's online status as seen by this user.
+	online bool
+	// True if we care about the updates from the other user/topic: (want&given).IsPresencer().
+	// Does not affect sending notifications from this user to other users.
+	enabled bool
+}
+
+// Data related to a subscription of a session to a topic.
+type perSessionData struct {
+	// ID of the subscribed user (asUid); not necessarily the session owner.
+	uid types.Uid
+	// The session is attached as a channel reader.
+	isChanSub bool
+}
+
+// Reasons why topic is being shut down.
+const (
+	// StopNone no reason given/default.
+	StopNone = iota
+	// StopShutdown terminated due to system shutdown.
+	StopShutdown
+	// StopDeleted terminated due to being deleted.
+	StopDeleted
+)
+
+// Topic shutdown
+type shutDown struct {
+	// Channel to report back completion of topic shutdown. Could be nil
+	done chan<- bool
+	// Topic is being deleted as opposite to total system shutdown
+	reason int
+	// If not zero, the topic is stopped only if it belongs to this user, see belongsTo.
+	// Otherwise the topic keeps running and reports false to 'done'.
+	forUser types.Uid
+}
+
 // Session Update: user agent change或者background session becoming normal
 //if sess is nil then user agent change
 type sessionUpdate struct {
 	sess      *Session
 	userAgent string
 }
+
+// getPerUserAcs returns `want` and `given` permissions for the given user id.
+func (t *Topic) getPerUserAcs(uid types.Uid) (types.AccessMode, types.AccessMode) {
+	pud := t.perUser[uid]
+	return pud.modeWant, pud.modeGiven
+}
+
+// passesPresenceFilters applies presence filters to `msg`
+// depending on per-user want and given acls for the provided `uid`.
+func (t *Topic) passesPresenceFilters(pres *MsgServerPres, uid types.Uid) bool {
+	modeWant, modeGiven := t.getPerUserAcs(uid)
+	// "gone" and "acs" notifications are sent even if the topic is muted.
+	return ((modeGiven & modeWant).IsPresencer() || pres.What == "gone" || pres.What == "acs") &&
+		(pres.FilterIn == 0 || int(modeGiven&modeWant)&pres.FilterIn != 0) &&
+		(pres.FilterOut == 0 || int(modeGiven&modeWant)&pres.FilterOut == 0)
+}
+
+// userIsReader returns true if the user (specified by `uid`) may read the given topic.
+func (t *Topic) userIsReader(uid types.Uid) bool {
+	modeWant, modeGiven := t.getPerUserAcs(uid)
+	return (modeGiven & modeWant).IsReader()
+}
+
+// unregisterSession 处理从t.unreg收到的离开请求
+func (t *Topic) unregisterSession(leave *sessionLeave) {
+	t.handleLeaveRequest(leave)
+	if leave.pkt != nil && leave.sess.inflightReqs != nil {
+		// If it's a client initiated request.
+		leave.sess.inflightReqs.Done()
+	}
+
+	// If there are no more subscriptions to this topic, start a kill timer
+	if len(t.sessions) == 0 {
+		t.killTimer.Reset(idleMasterTopicTimeout)
+	}
+}
+
+//topic的主循环，每个topic运行在自己的goroutine中
+func (t *Topic) run(hub *Hub) {
+	// Kills topic after a period of inactivity.
+	t.killTimer = time.NewTimer(time.Hour)
+	t.killTimer.Stop()
+
+	// Notifies about user agent change. 'me' only
+	uaTimer := time.NewTimer(time.Minute)
+	var currentUA string
+	uaTimer.Stop()
+
+	for {
+		select {
+		case join := <-t.reg:
+			// Request to add a connection to this topic
+			if t.isInactive() {
+				join.sess.queueOut(ErrLockedReply(join.pkt, types.TimeNow()))
+			} else {
+				// The topic is alive, so stop the kill timer, if it's ticking. We don't want the topic to die
+				// while processing the call
+				t.killTimer.Stop()
+				if err := t.handleSubscription(join); err != nil {
+					if len(t.sessions) == 0 {
+						// Failed to subscribe, the topic is still inactive
+						t.killTimer.Reset(idleMasterTopicTimeout)
+					}
+					logs.Warn.Printf("topic[%s] subscription failed %v, sid=%s", t.name, err, join.sess.sid)
+				}
+			}
+			if join.sess.inflightReqs != nil {
+				join.sess.inflightReqs.Done()
+			}
+
+		case leave := <-t.unreg:
+			t.unregisterSession(leave)
+
+		case msg := <-t.broadcast:
+			// Content message intended for broadcasting to recipients
+			t.handleBroadcast(msg)
+
+		case meta := <-t.meta:
+			// Request to get/set topic metadata
+			t.handleMeta(meta)
+
+		case upd := <-t.supd:
+			if upd.sess != nil {
+				// 'me' & 'grp' only. Background session timed out and came online.
+				t.sessToForeground(upd.sess)
+			} else if currentUA != upd.userAgent {
+				if t.cat != types.TopicCatMe {
+					logs.Warn.Panicln("invalid topic category in UA update", t.name)
+				}
+				// 'me' only. Process an update to user agent from one of the sessions.
+				currentUA = upd.userAgent
+				uaTimer.Reset(uaTimerDelay)
+			}
+
+		case <-uaTimer.C:
+			// Publish user agent changes after a delay
+			if currentUA == "" || currentUA == t.userAgent {
+				continue
+			}
+			t.userAgent = currentUA
+			t.presUsersOfInterest("ua", t.userAgent)
+
+		case <-t.killTimer.C:
+			// Topic timeout
+			hub.unreg <- &topicUnreg{rcptTo: t.name}
+			// 如果只有后台session访问过该topic，则从未发送过"on"，也就不需要发送"off"
+			if t.cat == types.TopicCatMe {
+				uaTimer.Stop()
+				if t.isLoaded() {
+					t.presUsersOfInterest("off", currentUA)
+				}
+			} else if t.cat == types.TopicCatGrp && t.isLoaded() {
+				t.presSubsOffline("off", nilPresParams, nilPresFilters, nilPresFilters, "", false)
+			}
+
+		case sd := <-t.exit:
+			// Handle three cases:
+			// 1. Topic is shutting down by timer due to inactivity (reason == StopNone)
+			// 2. Topic is being deleted (reason == StopDeleted)
+			// 3. System shutdown (reason == StopShutdown, done != nil).
+			// 4. User is being deleted (forUser is set): only the user's topics are stopped.
+
+			if !sd.forUser.IsZero() {
+				// Membership is checked here because perUser is owned by the topic goroutine.
+				if !t.belongsTo(sd.forUser) {
+					if sd.done != nil {
+						sd.done <- false
+					}
+					continue
+				}
+				t.markDeleted()
+				hub.topicDel(t.name)
+			}
+
+			if sd.reason == StopDeleted && t.cat == types.TopicCatGrp {
+				t.presSubsOffline("gone", nilPresParams, nilPresFilters, nilPresFilters, "", false)
+			}
+			// P2P users get "off+remove" earlier in the process
+			// In case of a system shutdown don't bother with notifications. They won't be delivered anyway.
+
+			// Tell sessions to remove the topic
+			for s := range t.sessions {
+				s.detachSession(t.name)
+			}
+
+			// Report completion back to sender, if 'done' is not nil.
+			if sd.done != nil {
+				sd.done <- true
+			}
+			return
+		}
+	}
+}
+
+// belongsTo 检查topic是否随用户一起停止：用户的P2P、'me'和'fnd' topic，以及用户是所有者的群组topic
+func (t *Topic) belongsTo(uid types.Uid) bool {
+	_, isMember := t.perUser[uid]
+	return (t.cat != types.TopicCatGrp && isMember) || t.owner == uid
+}
+
+// handleMeta 处理{get}/{set}/{del}请求
+func (t *Topic) handleMeta(meta *metaReq) {
+	asUid := types.ParseUserId(meta.pkt.AsUser)
+	authLevel := auth.Level(meta.pkt.AuthLvl)
+	switch {
+	case meta.pkt.Get != nil:
+		// Get request
+		if meta.pkt.MetaWhat&constMsgMetaDesc != 0 {
+			if err := t.replyGetDesc(meta.sess, asUid, meta.pkt.Get.Desc, meta.pkt); err != nil {
+				logs.Warn.Printf("topic[%s] meta.Get.Desc failed: %s", t.name, err)
+			}
+		}
+		if meta.pkt.MetaWhat&constMsgMetaSub != 0 {
+			if err := t.replyGetSub(meta.sess, asUid, authLevel, meta.pkt); err != nil {
+				logs.Warn.Printf("topic[%s] meta.Get.Sub failed: %s", t.name, err)
+			}
+		}
+		if meta.pkt.MetaWhat&constMsgMetaData != 0 {
+			if err := t.replyGetData(meta.sess, asUid, meta.pkt.Get.Data, meta.pkt); err != nil {
+				logs.Warn.Printf("topic[%s] meta.Get.Data failed: %s", t.name, err)
+			}
+		}
+		if meta.pkt.MetaWhat&constMsgMetaDel != 0 {
+			if err := t.replyGetDel(meta.sess, asUid, meta.pkt.Get.Del, meta.pkt); err != nil {
+				logs.Warn.Printf("topic[%s] meta.Get.Del failed: %s", t.name, err)
+			}
+		}
+		if meta.pkt.MetaWhat&constMsgMetaTags != 0 {
+			if err := t.replyGetTags(meta.sess, asUid, meta.pkt); err != nil {
+				logs.Warn.Printf("topic[%s] meta.Get.Tags failed: %s", t.name, err)
+			}
+		}
+
+	case meta.pkt.Set != nil:
+		// Set request
+		if meta.pkt.MetaWhat&constMsgMetaDesc != 0 {
+			if err := t.replySetDesc(meta.sess, asUid, meta.pkt); err != nil {
+				logs.Warn.Printf("topic[%s] meta.Set.Desc failed: %v", t.name, err)
+			}
+		}
+		if meta.pkt.MetaWhat&constMsgMetaSub != 0 {
+			if err := t.replySetSub(meta.sess, meta.pkt); err != nil {
+				logs.Warn.Printf("topic[%s] meta.Set.Sub failed: %v", t.name, err)
+			}
+		}
+		if meta.pkt.MetaWhat&constMsgMetaTags != 0 {
+			if err := t.replySetTags(meta.sess, asUid, meta.pkt); err != nil {
+				logs.Warn.Printf("topic[%s] meta.Set.Tags failed: %v", t.name, err)
+			}
+		}
+
+	case meta.pkt.Del != nil:
+		// Del request
+		var err error
+		switch meta.pkt.MetaWhat {
+		case constMsgDelMsg:
+			err = t.replyDelMsg(meta.sess, asUid, meta.pkt)
+		case constMsgDelSub:
+			err = t.replyDelSub(meta.sess, asUid, meta.pkt)
+		case constMsgDelTopic:
+			err = t.replyDelTopic(meta.sess, asUid, meta.pkt)
+		}
+
+		if err != nil {
+			logs.Warn.Printf("topic[%s] meta.Del failed: %v", t.name, err)
+		}
+	}
+}
+
+// Session subscribed to a topic, created == true if topic was just created and {pres} needs to be announced
+func (t *Topic) handleSubscription(join *sessionJoin) error {
+	asUid := types.ParseUserId(join.pkt.AsUser)
+	authLevel := auth.Level(join.pkt.AuthLvl)
+
+	msgsub := join.pkt.Sub
+	getWhat := 0
+	if msgsub.Get != nil {
+		getWhat = parseMsgClientMeta(msgsub.Get.What)
+	}
+
+	if err := t.subscriptionReply(join); err != nil {
+		return err
+	}
+
+	if getWhat&constMsgMetaDesc != 0 {
+		// Send get.desc as a {meta} packet.
+		if err := t.replyGetDesc(join.sess, asUid, msgsub.Get.Desc, join.pkt); err != nil {
+			logs.Warn.Printf("topic[%s] handleSubscription Get.Desc failed: %v sid=%s", t.name, err, join.sess.sid)
+		}
+	}
+
+	if getWhat&constMsgMetaSub != 0 {
+		// Send get.sub response as a separate {meta} packet
+		if err := t.replyGetSub(join.sess, asUid, authLevel, join.pkt); err != nil {
+			logs.Warn.Printf("topic[%s] handleSubscription Get.Sub failed: %v sid=%s", t.name, err, join.sess.sid)
+		}
+	}
+
+	if getWhat&constMsgMetaTags != 0 {
+		// Send get.tags response as a separate {meta} packet
+		if err := t.replyGetTags(join.sess, asUid, join.pkt); err != nil {
+			logs.Warn.Printf("topic[%s] handleSubscription Get.Tags failed: %v sid=%s", t.name, err, join.sess.sid)
+		}
+	}
+
+	if getWhat&constMsgMetaData != 0 {
+		// Send get.data response as {data} packets
+		if err := t.replyGetData(join.sess, asUid, msgsub.Get.Data, join.pkt); err != nil {
+			logs.Warn.Printf("topic[%s] handleSubscription Get.Data failed: %v sid=%s", t.name, err, join.sess.sid)
+		}
+	}
+
+	if getWhat&constMsgMetaDel != 0 {
+		// Send get.del response as a separate {meta} packet
+		if err := t.replyGetDel(join.sess, asUid, msgsub.Get.Del, join.pkt); err != nil {
+			logs.Warn.Printf("topic[%s] handleSubscription Get.Del failed: %v sid=%s", t.name, err, join.sess.sid)
+		}
+	}
+
+	return nil
+}
+
+// handleLeaveRequest processes a session leave request.
+func (t *Topic) handleLeaveRequest(leave *sessionLeave) {
+	// Remove connection from topic; session may continue to function
+	now := types.TimeNow()
+
+	// userId.IsZero() == true when the entire session is being dropped.
+	var asUid types.Uid
+	if leave.pkt != nil {
+		asUid = types.ParseUserId(leave.pkt.AsUser)
+	}
+
+	if t.isInactive() {
+		if !asUid.IsZero() && leave.pkt != nil {
+			leave.sess.queueOut(ErrLockedReply(leave.pkt, now))
+		}
+		return
+	} else if leave.pkt != nil && leave.pkt.Leave.Unsub {
+		// User wants to leave and unsubscribe.
+		// asUid must not be Zero.
+		if err := t.replyLeaveUnsub(leave.sess, leave.pkt, asUid); err != nil {
+			logs.Err.Println("failed to unsub", err, leave.sess.sid)
+			return
+		}
+	} else if pssd, _ := t.remSession(leave.sess, asUid); pssd != nil {
+		uid := pssd.uid
+		pud := t.perUser[uid]
+		if atomic.LoadInt32(&leave.sess.background) == 0 {
+			pud.online--
+		}
+
+		switch t.cat {
+		case types.TopicCatMe:
+			mrs := t.mostRecentSession()
+			if mrs == nil {
+				// Last session
+				mrs = leave.sess
+			} else {
+				// Change UA to the most recent live session and announce it. Don't block.
+				select {
+				case t.supd <- &sessionUpdate{userAgent: mrs.userAgent}:
+				default:
+				}
+			}
+
+			// Update user's last online timestamp & user agent. Only one user can be subscribed to 'me' topic.
+			// Background sessions do not mark the user as active.
+			if atomic.LoadInt32(&leave.sess.background) == 0 {
+				if err := store.Users.UpdateLastSeen(uid, mrs.userAgent, now); err != nil {
+					logs.Warn.Println(err)
+				}
+			}
+		case types.TopicCatFnd:
+			// Remove ephemeral query.
+			t.fndRemovePublic(leave.sess)
+		case types.TopicCatGrp:
+			// Topic is going offline: notify online subscribers on 'me'.
+			// Channel readers are invisible to other subscribers.
+			if pud.online == 0 && atomic.LoadInt32(&leave.sess.background) == 0 && !pud.isChan {
+				t.presSubsOnline("off", uid.UserId(), nilPresParams, &presFilters{filterIn: types.ModeRead}, "")
+			}
+		}
+
+		t.perUser[uid] = pud
+
+		// Respond if contains an id.
+		if leave.pkt != nil {
+			leave.sess.queueOut(NoErrReply(leave.pkt, now))
+		}
+	}
+}
+
+// sessToForeground updates perUser online status accounting and fires due
+// deferred notifications for the provided session.
+func (t *Topic) sessToForeground(sess *Session) {
+	if pssd, ok := t.sessions[sess]; ok {
+		uid := pssd.uid
+		// Mark user as online
+		pud := t.perUser[uid]
+		pud.online++
+		t.perUser[uid] = pud
+
+		t.sendSubNotifications(uid, sess.sid, sess.userAgent)
+	}
+}
+
+// Send immediate presence notification in response to a subscription.
+// These notifications are always sent immediately even if background is requested.
+func (t *Topic) sendImmediateSubNotifications(asUid types.Uid, acs *MsgAccessMode, sreg *sessionJoin) {
+	modeWant, _ := types.ParseAcs([]byte(acs.Want))
+	modeGiven, _ := types.ParseAcs([]byte(acs.Given))
+	mode := modeWant & modeGiven
+
+	if t.cat == types.TopicCatP2P {
+		uid2 := t.p2pOtherUser(asUid)
+		pud2 := t.perUser[uid2]
+		mode2 := pud2.modeGiven & pud2.modeWant
+		if pud2.deleted {
+			mode2 = types.ModeInvalid
+		}
+
+		// Inform the other user that the topic was just created.
+		if sreg.pkt.Sub.Created {
+			t.presSingleUserOffline(uid2, mode2, "acs", &presParams{
+				dWant:  pud2.modeWant.String(),
+				dGiven: pud2.modeGiven.String(),
+				actor:  asUid.UserId()}, "", false)
+		}
+
+		if sreg.pkt.Sub.NewSub {
+			// Notify current user's 'me' topic to accept notifications from user2
+			t.presSingleUserOffline(asUid, mode, "?none+en", nilPresParams, "", false)
+
+			// Initiate exchange of 'online' status with the other user.
+			// We don't know if the current user is online in the 'me' topic,
+			// so sending an '?unkn' status to user2. His 'me' topic
+			// will reply with user2's status and request an actual status from user1.
+			status := "?unkn"
+			if mode2.IsPresencer() {
+				// If user2 should receive notifications, enable it.
+				status += "+en"
+			}
+			t.presSingleUserOffline(uid2, mode2, status, nilPresParams, "", false)
+		}
+	}
+
+	// NewSub could be true only for p2p and group topics, no need to check topic category explicitly.
+	if sreg.pkt.Sub.NewSub {
+		// Notify creator's other sessions that the subscription (or the entire topic) was created.
+		t.presSingleUserOffline(asUid, mode, "acs",
+			&presParams{
+				dWant:  acs.Want,
+				dGiven: acs.Given,
+				actor:  asUid.UserId()},
+			sreg.sess.sid, false)
+	}
+}
+
+// Send immediate or deferred presence notification in response to a subscription.
+func (t *Topic) sendSubNotifications(asUid types.Uid, sid, userAgent string) {
+	switch t.cat {
+	case types.TopicCatMe:
+		// Notify user's contact that the given user is online now.
+		if !t.isLoaded() {
+			t.markLoaded()
+			if err := t.loadContacts(asUid); err != nil {
+				logs.Err.Println("topic: failed to load contacts", t.name, err.Error())
+			}
+			// User online: notify users of interest without forcing response (no +en here).
+			t.presUsersOfInterest("on", userAgent)
+		}
+
+	case types.TopicCatGrp:
+		pud := t.perUser[asUid]
+
+		// Enable notifications for a new group topic, if appropriate.
+		if !t.isLoaded() {
+			t.markLoaded()
+			status := "on"
+			if (pud.modeGiven & pud.modeWant).IsPresencer() {
+				status += "+en"
+			}
+
+			// Notify topic subscribers that the topic is online now.
+			t.presSubsOffline(status, nilPresParams, nilPresFilters, nilPresFilters, "", false)
+		} else if pud.online == 1 && !pud.isChan {
+			// If this is the first session of the user in the topic.
+			// Notify other online group members that the user is online now.
+			t.presSubsOnline("on", asUid.UserId(), nilPresParams,
+				&presFilters{filterIn: types.ModeRead}, sid)
+		}
+	}
+}
+
+// handleBroadcast 将{data}、{pres}、{info}消息分发给topic中的所有session
+func (t *Topic) handleBroadcast(msg *ServerComMessage) {
+	asUid := types.ParseUserId(msg.AsUser)
+	if t.isInactive() {
+		// Ignore broadcast - topic is paused or being deleted.
+		if msg.Data != nil {
+			msg.sess.queueOut(ErrLocked(msg.Id, t.original(asUid), msg.Timestamp))
+		}
+		return
+	}
+
+	if msg.Data != nil {
+		if t.isReadOnly() {
+			msg.sess.queueOut(ErrPermissionDenied(msg.Id, t.original(asUid), msg.Timestamp))
+			return
+		}
+
+		asUser := types.ParseUserId(msg.Data.From)
+		userData, userFound := t.perUser[asUser]
+		// Check write permission.
+		if !(userData.modeWant & userData.modeGiven).IsWriter() {
+			msg.sess.queueOut(ErrPermissionDenied(msg.Id, t.original(asUid), msg.Timestamp))
+			return
+		}
+
+		if err := store.Messages.Save(&types.Message{
+			ObjHeader: types.ObjHeader{CreatedAt: msg.Data.Timestamp},
+			SeqId:     t.lastID + 1,
+			Topic:     t.name,
+			From:      asUser.String(),
+			Head:      msg.Data.Head,
+			Content:   msg.Data.Content}, (userData.modeGiven & userData.modeWant).IsReader()); err != nil {
+
+			logs.Warn.Printf("topic[%s]: failed to save message: %v", t.name, err)
+			msg.sess.queueOut(ErrUnknown(msg.Id, t.original(asUid), msg.Timestamp))
+
+			return
+		}
+
+		t.lastID++
+		t.touched = msg.Data.Timestamp
+		msg.Data.SeqId = t.lastID
+
+		if userFound {
+			userData.readID = t.lastID
+			t.perUser[asUser] = userData
+		}
+
+		if msg.Id != "" && msg.sess != nil {
+			reply := NoErrAccepted(msg.Id, t.original(asUid), msg.Timestamp)
+			reply.Ctrl.Params = map[string]int{"seq": t.lastID}
+			msg.sess.queueOut(reply)
+		}
+
+		// Message sent: notify offline 'R' subscrbers on 'me'.
+		t.presSubsOffline("msg", &presParams{seqID: t.lastID, actor: msg.Data.From},
+			&presFilters{filterIn: types.ModeRead}, nilPresFilters, "", true)
+
+	} else if msg.Pres != nil {
+		what := t.presProcReq(msg.Pres.Src, msg.Pres.What, msg.Pres.WantReply)
+		if t.xoriginal != msg.Pres.Topic || what == "" {
+			// This is just a request for status, don't forward it to sessions
+			return
+		}
+
+		// "what" may have changed, i.e. unset or "+command" removed ("on+en" -> "on")
+		msg.Pres.What = what
+	} else if msg.Info != nil {
+		// No need to process {info} sent to 'me' topic.
+		if msg.Info.Src == "" {
+			if msg.Info.SeqId > t.lastID {
+				// Drop bogus read notification
+				return
+			}
+
+			asUser := types.ParseUserId(msg.Info.From)
+			pud := t.perUser[asUser]
+			mode := pud.modeGiven & pud.modeWant
+
+			// Filter out "kp" from users with no 'W' permission (or people without a subscription)
+			if msg.Info.What == "kp" && (!mode.IsWriter() || t.isReadOnly()) {
+				return
+			}
+
+			if (msg.Info.What == "read" || msg.Info.What == "recv") && !mode.IsReader() {
+				// Filter out "read/recv" from users with no 'R' permission (or people without a subscription)
+				return
+			}
+
+			var read, recv, seq int
+			if msg.Info.What == "read" {
+				if msg.Info.SeqId <= pud.readID {
+					// No need to report stale or bogus read status.
+					return
+				}
+
+				pud.readID = msg.Info.SeqId
+				if pud.readID > pud.recvID {
+					pud.recvID = pud.readID
+				}
+				read = pud.readID
+				seq = read
+			} else if msg.Info.What == "recv" {
+				if msg.Info.SeqId <= pud.recvID {
+					// Stale or bogus recv status.
+					return
+				}
+
+				pud.recvID = msg.Info.SeqId
+				if pud.readID > pud.recvID {
+					pud.recvID = pud.readID
+				}
+				recv = pud.recvID
+				seq = recv
+			}
+
+			if seq > 0 {
+				if err := store.Subs.Update(t.subName(asUser), asUser,
+					map[string]interface{}{
+						"RecvSeqId": pud.recvID,
+						"ReadSeqId": pud.readID},
+					false); err != nil {
+
+					logs.Warn.Printf("topic[%s]: failed to update SeqRead/Recv counter: %v", t.name, err)
+					return
+				}
+
+				// Read/recv updated: notify user's other sessions of the change
+				t.presPubMessageCount(asUser, mode, read, recv, msg.SkipSid)
+
+				t.perUser[asUser] = pud
+			}
+
+			if pud.isChan {
+				// Read receipts of channel readers are not shared with the topic.
+				return
+			}
+		}
+	} else {
+		logs.Err.Panic("topic: wrong message type for broadcasting", t.name)
+	}
+
+	// User IDs are parsed once instead of formatting the ID of every session.
+	var singleUser, excludeUser, infoFrom types.Uid
+	if msg.Pres != nil {
+		singleUser = types.ParseUserId(msg.Pres.SingleUser)
+		excludeUser = types.ParseUserId(msg.Pres.ExcludeUser)
+	} else if msg.Info != nil {
+		infoFrom = types.ParseUserId(msg.Info.From)
+	}
+
+	// Find recipients of the message. Only {data}, {pres}, {info} are broadcastable.
+	// {meta} and {ctrl} are sent to the session only.
+	for sess, pssd := range t.sessions {
+		if sess.sid == msg.SkipSid {
+			continue
+		}
+
+		if msg.Pres != nil {
+			// Channel readers receive only notifications addressed to them.
+			if pssd.isChanSub && msg.Pres.SingleUser == "" {
+				continue
+			}
+
+			// Skip notifying - already notified on topic.
+			if msg.Pres.SkipTopic != "" && sess.getSub(msg.Pres.SkipTopic) != nil {
+				continue
+			}
+
+			// Notification addressed to a single user only.
+			if msg.Pres.SingleUser != "" && pssd.uid != singleUser {
+				continue
+			}
+			// Notification should skip a single user.
+			if msg.Pres.ExcludeUser != "" && pssd.uid == excludeUser {
+				continue
+			}
+
+			// Check presence filters
+			if !t.passesPresenceFilters(msg.Pres, pssd.uid) {
+				continue
+			}
+
+		} else if msg.Info != nil {
+			// Channel readers don't see read receipts and key presses.
+			if pssd.isChanSub {
+				continue
+			}
+
+			// Don't forward read receipts and key presses to those without the R permission.
+			// OK to forward with Src != "" because it's sent from another topic to 'me', permissions already
+			// checked there.
+			if msg.Info.Src == "" && !t.userIsReader(pssd.uid) {
+				continue
+			}
+
+			// Skip notifying - already notified on topic.
+			if msg.Info.SkipTopic != "" && sess.getSub(msg.Info.SkipTopic) != nil {
+				continue
+			}
+
+			// Don't send key presses from one user's session to the other sessions of the same user.
+			if msg.Info.What == "kp" && pssd.uid == infoFrom {
+				continue
+			}
+
+		} else if !t.userIsReader(pssd.uid) {
+			// Skip {data} if the user has no Read permission.
+			continue
+		}
+
+		t.addRecipient(sess, pssd.uid)
+	}
+
+	t.sendToRecipients(msg)
+}
+
+// addRecipient adds the session to recipients of the message being broadcast. Recipients see
+// the topic under one of at most two names: group members and channel readers, or the two users
+// of a P2P topic. Recipients are grouped by the name.
+func (t *Topic) addRecipient(sess *Session, uid types.Uid) {
+	if name := t.original(uid); len(t.recipients) == 0 || name == t.recipientNames[0] {
+		t.recipientNames[0] = name
+		t.recipients = append(t.recipients, sess)
+	} else {
+		t.recipientNames[1] = name
+		t.otherRecipients = append(t.otherRecipients, sess)
+	}
+}
+
+// sendToRecipients sends the message to the sessions added by addRecipient, the message is
+// addressed to the topic name of each group. Sessions which failed to receive it are dropped.
+func (t *Topic) sendToRecipients(msg *ServerComMessage) {
+	// List of sessions to be dropped.
+	var dropSessions []*Session
+	if len(t.recipients) > 0 {
+		t.recipients, dropSessions = t.fanOut(renamedMessage(msg, t.recipientNames[0]), t.recipients, dropSessions)
+	}
+	if len(t.otherRecipients) > 0 {
+		t.otherRecipients, dropSessions = t.fanOut(renamedMessage(msg, t.recipientNames[1]), t.otherRecipients, dropSessions)
+	}
+
+	// Drop "bad" sessions.
+	for _, sess := range dropSessions {
+		// The whole session is being dropped, so sessionLeave.pkt is not set.
+		t.unregisterSession(&sessionLeave{sess: sess})
+	}
+}
+
+// fanOut queues the message to the given sessions. The message is serialized once per codec,
+// all sessions receive the same immutable copy. Returns the emptied slice of sessions for reuse
+// and the list of sessions to be dropped.
+func (t *Topic) fanOut(msg *ServerComMessage, sessions, dropSessions []*Session) ([]*Session, []*Session) {
+	// Codecs used by the recipients.
+	var codecsUsed uint64
+	var grpcUsed bool
+	for _, sess := range sessions {
+		if sess.proto == GRPC {
+			grpcUsed = true
+		} else {
+			codecsUsed |= 1 << uint(sess.getCodec())
+		}
+	}
+
+	msg.serialized = newSerializedCache(msg, codecsUsed, grpcUsed)
+
+	return t.queueToSessions(msg, sessions, dropSessions)
+}
+
+// queueToSessions queues the message to the given sessions as is. Without a serialization
+// cache each session serializes the message on its own.
+func (t *Topic) queueToSessions(msg *ServerComMessage, sessions, dropSessions []*Session) ([]*Session, []*Session) {
+	for i, sess := range sessions {
+		// Release the session, the buffer is kept until the next broadcast.
+		sessions[i] = nil
+		if !sess.queueOut(msg) {
+			logs.Warn.Printf("topic[%s]: connection stuck, detaching - %s", t.name, sess.sid)
+			dropSessions = append(dropSessions, sess)
+		}
+	}
+	return sessions[:0], dropSessions
+}
+
+// renamedMessage returns the broadcast message addressed to the given topic name. The message is copied
+// if it was addressed to a different name, i.e. to a channel reader or to the other user of a P2P topic.
+func renamedMessage(msg *ServerComMessage, name string) *ServerComMessage {
+	switch {
+	case msg.Data != nil && msg.Data.Topic != name:
+		msg = msg.copy()
+		msg.Data.Topic = name
+	case msg.Pres != nil && msg.Pres.Topic != name:
+		msg = msg.copy()
+		msg.Pres.Topic = name
+	case msg.Info != nil && msg.Info.Topic != name:
+		msg = msg.copy()
+		msg.Info.Topic = name
+	}
+	return msg
+}
+
+// subscriptionReply generates a response to a subscription request
+func (t *Topic) subscriptionReply(join *sessionJoin) error {
+	// The topic is already initialized by the Hub
+
+	msgsub := join.pkt.Sub
+
+	// For newly created topics report topic creation time.
+	var now time.Time
+	if msgsub.Created {
+		now = t.updated
+	} else {
+		now = types.TimeNow()
+	}
+
+	asUid := types.ParseUserId(join.pkt.AsUser)
+
+	if types.IsChannel(join.pkt.Original) {
+		if !t.isChan {
+			join.sess.queueOut(ErrTopicNotFoundReply(join.pkt, now))
+			return types.ErrTopicNotFound
+		}
+		if pud, ok := t.perUser[asUid]; ok && !pud.isChan {
+			// Members access the topic as 'grpXXX' only.
+			join.sess.queueOut(ErrPermissionDeniedReply(join.pkt, now))
+			return errors.New("member cannot subscribe as a channel reader")
+		}
+	} else if pud, ok := t.perUser[asUid]; ok && pud.isChan {
+		// Channel readers access the topic as 'chnXXX' only.
+		join.sess.queueOut(ErrPermissionDeniedReply(join.pkt, now))
+		return errors.New("channel reader cannot subscribe as a member")
+	}
+
+	if !msgsub.NewSub && (t.cat == types.TopicCatP2P || t.cat == types.TopicCatGrp) {
+		// Check if this is a new subscription.
+		pud, found := t.perUser[asUid]
+		msgsub.NewSub = !found || pud.deleted
+	}
+
+	var private interface{}
+	var mode string
+	if msgsub.Set != nil {
+		if msgsub.Set.Sub != nil {
+			if msgsub.Set.Sub.User != "" {
+				join.sess.queueOut(ErrMalformedReply(join.pkt, now))
+				return errors.New("user id must not be specified")
+			}
+			mode = msgsub.Set.Sub.Mode
+		}
+
+		if msgsub.Set.Desc != nil {
+			private = msgsub.Set.Desc.Private
+		}
+	}
+
+	var err error
+	var modeChanged *MsgAccessMode
+	// Create new subscription or modify an existing one.
+	if modeChanged, err = t.thisUserSub(join.sess, join.pkt, asUid, mode, private); err != nil {
+		return err
+	}
+
+	// Subscription successfully created. Link topic to session.
+	join.sess.addSub(t.name, &Subscription{
+		broadcast: t.broadcast,
+		done:      t.unreg,
+		meta:      t.meta,
+		supd:      t.supd})
+	t.addSession(join.sess, asUid)
+
+	// The user is online in the topic. Increment the counter if notifications are not deferred.
+	if atomic.LoadInt32(&join.sess.background) == 0 {
+		userData := t.perUser[asUid]
+		userData.online++
+		t.perUser[asUid] = userData
+	}
+
+	params := map[string]interface{}{}
+	// Report back the assigned access mode.
+	if modeChanged != nil {
+		params["acs"] = modeChanged
+	}
+	toriginal := t.original(asUid)
+
+	// When a group topic is created, it's given a temporary name by the client.
+	// Then this name changes. Report back the original name here.
+	if msgsub.Created && join.pkt.Original != toriginal {
+		params["tmpname"] = join.pkt.Original
+	}
+
+	if len(params) == 0 {
+		// Don't send empty params '{}'
+		join.sess.queueOut(NoErr(join.pkt.Id, toriginal, now))
+	} else {
+		join.sess.queueOut(NoErrParams(join.pkt.Id, toriginal, now, params))
+	}
+
+	// Some notifications are always sent immediately.
+	if modeChanged != nil {
+		t.sendImmediateSubNotifications(asUid, modeChanged, join)
+	}
+
+	if atomic.LoadInt32(&join.sess.background) == 0 {
+		// Other notifications are also sent immediately for foreground sessions.
+		t.sendSubNotifications(asUid, join.sess.sid, join.sess.userAgent)
+	}
+
+	return nil
+}
+
+// User requests or updates a self-subscription to a topic. Called as a
+// result of {sub} or {meta set=sub}.
+// Returns new access mode as *MsgAccessMode if user's access mode has changed, nil otherwise.
+//
+//	sess			- originating session
+//	pkt				- client message which triggered this request (sub or set)
+//	asUid			- id of the user making the request
+//	want			- requested access mode
+//	private			- private value to assign to the subscription
+//
+// Handle these cases:
+// A. User is trying to subscribe for the first time (no subscription).
+// B. User is already subscribed, just joining without changing anything.
+// C. User is responding to an earlier invite (modeWant was "N" in subscription).
+// D. User is already subscribed, changing modeWant.
+// E. User is accepting ownership transfer (requesting ownership transfer is not permitted).
+func (t *Topic) thisUserSub(sess *Session, pkt *ClientComMessage, asUid types.Uid, want string,
+	private interface{}) (*MsgAccessMode, error) {
+
+	now := types.TimeNow()
+	asLvl := auth.Level(pkt.AuthLvl)
+
+	// Access mode values as they were before this request was processed.
+	oldWant := types.ModeNone
+	oldGiven := types.ModeNone
+
+	// Parse access mode requested by the user
+	modeWant := types.ModeUnset
+	if want != "" {
+		if err := modeWant.UnmarshalText([]byte(want)); err != nil {
+			sess.queueOut(ErrMalformedReply(pkt, now))
+			return nil, err
+		}
+	}
+
+	// Check if it's an attempt at a new subscription to the topic.
+	// It could be an actual subscription (IsJoiner() == true) or a ban (IsJoiner() == false).
+	userData, existingSub := t.perUser[asUid]
+	if !existingSub || userData.deleted {
+		// New subscription. Users subscribing as 'chnXXX' become channel readers.
+		userData.isChan = types.IsChannel(pkt.Original)
+
+		// Check if the max number of subscriptions is already reached. Channel readers are not limited.
+		if t.cat == types.TopicCatGrp && !userData.isChan && t.subsCount() >= globals.maxSubscriberCount {
+			sess.queueOut(ErrPolicyReply(pkt, now))
+			return nil, errors.New("max subscription count exceeded")
+		}
+
+		if t.cat == types.TopicCatP2P {
+			// P2P could be here only if it was previously deleted. I.e. existingSub is always true for P2P.
+			// The access given by the other user is kept unchanged.
+			if modeWant != types.ModeUnset {
+				userData.modeWant = modeWant
+			}
+			// If no modeWant is provided, leave existing one unchanged.
+
+			// Make sure the user is not asking for unreasonable permissions
+			userData.modeWant = (userData.modeWant & types.ModeCP2P) | types.ModeApprove
+		} else {
+			if asLvl == auth.LevelAnon && !t.accessFor(asLvl).IsJoiner() {
+				// 匿名用户只能加入默认匿名权限允许加入的话题，包括以频道读者的身份加入
+				sess.queueOut(ErrPermissionDeniedReply(pkt, now))
+				return nil, errors.New("topic access denied; anonymous access is not permitted")
+			}
+
+			if userData.isChan {
+				// Channel readers get read-only access.
+				userData.modeGiven = types.ModeCChnReader
+			} else {
+				// For all topics access is given as default access.
+				userData.modeGiven = t.accessFor(asLvl)
+			}
+
+			if modeWant == types.ModeUnset {
+				// User wants default access mode.
+				userData.modeWant = userData.modeGiven
+			} else {
+				userData.modeWant = modeWant
+			}
+		}
+
+		// Undelete.
+		userData.deleted = false
+
+		if isNullValue(private) {
+			private = nil
+		}
+		userData.private = private
+
+		// Add subscription to database.
+		sub := &types.Subscription{
+			User:      asUid.String(),
+			Topic:     t.name,
+			ModeWant:  userData.modeWant,
+			ModeGiven: userData.modeGiven,
+			Private:   userData.private,
+		}
+		if userData.isChan {
+			sub.Topic = types.GrpToChn(t.name)
+		}
+
+		if err := store.Subs.Create(sub); err != nil {
+			sess.queueOut(ErrUnknownReply(pkt, now))
+			return nil, err
+		}
+
+		if userData.isChan {
+			t.chnReaders++
+		}
+
+	} else {
+		// Process update to existing subscription. It could be an incomplete subscription for a new topic.
+		var ownerChange bool
+
+		// Save old access values
+
+		oldWant = userData.modeWant
+		oldGiven = userData.modeGiven
+
+		if modeWant != types.ModeUnset {
+			// Explicit modeWant is provided
+
+			// Perform sanity checks
+			if userData.modeGiven.IsOwner() {
+				// Check for possible ownership transfer. Handle the following cases:
+				// 1. Owner joining the topic without any changes
+				// 2. Owner changing own settings
+				// 3. Acceptance or rejection of the ownership transfer
+
+				// Make sure the current owner cannot unset the owner flag or ban himself
+				if t.owner == asUid && (!modeWant.IsOwner() || !modeWant.IsJoiner()) {
+					sess.queueOut(ErrPermissionDeniedReply(pkt, now))
+					return nil, errors.New("cannot unset ownership or self-ban the owner")
+				}
+
+				// Ownership transfer
+				ownerChange = modeWant.IsOwner() && !userData.modeWant.IsOwner()
+
+				// The owner should be able to grant himself any access permissions.
+				// If ownership transfer is rejected don't upgrade.
+				if modeWant.IsOwner() && !userData.modeGiven.BetterEqual(modeWant) {
+					userData.modeGiven |= modeWant
+				}
+			} else if modeWant.IsOwner() {
+				// Ownership transfer can only be initiated by the owner.
+				sess.queueOut(ErrPermissionDeniedReply(pkt, now))
+				return nil, errors.New("non-owner cannot request ownership transfer")
+			} else if t.cat == types.TopicCatGrp && userData.modeGiven.IsAdmin() && modeWant.IsAdmin() {
+				// A group topic Admin should be able to grant himself any permissions except
+				// ownership (checked previously) & hard-deleting messages.
+				if !userData.modeGiven.BetterEqual(modeWant & ^types.ModeDelete) {
+					userData.modeGiven |= (modeWant & ^types.ModeDelete)
+				}
+			}
+
+			if t.cat == types.TopicCatP2P {
+				// For P2P topics ignore requests for 'D'. Otherwise it will generate a useless announcement.
+				modeWant = (modeWant & types.ModeCP2P) | types.ModeApprove
+			}
+		}
+
+		// If user has not requested a new access mode, provide one by default.
+		if modeWant == types.ModeUnset {
+			// If the user has self-banned before, un-self-ban. Otherwise do not make a change.
+			if !oldWant.IsJoiner() {
+				// Set permissions NO WORSE than default, but possibly better (admin or owner banned himself).
+				userData.modeWant = userData.modeGiven | t.accessFor(asLvl)
+			}
+		} else if userData.modeWant != modeWant {
+			// The user has provided a new modeWant and it' different from the one before
+			userData.modeWant = modeWant
+		}
+
+		// Save changes to DB
+		update := map[string]interface{}{}
+		if isNullValue(private) {
+			update["Private"] = nil
+			userData.private = nil
+		} else if private != nil {
+			update["Private"] = private
+			userData.private = private
+		}
+		if userData.modeWant != oldWant {
+			update["ModeWant"] = userData.modeWant
+		}
+		if userData.modeGiven != oldGiven {
+			update["ModeGiven"] = userData.modeGiven
+		}
+		if len(update) > 0 {
+			if err := store.Subs.Update(t.subName(asUid), asUid, update, true); err != nil {
+				sess.queueOut(ErrUnknownReply(pkt, now))
+				return nil, err
+			}
+		}
+
+		// No transactions in RethinkDB, but two owners are better than none
+		if ownerChange {
+			oldOwnerData := t.perUser[t.owner]
+			oldOwnerOldWant, oldOwnerOldGiven := oldOwnerData.modeWant, oldOwnerData.modeGiven
+			oldOwnerData.modeGiven = (oldOwnerData.modeGiven & ^types.ModeOwner)
+			oldOwnerData.modeWant = (oldOwnerData.modeWant & ^types.ModeOwner)
+			if err := store.Subs.Update(t.name, t.owner,
+				map[string]interface{}{
+					"ModeWant":  oldOwnerData.modeWant,
+					"ModeGiven": oldOwnerData.modeGiven}, false); err != nil {
+				return nil, err
+			}
+			if err := store.Topics.OwnerChange(t.name, asUid); err != nil {
+				return nil, err
+			}
+			t.perUser[t.owner] = oldOwnerData
+			// Send presence notifications.
+			t.notifySubChange(t.owner, asUid,
+				oldOwnerOldWant, oldOwnerOldGiven, oldOwnerData.modeWant, oldOwnerData.modeGiven, "")
+			t.owner = asUid
+		}
+	}
+
+	// If topic is being muted, send "off" notification and disable updates.
+	// Do it before applying the new permissions.
+	if (oldWant & oldGiven).IsPresencer() && !(userData.modeWant & userData.modeGiven).IsPresencer() {
+		if t.cat == types.TopicCatMe {
+			t.presUsersOfInterest("off+dis", t.userAgent)
+		} else {
+			t.presSingleUserOffline(asUid, userData.modeWant&userData.modeGiven,
+				"off+dis", nilPresParams, "", false)
+		}
+	}
+
+	// Apply changes.
+	t.perUser[asUid] = userData
+
+	var modeChanged *MsgAccessMode
+	// Send presence notifications.
+	if oldWant != userData.modeWant || oldGiven != userData.modeGiven {
+		// Notify actor of the changes in access mode.
+		t.notifySubChange(asUid, asUid, oldWant, oldGiven, userData.modeWant, userData.modeGiven, sess.sid)
+	}
+
+	if (pkt.Sub != nil && pkt.Sub.NewSub) || oldWant != userData.modeWant || oldGiven != userData.modeGiven {
+		modeChanged = &MsgAccessMode{
+			Want:  userData.modeWant.String(),
+			Given: userData.modeGiven.String(),
+			Mode:  (userData.modeGiven & userData.modeWant).String(),
+		}
+	}
+
+	if !userData.modeWant.IsJoiner() {
+		// The user is self-banning from the topic. Re-subscription will unban.
+		t.evictUser(asUid, false, "")
+		// The callee will send NoErrOK
+		return modeChanged, nil
+
+	} else if !userData.modeGiven.IsJoiner() {
+		// User was banned
+		sess.queueOut(ErrPermissionDeniedReply(pkt, now))
+		return nil, errors.New("topic access denied; user is banned")
+	}
+
+	return modeChanged, nil
+}
+
+// anotherUserSub processes a request to initiate an invite or approve a subscription request from another user.
+// Returns changed == true if user's access mode has changed.
+// Handle these cases:
+// A. Sharer or Approver is inviting another user for the first time (no prior subscription)
+// B. Sharer or Approver is re-inviting another user (adjusting modeGiven, modeWant is still Unset)
+// C. Approver is changing modeGiven for another user, modeWant != Unset
+func (t *Topic) anotherUserSub(sess *Session, asUid, target types.Uid,
+	pkt *ClientComMessage) (*MsgAccessMode, error) {
+
+	now := types.TimeNow()
+	set := pkt.Set
+
+	// Access mode values as they were before this request was processed.
+	oldWant := types.ModeUnset
+	oldGiven := types.ModeUnset
+
+	// Access mode of the person who is executing this approval process
+	var hostMode types.AccessMode
+
+	// Check if approver actually has permission to manage sharing
+	userData, ok := t.perUser[asUid]
+	if !ok || !(userData.modeGiven & userData.modeWant).IsSharer() {
+		sess.queueOut(ErrPermissionDeniedReply(pkt, now))
+		return nil, errors.New("topic access denied; approver has no permission")
+	}
+
+	// Check if topic is suspended.
+	if t.isReadOnly() {
+		sess.queueOut(ErrPermissionDeniedReply(pkt, now))
+		return nil, errors.New("topic is suspended")
+	}
+
+	hostMode = userData.modeGiven & userData.modeWant
+
+	// Parse the access mode granted
+	modeGiven := types.ModeUnset
+	if set.Sub.Mode != "" {
+		if err := modeGiven.UnmarshalText([]byte(set.Sub.Mode)); err != nil {
+			sess.queueOut(ErrMalformedReply(pkt, now))
+			return nil, err
+		}
+
+		// Make sure the new permissions are reasonable in P2P topics: permissions no greater than default,
+		// approver permission cannot be removed.
+		if t.cat == types.TopicCatP2P {
+			modeGiven = (modeGiven & types.ModeCP2P) | types.ModeApprove
+		}
+	}
+
+	// Make sure only the owner & approvers can set non-default access mode
+	if modeGiven != types.ModeUnset && !hostMode.IsAdmin() {
+		sess.queueOut(ErrPermissionDeniedReply(pkt, now))
+		return nil, errors.New("sharer cannot set explicit modeGiven")
+	}
+
+	// Make sure no one but the owner can do an ownership transfer
+	if modeGiven.IsOwner() && t.owner != asUid {
+		sess.queueOut(ErrPermissionDeniedReply(pkt, now))
+		return nil, errors.New("attempt to transfer ownership by non-owner")
+	}
+
+	// Check if it's a new invite. If so, save it to database as a subscription.
+	// Saved subscription does not mean the user is allowed to post/read
+	userData, existingSub := t.perUser[target]
+	if !existingSub {
+		// Check if the max number of subscriptions is already reached.
+		if t.cat == types.TopicCatGrp && t.subsCount() >= globals.maxSubscriberCount {
+			sess.queueOut(ErrPolicyReply(pkt, now))
+			return nil, errors.New("max subscription count exceeded")
+		}
+
+		if modeGiven == types.ModeUnset {
+			// Request to use default access mode for the new subscriptions.
+			// Assuming LevelAuth. Approver should use non-default access if that is not suitable.
+			modeGiven = t.accessFor(auth.LevelAuth)
+			// Enable new subscription even if default is no joiner.
+			modeGiven |= types.ModeJoin
+		}
+
+		// Get user's default access mode to be used as modeWant
+		var modeWant types.AccessMode
+		if user, err := store.Users.Get(target); err != nil {
+			sess.queueOut(ErrUnknownReply(pkt, now))
+			return nil, err
+		} else if user == nil {
+			sess.queueOut(ErrUserNotFoundReply(pkt, now))
+			return nil, errors.New("user not found")
+		} else if user.State != types.StateOK {
+			sess.queueOut(ErrPermissionDeniedReply(pkt, now))
+			return nil, errors.New("user is suspended")
+		} else {
+			// Don't ask by default for more permissions than the granted ones.
+			modeWant = user.Access.Auth & modeGiven
+		}
+
+		// Add subscription to database
+		sub := &types.Subscription{
+			User:      target.String(),
+			Topic:     t.name,
+			ModeWant:  modeWant,
+			ModeGiven: modeGiven,
+		}
+
+		if err := store.Subs.Create(sub); err != nil {
+			sess.queueOut(ErrUnknownReply(pkt, now))
+			return nil, err
+		}
+
+		userData = perUserData{
+			modeGiven: sub.ModeGiven,
+			modeWant:  sub.ModeWant,
+			private:   nil,
+		}
+		t.perUser[target] = userData
+	} else {
+		// Action on an existing subscription: re-invite, change existing permission, confirm/decline request.
+		oldGiven = userData.modeGiven
+		oldWant = userData.modeWant
+
+		if modeGiven == types.ModeUnset {
+			// Request to re-send invite without changing the access mode
+			modeGiven = userData.modeGiven
+		} else if userData.isChan && modeGiven != userData.modeGiven {
+			// Channel readers cannot be given more than read-only access.
+			modeGiven &= types.ModeCChnReader
+		}
+
+		if modeGiven != userData.modeGiven {
+			// Changing the previously assigned value
+			userData.modeGiven = modeGiven
+
+			// Save changed value to database
+			if err := store.Subs.Update(t.subName(target), target,
+				map[string]interface{}{"ModeGiven": modeGiven}, false); err != nil {
+				return nil, err
+			}
+			t.perUser[target] = userData
+		}
+	}
+
+	var modeChanged *MsgAccessMode
+	// Access mode has changed.
+	if oldGiven != userData.modeGiven {
+		t.notifySubChange(target, asUid,
+			oldWant, oldGiven, userData.modeWant, userData.modeGiven, sess.sid)
+
+		modeChanged = &MsgAccessMode{
+			Given: userData.modeGiven.String(),
+			Want:  userData.modeWant.String(),
+			Mode:  (userData.modeGiven & userData.modeWant).String(),
+		}
+	}
+
+	if !userData.modeGiven.IsJoiner() {
+		// The user is banned from the topic.
+		t.evictUser(target, false, "")
+	}
+
+	return modeChanged, nil
+}
+
+// replyGetDesc is a response to a get.desc request on a topic, sent to just the session as a {meta} packet
+func (t *Topic) replyGetDesc(sess *Session, asUid types.Uid, opts *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	id := msg.Id
+
+	if opts != nil && (opts.User != "" || opts.Limit != 0) {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid GetDesc query")
+	}
+
+	// Check if user requested modified data
+	ifUpdated := opts == nil || opts.IfModifiedSince == nil || opts.IfModifiedSince.Before(t.updated)
+
+	desc := &MsgTopicDesc{}
+	if !ifUpdated {
+		desc.CreatedAt = &t.created
+	}
+	if !t.updated.IsZero() {
+		desc.UpdatedAt = &t.updated
+	}
+
+	pud, full := t.perUser[asUid]
+
+	if t.cat == types.TopicCatMe {
+		full = true
+	}
+
+	if ifUpdated {
+		if t.public != nil {
+			desc.Public = t.public
+		} else if full && t.cat == types.TopicCatP2P {
+			desc.Public = pud.public
+		}
+	}
+
+	if t.cat == types.TopicCatGrp {
+		desc.IsChan = t.isChan
+	}
+
+	// Request may come from a subscriber (full == true) or a stranger.
+	// Give subscriber a fuller description than to a stranger
+	if full {
+		if t.cat == types.TopicCatP2P {
+			// For p2p topics default access mode makes no sense.
+			// Don't report it.
+		} else if t.cat == types.TopicCatMe || (pud.modeGiven & pud.modeWant).IsSharer() {
+			desc.DefaultAcs = &MsgDefaultAcsMode{
+				Auth: t.accessAuth.String(),
+				Anon: t.accessAnon.String()}
+
+			if t.isChan {
+				desc.Members = t.subsCount()
+				desc.Readers = t.chnReaders
+			}
+		}
+
+		desc.Acs = &MsgAccessMode{
+			Want:  pud.modeWant.String(),
+			Given: pud.modeGiven.String(),
+			Mode:  (pud.modeGiven & pud.modeWant).String()}
+
+		if t.cat == types.TopicCatMe && sess.authLvl == auth.LevelRoot {
+			// If 'me' is in memory then user account is invariably not suspended.
+			desc.State = types.StateOK.String()
+		}
+
+		if t.cat == types.TopicCatGrp && (pud.modeGiven & pud.modeWant).IsPresencer() {
+			desc.Online = t.isOnline()
+		}
+		if ifUpdated {
+			desc.Private = pud.private
+		}
+
+		// Don't report message IDs to users without Read access.
+		if (pud.modeGiven & pud.modeWant).IsReader() {
+			desc.SeqId = t.lastID
+			if !t.touched.IsZero() {
+				desc.TouchedAt = &t.touched
+			}
+
+			// Make sure reported values are sane:
+			// t.delID <= pud.delID; t.readID <= t.recvID <= t.lastID
+			desc.DelId = max(pud.delID, t.delID)
+			desc.ReadSeqId = pud.readID
+			desc.RecvSeqId = max(pud.recvID, pud.readID)
+		} else {
+			// Send some sane value of touched.
+			desc.TouchedAt = &t.updated
+		}
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        id,
+			Topic:     msg.Original,
+			Desc:      desc,
+			Timestamp: &now}})
+
+	return nil
+}
+
+// replySetDesc updates topic metadata, saves it to DB,
+// replies to the caller as {ctrl} message, generates {pres} update if necessary
+func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	set := msg.Set
+
+	assignAccess := func(upd map[string]interface{}, mode *MsgDefaultAcsMode) error {
+		if mode == nil {
+			return nil
+		}
+		if auth, anon, err := parseTopicAccess(mode, types.ModeUnset, types.ModeUnset); err != nil {
+			return err
+		} else if auth.IsOwner() || anon.IsOwner() {
+			return errors.New("default 'owner' access is not permitted")
+		} else {
+			access := types.DefaultAccess{Auth: t.accessAuth, Anon: t.accessAnon}
+			if auth != types.ModeUnset {
+				if t.cat == types.TopicCatMe {
+					auth &= types.ModeCAuth
+					if auth != types.ModeNone {
+						// This is the default access mode for P2P topics.
+						// It must be either an N or must include an A permission.
+						auth |= types.ModeApprove
+					}
+				}
+				access.Auth = auth
+			}
+			if anon != types.ModeUnset {
+				if t.cat == types.TopicCatMe {
+					anon &= types.ModeCP2P
+					if anon != types.ModeNone {
+						anon |= types.ModeApprove
+					}
+				}
+				access.Anon = anon
+			}
+			if access.Auth != t.accessAuth || access.Anon != t.accessAnon {
+				upd["Access"] = access
+			}
+		}
+		return nil
+	}
+
+	assignGenericValues := func(upd map[string]interface{}, what string, dst, src interface{}) (changed bool) {
+		if dst, changed = mergeInterfaces(dst, src); changed {
+			upd[what] = dst
+		}
+		return
+	}
+
+	// DefaultAccess and/or Public have chanegd
+	var sendCommon bool
+	// Private has changed
+	var sendPriv bool
+	var err error
+
+	// Change to the main object (user or topic).
+	core := make(map[string]interface{})
+	// Change to subscription.
+	sub := make(map[string]interface{})
+	if set.Desc != nil {
+		switch t.cat {
+		case types.TopicCatMe:
+			// Update current user
+			err = assignAccess(core, set.Desc.DefaultAcs)
+			sendCommon = assignGenericValues(core, "Public", t.public, set.Desc.Public)
+		case types.TopicCatFnd:
+			// set.Desc.DefaultAcs is ignored.
+			// Do not send presence if fnd.Public has changed.
+			assignGenericValues(core, "Public", t.fndGetPublic(sess), set.Desc.Public)
+		case types.TopicCatP2P:
+			// Reject direct changes to P2P topics.
+			if set.Desc.Public != nil || set.Desc.DefaultAcs != nil {
+				sess.queueOut(ErrPermissionDeniedReply(msg, now))
+				return errors.New("incorrect attempt to change metadata of a p2p topic")
+			}
+		case types.TopicCatGrp:
+			// Update group topic
+			if t.owner == asUid {
+				err = assignAccess(core, set.Desc.DefaultAcs)
+				sendCommon = assignGenericValues(core, "Public", t.public, set.Desc.Public)
+			} else if set.Desc.DefaultAcs != nil || set.Desc.Public != nil {
+				// This is a request from non-owner
+				sess.queueOut(ErrPermissionDeniedReply(msg, now))
+				return errors.New("attempt to change public or permissions by non-owner")
+			}
+		}
+
+		if err != nil {
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return err
+		}
+
+		sendPriv = assignGenericValues(sub, "Private", t.perUser[asUid].private, set.Desc.Private)
+	}
+
+	if len(core)+len(sub) == 0 {
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return errors.New("{set} generated no update to DB")
+	}
+
+	if len(core) > 0 {
+		core["UpdatedAt"] = now
+		switch t.cat {
+		case types.TopicCatMe:
+			err = store.Users.Update(asUid, core)
+		case types.TopicCatFnd:
+			// The only value to be stored in topic is Public, and Public for fnd is not saved according to specs.
+		default:
+			err = store.Topics.Update(t.name, core)
+		}
+	}
+	if err == nil && len(sub) > 0 {
+		err = store.Subs.Update(t.subName(asUid), asUid, sub, true)
+	}
+
+	if err != nil {
+		sess.queueOut(ErrUnknownReply(msg, now))
+		return err
+	}
+
+	// Update values cached in the topic object
+	if t.cat == types.TopicCatMe || t.cat == types.TopicCatGrp {
+		if tmp, ok := core["Access"]; ok {
+			access := tmp.(types.DefaultAccess)
+			t.accessAuth = access.Auth
+			t.accessAnon = access.Anon
+		}
+		if public, ok := core["Public"]; ok {
+			t.public = public
+		}
+	} else if t.cat == types.TopicCatFnd {
+		// Assign per-session fnd.Public.
+		t.fndSetPublic(sess, core["Public"])
+	}
+
+	mode := types.ModeNone
+	if private, ok := sub["Private"]; ok {
+		pud := t.perUser[asUid]
+		pud.private = private
+		pud.updated = now
+		t.perUser[asUid] = pud
+		mode = pud.modeGiven & pud.modeWant
+	}
+
+	if sendCommon || sendPriv {
+		// t.public, t.accessAuth/Anon have changed, make an announcement
+		if sendCommon {
+			if t.cat == types.TopicCatMe {
+				t.presUsersOfInterest("upd", "")
+			} else {
+				// Notify all subscribers on 'me' except the user who made the change and blocked users.
+				// The user who made the change will be notified separately (see below).
+				filter := &presFilters{excludeUser: asUid.UserId(), filterIn: types.ModeJoin}
+				t.presSubsOffline("upd", nilPresParams, filter, filter, sess.sid, false)
+			}
+
+			t.updated = now
+		}
+		// Notify user's other sessions.
+		t.presSingleUserOffline(asUid, mode, "upd", nilPresParams, sess.sid, false)
+	}
+
+	sess.queueOut(NoErrReply(msg, now))
+
+	return nil
+}
+
+// replyGetSub is a response to a get.sub request on a topic - load a list of subscriptions/subscribers,
+// send it just to the session as a {meta} packet
+func (t *Topic) replyGetSub(sess *Session, asUid types.Uid, authLevel auth.Level, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	id := msg.Id
+	incomingReqTs := msg.Timestamp
+	var req *MsgGetOpts
+	if msg.Sub != nil {
+		req = msg.Sub.Get.Sub
+	} else {
+		req = msg.Get.Sub
+	}
+
+	if req != nil && (req.SinceId != 0 || req.BeforeId != 0) {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid MsgGetOpts query")
+	}
+
+	var ifModified time.Time
+	if req != nil && req.IfModifiedSince != nil {
+		ifModified = *req.IfModifiedSince
+	}
+
+	userData := t.perUser[asUid]
+	var subs []types.Subscription
+	var err error
+
+	switch t.cat {
+	case types.TopicCatMe:
+		if req != nil {
+			// If topic is provided, it could be in the form of user ID 'usrAbCd'.
+			// Convert it to P2P topic name.
+			if uid2 := types.ParseUserId(req.Topic); !uid2.IsZero() {
+				req.Topic = uid2.P2PName(asUid)
+			}
+		}
+		// Fetch user's subscriptions, with Topic.Public denormalized into subscription.
+		if ifModified.IsZero() {
+			// No cache management. Skip deleted subscriptions.
+			subs, err = store.Users.GetTopics(asUid, msgOpts2storeOpts(req))
+		} else {
+			// User manages cache. Include deleted subscriptions too.
+			subs, err = store.Users.GetTopicsAny(asUid, msgOpts2storeOpts(req))
+		}
+	case types.TopicCatFnd:
+		// Select public or private query. Public has priority.
+		rewriteLogin := true
+		raw := t.fndGetPublic(sess)
+		if raw == nil {
+			rewriteLogin = false
+			raw = userData.private
+		}
+
+		if query, ok := raw.(string); ok && len(query) > 0 {
+			var req [][]string
+			var opt []string
+			if req, opt, err = parseSearchQuery(query, sess.countryCode, rewriteLogin); err == nil {
+				if len(req) > 0 || len(opt) > 0 {
+					subs, err = store.Users.FindSubs(asUid, req, opt)
+					if err != nil {
+						sess.queueOut(decodeStoreErrorExplicitTs(err, id, t.original(asUid), now, incomingReqTs, nil))
+						return err
+					}
+
+				} else {
+					// Query string is empty.
+					sess.queueOut(ErrMalformedReply(msg, now))
+					return errors.New("empty search query")
+				}
+			} else {
+				// Query parsing error. Report it externally as a generic ErrMalformed.
+				sess.queueOut(ErrMalformedReply(msg, now))
+				return errors.New("failed to parse search query; " + err.Error())
+			}
+		}
+	case types.TopicCatP2P:
+		// No need to load Public for p2p topics.
+		if ifModified.IsZero() {
+			// No cache management. Skip deleted subscriptions.
+			subs, err = store.Topics.GetSubs(t.name, msgOpts2storeOpts(req))
+		} else {
+			// User manages cache. Include deleted subscriptions too.
+			subs, err = store.Topics.GetSubsAny(t.name, msgOpts2storeOpts(req))
+		}
+	case types.TopicCatGrp:
+		topic, opts := t.name, msgOpts2storeOpts(req)
+		if userData.isChan {
+			// Channel readers don't see the members or other readers, only own subscription.
+			topic, opts = types.GrpToChn(t.name), &types.QueryOpt{User: asUid}
+		}
+		// Include sub.Public.
+		if ifModified.IsZero() {
+			// No cache management. Skip deleted subscriptions.
+			subs, err = store.Topics.GetUsers(topic, opts)
+		} else {
+			// User manages cache. Include deleted subscriptions too.
+			subs, err = store.Topics.GetUsersAny(topic, opts)
+		}
+	}
+
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, id, t.original(asUid), now, incomingReqTs, nil))
+		return err
+	}
+
+	if len(subs) > 0 {
+		meta := &MsgServerMeta{Id: id, Topic: t.original(asUid), Timestamp: &now}
+		meta.Sub = make([]MsgTopicSub, 0, len(subs))
+		presencer := (userData.modeGiven & userData.modeWant).IsPresencer()
+		sharer := (userData.modeGiven & userData.modeWant).IsSharer()
+
+		for i := range subs {
+			sub := &subs[i]
+			// Indicator if the requester has provided a cut off date for ts of pub & priv updates.
+			var sendPubPriv bool
+			var banned bool
+			var mts MsgTopicSub
+			deleted := sub.DeletedAt != nil
+
+			if ifModified.IsZero() {
+				sendPubPriv = true
+			} else {
+				// Skip sending deleted subscriptions if they were deleted before the cut off date.
+				// If they are freshly deleted send minimum info
+				if deleted {
+					if !sub.DeletedAt.After(ifModified) {
+						continue
+					}
+					mts.DeletedAt = sub.DeletedAt
+				}
+				sendPubPriv = !deleted && sub.UpdatedAt.After(ifModified)
+			}
+
+			uid := types.ParseUid(sub.User)
+			subMode := sub.ModeGiven & sub.ModeWant
+			isReader := subMode.IsReader()
+			if t.cat == types.TopicCatMe {
+				// Mark subscriptions that the user does not care about.
+				if !subMode.IsJoiner() {
+					banned = true
+				}
+
+				// Reporting user's subscriptions to other topics. P2P topic name is the
+				// UID of the other user.
+				with := sub.GetWith()
+				if with != "" {
+					mts.Topic = with
+					mts.Online = t.perSubs[with].online && !deleted && presencer
+				} else {
+					mts.Topic = sub.Topic
+					mts.Online = t.perSubs[sub.Topic].online && !deleted && presencer
+				}
+
+				if !deleted && !banned {
+					if isReader {
+						if sub.GetTouchedAt().IsZero() {
+							mts.TouchedAt = nil
+						} else {
+							touchedAt := sub.GetTouchedAt()
+							mts.TouchedAt = &touchedAt
+						}
+						mts.SeqId = sub.GetSeqId()
+						mts.DelId = sub.DelId
+					} else {
+						mts.TouchedAt = &sub.UpdatedAt
+					}
+
+					lastSeen := sub.GetLastSeen()
+					if !lastSeen.IsZero() && !mts.Online {
+						mts.LastSeen = &MsgLastSeenInfo{
+							When:      lastSeen,
+							UserAgent: sub.GetUserAgent()}
+					}
+				}
+			} else {
+				// Mark subscriptions that the user does not care about.
+				if t.cat == types.TopicCatGrp && !subMode.IsJoiner() {
+					banned = true
+				}
+
+				// Reporting subscribers to fnd or a group topic
+				mts.User = uid.UserId()
+				if t.cat == types.TopicCatFnd {
+					mts.Topic = sub.Topic
+				}
+
+				if !deleted {
+					if uid == asUid && isReader && !banned {
+						// Report deleted ID for own subscriptions only
+						mts.DelId = sub.DelId
+					}
+
+					if t.cat == types.TopicCatGrp {
+						pud := t.perUser[uid]
+						mts.Online = pud.online > 0 && presencer
+					}
+				}
+			}
+
+			if !deleted {
+				mts.UpdatedAt = &sub.UpdatedAt
+				if isReader && !banned {
+					mts.ReadSeqId = sub.ReadSeqId
+					mts.RecvSeqId = sub.RecvSeqId
+				}
+
+				if t.cat != types.TopicCatFnd {
+					if sharer || uid == asUid || subMode.IsAdmin() {
+						// If user is not a sharer, the access mode of other ordinary users if not accessible.
+						// Own and admin permissions only are visible to non-sharers.
+						mts.Acs.Mode = subMode.String()
+						mts.Acs.Want = sub.ModeWant.String()
+						mts.Acs.Given = sub.ModeGiven.String()
+					}
+				} else {
+					// Topic 'fnd'
+					if sub.ModeGiven.IsDefined() && sub.ModeWant.IsDefined() {
+						mts.Acs.Mode = subMode.String()
+						mts.Acs.Want = sub.ModeWant.String()
+						mts.Acs.Given = sub.ModeGiven.String()
+					} else if defacs := sub.GetDefaultAccess(); defacs != nil {
+						switch authLevel {
+						case auth.LevelAnon:
+							mts.Acs.Mode = defacs.Anon.String()
+						case auth.LevelAuth, auth.LevelRoot:
+							mts.Acs.Mode = defacs.Auth.String()
+						}
+					}
+				}
+
+				// Returning public and private only if they have changed since ifModified
+				if sendPubPriv {
+					mts.Public = sub.GetPublic()
+					// Reporting 'private' only if it's user's own subscription.
+					if uid == asUid {
+						mts.Private = sub.Private
+					}
+				}
+
+				// Always reporting 'private' for fnd topic.
+				if t.cat == types.TopicCatFnd {
+					mts.Private = sub.Private
+				}
+			}
+
+			meta.Sub = append(meta.Sub, mts)
+		}
+		sess.queueOut(&ServerComMessage{Meta: meta})
+	} else {
+		// Inform the client that there are no subscriptions.
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]interface{}{"what": "sub"}))
+	}
+
+	return nil
+}
+
+// replySetSub is a response to new subscription request or an update to a subscription {set.sub}:
+// update topic metadata cache, save/update subs, reply to the caller as {ctrl} message,
+// generate a presence notification, if appropriate.
+func (t *Topic) replySetSub(sess *Session, pkt *ClientComMessage) error {
+	now := types.TimeNow()
+
+	asUid := types.ParseUserId(pkt.AsUser)
+	set := pkt.Set
+
+	var target types.Uid
+	if target = types.ParseUserId(set.Sub.User); target.IsZero() && set.Sub.User != "" {
+		// Invalid user ID
+		sess.queueOut(ErrMalformedReply(pkt, now))
+		return errors.New("invalid user id")
+	}
+
+	// if set.User is not set, request is for the current user
+	if target.IsZero() {
+		target = asUid
+	}
+
+	var err error
+	var modeChanged *MsgAccessMode
+	if target == asUid {
+		// Request new subscription or modify own subscription
+		modeChanged, err = t.thisUserSub(sess, pkt, asUid, set.Sub.Mode, nil)
+	} else {
+		// Request to approve/change someone's subscription
+		modeChanged, err = t.anotherUserSub(sess, asUid, target, pkt)
+	}
+	if err != nil {
+		return err
+	}
+
+	var resp *ServerComMessage
+	if modeChanged != nil {
+		// Report resulting access mode.
+		params := map[string]interface{}{"acs": modeChanged}
+		if target != asUid {
+			params["user"] = target.UserId()
+		}
+		resp = NoErrParamsReply(pkt, now, params)
+	} else {
+		resp = InfoNotModifiedReply(pkt, now)
+	}
+
+	sess.queueOut(resp)
+
+	return nil
+}
+
+// replyGetData is a response to a get.data request - load a list of stored messages, send them to session as {data}
+// response goes to a single session rather than all sessions in a topic
+func (t *Topic) replyGetData(sess *Session, asUid types.Uid, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	toriginal := t.original(asUid)
+
+	if req != nil && (req.IfModifiedSince != nil || req.User != "" || req.Topic != "") {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid MsgGetOpts query")
+	}
+
+	// Check if the user has permission to read the topic data
+	count := 0
+	if userData := t.perUser[asUid]; (userData.modeGiven & userData.modeWant).IsReader() {
+		// Read messages from DB
+		messages, err := store.Messages.GetAll(t.name, asUid, msgOpts2storeOpts(req))
+		if err != nil {
+			sess.queueOut(ErrUnknownReply(msg, now))
+			return err
+		}
+
+		// Push the list of messages to the client as {data}.
+		count = len(messages)
+		for i := range messages {
+			mm := &messages[i]
+			sess.queueOut(&ServerComMessage{Data: &MsgServerData{
+				Topic:     toriginal,
+				Head:      mm.Head,
+				SeqId:     mm.SeqId,
+				From:      types.ParseUid(mm.From).UserId(),
+				Timestamp: mm.CreatedAt,
+				Content:   mm.Content}})
+		}
+	}
+
+	// Inform the requester that all the data has been served.
+	if count == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]interface{}{"what": "data"}))
+	} else {
+		sess.queueOut(NoErrDeliveredParams(msg.Id, msg.Original, now,
+			map[string]interface{}{"what": "data", "count": count}))
+	}
+
+	return nil
+}
+
+// replyGetTags returns topic's tags - tokens used for discovery.
+func (t *Topic) replyGetTags(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe && t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for getting tags")
+	}
+	if t.cat == types.TopicCatGrp && t.owner != asUid {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("request for tags from non-owner")
+	}
+
+	if len(t.tags) > 0 {
+		sess.queueOut(&ServerComMessage{
+			Meta: &MsgServerMeta{Id: msg.Id, Topic: t.original(asUid), Timestamp: &now, Tags: t.tags}})
+		return nil
+	}
+
+	// Inform the requester that there are no tags.
+	sess.queueOut(NoContentParamsReply(msg, now, map[string]string{"what": "tags"}))
+
+	return nil
+}
+
+// replySetTags updates topic's tags - tokens used for discovery.
+func (t *Topic) replySetTags(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	var resp *ServerComMessage
+	var err error
+	set := msg.Set
+
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe && t.cat != types.TopicCatGrp {
+		resp = ErrOperationNotAllowedReply(msg, now)
+		err = errors.New("invalid topic category to assign tags")
+
+	} else if t.cat == types.TopicCatGrp && t.owner != asUid {
+		resp = ErrPermissionDeniedReply(msg, now)
+		err = errors.New("tags update by non-owner")
+
+	} else if tags := normalizeTags(set.Tags); tags != nil {
+		added, removed := stringSliceDelta(t.tags, tags)
+		if len(added) > 0 || len(removed) > 0 {
+			update := map[string]interface{}{"Tags": types.StringSlice(tags), "UpdatedAt": now}
+			if t.cat == types.TopicCatMe {
+				err = store.Users.Update(asUid, update)
+			} else if t.cat == types.TopicCatGrp {
+				err = store.Topics.Update(t.name, update)
+			}
+
+			if err != nil {
+				resp = ErrUnknownReply(msg, now)
+			} else {
+				t.tags = tags
+				t.presSubsOnline("tags", "", nilPresParams, &presFilters{singleUser: asUid.UserId()}, sess.sid)
+
+				params := make(map[string]interface{})
+				if len(added) > 0 {
+					params["added"] = len(added)
+				}
+				if len(removed) > 0 {
+					params["removed"] = len(removed)
+				}
+				resp = NoErrParamsReply(msg, now, params)
+			}
+		} else {
+			resp = InfoNotModifiedReply(msg, now)
+		}
+	} else {
+		resp = InfoNotModifiedReply(msg, now)
+	}
+
+	sess.queueOut(resp)
+
+	return err
+}
+
+// replyGetDel is a response to a get[what=del] request: load a list of deleted message ids, send them to
+// a session as {meta}
+// response goes to a single session rather than all sessions in a topic
+func (t *Topic) replyGetDel(sess *Session, asUid types.Uid, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	toriginal := t.original(asUid)
+
+	id := msg.Id
+	incomingReqTs := msg.Timestamp
+
+	if req != nil && (req.IfModifiedSince != nil || req.User != "" || req.Topic != "") {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid MsgGetOpts query")
+	}
+
+	// Check if the user has permission to read the topic data and the request is valid.
+	if userData := t.perUser[asUid]; (userData.modeGiven & userData.modeWant).IsReader() {
+		ranges, delID, err := store.Messages.GetDeleted(t.name, asUid, msgOpts2storeOpts(req))
+		if err != nil {
+			sess.queueOut(ErrUnknownReply(msg, now))
+			return err
+		}
+
+		if len(ranges) > 0 {
+			sess.queueOut(&ServerComMessage{Meta: &MsgServerMeta{
+				Id:    id,
+				Topic: toriginal,
+				Del: &MsgDelValues{
+					DelId:  delID,
+					DelSeq: delrangeDeserialize(ranges)},
+				Timestamp: &now}})
+			return nil
+		}
+	}
+
+	sess.queueOut(NoContentParams(id, toriginal, now, incomingReqTs, map[string]string{"what": "del"}))
+
+	return nil
+}
+
+// replyDelMsg deletes (soft or hard) messages in response to del.msg packet.
+func (t *Topic) replyDelMsg(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	del := msg.Del
+
+	pud := t.perUser[asUid]
+	if !(pud.modeGiven & pud.modeWant).IsDeleter() {
+		// User must have an R permission: if the user cannot read messages, he has
+		// no business of deleting them.
+		if !(pud.modeGiven & pud.modeWant).IsReader() {
+			sess.queueOut(ErrPermissionDeniedReply(msg, now))
+			return errors.New("del.msg: permission denied")
+		}
+
+		// User has just the R permission, cannot hard-delete messages, silently
+		// switching to soft-deleting
+		del.Hard = false
+	}
+
+	var err error
+	var ranges []types.Range
+	if len(del.DelSeq) == 0 {
+		err = errors.New("del.msg: no IDs to delete")
+	} else {
+		count := 0
+		for _, dq := range del.DelSeq {
+			if dq.LowId > t.lastID || dq.LowId < 0 || dq.HiId < 0 ||
+				(dq.HiId > 0 && dq.LowId > dq.HiId) ||
+				(dq.LowId == 0 && dq.HiId == 0) {
+				err = errors.New("del.msg: invalid entry in list")
+				break
+			}
+
+			if dq.HiId > t.lastID {
+				// Range is inclusive - exclusive [low, hi),
+				// to delete all messages hi must be lastId + 1
+				dq.HiId = t.lastID + 1
+			} else if dq.LowId == dq.HiId || dq.LowId+1 == dq.HiId {
+				dq.HiId = 0
+			}
+
+			if dq.HiId == 0 {
+				count++
+			} else {
+				count += dq.HiId - dq.LowId
+			}
+
+			ranges = append(ranges, types.Range{Low: dq.LowId, Hi: dq.HiId})
+		}
+
+		if err == nil {
+			// Sort by Low ascending then by Hi descending.
+			sort.Sort(types.RangeSorter(ranges))
+			// Collapse overlapping ranges
+			ranges = types.RangeSorter(ranges).Normalize()
+		}
+
+		if count > defaultMaxDeleteCount && len(ranges) > 1 {
+			err = errors.New("del.msg: too many messages to delete")
+		}
+	}
+
+	if err != nil {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return err
+	}
+
+	forUser := asUid
+	if del.Hard {
+		forUser = types.ZeroUid
+	}
+
+	if err = store.Messages.DeleteList(t.name, t.delID+1, forUser, ranges); err != nil {
+		sess.queueOut(ErrUnknownReply(msg, now))
+		return err
+	}
+
+	// Increment Delete transaction ID
+	t.delID++
+	dr := delrangeDeserialize(ranges)
+	if del.Hard {
+		for uid, pud := range t.perUser {
+			pud.delID = t.delID
+			t.perUser[uid] = pud
+		}
+		// Broadcast the change to all, online and offline, exclude the session making the change.
+		params := &presParams{delID: t.delID, delSeq: dr, actor: asUid.UserId()}
+		filters := &presFilters{filterIn: types.ModeRead}
+		t.presSubsOnline("del", params.actor, params, filters, sess.sid)
+		t.presSubsOffline("del", params, filters, nilPresFilters, sess.sid, true)
+	} else {
+		pud := t.perUser[asUid]
+		pud.delID = t.delID
+		t.perUser[asUid] = pud
+
+		// Notify user's other sessions
+		t.presPubMessageDelete(asUid, pud.modeGiven&pud.modeWant, t.delID, dr, sess.sid)
+	}
+
+	sess.queueOut(NoErrParamsReply(msg, now, map[string]int{"del": t.delID}))
+
+	return nil
+}
+
+// Shut down the topic in response to {del what="topic"} request
+// See detailed description at hub.topicUnreg()
+// 1. Checks if the requester is the owner. If so:
+// 1.2 Evict all sessions
+// 1.3 Ask hub to unregister self
+// 1.4 Exit the run() loop
+// 2. If requester is not the owner:
+// 2.1 If this is a p2p topic:
+// 2.1.1 Check if the other subscription still exists, if so, treat request as {leave unreg=true}
+// 2.1.2 If the other subscription does not exist, delete topic
+// 2.2 If this is not a p2p topic, treat it as {leave unreg=true}
+func (t *Topic) replyDelTopic(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	if t.owner != asUid {
+		// Cases 2.1.1 and 2.2
+		if t.cat != types.TopicCatP2P || t.subsCount() == 2 {
+			return t.replyLeaveUnsub(sess, msg, asUid)
+		}
+	}
+
+	// Notifications are sent from the topic loop.
+
+	return nil
+}
+
+// Delete subscription.
+func (t *Topic) replyDelSub(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	del := msg.Del
+
+	// Get ID of the affected user
+	uid := types.ParseUserId(del.User)
+
+	var err error
+	pud := t.perUser[asUid]
+	if !(pud.modeGiven & pud.modeWant).IsAdmin() {
+		err = errors.New("del.sub: permission denied")
+	} else if uid.IsZero() || uid == asUid {
+		// Cannot delete self-subscription. User [leave unsub] or [delete topic]
+		err = errors.New("del.sub: cannot delete self-subscription")
+	} else if t.cat == types.TopicCatP2P {
+		// Don't try to delete the other P2P user
+		err = errors.New("del.sub: cannot apply to a P2P topic")
+	}
+
+	if err != nil {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return err
+	}
+
+	pud, ok := t.perUser[uid]
+	if !ok {
+		sess.queueOut(InfoNoActionReply(msg, now))
+		return errors.New("del.sub: user not found")
+	}
+
+	// Check if the user being ejected is the owner.
+	if (pud.modeGiven & pud.modeWant).IsOwner() {
+		err = errors.New("del.sub: cannot evict topic owner")
+	} else if !pud.modeWant.IsJoiner() {
+		// If the user has banned the topic, subscription should not be deleted. Otherwise user may be re-invited
+		// which defeats the purpose of banning.
+		err = errors.New("del.sub: cannot delete banned subscription")
+	}
+
+	if err != nil {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return err
+	}
+
+	// Delete user's subscription from the database
+	if err := store.Subs.Delete(t.subName(uid), uid); err != nil {
+		if err == types.ErrNotFound {
+			sess.queueOut(InfoNoActionReply(msg, now))
+		} else {
+			sess.queueOut(ErrUnknownReply(msg, now))
+			return err
+		}
+	} else {
+		sess.queueOut(NoErrReply(msg, now))
+	}
+
+	// ModeUnset signifies deleted subscription as opposite to ModeNone - no access.
+	t.notifySubChange(uid, asUid,
+		pud.modeWant, pud.modeGiven, types.ModeUnset, types.ModeUnset, sess.sid)
+
+	t.evictUser(uid, true, "")
+
+	return nil
+}
+
+// replyLeaveUnsub is request to unsubscribe user and detach all user's sessions from topic.
+func (t *Topic) replyLeaveUnsub(sess *Session, msg *ClientComMessage, asUid types.Uid) error {
+	now := types.TimeNow()
+
+	if asUid.IsZero() {
+		panic("replyLeaveUnsub: zero asUid")
+	}
+
+	if t.owner == asUid {
+		if msg != nil {
+			sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		}
+		return errors.New("replyLeaveUnsub: owner cannot unsubscribe")
+	}
+
+	// Delete user's subscription from the database.
+	if err := store.Subs.Delete(t.subName(asUid), asUid); err != nil {
+		if err == types.ErrNotFound {
+			if msg != nil {
+				sess.queueOut(InfoNoActionReply(msg, now))
+			}
+			err = nil
+		} else if msg != nil {
+			sess.queueOut(ErrUnknownReply(msg, now))
+		}
+		return err
+	}
+
+	if msg != nil {
+		sess.queueOut(NoErrReply(msg, now))
+	}
+
+	pud := t.perUser[asUid]
+
+	// Send prsence notifictions to admins, other users, and user's other sessions.
+	t.notifySubChange(asUid, asUid, pud.modeWant, pud.modeGiven, types.ModeUnset, types.ModeUnset, sess.sid)
+
+	// Evict all user's sessions, clear cached data, send notifications.
+	t.evictUser(asUid, true, sess.sid)
+
+	return nil
+}
+
+// evictUser evicts all given user's sessions from the topic and clears user's cached data, if appropriate.
+func (t *Topic) evictUser(uid types.Uid, unsub bool, skip string) {
+	now := types.TimeNow()
+	pud, ok := t.perUser[uid]
+	// Topic name must be obtained before the per-user data is deleted.
+	original := t.original(uid)
+
+	// Detach user from topic
+	if unsub {
+		if t.cat == types.TopicCatP2P {
+			// P2P: mark user as deleted
+			pud.online = 0
+			pud.deleted = true
+			t.perUser[uid] = pud
+		} else if ok {
+			// Grp: delete per-user data
+			delete(t.perUser, uid)
+			if pud.isChan {
+				t.chnReaders--
+			}
+		}
+	} else if ok {
+		// Clear online status
+		pud.online = 0
+		t.perUser[uid] = pud
+	}
+
+	// Detach all user's sessions
+	msg := NoErrEvicted("", original, now)
+	msg.Ctrl.Params = map[string]interface{}{"unsub": unsub}
+	msg.SkipSid = skip
+	msg.uid = uid
+	msg.AsUser = uid.UserId()
+	for s := range t.sessions {
+		if pssd, removed := t.remSession(s, uid); pssd != nil {
+			if removed {
+				s.detachSession(t.name)
+			}
+			if s.sid != skip {
+				s.queueOut(msg)
+			}
+		}
+	}
+}
+
+// User's subscription to a topic has changed, send presence notifications.
+// 1. New subscription
+// 2. Deleted subscription
+// 3. Permissions changed
+// Sending to
+// (a) Topic admins online on topic itself.
+// (b) Topic admins offline on 'me' if approval is needed.
+// (c) If subscription is deleted, 'gone' to target.
+// (d) 'off' to topic members online if deleted or muted.
+// (e) To target user.
+func (t *Topic) notifySubChange(uid, actor types.Uid,
+	oldWant, oldGiven, newWant, newGiven types.AccessMode, skip string) {
+
+	unsub := newWant == types.ModeUnset || newGiven == types.ModeUnset
+
+	target := uid.UserId()
+
+	dWant := types.ModeNone.String()
+	if newWant.IsDefined() {
+		if oldWant.IsDefined() && !oldWant.IsZero() {
+			dWant = oldWant.Delta(newWant)
+		} else {
+			dWant = newWant.String()
+		}
+	}
+
+	dGiven := types.ModeNone.String()
+	if newGiven.IsDefined() {
+		if oldGiven.IsDefined() && !oldGiven.IsZero() {
+			dGiven = oldGiven.Delta(newGiven)
+		} else {
+			dGiven = newGiven.String()
+		}
+	}
+	params := &presParams{
+		target: target,
+		actor:  actor.UserId(),
+		dWant:  dWant,
+		dGiven: dGiven}
+
+	filterSharers := &presFilters{
+		filterIn:    types.ModeCSharer,
+		excludeUser: target}
+
+	// Changes to subscriptions of channel readers are not announced to the topic admins.
+	isReader := t.perUser[uid].isChan
+
+	if !isReader {
+		// Announce the change in permissions to the admins who are online in the topic, exclude the target
+		// and exclude the actor's session.
+		t.presSubsOnline("acs", target, params, filterSharers, skip)
+
+		// If it's a new subscription or if the user asked for permissions in excess of what was granted,
+		// announce the request to topic admins on 'me' so they can approve the request. The notification
+		// is not sent to the target user or the actor's session.
+		if newWant.BetterThan(newGiven) || oldWant == types.ModeNone {
+			t.presSubsOffline("acs", params, filterSharers, filterSharers, skip, true)
+		}
+	}
+
+	// Handling of muting/unmuting.
+	// Case A: subscription deleted.
+	// Case B: subscription muted only.
+	if unsub {
+		// Subscription deleted.
+
+		// In case of a P2P topic subscribe/unsubscribe users from each other's notifications.
+		if t.cat == types.TopicCatP2P {
+			uid2 := t.p2pOtherUser(uid)
+			// Remove user1's subscription to user2 and notify user1's other sessions that he is gone.
+			t.presSingleUserOffline(uid, newWant&newGiven, "gone", nilPresParams, skip, false)
+			// Tell user2 that user1 is offline but let him keep sending updates in case user1 resubscribes.
+			presSingleUserOfflineOffline(uid2, target, "off", nilPresParams, "")
+		} else if t.cat == types.TopicCatGrp {
+			if !isReader {
+				// Notify all sharers that the user is offline now.
+				t.presSubsOnline("off", uid.UserId(), nilPresParams, filterSharers, skip)
+			}
+			// Notify target that the subscription is gone.
+			presSingleUserOfflineOffline(uid, t.original(uid), "gone", nilPresParams, skip)
+		}
+	} else {
+		// Subscription altered.
+
+		if !(newWant & newGiven).IsPresencer() && (oldWant & oldGiven).IsPresencer() {
+			// Subscription just muted.
+			if t.cat == types.TopicCatP2P || t.cat == types.TopicCatGrp {
+				// Tell user1 to start discarding updates from muted topic/user.
+				presSingleUserOfflineOffline(uid, t.original(uid), "off+dis", nilPresParams, "")
+			}
+
+		} else if (newWant & newGiven).IsPresencer() && !(oldWant & oldGiven).IsPresencer() {
+			// Subscription un-muted.
+
+			// Notify subscriber of topic's online status.
+			if t.cat == types.TopicCatGrp {
+				t.presSingleUserOffline(uid, newWant&newGiven, "?unkn+en", nilPresParams, "", false)
+			} else if t.cat == types.TopicCatMe {
+				// User is visible online now, notify subscribers.
+				t.presUsersOfInterest("on+en", t.userAgent)
+			}
+		}
+
+		// Notify target that permissions have changed.
+
+		// Notify sessions online in the topic.
+		t.presSubsOnlineDirect("acs", params, &presFilters{singleUser: target}, skip)
+		// Notify target's other sessions on 'me'.
+		t.presSingleUserOffline(uid, newWant&newGiven, "acs", params, skip, true)
+	}
+}
+
+// mostRecentSession 返回最近有活动的session
+func (t *Topic) mostRecentSession() *Session {
+	var sess *Session
+	var latest int64
+	for s := range t.sessions {
+		sessionLastAction := atomic.LoadInt64(&s.lastAction)
+		if sessionLastAction > latest {
+			sess = s
+			latest = sessionLastAction
+		}
+	}
+	return sess
+}
+
+const (
+	// Topic is fully initialized.
+	topicStatusLoaded = 0x1
+	// Topic is paused: all packets are rejected.
+	topicStatusPaused = 0x2
+
+	// Topic is in the process of being deleted. This is irrecoverable.
+	topicStatusMarkedDeleted = 0x10
+	// Topic is suspended: read-only mode.
+	topicStatusReadOnly = 0x20
+)
+
+// statusChangeBits sets or removes given bits from t.status
+func (t *Topic) statusChangeBits(bits int32, set bool) {
+	for {
+		oldStatus := atomic.LoadInt32(&t.status)
+		newStatus := oldStatus
+		if set {
+			newStatus = newStatus | bits
+		} else {
+			newStatus = newStatus & ^bits
+		}
+		if newStatus == oldStatus {
+			break
+		}
+		if atomic.CompareAndSwapInt32(&t.status, oldStatus, newStatus) {
+			break
+		}
+	}
+}
+
+// markLoaded indicates that topic subscribers have been loaded into memory.
+func (t *Topic) markLoaded() {
+	t.statusChangeBits(topicStatusLoaded, true)
+}
+
+// markPaused pauses or unpauses the topic. When the topic is paused all
+// messages are rejected.
+func (t *Topic) markPaused(pause bool) {
+	t.statusChangeBits(topicStatusPaused, pause)
+}
+
+// markDeleted marks topic as being deleted.
+func (t *Topic) markDeleted() {
+	t.statusChangeBits(topicStatusMarkedDeleted, true)
+}
+
+// markReadOnly suspends/un-suspends the topic: adds or removes the 'read-only' flag.
+func (t *Topic) markReadOnly(readOnly bool) {
+	t.statusChangeBits(topicStatusReadOnly, readOnly)
+}
+
+// isInactive checks if topic is paused or being deleted.
+func (t *Topic) isInactive() bool {
+	return (atomic.LoadInt32(&t.status) & (topicStatusPaused | topicStatusMarkedDeleted)) != 0
+}
+
+func (t *Topic) isReadOnly() bool {
+	return (atomic.LoadInt32(&t.status) & topicStatusReadOnly) != 0
+}
+
+func (t *Topic) isLoaded() bool {
+	return (atomic.LoadInt32(&t.status) & topicStatusLoaded) != 0
+}
+
+func (t *Topic) isDeleted() bool {
+	return (atomic.LoadInt32(&t.status) & topicStatusMarkedDeleted) != 0
+}
+
+// Get topic name suitable for the given client
+func (t *Topic) original(uid types.Uid) string {
+	if t.cat == types.TopicCatP2P {
+		if pud, ok := t.perUser[uid]; ok {
+			return pud.topicName
+		}
+		panic("Invalid P2P topic")
+	}
+	if t.perUser[uid].isChan {
+		return types.GrpToChn(t.xoriginal)
+	}
+	return t.xoriginal
+}
+
+// Get ID of the other user in a P2P topic
+func (t *Topic) p2pOtherUser(uid types.Uid) types.Uid {
+	if t.cat == types.TopicCatP2P {
+		// Try to find user in subscribers.
+		for u2 := range t.perUser {
+			if u2 != uid {
+				return u2
+			}
+		}
+	}
+
+	// Even when one user is deleted, the subscription must be restored
+	// before p2pOtherUser is called.
+	panic("Not a valid P2P topic")
+}
+
+// subName returns the name of the topic under which the user's subscription is stored:
+// 'chnXXX' for channel readers, the topic name otherwise.
+func (t *Topic) subName(uid types.Uid) string {
+	if t.perUser[uid].isChan {
+		return types.GrpToChn(t.name)
+	}
+	return t.name
+}
+
+// Get per-session value of fnd.Public
+func (t *Topic) fndGetPublic(sess *Session) interface{} {
+	if t.cat == types.TopicCatFnd {
+		if t.public == nil {
+			return nil
+		}
+		if pubmap, ok := t.public.(map[string]interface{}); ok {
+			return pubmap[sess.sid]
+		}
+		panic("Invalid Fnd.Public type")
+	}
+	panic("Not Fnd topic")
+}
+
+// Assign per-session fnd.Public. Returns true if value has been changed.
+func (t *Topic) fndSetPublic(sess *Session, public interface{}) bool {
+	if t.cat != types.TopicCatFnd {
+		panic("Not Fnd topic")
+	}
+
+	var pubmap map[string]interface{}
+	var ok bool
+	if t.public != nil {
+		if pubmap, ok = t.public.(map[string]interface{}); !ok {
+			// This could only happen if fnd.public is assigned outside of this function.
+			panic("Invalid Fnd.Public type")
+		}
+	}
+	if pubmap == nil {
+		pubmap = make(map[string]interface{})
+	}
+
+	if public != nil {
+		pubmap[sess.sid] = public
+	} else {
+		ok = (pubmap[sess.sid] != nil)
+		delete(pubmap, sess.sid)
+		if len(pubmap) == 0 {
+			pubmap = nil
+		}
+	}
+	t.public = pubmap
+	return ok
+}
+
+// Remove per-session value of fnd.Public.
+func (t *Topic) fndRemovePublic(sess *Session) {
+	if t.public == nil {
+		return
+	}
+	if pubmap, ok := t.public.(map[string]interface{}); ok {
+		delete(pubmap, sess.sid)
+		return
+	}
+	panic("Invalid Fnd.Public type")
+}
+
+func (t *Topic) accessFor(authLvl auth.Level) types.AccessMode {
+	return selectAccessMode(authLvl, t.accessAnon, t.accessAuth, getDefaultAccess(t.cat, true, t.isChan))
+}
+
+// subsCount returns the number of topic subsribers. Channel readers are not counted.
+func (t *Topic) subsCount() int {
+	if t.cat == types.TopicCatP2P {
+		count := 0
+		for uid := range t.perUser {
+			if !t.perUser[uid].deleted {
+				count++
+			}
+		}
+		return count
+	}
+	return len(t.perUser) - t.chnReaders
+}
+
+// Add session record. 'user' may be different from sess.uid.
+func (t *Topic) addSession(sess *Session, asUid types.Uid) {
+	if _, ok := t.sessions[sess]; ok {
+		// Subscription already exists.
+		return
+	}
+	t.sessions[sess] = perSessionData{uid: asUid, isChanSub: t.perUser[asUid].isChan}
+}
+
+// Disconnects session from topic if 'asUid' is zero or 'asUid' matches subscribed user.
+// Returns perSessionData if it was found and true if session was actually detached from topic.
+func (t *Topic) remSession(sess *Session, asUid types.Uid) (*perSessionData, bool) {
+	pssd, ok := t.sessions[sess]
+	if !ok {
+		// Session not found at all.
+		return nil, false
+	}
+
+	if pssd.uid == asUid || asUid.IsZero() {
+		delete(t.sessions, sess)
+		return &pssd, true
+	}
+
+	return nil, false
+}
+
+// Check if topic has any online (non-background) users.
+func (t *Topic) isOnline() bool {
+	// Find at least one non-background session.
+	for s := range t.sessions {
+		if atomic.LoadInt32(&s.background) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Infer topic category from name.
+func topicCat(name string) types.TopicCat {
+	return types.GetTopicCat(name)
+}
+
+// Generate random string as a name of the group topic
+func genTopicName() string {
+	return "grp" + store.GetUidString()
+}
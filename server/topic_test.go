@@ -0,0 +1,277 @@
+package main
+
+import (
+	"GoChat/server/auth"
+	"GoChat/server/store/types"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// newBenchTopic 创建一个有n个读者session的群组topic，每个session使用codecOf返回的编解码器
+func newBenchTopic(n int, codecOf func(i int) int) *Topic {
+	t := &Topic{
+		name:      "grpBenchmark",
+		xoriginal: "grpBenchmark",
+		cat:       types.TopicCatGrp,
+		perUser:   make(map[types.Uid]perUserData),
+		sessions:  make(map[*Session]perSessionData),
+	}
+	// Sender of the messages, not attached to the topic.
+	t.perUser[benchSender] = perUserData{modeWant: types.ModeCPublic, modeGiven: types.ModeCPublic}
+	for i := 0; i < n; i++ {
+		uid := types.Uid(i + 1)
+		t.perUser[uid] = perUserData{modeWant: types.ModeCPublic, modeGiven: types.ModeCPublic}
+		sess := &Session{
+			proto: WEBSOCK,
+			sid:   "sid" + strconv.Itoa(i),
+			send:  make(chan interface{}, sendQueueLimit+32),
+		}
+		sess.setCodec(codecOf(i))
+		t.sessions[sess] = perSessionData{uid: uid}
+	}
+	return t
+}
+
+// drainBenchTopic 模拟session的写循环：取出并序列化所有待发送的消息
+func drainBenchTopic(b *testing.B, t *Topic) {
+	for sess := range t.sessions {
+		if len(sess.send) == 0 {
+			b.Fatal("message not delivered", sess.sid)
+		}
+		for len(sess.send) > 0 {
+			var out interface{}
+			switch v := (<-sess.send).(type) {
+			case *ServerComMessage:
+				_, out = sess.serialize(v)
+			default:
+				out = v
+			}
+			if len(out.([]byte)) == 0 {
+				b.Fatal("empty message", sess.sid)
+			}
+		}
+	}
+}
+
+const benchSender = types.Uid(1 << 40)
+
+func benchKeyPress() *ServerComMessage {
+	return &ServerComMessage{Info: &MsgServerInfo{
+		Topic: "grpBenchmark",
+		From:  benchSender.UserId(),
+		What:  "kp",
+	}}
+}
+
+// benchFanOut 将消息放入topic所有session的发送队列。cached为false时不创建序列化缓存，
+// 每个session的写循环各自序列化消息，即没有缓存时的开销。
+func benchFanOut(b *testing.B, t *Topic, sessions []*Session, cached bool) []*Session {
+	for sess := range t.sessions {
+		sessions = append(sessions, sess)
+	}
+	msg := benchKeyPress()
+	var drop []*Session
+	if cached {
+		sessions, drop = t.fanOut(msg, sessions, nil)
+	} else {
+		sessions, drop = t.queueToSessions(msg, sessions, nil)
+	}
+	if len(drop) != 0 {
+		b.Fatal("sessions dropped", len(drop))
+	}
+	return sessions
+}
+
+// BenchmarkBroadcast 测量向1000个session广播一个消息的内存分配，包括session写循环的序列化。
+// 有缓存和没有缓存的情况经过相同的queueOut和序列化代码，区别只在于是否创建共享的序列化结果。
+func BenchmarkBroadcast(b *testing.B) {
+	const sessions = 1000
+	jsonIdx, protoIdx := codecByName("json"), codecByName("proto")
+
+	cases := []struct {
+		name    string
+		codecOf func(i int) int
+	}{
+		{"json", func(int) int { return jsonIdx }},
+		{"json+proto", func(i int) int {
+			if i%2 == 0 {
+				return jsonIdx
+			}
+			return protoIdx
+		}},
+	}
+
+	for _, tc := range cases {
+		for _, cached := range []bool{true, false} {
+			name := tc.name + "/cached"
+			if !cached {
+				name = tc.name + "/uncached"
+			}
+			b.Run(name, func(b *testing.B) {
+				t := newBenchTopic(sessions, tc.codecOf)
+				buf := make([]*Session, 0, sessions)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					buf = benchFanOut(b, t, buf, cached)
+					drainBenchTopic(b, t)
+				}
+			})
+		}
+	}
+}
+
+// receivedTopics 返回每个session收到的{pres}消息中的topic名称
+func receivedTopics(t *testing.T, topic *Topic) map[types.Uid][]string {
+	got := make(map[types.Uid][]string)
+	for sess, pssd := range topic.sessions {
+		for len(sess.send) > 0 {
+			msg, ok := (<-sess.send).(*ServerComMessage)
+			if !ok || msg.Pres == nil {
+				t.Fatal("unexpected message", sess.sid)
+			}
+			got[pssd.uid] = append(got[pssd.uid], msg.Pres.Topic)
+		}
+	}
+	return got
+}
+
+func newTestSession(topic *Topic, uid types.Uid) {
+	sess := &Session{proto: WEBSOCK, sid: uid.UserId(), send: make(chan interface{}, 8)}
+	topic.sessions[sess] = perSessionData{uid: uid, isChanSub: topic.perUser[uid].isChan}
+}
+
+func TestBroadcastP2PTopicNames(t *testing.T) {
+	alice, bob := types.Uid(1), types.Uid(2)
+	topic := &Topic{
+		name:     alice.P2PName(bob),
+		cat:      types.TopicCatP2P,
+		perUser:  make(map[types.Uid]perUserData),
+		sessions: make(map[*Session]perSessionData),
+	}
+	topic.perUser[alice] = perUserData{modeWant: types.ModeCP2P, modeGiven: types.ModeCP2P, topicName: bob.UserId()}
+	topic.perUser[bob] = perUserData{modeWant: types.ModeCP2P, modeGiven: types.ModeCP2P, topicName: alice.UserId()}
+	newTestSession(topic, alice)
+	newTestSession(topic, bob)
+
+	topic.handleBroadcast(&ServerComMessage{Pres: &MsgServerPres{What: "upd", Src: alice.UserId()}})
+
+	got := receivedTopics(t, topic)
+	if len(got[alice]) != 1 || got[alice][0] != bob.UserId() {
+		t.Error("alice must see the topic as", bob.UserId(), "got", got[alice])
+	}
+	if len(got[bob]) != 1 || got[bob][0] != alice.UserId() {
+		t.Error("bob must see the topic as", alice.UserId(), "got", got[bob])
+	}
+}
+
+func TestBroadcastChannelReaders(t *testing.T) {
+	member, reader := types.Uid(1), types.Uid(2)
+	topic := &Topic{
+		name:      "grpNews",
+		xoriginal: "grpNews",
+		cat:       types.TopicCatGrp,
+		isChan:    true,
+		perUser:   make(map[types.Uid]perUserData),
+		sessions:  make(map[*Session]perSessionData),
+	}
+	topic.perUser[member] = perUserData{modeWant: types.ModeCPublic, modeGiven: types.ModeCPublic}
+	topic.perUser[reader] = perUserData{modeWant: types.ModeCChnReader, modeGiven: types.ModeCChnReader, isChan: true}
+	topic.chnReaders = 1
+	newTestSession(topic, member)
+	newTestSession(topic, reader)
+
+	if topic.subsCount() != 1 {
+		t.Error("channel readers must not be counted as members, got", topic.subsCount())
+	}
+
+	// Presence of other users is not sent to channel readers.
+	topic.handleBroadcast(&ServerComMessage{Pres: &MsgServerPres{Topic: "grpNews", What: "on", Src: member.UserId()}})
+	got := receivedTopics(t, topic)
+	if len(got[member]) != 1 || len(got[reader]) != 0 {
+		t.Error("presence must be sent to members only, got", got)
+	}
+
+	// Notifications addressed to the reader use the channel name.
+	topic.handleBroadcast(&ServerComMessage{Pres: &MsgServerPres{Topic: "grpNews", What: "acs",
+		SingleUser: reader.UserId()}})
+	got = receivedTopics(t, topic)
+	if len(got[reader]) != 1 || got[reader][0] != "chnNews" {
+		t.Error("reader must see the topic as chnNews, got", got[reader])
+	}
+}
+
+func TestAnonSubscriptionDenied(t *testing.T) {
+	anon := types.Uid(1)
+	topic := &Topic{
+		name:       "grpNews",
+		xoriginal:  "grpNews",
+		cat:        types.TopicCatGrp,
+		isChan:     true,
+		accessAuth: types.ModeCPublic,
+		accessAnon: types.ModeNone,
+		perUser:    make(map[types.Uid]perUserData),
+		sessions:   make(map[*Session]perSessionData),
+	}
+	sess := &Session{proto: WEBSOCK, sid: anon.UserId(), send: make(chan interface{}, 8)}
+
+	maxSubs := globals.maxSubscriberCount
+	globals.maxSubscriberCount = 10
+	defer func() { globals.maxSubscriberCount = maxSubs }()
+
+	// Anonymous users cannot join either as members or as channel readers.
+	for _, original := range []string{"grpNews", "chnNews"} {
+		pkt := &ClientComMessage{Original: original, AuthLvl: int(auth.LevelAnon)}
+		if _, err := topic.thisUserSub(sess, pkt, anon, "", nil); err == nil {
+			t.Error("anonymous subscription must be denied", original)
+		}
+		if len(sess.send) != 1 {
+			t.Fatal("expected an error reply", original)
+		}
+		if msg := (<-sess.send).(*ServerComMessage); msg.Ctrl == nil || msg.Ctrl.Code != http.StatusForbidden {
+			t.Error("expected permission denied", original, msg.Ctrl)
+		}
+	}
+	if _, ok := topic.perUser[anon]; ok {
+		t.Error("subscription must not be created")
+	}
+}
+
+func TestPresSubsOnlineDirectSharedCopy(t *testing.T) {
+	alice, bob := types.Uid(1), types.Uid(2)
+	topic := &Topic{
+		name:     alice.P2PName(bob),
+		cat:      types.TopicCatP2P,
+		perUser:  make(map[types.Uid]perUserData),
+		sessions: make(map[*Session]perSessionData),
+	}
+	topic.perUser[alice] = perUserData{modeWant: types.ModeCP2P, modeGiven: types.ModeCP2P, topicName: bob.UserId()}
+	topic.perUser[bob] = perUserData{modeWant: types.ModeCP2P, modeGiven: types.ModeCP2P, topicName: alice.UserId()}
+	for i := 0; i < 2; i++ {
+		for _, uid := range []types.Uid{alice, bob} {
+			sess := &Session{proto: WEBSOCK, sid: uid.UserId() + strconv.Itoa(i), send: make(chan interface{}, 8)}
+			topic.sessions[sess] = perSessionData{uid: uid}
+		}
+	}
+
+	topic.presSubsOnlineDirect("acs", &presParams{dWant: "+S"}, nil, "")
+
+	// Sessions which see the topic under the same name share one serialized message.
+	got := make(map[types.Uid][]*ServerComMessage)
+	for sess, pssd := range topic.sessions {
+		if len(sess.send) != 1 {
+			t.Fatal("expected one message", sess.sid, len(sess.send))
+		}
+		got[pssd.uid] = append(got[pssd.uid], (<-sess.send).(*ServerComMessage))
+	}
+	for uid, other := range map[types.Uid]types.Uid{alice: bob, bob: alice} {
+		msgs := got[uid]
+		if msgs[0] != msgs[1] || msgs[0].serialized == nil {
+			t.Error("message is not shared between sessions of", uid.UserId())
+		}
+		if msgs[0].Pres.Topic != other.UserId() {
+			t.Error("wrong topic name", msgs[0].Pres.Topic, "for", uid.UserId())
+		}
+	}
+}
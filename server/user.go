@@ -0,0 +1,581 @@
+// 用户账户的创建和更新: {acc}
+
+package main
+
+import (
+	"GoChat/server/auth"
+	"GoChat/server/auth/anon"
+	"GoChat/server/store"
+	"GoChat/server/store/types"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+// 创建新账户
+func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
+	// The session cannot authenticate with the new account because it's already authenticated.
+	if msg.Acc.Login && (!s.uid.IsZero() || rec != nil) {
+		s.queueOut(ErrAlreadyAuthenticated(msg.Id, "", msg.Timestamp))
+		logs.Warn.Println("create user: login requested while authenticated", s.sid)
+		return
+	}
+
+	// 新账户必须指定认证方案
+	authhdl := store.GetLogicalAuthHandler(msg.Acc.Scheme)
+	if authhdl == nil {
+		s.queueOut(ErrMalformed(msg.Id, "", msg.Timestamp))
+		logs.Warn.Println("create user: unknown auth handler", msg.Acc.Scheme, s.sid)
+		return
+	}
+
+	// Check if login is unique.
+	if ok, err := authhdl.IsUnique(msg.Acc.Secret, s.remoteAddr); !ok {
+		logs.Warn.Println("create user: auth secret is not unique", err, s.sid)
+		s.queueOut(decodeStoreError(err, msg.Id, "", msg.Timestamp,
+			map[string]interface{}{"what": "auth"}))
+		return
+	}
+
+	var user types.User
+	var private interface{}
+
+	// 只有root用户可以指定账户状态
+	if msg.Acc.State != "" {
+		if auth.Level(msg.AuthLvl) != auth.LevelRoot {
+			logs.Warn.Println("create user: attempt to set account state by non-root", s.sid)
+			resp := ErrPermissionDenied(msg.Id, "", msg.Timestamp)
+			resp.Ctrl.Params = map[string]interface{}{"what": "state"}
+			s.queueOut(resp)
+			return
+		}
+
+		state, err := types.NewObjState(msg.Acc.State)
+		if err != nil || state == types.StateDeleted {
+			logs.Warn.Println("create user: invalid account state", err, s.sid)
+			s.queueOut(ErrMalformed(msg.Id, "", msg.Timestamp))
+			return
+		}
+		user.State = state
+	}
+
+	// Ensure tags are unique and not restricted.
+	if tags := normalizeTags(msg.Acc.Tags); tags != nil {
+		if !restrictedTagsEqual(tags, nil, globals.immutableTagNS) {
+			logs.Warn.Println("create user: attempt to directly assign restricted tags", s.sid)
+			resp := ErrPermissionDenied(msg.Id, "", msg.Timestamp)
+			resp.Ctrl.Params = map[string]interface{}{"what": "tags"}
+			s.queueOut(resp)
+			return
+		}
+		user.Tags = tags
+	}
+
+	// Pre-check credentials for validity. The auth level is not known yet, consequently
+	// presence of required credentials is checked later.
+	creds := normalizeCredentials(msg.Acc.Cred, true)
+	for i := range creds {
+		cr := &creds[i]
+		vld := store.GetValidator(cr.Method)
+		if _, err := vld.PreCheck(cr.Value, cr.Params); err != nil {
+			logs.Warn.Println("create user: failed credential pre-check", cr.Method, err, s.sid)
+			s.queueOut(decodeStoreError(err, msg.Id, "", msg.Timestamp,
+				map[string]interface{}{"what": cr.Method}))
+			return
+		}
+	}
+
+	// 客户端没有指定时使用默认的权限
+	user.Access.Auth = getDefaultAccess(types.TopicCatP2P, true, false) |
+		getDefaultAccess(types.TopicCatGrp, true, false)
+	user.Access.Anon = getDefaultAccess(types.TopicCatP2P, false, false) |
+		getDefaultAccess(types.TopicCatGrp, false, false)
+
+	if msg.Acc.Desc != nil {
+		if msg.Acc.Desc.DefaultAcs != nil {
+			if msg.Acc.Desc.DefaultAcs.Auth != "" {
+				user.Access.Auth = userDefaultAccess(msg.Acc.Desc.DefaultAcs.Auth, user.Access.Auth)
+			}
+			if msg.Acc.Desc.DefaultAcs.Anon != "" {
+				user.Access.Anon = userDefaultAccess(msg.Acc.Desc.DefaultAcs.Anon, user.Access.Anon)
+			}
+		}
+		if !isNullValue(msg.Acc.Desc.Public) {
+			user.Public = msg.Acc.Desc.Public
+		}
+		if !isNullValue(msg.Acc.Desc.Private) {
+			private = msg.Acc.Desc.Private
+		}
+	}
+
+	if _, err := store.Users.Create(&user, private); err != nil {
+		logs.Warn.Println("create user: failed to create user", err, s.sid)
+		s.queueOut(ErrUnknown(msg.Id, "", msg.Timestamp))
+		return
+	}
+
+	// Add authentication record. The authhdl.AddRecord may change tags.
+	rec, err := authhdl.AddRecord(&auth.Rec{Uid: user.Uid(), Tags: user.Tags}, msg.Acc.Secret, s.remoteAddr)
+	if err != nil {
+		logs.Warn.Println("create user: add auth record failed", err, s.sid)
+		// Attempt to delete incomplete user record
+		store.Users.Delete(user.Uid(), false)
+		s.queueOut(decodeStoreError(err, msg.Id, "", msg.Timestamp, nil))
+		return
+	}
+
+	// 创建账户时必须提供该认证级别要求的所有凭证
+	if len(creds) < len(globals.authValidators[rec.AuthLevel]) {
+		logs.Warn.Println("create user: missing credentials; have:", creds, "want:",
+			globals.authValidators[rec.AuthLevel], s.sid)
+		store.Users.Delete(user.Uid(), false)
+		_, missing := stringSliceDelta(globals.authValidators[rec.AuthLevel], credentialMethods(creds))
+		s.queueOut(decodeStoreError(types.ErrPolicy, msg.Id, "", msg.Timestamp,
+			map[string]interface{}{"creds": missing}))
+		return
+	}
+
+	// Save credentials, update tags if necessary.
+	validated, _, err := addCreds(user.Uid(), creds, rec.Tags, s.lang, credToken(user.Uid()))
+	if err != nil {
+		store.Users.Delete(user.Uid(), false)
+		logs.Warn.Println("create user: failed to save or validate credential", err, s.sid)
+		s.queueOut(decodeStoreError(err, msg.Id, "", msg.Timestamp, nil))
+		return
+	}
+
+	var reply *ServerComMessage
+	if msg.Acc.Login {
+		// 使用新账户登录当前session
+		_, missing := stringSliceDelta(globals.authValidators[rec.AuthLevel], validated)
+		reply = s.onLogin(msg.Id, msg.Timestamp, rec, missing)
+	} else {
+		reply = NoErrCreated(msg.Id, "", msg.Timestamp)
+		reply.Ctrl.Params = map[string]interface{}{
+			"user":    user.Uid().UserId(),
+			"authlvl": rec.AuthLevel.String(),
+		}
+	}
+	params := reply.Ctrl.Params.(map[string]interface{})
+	params["desc"] = &MsgTopicDesc{
+		CreatedAt: &user.CreatedAt,
+		UpdatedAt: &user.UpdatedAt,
+		DefaultAcs: &MsgDefaultAcsMode{
+			Auth: user.Access.Auth.String(),
+			Anon: user.Access.Anon.String()},
+		Public:  user.Public,
+		Private: private}
+
+	s.queueOut(reply)
+}
+
+// userDefaultAccess 解析用户指定的默认权限。用户的默认权限只用于p2p topic，
+// 非空的权限总是包含Approve，这样用户可以管理p2p topic的访问
+func userDefaultAccess(val string, def types.AccessMode) types.AccessMode {
+	var mode types.AccessMode
+	if err := mode.UnmarshalText([]byte(val)); err != nil {
+		return def
+	}
+	mode &= types.ModeCP2P
+	if mode != types.ModeNone {
+		mode |= types.ModeApprove
+	}
+	return mode
+}
+
+// 更新已有的账户:
+// * 认证信息，比如修改登录名或者密码
+// * 凭证
+// * 账户状态，只有root用户可以修改
+func replyUpdateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
+	if s.uid.IsZero() && rec == nil {
+		// Session is not authenticated and no token provided.
+		logs.Warn.Println("replyUpdateUser: not a new account and not authenticated", s.sid)
+		s.queueOut(ErrPermissionDenied(msg.Id, "", msg.Timestamp))
+		return
+	} else if msg.AsUser != "" && rec != nil {
+		// Two UIDs: one from the session, one from the token. Ambigous, reject.
+		logs.Warn.Println("replyUpdateUser: got both authenticated session and token", s.sid)
+		s.queueOut(ErrMalformed(msg.Id, "", msg.Timestamp))
+		return
+	}
+
+	userId := msg.AsUser
+	authLvl := auth.Level(msg.AuthLvl)
+	if rec != nil {
+		userId = rec.Uid.UserId()
+		authLvl = rec.AuthLevel
+	}
+
+	if msg.Acc.User != "" && msg.Acc.User != userId {
+		if s.authLvl != auth.LevelRoot {
+			logs.Warn.Println("replyUpdateUser: attempt to change another's account by non-root", s.sid)
+			s.queueOut(ErrPermissionDenied(msg.Id, "", msg.Timestamp))
+			return
+		}
+		// Root is editing someone else's account.
+		userId = msg.Acc.User
+		authLvl = auth.ParseAuthLevel(msg.Acc.AuthLevel)
+	}
+
+	uid := types.ParseUserId(userId)
+	if uid.IsZero() {
+		s.queueOut(ErrMalformed(msg.Id, "", msg.Timestamp))
+		logs.Warn.Println("replyUpdateUser: user id is invalid or missing", s.sid)
+		return
+	}
+
+	// Only root can suspend accounts, including own account.
+	if msg.Acc.State != "" && s.authLvl != auth.LevelRoot {
+		s.queueOut(ErrPermissionDenied(msg.Id, "", msg.Timestamp))
+		logs.Warn.Println("replyUpdateUser: attempt to change account state by non-root", s.sid)
+		return
+	}
+
+	user, err := store.Users.Get(uid)
+	if user == nil && err == nil {
+		err = types.ErrNotFound
+	}
+	if err != nil {
+		logs.Warn.Println("replyUpdateUser: failed to fetch user from DB", err, s.sid)
+		s.queueOut(decodeStoreError(err, msg.Id, "", msg.Timestamp, nil))
+		return
+	}
+
+	var params map[string]interface{}
+	if msg.Acc.Scheme != "" {
+		var added *auth.Rec
+		if added, err = updateUserAuth(msg, user, s.remoteAddr); err == nil && added != nil {
+			params, err = upgradeAnonUser(s, added)
+		}
+	} else if len(msg.Acc.Cred) > 0 {
+		if authLvl == auth.LevelNone {
+			// msg.Acc.AuthLevel contains invalid data.
+			s.queueOut(ErrMalformed(msg.Id, "", msg.Timestamp))
+			logs.Warn.Println("replyUpdateUser: auth level is missing", s.sid)
+			return
+		}
+		if _, _, err = addCreds(uid, normalizeCredentials(msg.Acc.Cred, true), nil, s.lang,
+			credToken(uid)); err == nil {
+			// 返回仍然需要验证的凭证
+			var allCreds []types.Credential
+			if allCreds, err = store.Users.GetAllCreds(uid, "", true); err == nil {
+				var validated []string
+				for i := range allCreds {
+					validated = append(validated, allCreds[i].Method)
+				}
+				_, missing := stringSliceDelta(globals.authValidators[authLvl], validated)
+				if len(missing) > 0 {
+					params = map[string]interface{}{"cred": missing}
+				}
+			}
+		}
+	} else if msg.Acc.State != "" {
+		var changed bool
+		changed, err = changeUserState(s, uid, user, msg)
+		if !changed && err == nil {
+			s.queueOut(InfoNotModified(msg.Id, "", msg.Timestamp))
+			return
+		}
+	} else {
+		err = types.ErrMalformed
+	}
+
+	if err != nil {
+		logs.Warn.Println("replyUpdateUser: failed to update user", err, s.sid)
+		s.queueOut(decodeStoreError(err, msg.Id, "", msg.Timestamp, nil))
+		return
+	}
+
+	s.queueOut(NoErrParams(msg.Id, "", msg.Timestamp, params))
+}
+
+// 更新账户的认证信息。用户还没有该认证方案的记录时添加一条新的记录并返回，否则返回nil
+func updateUserAuth(msg *ClientComMessage, user *types.User, remoteAddr string) (*auth.Rec, error) {
+	authhdl := store.GetLogicalAuthHandler(msg.Acc.Scheme)
+	if authhdl == nil {
+		// Invalid or unknown auth scheme
+		return nil, types.ErrMalformed
+	}
+
+	var added *auth.Rec
+	rec, err := authhdl.UpdateRecord(&auth.Rec{Uid: user.Uid(), Tags: user.Tags}, msg.Acc.Secret, remoteAddr)
+	if err == types.ErrNotFound {
+		// The user does not have a record of this scheme yet, e.g. an anonymous user is adding a login.
+		if ok, err := authhdl.IsUnique(msg.Acc.Secret, remoteAddr); !ok {
+			return nil, err
+		}
+		rec, err = authhdl.AddRecord(&auth.Rec{Uid: user.Uid(), Tags: user.Tags}, msg.Acc.Secret, remoteAddr)
+		if err != nil {
+			return nil, err
+		}
+		added = rec
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Tags may have been changed by the handler, reset them.
+	// Can't do much with the error here, logging it but not returning.
+	if _, err = store.Users.UpdateTags(user.Uid(), nil, nil, rec.Tags); err != nil {
+		logs.Warn.Println("updateUserAuth tags update failed:", err)
+	}
+	return added, nil
+}
+
+// upgradeAnonUser 匿名用户添加了正式的认证方案后升级为正式用户。用户ID不变，所有的订阅和消息都保留，
+// 删除匿名认证记录，撤销之前按照匿名级别发放的token，并断开该用户的其他session。
+// 返回回复给客户端的参数，用户不是匿名用户时返回nil
+func upgradeAnonUser(s *Session, rec *auth.Rec) (map[string]interface{}, error) {
+	anonhdl := store.GetAuthHandler(anon.SchemeName)
+	if anonhdl == nil || rec.AuthLevel == auth.LevelAnon {
+		return nil, nil
+	}
+	unique, _, _, _, err := store.Users.GetAuthRecord(rec.Uid, anon.SchemeName)
+	if err != nil || unique == "" {
+		return nil, err
+	}
+	if err = anonhdl.DelRecords(rec.Uid); err != nil {
+		return nil, err
+	}
+
+	params := map[string]interface{}{
+		"user":    rec.Uid.UserId(),
+		"authlvl": rec.AuthLevel.String()}
+
+	if tokhdl := store.GetLogicalAuthHandler("token"); tokhdl != nil {
+		if _, err = tokhdl.UpdateRecord(&auth.Rec{Uid: rec.Uid}, nil, s.remoteAddr); err != nil {
+			logs.Warn.Println("upgradeAnonUser: failed to revoke tokens", rec.Uid.UserId(), err, s.sid)
+		}
+		if s.uid == rec.Uid {
+			params["token"], params["expires"], _ = tokhdl.GenSecret(&auth.Rec{
+				Uid:       rec.Uid,
+				AuthLevel: rec.AuthLevel,
+				Features:  auth.FeatureValidated})
+		}
+	}
+
+	if s.uid == rec.Uid {
+		s.authLvl = rec.AuthLevel
+	}
+	globals.sessionStore.EvictUser(rec.Uid, s.sid)
+
+	return params, nil
+}
+
+// addCreds 保存新的凭证，对已有的未验证凭证重新发送验证请求，需要时把凭证添加到用户的标签中。
+// 返回本次验证通过的凭证方式，以及更新后的全部标签，标签没有改变时返回nil。
+func addCreds(uid types.Uid, creds []MsgCredClient, extraTags []string, lang string,
+	tmpToken []byte) ([]string, []string, error) {
+	var validated []string
+	for i := range creds {
+		cr := &creds[i]
+		vld := store.GetValidator(cr.Method)
+		if vld == nil {
+			// Ignore unknown validator.
+			continue
+		}
+
+		isNew, err := vld.Request(uid, cr.Value, lang, cr.Response, tmpToken)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if isNew && cr.Response != "" {
+			// Response is provided and vld.Request did not return an error: the new credential is validated.
+			validated = append(validated, cr.Method)
+
+			if globals.validators[cr.Method].addToTags {
+				extraTags = append(extraTags, cr.Method+":"+cr.Value)
+			}
+		}
+	}
+
+	// Save tags potentially changed by the validator.
+	if len(extraTags) > 0 {
+		if utags, err := store.Users.UpdateTags(uid, extraTags, nil, nil); err == nil {
+			extraTags = utags
+		} else {
+			logs.Warn.Println("add cred tags update failed:", err)
+		}
+	} else {
+		extraTags = nil
+	}
+	return validated, extraTags, nil
+}
+
+// validatedCreds 检查客户端对凭证验证请求的回应，返回所有已经验证的凭证方式，包括之前验证过的。
+// 返回更新后的全部标签，标签没有改变时返回nil。
+func validatedCreds(uid types.Uid, authLvl auth.Level, creds []MsgCredClient,
+	errorOnFail bool) ([]string, []string, error) {
+	// Check if credential validation is required.
+	if len(globals.authValidators[authLvl]) == 0 {
+		return nil, nil, nil
+	}
+
+	// Get all validated methods
+	allCreds, err := store.Users.GetAllCreds(uid, "", true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	methods := make(map[string]struct{})
+	for i := range allCreds {
+		methods[allCreds[i].Method] = struct{}{}
+	}
+
+	// Add credentials which are validated in this call. Unknown validators are removed.
+	creds = normalizeCredentials(creds, false)
+	var tagsToAdd []string
+	for i := range creds {
+		cr := &creds[i]
+		if cr.Response == "" {
+			// Ignore empty response.
+			continue
+		}
+
+		vld := store.GetValidator(cr.Method)
+		value, err := vld.Check(uid, cr.Response)
+		if err != nil {
+			if err == types.ErrCredentials {
+				if errorOnFail {
+					// Report invalid response.
+					return nil, nil, types.ErrInvalidResponse
+				}
+				// Skip invalid response. Keep credential unvalidated.
+				continue
+			}
+			return nil, nil, err
+		}
+
+		methods[cr.Method] = struct{}{}
+
+		if globals.validators[cr.Method].addToTags {
+			tagsToAdd = append(tagsToAdd, cr.Method+":"+value)
+		}
+	}
+
+	var tags []string
+	if len(tagsToAdd) > 0 {
+		if utags, err := store.Users.UpdateTags(uid, tagsToAdd, nil, nil); err == nil {
+			tags = utags
+		} else {
+			logs.Warn.Println("validated creds tags update failed:", err)
+		}
+	}
+
+	var validated []string
+	for method := range methods {
+		validated = append(validated, method)
+	}
+
+	return validated, tags, nil
+}
+
+// userGetState 返回用户账户的状态
+func userGetState(uid types.Uid) (types.ObjState, error) {
+	user, err := store.Users.Get(uid)
+	if err != nil {
+		return types.StateUndefined, err
+	}
+	if user == nil {
+		return types.StateUndefined, types.ErrUserNotFound
+	}
+	return user.State, nil
+}
+
+// credToken 生成发送给验证器的临时token，用户通过该token确认凭证。token认证方案不可用时返回nil
+func credToken(uid types.Uid) []byte {
+	tokhdl := store.GetLogicalAuthHandler("token")
+	if tokhdl == nil {
+		return nil
+	}
+	token, _, err := tokhdl.GenSecret(&auth.Rec{
+		Uid:       uid,
+		AuthLevel: auth.LevelNone,
+		Lifetime:  auth.Duration(time.Hour * 24),
+		Features:  auth.FeatureNoLogin})
+	if err != nil {
+		logs.Warn.Println("failed to generate credential token", uid, err)
+		return nil
+	}
+	return token
+}
+
+// 修改账户状态:
+// 1. 暂停账户时断开该用户的所有session
+// 2. 更新数据库中的用户状态
+// 3. 暂停或者恢复已经加载的用户的p2p topic以及用户拥有的群组topic
+func changeUserState(s *Session, uid types.Uid, user *types.User, msg *ClientComMessage) (bool, error) {
+	state, err := types.NewObjState(msg.Acc.State)
+	if err != nil || state == types.StateDeleted {
+		logs.Warn.Println("replyUpdateUser: invalid account state", msg.Acc.State, s.sid)
+		return false, types.ErrMalformed
+	}
+
+	// State unchanged.
+	if user.State == state {
+		return false, nil
+	}
+
+	if state != types.StateOK {
+		globals.sessionStore.EvictUser(uid, "")
+	}
+
+	if err = store.Users.UpdateState(uid, state); err != nil {
+		return false, err
+	}
+
+	globals.hub.meta <- &metaReq{forUser: uid, state: state, sess: s}
+	user.State = state
+
+	return true, nil
+}
+
+// anonUsersRunGarbageCollection 定期删除长时间不活跃的匿名用户
+func anonUsersRunGarbageCollection(period, maxInactive time.Duration, block int) chan<- bool {
+	// Unbuffered stop channel. Whoever stops it must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		gcTimer := time.Tick(period)
+		for {
+			select {
+			case <-gcTimer:
+				uids, err := store.Users.GetInactive(anon.SchemeName, time.Now().Add(-maxInactive), block)
+				if err != nil {
+					logs.Warn.Println("anon gc:", err)
+					continue
+				}
+				for _, uid := range uids {
+					if globals.shuttingDown {
+						// The hub is no longer stopping topics.
+						break
+					}
+					// The user cannot log in while being deleted.
+					if !globals.sessionStore.LockOffline(uid) {
+						// Last seen time is updated when the user leaves, the user is still here.
+						continue
+					}
+					if err := deleteUser(uid); err != nil {
+						logs.Warn.Println("anon gc: failed to delete user", uid.UserId(), err)
+					}
+					globals.sessionStore.UnlockUser(uid)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
+
+// deleteUser 删除用户：断开用户的所有session，停止用户的p2p topic以及用户拥有的topic，然后从数据库中删除
+func deleteUser(uid types.Uid) error {
+	globals.sessionStore.EvictUser(uid, "")
+
+	done := make(chan bool)
+	globals.hub.unreg <- &topicUnreg{forUser: uid, del: true, done: done}
+	<-done
+
+	return store.Users.Delete(uid, true)
+}
@@ -18,10 +18,10 @@ import (
 	"unicode"
 	"unicode/utf8"
 
-	"github.com/tinode/chat/server/auth"
+	"GoChat/server/auth"
+	"GoChat/server/store"
+	"GoChat/server/store/types"
 	"github.com/tinode/chat/server/logs"
-	"github.com/tinode/chat/server/store"
-	"github.com/tinode/chat/server/store/types"
 
 	"golang.org/x/crypto/acme/autocert"
 )